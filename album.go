@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bogem/id3v2"
+	"github.com/spf13/pflag"
+)
+
+// Album mode option; YouTube Music album playlists use it unless it is
+// turned off
+var albumMode bool
+
+const (
+	// albumPlaylistPrefix starts the IDs of YouTube Music album playlists.
+	albumPlaylistPrefix = "OLAK5uy_"
+	// variousArtists is the album artist of albums whose tracks are by
+	// different artists.
+	variousArtists = "Various Artists"
+)
+
+// playlistIDFromURL returns the ID of the playlist that raw links to, or
+// "" if it links to none.
+func playlistIDFromURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("list")
+}
+
+// useAlbumMode reports whether the playlist at raw is downloaded as an
+// album: if flag was given as true, or, unless it was given as false, if
+// the playlist is a YouTube Music album.
+func useAlbumMode(raw string, flag *pflag.Flag) bool {
+	id := playlistIDFromURL(raw)
+	if id == "" {
+		return false
+	}
+	if flag != nil && flag.Changed {
+		return flag.Value.String() == "true"
+	}
+	return strings.HasPrefix(id, albumPlaylistPrefix)
+}
+
+// album holds the tags that the tracks of an album playlist share.
+type album struct {
+	Title string
+	// Artist is the album artist: the artist of every track, or
+	// variousArtists.
+	Artist string
+	// Compilation is set for albums whose tracks are by different artists.
+	Compilation bool
+	Total       int
+	// Year is the first track's, from albumYear; it is empty if that is
+	// unknown, and the tracks keep their own dates.
+	Year string
+	// Cover is the playlist's thumbnail or, failing that, the cover of the
+	// first track that has one.
+	Cover *id3v2.PictureFrame
+}
+
+// newAlbum derives the shared tags of an album from its playlist listing.
+// YouTube Music names album playlists "Album - TITLE" and lists the tracks
+// under their artists' " - Topic" channels.
+func newAlbum(pl playlist) *album {
+	a := &album{
+		Title: strings.TrimPrefix(pl.Title, "Album - "),
+		Total: len(pl.Entries),
+	}
+	seen := map[string]bool{}
+	for _, e := range pl.Entries {
+		if artist := strings.TrimSuffix(e.Channel, " - Topic"); artist != "" && !seen[artist] {
+			seen[artist] = true
+			a.Artist = artist
+		}
+	}
+	switch {
+	case len(seen) > 1:
+		a.Artist, a.Compilation = variousArtists, true
+	case len(seen) == 0:
+		a.Artist = strings.TrimSuffix(pl.Channel, " - Topic")
+	}
+	return a
+}
+
+// albumYear returns the year of the first track of pl: its upload year in
+// the listing or, as flat listings often lack it, its release or upload
+// year fetched with f.
+func albumYear(ctx context.Context, f infoFetcher, pl playlist) (string, error) {
+	first := pl.Entries[0]
+	if len(first.UploadDate) >= 4 {
+		return first.UploadDate[:4], nil
+	}
+	info, err := f.Info(ctx, first.URL)
+	switch {
+	case err != nil:
+		return "", err
+	case info.ReleaseYear > 0:
+		return strconv.Itoa(info.ReleaseYear), nil
+	case len(info.UploadDate) >= 4:
+		return info.UploadDate[:4], nil
+	}
+	return "", nil
+}
+
+// batchItem is one URL of a batch after album playlists were expanded into
+// their tracks.
+type batchItem struct {
+	URL string
+	// album is the album the track belongs to, or nil.
+	album *album
+	// track is the track's position in the album, from 1.
+	track int
+	// err is why an album playlist could not be listed.
+	err error
+}
+
+// expandAlbums replaces the URLs of playlists that are downloaded as albums
+// with the URLs of their tracks. A playlist that cannot be listed stays in
+// the batch as a failed item. The album's year is settled here, before any
+// of its tracks is tagged.
+func expandAlbums(ctx context.Context, l playlistLister, f infoFetcher, client *http.Client, urls []string, flag *pflag.Flag, log io.Writer) []batchItem {
+	var items []batchItem
+	for _, u := range urls {
+		if !useAlbumMode(u, flag) {
+			if flag != nil && flag.Changed && flag.Value.String() == "true" {
+				fmt.Fprintf(log, "Warning: %s is not a playlist; downloading it without album mode\n", u)
+			}
+			items = append(items, batchItem{URL: u})
+			continue
+		}
+		pl, err := l.List(ctx, u)
+		if err == nil && len(pl.Entries) == 0 {
+			err = classify(ErrUnavailable, fmt.Errorf("playlist %s has no videos", u))
+		}
+		if err != nil {
+			items = append(items, batchItem{URL: u, err: err})
+			continue
+		}
+		a := newAlbum(pl)
+		fmt.Fprintf(log, "Downloading %q by %s as an album of %d tracks\n", a.Title, a.Artist, a.Total)
+		if a.Year, err = albumYear(ctx, f, pl); err != nil {
+			fmt.Fprintf(log, "Warning: %s: keeping the dates of the tracks: %v\n", u, err)
+		}
+		if cu := coverURL(videoInfo{Thumbnails: pl.Thumbnails}); cu != "" {
+			if a.Cover, err = fetchCover(ctx, client, cu); err != nil {
+				fmt.Fprintf(log, "Warning: %s: using the cover of the first track: %v\n", u, err)
+			}
+		}
+		for i, e := range pl.Entries {
+			items = append(items, batchItem{URL: e.URL, album: a, track: i + 1})
+		}
+	}
+	return items
+}
+
+// albumFrames are the text frames tagTrack writes.
+var albumFrames = []string{"TALB", "TPE2", "TYER", "TRCK", "TCMP"}
+
+// tagTrack gives the MP3 file of res, the album's track at position, the
+// tags the album's tracks share and updates the tags res reports. Frames
+// in keep, which --tag overrides set, are left alone.
+func (a *album) tagTrack(res *Result, position int, keep map[string]bool) error {
+	if !strings.EqualFold(filepath.Ext(res.FinalPath), ".mp3") {
+		return nil
+	}
+	tag, err := openID3Tag(res.FinalPath)
+	if err != nil {
+		return err
+	}
+	defer tag.Close()
+	if a.Cover == nil {
+		for _, f := range tag.GetFrames(tag.CommonID("Attached picture")) {
+			if pic, ok := f.(id3v2.PictureFrame); ok && len(pic.Picture) > 0 {
+				a.Cover = &pic
+				break
+			}
+		}
+	}
+
+	if res.Tags == nil {
+		res.Tags = map[string]string{}
+	}
+	set := func(id, key, v string) {
+		if keep[id] {
+			return
+		}
+		setTextFrame(tag, id, v)
+		if v == "" {
+			delete(res.Tags, key)
+		} else {
+			res.Tags[key] = v
+		}
+	}
+	set("TALB", "album", a.Title)
+	set("TPE2", "album_artist", a.Artist)
+	if a.Year != "" && !keep["TYER"] {
+		// The day and month of each video's upload would not match.
+		tag.DeleteFrames("TDAT")
+		tag.DeleteFrames("TDRC")
+		set("TYER", "date", a.Year)
+	}
+	set("TRCK", "track", fmt.Sprintf("%d/%d", position, a.Total))
+	if a.Compilation {
+		set("TCMP", "compilation", "1")
+	}
+	if a.Cover != nil {
+		tag.DeleteFrames(tag.CommonID("Attached picture"))
+		tag.AddAttachedPicture(*a.Cover)
+	}
+	return saveID3Tag(tag)
+}
+
+// overriddenFrames returns the frames among albumFrames that the --tag
+// overrides in tags set.
+func overriddenFrames(tags []string) map[string]bool {
+	keep := map[string]bool{}
+	// The overrides were checked when the settings were validated.
+	overrides, _ := parseTagOverrides(tags)
+	for _, o := range overrides {
+		if slices.Contains(albumFrames, o.Frame) {
+			keep[o.Frame] = true
+		}
+	}
+	return keep
+}
+
+// batchURLs returns the URLs of items.
+func batchURLs(items []batchItem) []string {
+	urls := make([]string, len(items))
+	for i, item := range items {
+		urls[i] = item.URL
+	}
+	return urls
+}
+
+// processBatchItem downloads item with processURL and, for the track of an
+// album, gives it the album's tags before its result is reported.
+func processBatchItem(ctx context.Context, d downloader, item batchItem, s Settings, log io.Writer) (*Result, error) {
+	if item.err != nil {
+		return &Result{URL: item.URL, Status: statusFailed, ErrorCode: errorCode(item.err), Error: item.err.Error()}, item.err
+	}
+	res, err := processURL(ctx, d, item.URL, s, log, nil)
+	if err != nil || item.album == nil {
+		return res, err
+	}
+	if err := item.album.tagTrack(res, item.track, overriddenFrames(s.Tags)); err != nil {
+		err = classify(ErrTagging, err)
+		res.Status, res.ErrorCode, res.Error = statusFailed, errorCode(err), err.Error()
+		return res, err
+	}
+	return res, nil
+}
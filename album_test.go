@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/bogem/id3v2"
+	"github.com/spf13/pflag"
+)
+
+// albumModeFlag returns the --album-mode flag after parsing args.
+func albumModeFlag(t *testing.T, args ...string) *pflag.Flag {
+	t.Helper()
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	fs.Bool("album-mode", false, "")
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return fs.Lookup("album-mode")
+}
+
+func TestUseAlbumMode(t *testing.T) {
+	const (
+		album    = "https://music.youtube.com/playlist?list=OLAK5uy_abc"
+		playlist = "https://www.youtube.com/playlist?list=PLabc"
+		video    = "https://www.youtube.com/watch?v=abc"
+	)
+	tests := []struct {
+		url  string
+		args []string
+		want bool
+	}{
+		{album, nil, true},
+		{album, []string{"--album-mode=false"}, false},
+		{playlist, nil, false},
+		{playlist, []string{"--album-mode"}, true},
+		{video, []string{"--album-mode"}, false},
+		{"https://www.youtube.com/watch?v=abc&list=OLAK5uy_abc", nil, true},
+	}
+	for _, tt := range tests {
+		if got := useAlbumMode(tt.url, albumModeFlag(t, tt.args...)); got != tt.want {
+			t.Errorf("useAlbumMode(%q, %v) = %v, want %v", tt.url, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestNewAlbum(t *testing.T) {
+	tests := []struct {
+		name string
+		pl   playlist
+		want album
+	}{
+		{
+			name: "one artist",
+			pl: playlist{Title: "Album - Blue", Entries: []playlistEntry{
+				{ID: "a", Channel: "Band - Topic"}, {ID: "b", Channel: "Band - Topic"},
+			}},
+			want: album{Title: "Blue", Artist: "Band", Total: 2},
+		},
+		{
+			name: "various artists",
+			pl: playlist{Title: "Album - Hits", Entries: []playlistEntry{
+				{ID: "a", Channel: "One - Topic"}, {ID: "b", Channel: "Two - Topic"}, {ID: "c"},
+			}},
+			want: album{Title: "Hits", Artist: variousArtists, Compilation: true, Total: 3},
+		},
+		{
+			name: "no track channels",
+			pl:   playlist{Title: "Live Set", Channel: "Club", Entries: []playlistEntry{{ID: "a"}}},
+			want: album{Title: "Live Set", Artist: "Club", Total: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newAlbum(tt.pl); *got != tt.want {
+				t.Errorf("newAlbum() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlbumYear(t *testing.T) {
+	f := fakeFetcher{
+		"https://youtu.be/released": {ReleaseYear: 2018, UploadDate: "20200101"},
+		"https://youtu.be/uploaded": {UploadDate: "20200101"},
+	}
+	tests := []struct {
+		name    string
+		first   playlistEntry
+		want    string
+		wantErr bool
+	}{
+		{"listing", playlistEntry{URL: "https://youtu.be/released", UploadDate: "20170505"}, "2017", false},
+		{"release year", playlistEntry{URL: "https://youtu.be/released"}, "2018", false},
+		{"upload date", playlistEntry{URL: "https://youtu.be/uploaded"}, "2020", false},
+		{"unavailable", playlistEntry{URL: "https://youtu.be/gone"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := albumYear(context.Background(), f, playlist{Entries: []playlistEntry{tt.first}})
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("albumYear() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlbumBatch(t *testing.T) {
+	cover := append([]byte("\xff\xd8\xff\xe0"), bytes.Repeat([]byte{0}, 64)...)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(cover)
+	}))
+	defer ts.Close()
+
+	const albumURL = "https://music.youtube.com/playlist?list=OLAK5uy_abc"
+	lister := fakeLister{albumURL: {
+		Title:      "Album - Hits",
+		Thumbnails: []videoThumbnail{{URL: ts.URL + "/cover.jpg"}},
+		Entries: []playlistEntry{
+			{ID: "one", URL: "https://youtu.be/one", Channel: "First - Topic"},
+			{ID: "two", URL: "https://youtu.be/two", Channel: "Second - Topic"},
+		},
+	}}
+	d := &fakeDownloader{info: map[string]videoInfo{
+		"https://youtu.be/one": {ID: "one", Title: "Opener", Channel: "First - Topic", UploadDate: "20190301"},
+		"https://youtu.be/two": {ID: "two", Title: "Closer", Channel: "Second - Topic", UploadDate: "20240105"},
+	}}
+	out := t.TempDir()
+	s := Settings{OutputDir: out, AudioFormat: "mp3", AudioQuality: "0", Tags: []string{"album=Greatest Hits"}}
+
+	urls := []string{albumURL, "https://www.youtube.com/playlist?list=OLAK5uy_gone"}
+	// The release year of the first track wins over the upload dates.
+	fetcher := fakeFetcher{"https://youtu.be/one": {ID: "one", ReleaseYear: 2018, UploadDate: "20190301"}}
+	items := expandAlbums(context.Background(), lister, fetcher, ts.Client(), urls, albumModeFlag(t), io.Discard)
+	if got := batchURLs(items); len(got) != 3 || got[0] != "https://youtu.be/one" || got[2] != urls[1] {
+		t.Fatalf("batch = %v", got)
+	}
+	if res, err := processBatchItem(context.Background(), d, items[2], s, io.Discard); err == nil || res.Status != statusFailed {
+		t.Errorf("unlisted playlist: %+v, %v", res, err)
+	}
+
+	// The year does not depend on which track is tagged first.
+	for _, i := range []int{1, 0} {
+		want := []struct{ file, title, artist, track string }{
+			{"Opener.mp3", "Opener", "First", "1/2"},
+			{"Closer.mp3", "Closer", "Second", "2/2"},
+		}[i]
+		res, err := processBatchItem(context.Background(), d, items[i], s, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Tags["track"] != want.track || res.Tags["album_artist"] != variousArtists || res.Tags["date"] != "2018" || res.Tags["compilation"] != "1" {
+			t.Errorf("result tags = %v", res.Tags)
+		}
+
+		tag, err := id3v2.Open(filepath.Join(out, want.file), id3v2.Options{Parse: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for id, v := range map[string]string{
+			"TIT2": want.title,
+			"TPE1": want.artist,
+			"TALB": "Greatest Hits",
+			"TPE2": variousArtists,
+			"TYER": "2018",
+			"TDAT": "",
+			"TRCK": want.track,
+			"TCMP": "1",
+		} {
+			if got := tag.GetTextFrame(id).Text; got != v {
+				t.Errorf("%s: %s = %q, want %q", want.file, id, got, v)
+			}
+		}
+		pics := tag.GetFrames(tag.CommonID("Attached picture"))
+		if len(pics) != 1 || !bytes.Equal(pics[0].(id3v2.PictureFrame).Picture, cover) {
+			t.Errorf("%s: cover art is not the album's", want.file)
+		}
+		tag.Close()
+	}
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// tokenCookie is the cookie the web UI uses to send the API token, since
+// EventSource and download links cannot set an Authorization header.
+const tokenCookie = "yt2mp3_token"
+
+// userNameRe restricts user names to characters that are safe in a
+// directory name.
+var userNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+var (
+	// errUnauthorized is returned for requests without a valid token.
+	errUnauthorized = errors.New("missing or invalid API token")
+)
+
+var (
+	// Token file option for serve and token
+	tokensPath string
+	// Output directory option for token create
+	tokenOutputDir string
+	// Default profile option for token create
+	tokenProfile string
+	// Concurrency quota option for token create
+	tokenMaxJobs int
+	// Server URL option for token feed-url
+	tokenServerURL string
+)
+
+// apiUser is an API token holder. Only the SHA-256 hash of the token is
+// stored.
+type apiUser struct {
+	Name      string    `json:"name"`
+	TokenHash string    `json:"token_hash"`
+	OutputDir string    `json:"output_dir,omitempty"`
+	Profile   string    `json:"profile,omitempty"`
+	MaxJobs   int       `json:"max_jobs,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// root returns the user's output directory relative to the server's output
+// root. It defaults to the user name.
+func (u *apiUser) root() string {
+	if u.OutputDir != "" {
+		return u.OutputDir
+	}
+	return u.Name
+}
+
+// tokenFile is the on-disk format of the token store.
+type tokenFile struct {
+	Users []apiUser `json:"users"`
+}
+
+// defaultTokensPath returns tokens.json in the state directory.
+func defaultTokensPath() (string, error) {
+	dir, err := defaultStateDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate state directory: %v", err)
+	}
+	return filepath.Join(dir, "tokens.json"), nil
+}
+
+// resolveTokensPath returns the --tokens value or the default path.
+func resolveTokensPath() (string, error) {
+	if tokensPath != "" {
+		return tokensPath, nil
+	}
+	return defaultTokensPath()
+}
+
+// loadTokens reads the users in the token file at path. A missing file holds
+// no users.
+func loadTokens(path string) ([]apiUser, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token file: %v", err)
+	}
+	var f tokenFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse token file %s: %v", path, err)
+	}
+	return f.Users, nil
+}
+
+// saveTokens atomically replaces the token file at path with users.
+func saveTokens(path string, users []apiUser) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create token file directory: %v", err)
+	}
+	data, err := json.MarshalIndent(tokenFile{Users: users}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tokens-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to write token file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write token file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write token file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write token file: %v", err)
+	}
+	return nil
+}
+
+// hashToken returns the hex SHA-256 of token.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newToken returns a random API token.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	return "yt2mp3_" + hex.EncodeToString(b), nil
+}
+
+// tokenStore authenticates API tokens against the token file, reloading it
+// whenever it changes so that created and revoked tokens take effect without
+// a restart.
+type tokenStore struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	users   []apiUser
+}
+
+// newTokenStore loads the token file at path.
+func newTokenStore(path string) (*tokenStore, error) {
+	s := &tokenStore{path: path}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload rereads the token file if it changed since the last load. The
+// caller must hold s.mu, except during construction.
+func (s *tokenStore) reload() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.users, s.modTime, s.size = nil, time.Time{}, 0
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read token file: %v", err)
+	}
+	if info.ModTime().Equal(s.modTime) && info.Size() == s.size && s.users != nil {
+		return nil
+	}
+	users, err := loadTokens(s.path)
+	if err != nil {
+		return err
+	}
+	if users == nil {
+		users = []apiUser{}
+	}
+	s.users, s.modTime, s.size = users, info.ModTime(), info.Size()
+	return nil
+}
+
+// enabled reports whether any tokens exist, i.e. whether the API requires
+// authentication.
+func (s *tokenStore) enabled() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return false, err
+	}
+	return len(s.users) > 0, nil
+}
+
+// lookup returns the user owning token.
+func (s *tokenStore) lookup(token string) (*apiUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	if token == "" {
+		return nil, errUnauthorized
+	}
+	hash := hashToken(token)
+	for i := range s.users {
+		if subtle.ConstantTimeCompare([]byte(s.users[i].TokenHash), []byte(hash)) == 1 {
+			u := s.users[i]
+			return &u, nil
+		}
+	}
+	return nil, errUnauthorized
+}
+
+// user returns the user called name.
+func (s *tokenStore) user(name string) (*apiUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	for i := range s.users {
+		if s.users[i].Name == name {
+			u := s.users[i]
+			return &u, nil
+		}
+	}
+	return nil, errUnauthorized
+}
+
+// requestToken returns the bearer token of r, falling back to the web UI's
+// cookie.
+func requestToken(r *http.Request) string {
+	if auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(auth)
+	}
+	if c, err := r.Cookie(tokenCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+type userContextKey struct{}
+
+// requestUser returns the authenticated user of r, or nil when the server
+// runs without authentication.
+func requestUser(r *http.Request) *apiUser {
+	u, _ := r.Context().Value(userContextKey{}).(*apiUser)
+	return u
+}
+
+// authenticate wraps h so that it only runs for requests carrying a valid
+// token, once any tokens exist. The user is available through requestUser.
+func (s *server) authenticate(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.tokens == nil {
+			h(w, r)
+			return
+		}
+		enabled, err := s.tokens.enabled()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !enabled {
+			h(w, r)
+			return
+		}
+		u, err := s.tokens.lookup(requestToken(r))
+		if err != nil && !errors.Is(err, errUnauthorized) {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="yt2mp3"`)
+			writeError(w, http.StatusUnauthorized, errUnauthorized)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, u)))
+	}
+}
+
+// canAccess reports whether u may see job. Without authentication every job
+// is visible.
+func canAccess(u *apiUser, job Job) bool {
+	return u == nil || job.Owner == u.Name
+}
+
+// printUsers writes users as a table.
+func printUsers(w io.Writer, users []apiUser) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tOUTPUT DIR\tPROFILE\tMAX JOBS\tCREATED")
+	for _, u := range users {
+		profile, maxJobs := u.Profile, "unlimited"
+		if profile == "" {
+			profile = "-"
+		}
+		if u.MaxJobs > 0 {
+			maxJobs = fmt.Sprint(u.MaxJobs)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", u.Name, u.root(), profile, maxJobs, u.CreatedAt.Local().Format(time.DateTime))
+	}
+	return tw.Flush()
+}
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Manage API tokens for server mode",
+}
+
+var tokenCreateCmd = &cobra.Command{
+	Use:          "create NAME",
+	Short:        "Create a user and print their API token",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		if !userNameRe.MatchString(name) {
+			return fmt.Errorf("invalid user name %q: use letters, digits, '.', '_' and '-'", name)
+		}
+		if tokenMaxJobs < 0 {
+			return fmt.Errorf("--max-jobs must not be negative")
+		}
+		if tokenOutputDir != "" {
+			if _, err := confineDir(".", tokenOutputDir); err != nil {
+				return err
+			}
+		}
+		if tokenProfile != "" {
+			cfg, err := loadConfigFile()
+			if err != nil {
+				return err
+			}
+			if _, ok := cfg.Profiles[tokenProfile]; !ok {
+				return fmt.Errorf("unknown profile %q", tokenProfile)
+			}
+		}
+
+		path, err := resolveTokensPath()
+		if err != nil {
+			return err
+		}
+		users, err := loadTokens(path)
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			if u.Name == name {
+				return fmt.Errorf("user %q already exists; revoke the old token first", name)
+			}
+		}
+		token, err := newToken()
+		if err != nil {
+			return err
+		}
+		users = append(users, apiUser{
+			Name:      name,
+			TokenHash: hashToken(token),
+			OutputDir: tokenOutputDir,
+			Profile:   tokenProfile,
+			MaxJobs:   tokenMaxJobs,
+			CreatedAt: time.Now().UTC(),
+		})
+		if err := saveTokens(path, users); err != nil {
+			return err
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), token)
+		fmt.Fprintf(cmd.ErrOrStderr(), "Created token for %s. It is shown only once.\n", name)
+		return nil
+	},
+}
+
+var tokenRevokeCmd = &cobra.Command{
+	Use:          "revoke NAME",
+	Short:        "Revoke a user's API token",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := resolveTokensPath()
+		if err != nil {
+			return err
+		}
+		users, err := loadTokens(path)
+		if err != nil {
+			return err
+		}
+		kept := make([]apiUser, 0, len(users))
+		for _, u := range users {
+			if u.Name != args[0] {
+				kept = append(kept, u)
+			}
+		}
+		if len(kept) == len(users) {
+			return fmt.Errorf("unknown user %q", args[0])
+		}
+		if err := saveTokens(path, kept); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Revoked token for %s\n", args[0])
+		return nil
+	},
+}
+
+var tokenListCmd = &cobra.Command{
+	Use:          "list",
+	Short:        "List users with API tokens",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := resolveTokensPath()
+		if err != nil {
+			return err
+		}
+		users, err := loadTokens(path)
+		if err != nil {
+			return err
+		}
+		sort.Slice(users, func(i, k int) bool { return users[i].Name < users[k].Name })
+		return printUsers(cmd.OutOrStdout(), users)
+	},
+}
+
+var tokenFeedURLCmd = &cobra.Command{
+	Use:   "feed-url NAME [DIR]",
+	Short: "Print the podcast feed URL of a folder of a user's library",
+	Long: `Print the URL of the podcast feed of DIR, a folder of NAME's library
+(default the whole library), on the server at --server. The URL is signed
+with NAME's token instead of containing it, so it can be given to podcast
+apps, which cannot send the token as a header. It stays valid until the
+token is revoked.`,
+	Args:         cobra.RangeArgs(1, 2),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := resolveTokensPath()
+		if err != nil {
+			return err
+		}
+		users, err := loadTokens(path)
+		if err != nil {
+			return err
+		}
+		dir := ""
+		if len(args) == 2 {
+			dir = args[1]
+		}
+		for _, u := range users {
+			if u.Name == args[0] {
+				fmt.Fprintln(cmd.OutOrStdout(), signedFeedURL(tokenServerURL, &u, dir))
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown user %q", args[0])
+	},
+}
+
+func init() {
+	tokenCmd.PersistentFlags().StringVar(&tokensPath, "tokens", "", "Token file (default $XDG_STATE_HOME/yt2mp3/tokens.json)")
+	tokenCreateCmd.Flags().StringVar(&tokenOutputDir, "dir", "", "User's library, relative to the server's output directory (default NAME)")
+	tokenCreateCmd.Flags().StringVar(&tokenProfile, "default-profile", "", "Default config profile for the user's jobs")
+	tokenCreateCmd.Flags().IntVar(&tokenMaxJobs, "max-jobs", 0, "Maximum number of the user's jobs that run at once (0 for unlimited)")
+	tokenFeedURLCmd.Flags().StringVar(&tokenServerURL, "server", "http://localhost:8080", "URL the server is reached at")
+	tokenCmd.AddCommand(tokenCreateCmd, tokenRevokeCmd, tokenListCmd, tokenFeedURLCmd)
+	rootCmd.AddCommand(tokenCmd)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newAuthTestServer starts an API server that authenticates against a token
+// file holding users, returning the server, its output root and each user's
+// token keyed by name.
+func newAuthTestServer(t *testing.T, d downloader, users ...apiUser) (*httptest.Server, string, map[string]string) {
+	t.Helper()
+	root := t.TempDir()
+	tokens := map[string]string{}
+	for i := range users {
+		tok, err := newToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		users[i].TokenHash = hashToken(tok)
+		tokens[users[i].Name] = tok
+	}
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	if err := saveTokens(path, users); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newTokenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg := &Config{Profiles: map[string]Profile{"opus": {AudioFormat: strPtr("opus")}}}
+	jobs, err := newJobManager(ctx, d, newJobResolver(cfg, nil, "", root), jobManagerOptions{Workers: 1, QueueSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer((&server{jobs: jobs, tokens: store, root: root}).routes())
+	t.Cleanup(func() {
+		ts.Close()
+		cancel()
+		jobs.Wait()
+	})
+	return ts, root, tokens
+}
+
+func strPtr(s string) *string { return &s }
+
+// doAuth sends a JSON request authenticated with token and decodes the
+// response into out, returning the status code.
+func doAuth(t *testing.T, method, url, token string, body string, out any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		var buf bytes.Buffer
+		buf.ReadFrom(resp.Body)
+		if err := json.Unmarshal(buf.Bytes(), out); err != nil {
+			t.Fatalf("failed to decode %q: %v", buf.String(), err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestServerAuth(t *testing.T) {
+	d := &fakeDownloader{info: map[string]videoInfo{
+		"https://youtu.be/abc": {ID: "abc", Title: "Song"},
+	}}
+	ts, root, tokens := newAuthTestServer(t, d,
+		apiUser{Name: "alice", OutputDir: "shared/alice", Profile: "opus"},
+		apiUser{Name: "bob"},
+	)
+
+	if status := doAuth(t, http.MethodGet, ts.URL+"/jobs", "", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("no token: status %d, want 401", status)
+	}
+	if status := doAuth(t, http.MethodGet, ts.URL+"/jobs", "bogus", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("bad token: status %d, want 401", status)
+	}
+	resp, err := http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("web UI should not require a token: status %d", resp.StatusCode)
+	}
+
+	var job Job
+	if status := doAuth(t, http.MethodPost, ts.URL+"/jobs", tokens["alice"], `{"url": "https://youtu.be/abc"}`, &job); status != http.StatusAccepted {
+		t.Fatalf("create: status %d", status)
+	}
+	if job.Owner != "alice" {
+		t.Errorf("owner = %q", job.Owner)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for job.State != jobDone {
+		if time.Now().After(deadline) {
+			t.Fatalf("job did not finish: %+v", job)
+		}
+		time.Sleep(10 * time.Millisecond)
+		doAuth(t, http.MethodGet, ts.URL+"/jobs/"+job.ID, tokens["alice"], "", &job)
+	}
+	// The user's library and default profile apply.
+	if want := filepath.Join(root, "shared", "alice", "Song.opus"); job.Result.FinalPath != want {
+		t.Errorf("final path = %q, want %q", job.Result.FinalPath, want)
+	}
+
+	// Other users cannot see, fetch or cancel the job.
+	var list []Job
+	doAuth(t, http.MethodGet, ts.URL+"/jobs", tokens["bob"], "", &list)
+	if len(list) != 0 {
+		t.Errorf("bob sees %d jobs", len(list))
+	}
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		if status := doAuth(t, method, ts.URL+"/jobs/"+job.ID, tokens["bob"], "", nil); status != http.StatusNotFound {
+			t.Errorf("%s other user's job: status %d, want 404", method, status)
+		}
+	}
+	if status := doAuth(t, http.MethodGet, ts.URL+"/jobs/"+job.ID+"/file", tokens["bob"], "", nil); status != http.StatusNotFound {
+		t.Errorf("other user's file: status %d, want 404", status)
+	}
+
+	// A request cannot escape the user's library.
+	var body map[string]string
+	status := doAuth(t, http.MethodPost, ts.URL+"/jobs", tokens["bob"], `{"url": "https://youtu.be/abc", "options": {"output_dir": "../alice"}}`, &body)
+	if status != http.StatusBadRequest || body["error_code"] != "output_dir" {
+		t.Errorf("escaping output dir: status %d, body %v", status, body)
+	}
+
+	// The web UI authenticates with a cookie.
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/options", nil)
+	req.AddCookie(&http.Cookie{Name: tokenCookie, Value: tokens["alice"]})
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opts serverOptions
+	var buf bytes.Buffer
+	buf.ReadFrom(resp.Body)
+	resp.Body.Close()
+	if err := json.Unmarshal(buf.Bytes(), &opts); err != nil || opts.User != "alice" || opts.DefaultProfile != "opus" {
+		t.Errorf("options with cookie: %s (%v)", buf.String(), err)
+	}
+}
+
+func TestServerQuota(t *testing.T) {
+	d := &fakeDownloader{block: make(chan struct{})}
+	defer close(d.block)
+	ts, _, tokens := newAuthTestServer(t, d, apiUser{Name: "carol", MaxJobs: 1}, apiUser{Name: "dave"})
+
+	for _, url := range []string{"https://youtu.be/1", "https://youtu.be/2"} {
+		body := fmt.Sprintf(`{"url": %q}`, url)
+		if status := doAuth(t, http.MethodPost, ts.URL+"/jobs", tokens["carol"], body, nil); status != http.StatusAccepted {
+			t.Errorf("%s: status %d, want 202", url, status)
+		}
+	}
+}
+
+func TestJobManagerUserLimit(t *testing.T) {
+	d := &fakeDownloader{block: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m, err := newJobManager(ctx, d, func(req JobRequest, u *apiUser) (Settings, error) {
+		return Settings{OutputDir: t.TempDir(), AudioFormat: "mp3"}, nil
+	}, jobManagerOptions{Workers: 3, QueueSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Wait()
+	defer cancel()
+
+	carol, dave := &apiUser{Name: "carol", MaxJobs: 1}, &apiUser{Name: "dave"}
+	var ids []string
+	for _, u := range []*apiUser{carol, carol, dave} {
+		job, err := m.Submit(JobRequest{URL: "https://youtu.be/" + u.Name + fmt.Sprint(len(ids))}, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, job.ID)
+	}
+
+	wait := func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+	state := func(id string) string {
+		job, _ := m.Get(id)
+		return job.State
+	}
+	wait("the first jobs to run", func() bool {
+		m.mu.Lock()
+		held := m.heldCount()
+		m.mu.Unlock()
+		return held == 1 && state(ids[0]) == jobDownloading && state(ids[2]) == jobDownloading
+	})
+	if got := state(ids[1]); got != jobQueued {
+		t.Errorf("carol's second job is %s while her first runs, want queued", got)
+	}
+
+	close(d.block)
+	wait("every job to finish", func() bool {
+		return state(ids[0]) == jobDone && state(ids[1]) == jobDone && state(ids[2]) == jobDone
+	})
+}
+
+func TestTokenStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	store, err := newTokenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enabled, err := store.enabled(); err != nil || enabled {
+		t.Errorf("missing file: enabled = %v, %v", enabled, err)
+	}
+
+	if err := saveTokens(path, []apiUser{{Name: "erin", TokenHash: hashToken("secret")}}); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := store.lookup("secret"); err != nil || u.Name != "erin" {
+		t.Errorf("lookup after create = %v, %v", u, err)
+	}
+	if _, err := store.lookup(""); err == nil {
+		t.Error("empty token should be rejected")
+	}
+
+	if err := saveTokens(path, []apiUser{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.lookup("secret"); err == nil {
+		t.Error("revoked token should be rejected")
+	}
+}
+
+func TestTokenCommands(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	run := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		rootCmd.SetOut(&out)
+		rootCmd.SetErr(&bytes.Buffer{})
+		rootCmd.SetArgs(append(args, "--tokens", path))
+		err := rootCmd.Execute()
+		return out.String(), err
+	}
+	t.Cleanup(func() {
+		rootCmd.SetOut(nil)
+		rootCmd.SetErr(nil)
+		rootCmd.SetArgs(nil)
+		tokensPath, tokenOutputDir, tokenProfile, tokenMaxJobs = "", "", "", 0
+		tokenServerURL = "http://localhost:8080"
+	})
+
+	out, err := run("token", "create", "frank", "--dir", "music/frank", "--max-jobs", "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := strings.TrimSpace(out)
+	if !strings.HasPrefix(token, "yt2mp3_") {
+		t.Fatalf("unexpected token %q", token)
+	}
+	users, err := loadTokens(path)
+	if err != nil || len(users) != 1 {
+		t.Fatalf("users = %v, %v", users, err)
+	}
+	if u := users[0]; u.TokenHash != hashToken(token) || u.OutputDir != "music/frank" || u.MaxJobs != 2 {
+		t.Errorf("stored user = %+v", u)
+	}
+
+	if _, err := run("token", "create", "frank"); err == nil {
+		t.Error("duplicate user should fail")
+	}
+	if _, err := run("token", "create", "../evil", "--dir", ""); err == nil {
+		t.Error("invalid name should fail")
+	}
+	if _, err := run("token", "create", "grace", "--dir", "../outside"); err == nil {
+		t.Error("escaping library should fail")
+	}
+
+	if out, err := run("token", "list"); err != nil || !strings.Contains(out, "music/frank") {
+		t.Errorf("list = %q, %v", out, err)
+	}
+	out, err = run("token", "feed-url", "frank", "talks", "--server", "https://music.example/")
+	want := "https://music.example/feed.xml?dir=talks&sig=" + feedSignature(&users[0], "talks") + "&user=frank\n"
+	if err != nil || out != want || strings.Contains(out, token) {
+		t.Errorf("feed-url = %q, %v, want %q", out, err, want)
+	}
+	if _, err := run("token", "feed-url", "grace"); err == nil {
+		t.Error("feed URL of an unknown user should fail")
+	}
+	if _, err := run("token", "revoke", "frank"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run("token", "revoke", "frank"); err == nil {
+		t.Error("revoking an unknown user should fail")
+	}
+	if users, _ := loadTokens(path); len(users) != 0 {
+		t.Errorf("users after revoke = %v", users)
+	}
+}
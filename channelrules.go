@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ChannelRule adjusts the tags and folder of the videos of one channel,
+// for channels whose naming the title rules do not fit.
+type ChannelRule struct {
+	// Artist, Album and Genre replace the tags derived from the video.
+	Artist string `yaml:"artist,omitempty" json:"artist,omitempty"`
+	Album  string `yaml:"album,omitempty" json:"album,omitempty"`
+	Genre  string `yaml:"genre,omitempty" json:"genre,omitempty"`
+	// Title is a regular expression matched against the video title. Its
+	// named groups title, artist, album, genre and track set those tags
+	// when they match.
+	Title string `yaml:"title,omitempty" json:"title,omitempty"`
+	// Folder is a directory below the output directory that the files are
+	// moved into.
+	Folder string `yaml:"folder,omitempty" json:"folder,omitempty"`
+}
+
+// channelRuleGroups are the named groups a channel rule's title regular
+// expression may have.
+var channelRuleGroups = map[string]bool{
+	"title":  true,
+	"artist": true,
+	"album":  true,
+	"genre":  true,
+	"track":  true,
+}
+
+// compileChannelRule checks r, the rule for the channel id, and compiles
+// its title regular expression, which is nil if r has none.
+func compileChannelRule(id string, r ChannelRule) (*regexp.Regexp, error) {
+	if r.Folder != "" && !filepath.IsLocal(r.Folder) {
+		return nil, fmt.Errorf("channel %s: folder must be a relative path within the output directory, got %q", id, r.Folder)
+	}
+	if r.Title == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(r.Title)
+	if err != nil {
+		return nil, fmt.Errorf("channel %s: %v", id, err)
+	}
+	for _, name := range re.SubexpNames()[1:] {
+		if name != "" && !channelRuleGroups[name] {
+			return nil, fmt.Errorf("channel %s: unknown group %q in title; use title, artist, album, genre or track", id, name)
+		}
+	}
+	return re, nil
+}
+
+// validateChannelRules checks every rule of channels.
+func validateChannelRules(channels map[string]ChannelRule) error {
+	ids := make([]string, 0, len(channels))
+	for id := range channels {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if _, err := compileChannelRule(id, channels[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describeChannelRules summarizes channels for config show.
+func describeChannelRules(channels map[string]ChannelRule) string {
+	ids := make([]string, 0, len(channels))
+	for id := range channels {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ", ")
+}
+
+// applyChannelRule changes t as the rule for the video's channel in
+// channels says, after the title rules derived t from info. Groups of the
+// title expression that match win over the rule's fixed values.
+func applyChannelRule(t *trackTags, info videoInfo, channels map[string]ChannelRule) {
+	r, ok := channels[info.ChannelID]
+	if !ok || info.ChannelID == "" {
+		return
+	}
+	if r.Artist != "" {
+		t.Artist = r.Artist
+	}
+	if r.Album != "" {
+		t.Album = r.Album
+	}
+	if r.Genre != "" {
+		t.Genre = r.Genre
+	}
+	// The rule was checked when the settings were validated.
+	re, _ := compileChannelRule(info.ChannelID, r)
+	if re == nil || info.Title == "" {
+		return
+	}
+	m := re.FindStringSubmatch(info.Title)
+	if m == nil {
+		return
+	}
+	for i, name := range re.SubexpNames() {
+		v := strings.TrimSpace(m[i])
+		if name == "" || v == "" {
+			continue
+		}
+		switch name {
+		case "title":
+			t.Title = v
+		case "artist":
+			t.Artist = v
+		case "album":
+			t.Album = v
+		case "genre":
+			t.Genre = v
+		case "track":
+			if trackNumberPattern.MatchString(v) {
+				t.Track = v
+			}
+		}
+	}
+}
+
+// channelFolder returns the folder that the rule for the video's channel
+// in channels moves files into, or "".
+func channelFolder(info videoInfo, channels map[string]ChannelRule) string {
+	if info.ChannelID == "" {
+		return ""
+	}
+	return channels[info.ChannelID].Folder
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bogem/id3v2"
+)
+
+func TestApplyChannelRule(t *testing.T) {
+	channels := map[string]ChannelRule{
+		"UClabel": {Artist: "Label Artist", Album: "Label Sessions", Genre: "Jazz"},
+		"UCshow": {
+			Album: "The Show",
+			Title: `^The Show #(?P<track>[0-9]+): (?P<title>.+?)(?: with (?P<artist>.+))?$`,
+		},
+	}
+	tests := []struct {
+		name string
+		info videoInfo
+		want trackTags
+	}{
+		{
+			name: "fixed values replace the heuristics",
+			info: videoInfo{ChannelID: "UClabel", Title: "Someone - Song", Channel: "Label"},
+			want: trackTags{Title: "Song", Artist: "Label Artist", Album: "Label Sessions", Genre: "Jazz"},
+		},
+		{
+			name: "named groups set tags",
+			info: videoInfo{ChannelID: "UCshow", Title: "The Show #12: Episode Title with Guest", Channel: "Show"},
+			want: trackTags{Title: "Episode Title", Artist: "Guest", Album: "The Show", Track: "12"},
+		},
+		{
+			name: "groups that do not match keep the heuristics",
+			info: videoInfo{ChannelID: "UCshow", Title: "The Show #13: Solo", Channel: "Show"},
+			want: trackTags{Title: "Solo", Artist: "Show", Album: "The Show", Track: "13"},
+		},
+		{
+			name: "titles the expression does not match keep the heuristics",
+			info: videoInfo{ChannelID: "UCshow", Title: "Trailer - Season 2", Channel: "Show"},
+			want: trackTags{Title: "Season 2", Artist: "Trailer", Album: "The Show"},
+		},
+		{
+			name: "other channels are unchanged",
+			info: videoInfo{ChannelID: "UCother", Title: "Artist - Song", Channel: "Other"},
+			want: trackTags{Title: "Song", Artist: "Artist", Album: "YouTube"},
+		},
+	}
+	p, err := newTitleParser(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newTrackTags("file", "", tt.info, p)
+			applyChannelRule(&got, tt.info, channels)
+			if got != tt.want {
+				t.Errorf("tags = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateChannelRules(t *testing.T) {
+	tests := []struct {
+		rule    ChannelRule
+		wantErr string
+	}{
+		{rule: ChannelRule{Folder: "Labels/Label", Title: `(?P<artist>.+) - (?P<title>.+)`}},
+		{rule: ChannelRule{Folder: "../elsewhere"}, wantErr: "folder must be a relative path"},
+		{rule: ChannelRule{Folder: "/music"}, wantErr: "folder must be a relative path"},
+		{rule: ChannelRule{Title: `(?P<year>[0-9]{4})`}, wantErr: `unknown group "year"`},
+		{rule: ChannelRule{Title: `(`}, wantErr: "missing closing )"},
+	}
+	for _, tt := range tests {
+		err := validateChannelRules(map[string]ChannelRule{"UC1": tt.rule})
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("validateChannelRules(%+v) = %v", tt.rule, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !strings.Contains(err.Error(), "channel UC1") {
+			t.Errorf("validateChannelRules(%+v) error = %v, want %q", tt.rule, err, tt.wantErr)
+		}
+	}
+}
+
+func TestProcessURLChannelRule(t *testing.T) {
+	out := t.TempDir()
+	d := &fakeDownloader{info: map[string]videoInfo{
+		"https://youtu.be/abc": {ID: "abc", Title: "Song", Channel: "Label", ChannelID: "UClabel"},
+	}}
+	s := Settings{OutputDir: out, AudioFormat: "mp3", AudioQuality: "0", Channels: map[string]ChannelRule{
+		"UClabel": {Artist: "Label Artist", Genre: "Jazz", Folder: filepath.Join("Labels", "Label")},
+	}}
+
+	res, err := processURL(context.Background(), d, "https://youtu.be/abc", s, io.Discard, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(out, "Labels", "Label", "Song.mp3")
+	if res.FinalPath != want {
+		t.Errorf("FinalPath = %q, want %q", res.FinalPath, want)
+	}
+	if res.Tags["artist"] != "Label Artist" || res.Tags["genre"] != "Jazz" {
+		t.Errorf("result tags = %v", res.Tags)
+	}
+	if _, err := os.Stat(want); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := id3v2.Open(want, id3v2.Options{Parse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tag.Close()
+	if tag.Artist() != "Label Artist" || tag.Genre() != "Jazz" {
+		t.Errorf("TPE1 = %q, TCON = %q", tag.Artist(), tag.Genre())
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// Sources recorded for each effective setting, from lowest to highest
+// precedence (the profile source is "profile:<name>").
+const (
+	sourceBuiltin = "builtin"
+	sourceConfig  = "config"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+)
+
+// envPrefix is prepended to upper-cased setting keys to form environment
+// variable names, e.g. YT2MP3_AUDIO_FORMAT.
+const envPrefix = "YT2MP3_"
+
+var (
+	// Config file path option (defaults to defaultConfigPath)
+	configPath string
+	// Named profile option
+	profileName string
+)
+
+// audioFormatExt maps the audio formats accepted by yt-dlp's --audio-format
+// to the extension of the file it produces.
+var audioFormatExt = map[string]string{
+	"mp3":    ".mp3",
+	"m4a":    ".m4a",
+	"opus":   ".opus",
+	"flac":   ".flac",
+	"wav":    ".wav",
+	"vorbis": ".ogg",
+}
+
+// Settings are the effective download options after merging builtin
+// defaults, the config file, the selected profile, the environment and flags.
+type Settings struct {
+	OutputDir      string `yaml:"output_dir" json:"output_dir"`
+	AudioFormat    string `yaml:"audio_format" json:"audio_format"`
+	AudioQuality   string `yaml:"audio_quality" json:"audio_quality"`
+	Mono           bool   `yaml:"mono" json:"mono"`
+	EmbedThumbnail bool   `yaml:"embed_thumbnail" json:"embed_thumbnail"`
+	// Tags are KEY=VALUE overrides for the tags of downloaded MP3 files.
+	Tags []string `yaml:"tags" json:"tags,omitempty"`
+	// TitleRules split video titles into artist and title; nil selects
+	// the default rules and an empty list turns splitting off.
+	TitleRules []TitleRule `yaml:"title_rules" json:"title_rules"`
+	// Channels are the rules for the videos of channels, keyed by channel
+	// ID.
+	Channels map[string]ChannelRule `yaml:"channels" json:"channels,omitempty"`
+	// Retry replaces the retry options of the process that downloads;
+	// clients set it to their own when handing off to the daemon.
+	Retry *RetryOptions `yaml:"-" json:"retry,omitempty"`
+}
+
+// Profile is a partial set of settings. Nil fields inherit the value from
+// the layer below.
+type Profile struct {
+	OutputDir      *string `yaml:"output_dir" json:"output_dir,omitempty"`
+	AudioFormat    *string `yaml:"audio_format" json:"audio_format,omitempty"`
+	AudioQuality   *string `yaml:"audio_quality" json:"audio_quality,omitempty"`
+	Mono           *bool   `yaml:"mono" json:"mono,omitempty"`
+	EmbedThumbnail *bool   `yaml:"embed_thumbnail" json:"embed_thumbnail,omitempty"`
+	// Tags add to the tag overrides of the layers below; a later override
+	// of the same key wins.
+	Tags []string `yaml:"tags" json:"tags,omitempty"`
+	// TitleRules replace the title rules of the layers below.
+	TitleRules []TitleRule `yaml:"title_rules" json:"title_rules,omitempty"`
+	// Channels add to the channel rules of the layers below; a rule for
+	// the same channel replaces the one below.
+	Channels map[string]ChannelRule `yaml:"channels" json:"channels,omitempty"`
+}
+
+// Config is the on-disk configuration file.
+type Config struct {
+	Defaults Profile            `yaml:"defaults"`
+	Profiles map[string]Profile `yaml:"profiles"`
+	Webhooks []Webhook          `yaml:"webhooks"`
+}
+
+// builtinSettings returns the settings used when nothing is configured.
+func builtinSettings() Settings {
+	return Settings{
+		AudioFormat:  "mp3",
+		AudioQuality: "0",
+	}
+}
+
+// defaultConfigPath returns $XDG_CONFIG_HOME/yt2mp3/config.yaml, falling back
+// to the platform's user config directory when XDG_CONFIG_HOME is unset.
+func defaultConfigPath() (string, error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		var err error
+		if dir, err = os.UserConfigDir(); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(dir, "yt2mp3", "config.yaml"), nil
+}
+
+// loadConfig reads the config file at path. A missing file yields an empty
+// config unless mustExist is set, which is the case when the user named the
+// file explicitly.
+func loadConfig(path string, mustExist bool) (*Config, error) {
+	cfg := &Config{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && !mustExist {
+			return cfg, nil
+		}
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	cfg.Defaults.expandHome()
+	for name, p := range cfg.Profiles {
+		p.expandHome()
+		cfg.Profiles[name] = p
+	}
+	return cfg, nil
+}
+
+// expandHome expands a leading "~" in the output directory, since config
+// files are not run through a shell.
+func (p *Profile) expandHome() {
+	if p.OutputDir == nil {
+		return
+	}
+	dir := *p.OutputDir
+	if dir != "~" && !strings.HasPrefix(dir, "~/") {
+		return
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return
+	}
+	dir = filepath.Join(home, strings.TrimPrefix(dir, "~"))
+	p.OutputDir = &dir
+}
+
+// applyTo overlays the non-nil fields of p onto s and records source for
+// each overridden key.
+func (p Profile) applyTo(s *Settings, sources map[string]string, source string) {
+	if p.OutputDir != nil {
+		s.OutputDir = *p.OutputDir
+		sources["output_dir"] = source
+	}
+	if p.AudioFormat != nil {
+		s.AudioFormat = *p.AudioFormat
+		sources["audio_format"] = source
+	}
+	if p.AudioQuality != nil {
+		s.AudioQuality = *p.AudioQuality
+		sources["audio_quality"] = source
+	}
+	if p.Mono != nil {
+		s.Mono = *p.Mono
+		sources["mono"] = source
+	}
+	if p.EmbedThumbnail != nil {
+		s.EmbedThumbnail = *p.EmbedThumbnail
+		sources["embed_thumbnail"] = source
+	}
+	if len(p.Tags) > 0 {
+		s.Tags = append(slices.Clip(s.Tags), p.Tags...)
+		sources["tags"] = source
+	}
+	if p.TitleRules != nil {
+		s.TitleRules = p.TitleRules
+		sources["title_rules"] = source
+	}
+	if len(p.Channels) > 0 {
+		s.Channels = maps.Clone(s.Channels)
+		if s.Channels == nil {
+			s.Channels = map[string]ChannelRule{}
+		}
+		maps.Copy(s.Channels, p.Channels)
+		sources["channels"] = source
+	}
+}
+
+// profileFromEnv builds a profile from YT2MP3_* environment variables.
+func profileFromEnv(getenv func(string) string) (Profile, error) {
+	var p Profile
+	if v := getenv(envPrefix + "OUTPUT_DIR"); v != "" {
+		p.OutputDir = &v
+	}
+	if v := getenv(envPrefix + "AUDIO_FORMAT"); v != "" {
+		p.AudioFormat = &v
+	}
+	if v := getenv(envPrefix + "AUDIO_QUALITY"); v != "" {
+		p.AudioQuality = &v
+	}
+	for key, dst := range map[string]**bool{"MONO": &p.Mono, "EMBED_THUMBNAIL": &p.EmbedThumbnail} {
+		v := getenv(envPrefix + key)
+		if v == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return p, fmt.Errorf("invalid value for %s%s: %q", envPrefix, key, v)
+		}
+		*dst = &b
+	}
+	return p, nil
+}
+
+// profileFromFlags builds a profile from the flags the user actually set.
+func profileFromFlags(flags *pflag.FlagSet) Profile {
+	var p Profile
+	for name, dst := range map[string]**string{
+		"output-dir":    &p.OutputDir,
+		"audio-format":  &p.AudioFormat,
+		"audio-quality": &p.AudioQuality,
+	} {
+		if f := flags.Lookup(name); f != nil && f.Changed {
+			v := f.Value.String()
+			*dst = &v
+		}
+	}
+	for name, dst := range map[string]**bool{
+		"mono":            &p.Mono,
+		"embed-thumbnail": &p.EmbedThumbnail,
+	} {
+		if f := flags.Lookup(name); f != nil && f.Changed {
+			v := f.Value.String() == "true"
+			*dst = &v
+		}
+	}
+	if f := flags.Lookup("tag"); f != nil && f.Changed {
+		if v, ok := f.Value.(pflag.SliceValue); ok {
+			p.Tags = v.GetSlice()
+		}
+	}
+	return p
+}
+
+// resolveSettings merges every settings layer with precedence
+// flag > env > profile > config defaults > builtin defaults. It returns the
+// effective settings and, for each key, the layer it came from.
+func resolveSettings(cfg *Config, profile string, getenv func(string) string, flags *pflag.FlagSet) (Settings, map[string]string, error) {
+	s := builtinSettings()
+	sources := map[string]string{
+		"output_dir":      sourceBuiltin,
+		"audio_format":    sourceBuiltin,
+		"audio_quality":   sourceBuiltin,
+		"mono":            sourceBuiltin,
+		"embed_thumbnail": sourceBuiltin,
+		"tags":            sourceBuiltin,
+		"title_rules":     sourceBuiltin,
+		"channels":        sourceBuiltin,
+	}
+
+	cfg.Defaults.applyTo(&s, sources, sourceConfig)
+	if profile != "" {
+		p, ok := cfg.Profiles[profile]
+		if !ok {
+			return s, nil, fmt.Errorf("unknown profile %q", profile)
+		}
+		p.applyTo(&s, sources, "profile:"+profile)
+	}
+	envProfile, err := profileFromEnv(getenv)
+	if err != nil {
+		return s, nil, err
+	}
+	envProfile.applyTo(&s, sources, sourceEnv)
+	if flags != nil {
+		profileFromFlags(flags).applyTo(&s, sources, sourceFlag)
+	}
+
+	if err := validateSettings(s); err != nil {
+		return s, nil, err
+	}
+	return s, sources, nil
+}
+
+// validateSettings checks values that yt-dlp would otherwise reject late.
+func validateSettings(s Settings) error {
+	if _, ok := audioFormatExt[s.AudioFormat]; !ok {
+		return fmt.Errorf("unsupported audio format %q", s.AudioFormat)
+	}
+	if _, err := parseTagOverrides(s.Tags); err != nil {
+		return err
+	}
+	if _, err := newTitleParser(s.TitleRules); err != nil {
+		return err
+	}
+	if s.Retry != nil && s.Retry.Retries < 0 {
+		return fmt.Errorf("retries must not be negative, got %d", s.Retry.Retries)
+	}
+	return validateChannelRules(s.Channels)
+}
+
+// loadSettings resolves the effective settings for cmd from the config file,
+// the selected profile, the environment and cmd's flags.
+func loadSettings(cmd *cobra.Command) (Settings, map[string]string, error) {
+	cfg, err := loadConfigFile()
+	if err != nil {
+		return Settings{}, nil, err
+	}
+	return resolveSettings(cfg, selectedProfile(), os.Getenv, cmd.Flags())
+}
+
+// loadConfigFile loads the config file named by --config or YT2MP3_CONFIG,
+// or the one at the default location if it exists.
+func loadConfigFile() (*Config, error) {
+	path, explicit := configPath, configPath != ""
+	if !explicit {
+		if v := os.Getenv(envPrefix + "CONFIG"); v != "" {
+			path, explicit = v, true
+		}
+	}
+	if !explicit {
+		var err error
+		if path, err = defaultConfigPath(); err != nil {
+			return nil, fmt.Errorf("failed to locate config file: %v", err)
+		}
+	}
+	return loadConfig(path, explicit)
+}
+
+// selectedProfile returns the profile chosen with --profile or
+// YT2MP3_PROFILE.
+func selectedProfile() string {
+	if profileName != "" {
+		return profileName
+	}
+	return os.Getenv(envPrefix + "PROFILE")
+}
+
+// printSettings writes the effective settings and their sources as a table.
+func printSettings(w io.Writer, s Settings, sources map[string]string) error {
+	values := map[string]string{
+		"output_dir":      s.OutputDir,
+		"audio_format":    s.AudioFormat,
+		"audio_quality":   s.AudioQuality,
+		"mono":            strconv.FormatBool(s.Mono),
+		"embed_thumbnail": strconv.FormatBool(s.EmbedThumbnail),
+		"tags":            strings.Join(s.Tags, ", "),
+		"title_rules":     describeTitleRules(s.TitleRules),
+		"channels":        describeChannelRules(s.Channels),
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tVALUE\tSOURCE")
+	for _, k := range keys {
+		v := values[k]
+		if v == "" {
+			v = `""`
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", k, v, sources[k])
+	}
+	return tw.Flush()
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the configuration",
+}
+
+var configShowCmd = &cobra.Command{
+	Use:          "show",
+	Short:        "Print the effective settings and where each one comes from",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		settings, sources, err := loadSettings(cmd)
+		if err != nil {
+			return err
+		}
+		return printSettings(cmd.OutOrStdout(), settings, sources)
+	},
+}
+
+func init() {
+	pf := rootCmd.PersistentFlags()
+	pf.StringVar(&configPath, "config", "", "Config file (default $XDG_CONFIG_HOME/yt2mp3/config.yaml)")
+	pf.StringVarP(&profileName, "profile", "p", "", "Named profile from the config file")
+	pf.String("audio-format", "mp3", "Audio format: mp3, m4a, opus, flac, wav or vorbis")
+	pf.String("audio-quality", "0", "Audio quality: 0 (best) to 10 (worst) VBR, or a bitrate such as 128K")
+	pf.Bool("mono", false, "Downmix audio to mono")
+	pf.Bool("embed-thumbnail", false, "Embed the video thumbnail as cover art")
+	pf.StringArray("tag", nil, "Override a tag of MP3 files as KEY=VALUE, e.g. album=\"{channel} Live\" (repeatable)")
+
+	configCmd.AddCommand(configShowCmd)
+	rootCmd.AddCommand(configCmd)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+const testConfig = `
+defaults:
+  audio_quality: "2"
+profiles:
+  podcast:
+    audio_format: opus
+    audio_quality: 64K
+    mono: true
+    output_dir: ~/Podcasts
+  music:
+    audio_quality: 320K
+    embed_thumbnail: true
+  live:
+    tags: ["genre=Pop"]
+    channels:
+      UC123:
+        artist: Label Artist
+        folder: Label
+`
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("HOME", "/home/tester")
+
+	t.Run("parses defaults and profiles", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		mustWrite(t, path, testConfig)
+
+		cfg, err := loadConfig(path, true)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cfg.Defaults.AudioQuality == nil || *cfg.Defaults.AudioQuality != "2" {
+			t.Errorf("defaults not parsed: %+v", cfg.Defaults)
+		}
+		podcast := cfg.Profiles["podcast"]
+		if podcast.OutputDir == nil || *podcast.OutputDir != filepath.Join("/home/tester", "Podcasts") {
+			t.Errorf("output_dir not expanded: %v", podcast.OutputDir)
+		}
+		if podcast.Mono == nil || !*podcast.Mono {
+			t.Error("mono not parsed")
+		}
+	})
+
+	t.Run("missing default file is empty", func(t *testing.T) {
+		cfg, err := loadConfig(filepath.Join(t.TempDir(), "none.yaml"), false)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(cfg.Profiles) != 0 {
+			t.Error("expected no profiles")
+		}
+	})
+
+	t.Run("missing explicit file is an error", func(t *testing.T) {
+		if _, err := loadConfig(filepath.Join(t.TempDir(), "none.yaml"), true); err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("invalid yaml", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		mustWrite(t, path, "profiles: [not a map")
+		if _, err := loadConfig(path, true); err == nil {
+			t.Error("expected a parse error")
+		}
+	})
+}
+
+func TestResolveSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	mustWrite(t, path, testConfig)
+	cfg, err := loadConfig(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newFlags := func(args ...string) *pflag.FlagSet {
+		fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		fs.String("output-dir", "", "")
+		fs.String("audio-format", "mp3", "")
+		fs.String("audio-quality", "0", "")
+		fs.Bool("mono", false, "")
+		fs.Bool("embed-thumbnail", false, "")
+		fs.StringArray("tag", nil, "")
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		return fs
+	}
+	env := func(vars map[string]string) func(string) string {
+		return func(k string) string { return vars[k] }
+	}
+
+	tests := []struct {
+		name        string
+		profile     string
+		env         map[string]string
+		flags       []string
+		want        Settings
+		wantSources map[string]string
+		wantErr     string
+	}{
+		{
+			name:        "builtin and config defaults",
+			want:        Settings{AudioFormat: "mp3", AudioQuality: "2"},
+			wantSources: map[string]string{"audio_format": sourceBuiltin, "audio_quality": sourceConfig},
+		},
+		{
+			name:    "profile overrides defaults",
+			profile: "podcast",
+			want: Settings{
+				OutputDir:    filepath.Join(os.Getenv("HOME"), "Podcasts"),
+				AudioFormat:  "opus",
+				AudioQuality: "64K",
+				Mono:         true,
+			},
+			wantSources: map[string]string{"mono": "profile:podcast"},
+		},
+		{
+			name:        "env overrides profile",
+			profile:     "podcast",
+			env:         map[string]string{"YT2MP3_AUDIO_QUALITY": "96K", "YT2MP3_MONO": "false"},
+			want:        Settings{OutputDir: filepath.Join(os.Getenv("HOME"), "Podcasts"), AudioFormat: "opus", AudioQuality: "96K"},
+			wantSources: map[string]string{"audio_quality": sourceEnv, "mono": sourceEnv},
+		},
+		{
+			name:        "flag overrides env",
+			profile:     "music",
+			env:         map[string]string{"YT2MP3_AUDIO_QUALITY": "96K"},
+			flags:       []string{"--audio-quality", "128K", "--output-dir", "out"},
+			want:        Settings{OutputDir: "out", AudioFormat: "mp3", AudioQuality: "128K", EmbedThumbnail: true},
+			wantSources: map[string]string{"audio_quality": sourceFlag, "output_dir": sourceFlag, "embed_thumbnail": "profile:music"},
+		},
+		{
+			name:    "tag flags add to the profile's",
+			profile: "live",
+			flags:   []string{"--tag", "album={channel} Live", "--tag", "genre=Jazz"},
+			want: Settings{
+				AudioFormat:  "mp3",
+				AudioQuality: "2",
+				Tags:         []string{"genre=Pop", "album={channel} Live", "genre=Jazz"},
+				Channels:     map[string]ChannelRule{"UC123": {Artist: "Label Artist", Folder: "Label"}},
+			},
+			wantSources: map[string]string{"tags": sourceFlag, "channels": "profile:live"},
+		},
+		{
+			name:    "invalid tag",
+			flags:   []string{"--tag", "mood=happy"},
+			wantErr: `unknown key "mood"`,
+		},
+		{
+			name:    "unknown profile",
+			profile: "nope",
+			wantErr: "unknown profile",
+		},
+		{
+			name:    "invalid env bool",
+			env:     map[string]string{"YT2MP3_MONO": "maybe"},
+			wantErr: "YT2MP3_MONO",
+		},
+		{
+			name:    "unsupported format",
+			flags:   []string{"--audio-format", "aiff"},
+			wantErr: "unsupported audio format",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, sources, err := resolveSettings(cfg, tt.profile, env(tt.env), newFlags(tt.flags...))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("settings = %+v, want %+v", got, tt.want)
+			}
+			for k, v := range tt.wantSources {
+				if sources[k] != v {
+					t.Errorf("source of %s = %q, want %q", k, sources[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestPrintSettings(t *testing.T) {
+	var buf bytes.Buffer
+	s := Settings{AudioFormat: "opus", AudioQuality: "64K", Mono: true}
+	sources := map[string]string{"audio_format": "profile:podcast"}
+	if err := printSettings(&buf, s, sources); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{"audio_format", "opus", "profile:podcast", "mono", "true", `""`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestYtDlpArgs(t *testing.T) {
+	got := ytDlpArgs(Settings{AudioFormat: "mp3", AudioQuality: "0"}, "out/%(title)s.%(ext)s", "URL")
+	want := []string{
+		"--extract-audio", "--audio-format", "mp3", "--audio-quality", "0",
+		"--newline", "--no-playlist", "--write-info-json", "--output", "out/%(title)s.%(ext)s", "URL",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	got = ytDlpArgs(Settings{AudioFormat: "opus", AudioQuality: "64K", Mono: true, EmbedThumbnail: true}, "o", "URL")
+	joined := strings.Join(got, " ")
+	for _, want := range []string{"--audio-format opus", "ExtractAudio:-ac 1", "--embed-thumbnail", "--embed-metadata"} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("args %q missing %q", joined, want)
+		}
+	}
+}
+
+func TestEnsureOutputDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	origDir, _ := os.Getwd()
+	defer os.Chdir(origDir)
+	if err := os.Chdir(filepath.Join(tmpDir)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir("cwd", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir("cwd"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ensureOutputDir("../from-flag", sourceFlag); err == nil {
+		t.Error("expected --output-dir outside the current directory to be rejected")
+	}
+	if err := ensureOutputDir("../from-config", "profile:podcast"); err != nil {
+		t.Errorf("unexpected error for configured directory: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "from-config")); err != nil {
+		t.Errorf("configured directory was not created: %v", err)
+	}
+}
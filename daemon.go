@@ -0,0 +1,657 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// daemonDialTimeout bounds how long the CLI waits for a daemon before
+	// doing the work itself.
+	daemonDialTimeout = 500 * time.Millisecond
+	// daemonQueueSize is the number of jobs that may wait in the daemon.
+	daemonQueueSize = 1000
+	// daemonRetention is how long the daemon remembers finished jobs.
+	daemonRetention = 24 * time.Hour
+)
+
+// Daemon protocol operations.
+const (
+	opEnqueue = "enqueue"
+	opStatus  = "status"
+	opWait    = "wait"
+	opCancel  = "cancel"
+)
+
+var (
+	// Control socket option
+	daemonSocket string
+	// Option to never hand off to a running daemon
+	noDaemon bool
+	// Worker pool size option for daemon
+	daemonWorkers int
+	// Option to wait for enqueued jobs to finish
+	enqueueWait bool
+	// statusJSON makes the status command emit JSON instead of a table
+	statusJSON bool
+)
+
+// daemonRequest is sent by a client as a single JSON line. The daemon
+// answers with one or more daemonResponse lines and closes the connection.
+type daemonRequest struct {
+	Op       string    `json:"op"`
+	URL      string    `json:"url,omitempty"`
+	Settings *Settings `json:"settings,omitempty"`
+	ID       string    `json:"id,omitempty"`
+}
+
+// jobErrorCodes are the error codes of the job errors of the protocol,
+// next to the ones of errorClasses.
+var jobErrorCodes = map[string]error{
+	"job_not_found": errJobNotFound,
+	"job_finished":  errJobFinished,
+}
+
+// daemonError rebuilds the error of a reply line, so that clients can match
+// it with errors.Is.
+func daemonError(resp daemonResponse) error {
+	if kind, ok := jobErrorCodes[resp.ErrorCode]; ok {
+		return classify(kind, errors.New(resp.Error))
+	}
+	return errorFromCode(resp.ErrorCode, resp.Error)
+}
+
+// daemonResponse is one reply line. A wait request receives a line for
+// every change to the job until it finishes.
+type daemonResponse struct {
+	Job       *Job   `json:"job,omitempty"`
+	Jobs      []Job  `json:"jobs,omitempty"`
+	Error     string `json:"error,omitempty"`
+	ErrorCode string `json:"error_code,omitempty"`
+}
+
+// defaultSocketPath returns yt2mp3.sock in $XDG_RUNTIME_DIR, or daemon.sock
+// in the state directory.
+func defaultSocketPath() (string, error) {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "yt2mp3.sock"), nil
+	}
+	dir, err := defaultStateDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate state directory: %v", err)
+	}
+	return filepath.Join(dir, "daemon.sock"), nil
+}
+
+// socketPath returns the --socket value or the default path.
+func socketPath() (string, error) {
+	if daemonSocket != "" {
+		return daemonSocket, nil
+	}
+	return defaultSocketPath()
+}
+
+// daemon answers control socket requests using a jobManager.
+type daemon struct {
+	jobs *jobManager
+	log  io.Writer
+}
+
+// serve accepts connections on l until ctx is done.
+func (d *daemon) serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to accept connection: %v", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.handle(ctx, conn)
+		}()
+	}
+}
+
+// handle answers the single request on conn.
+func (d *daemon) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	// Unblock pending writes when shutting down.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	enc := json.NewEncoder(conn)
+	reply := func(job *Job, jobs []Job, err error) error {
+		resp := daemonResponse{Job: job, Jobs: jobs}
+		if err != nil {
+			resp.Error = err.Error()
+			if code := errorCode(err); code != "unknown" {
+				resp.ErrorCode = code
+			}
+			for code, kind := range jobErrorCodes {
+				if errors.Is(err, kind) {
+					resp.ErrorCode = code
+				}
+			}
+		}
+		return enc.Encode(resp)
+	}
+
+	// Read the whole line: closing the connection with the newline unread
+	// would reset it before the client reads the reply.
+	var req daemonRequest
+	line, err := bufio.NewReader(io.LimitReader(conn, maxRequestBody)).ReadBytes('\n')
+	if err == nil || err == io.EOF {
+		err = json.Unmarshal(line, &req)
+	}
+	if err != nil {
+		reply(nil, nil, fmt.Errorf("invalid request: %v", err))
+		return
+	}
+	switch req.Op {
+	case opEnqueue:
+		job, err := d.enqueue(req)
+		if err != nil {
+			reply(nil, nil, err)
+			return
+		}
+		fmt.Fprintf(d.log, "Queued %s as job %s\n", job.URL, job.ID)
+		reply(&job, nil, nil)
+	case opStatus:
+		if req.ID == "" {
+			reply(nil, d.jobs.List(), nil)
+			return
+		}
+		job, ok := d.jobs.Get(req.ID)
+		if !ok {
+			reply(nil, nil, errJobNotFound)
+			return
+		}
+		reply(&job, nil, nil)
+	case opWait:
+		d.wait(ctx, req.ID, func(job Job) error {
+			return reply(&job, nil, nil)
+		}, func(err error) { reply(nil, nil, err) })
+	case opCancel:
+		job, err := d.jobs.Cancel(req.ID)
+		if err != nil {
+			reply(nil, nil, err)
+			return
+		}
+		reply(&job, nil, nil)
+	default:
+		reply(nil, nil, fmt.Errorf("unknown operation %q", req.Op))
+	}
+}
+
+// enqueue validates the settings resolved by the client and queues the job.
+// The output directory must be absolute, since the client's working
+// directory means nothing to the daemon.
+func (d *daemon) enqueue(req daemonRequest) (Job, error) {
+	if err := validateURL(req.URL); err != nil {
+		return Job{}, err
+	}
+	if req.Settings == nil {
+		return Job{}, fmt.Errorf("missing settings")
+	}
+	s := *req.Settings
+	if err := validateSettings(s); err != nil {
+		return Job{}, err
+	}
+	if !filepath.IsAbs(s.OutputDir) {
+		return Job{}, classify(ErrOutputDir, fmt.Errorf("output directory must be absolute, got %q", s.OutputDir))
+	}
+	return d.jobs.SubmitResolved(JobRequest{URL: req.URL}, s, nil)
+}
+
+// wait calls send with the job and every later change to it until it
+// finishes, or fail if there is no such job.
+func (d *daemon) wait(ctx context.Context, id string, send func(Job) error, fail func(error)) {
+	// Subscribe before reading the job so that no change falls in between.
+	sub := d.jobs.Subscribe()
+	defer d.jobs.Unsubscribe(sub)
+	job, ok := d.jobs.Get(id)
+	if !ok {
+		fail(errJobNotFound)
+		return
+	}
+	for {
+		if err := send(job); err != nil || job.finished() {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-sub.C:
+			for _, j := range sub.Changes() {
+				if j.ID == id {
+					job = j
+				}
+			}
+		}
+	}
+}
+
+// listenDaemon listens on the Unix socket at path. A socket left behind by
+// a daemon that died is removed; a live one is an error.
+func listenDaemon(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %v", err)
+	}
+	if conn, err := net.DialTimeout("unix", path, daemonDialTimeout); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a yt2mp3 daemon is already listening on %s", path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale socket: %v", err)
+	}
+	// Only the owner may queue downloads.
+	l, err := listenSocket(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", path, err)
+	}
+	return l, nil
+}
+
+// daemonClient talks to a daemon over its control socket.
+type daemonClient struct {
+	path string
+}
+
+// findDaemon returns a client for the daemon listening on the configured
+// socket, if one is running.
+func findDaemon() (*daemonClient, bool) {
+	path, err := socketPath()
+	if err != nil {
+		return nil, false
+	}
+	conn, err := net.DialTimeout("unix", path, daemonDialTimeout)
+	if err != nil {
+		return nil, false
+	}
+	conn.Close()
+	return &daemonClient{path: path}, true
+}
+
+// connectDaemon returns a client for the running daemon or explains how to
+// start one.
+func connectDaemon() (*daemonClient, error) {
+	c, ok := findDaemon()
+	if !ok {
+		path, _ := socketPath()
+		return nil, fmt.Errorf("no yt2mp3 daemon is listening on %s; start one with `yt2mp3 daemon`", path)
+	}
+	return c, nil
+}
+
+// call sends req and passes every response line to fn. An error reported by
+// the daemon is returned with its original class.
+func (c *daemonClient) call(ctx context.Context, req daemonRequest, fn func(daemonResponse) error) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", c.path)
+	if err != nil {
+		return fmt.Errorf("failed to connect to daemon: %v", err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return fmt.Errorf("failed to send request to daemon: %v", err)
+	}
+	sc := bufio.NewScanner(conn)
+	sc.Buffer(make([]byte, 64<<10), maxRequestBody)
+	got := false
+	for sc.Scan() {
+		got = true
+		var resp daemonResponse
+		if err := json.Unmarshal(sc.Bytes(), &resp); err != nil {
+			return fmt.Errorf("invalid response from daemon: %v", err)
+		}
+		if resp.Error != "" {
+			return daemonError(resp)
+		}
+		if err := fn(resp); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return classify(ErrInterrupted, ctx.Err())
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("failed to read response from daemon: %v", err)
+	}
+	if !got {
+		return fmt.Errorf("daemon closed the connection without replying")
+	}
+	return nil
+}
+
+// single sends req and returns the one job in the response.
+func (c *daemonClient) single(ctx context.Context, req daemonRequest) (Job, error) {
+	var job Job
+	err := c.call(ctx, req, func(resp daemonResponse) error {
+		if resp.Job != nil {
+			job = *resp.Job
+		}
+		return nil
+	})
+	return job, err
+}
+
+// enqueue queues url with settings s.
+func (c *daemonClient) enqueue(ctx context.Context, url string, s Settings) (Job, error) {
+	return c.single(ctx, daemonRequest{Op: opEnqueue, URL: url, Settings: &s})
+}
+
+// cancel cancels the job with the given ID.
+func (c *daemonClient) cancel(ctx context.Context, id string) (Job, error) {
+	return c.single(ctx, daemonRequest{Op: opCancel, ID: id})
+}
+
+// status returns every job, or only the one with the given ID.
+func (c *daemonClient) status(ctx context.Context, id string) ([]Job, error) {
+	var jobs []Job
+	err := c.call(ctx, daemonRequest{Op: opStatus, ID: id}, func(resp daemonResponse) error {
+		if resp.Job != nil {
+			jobs = append(jobs, *resp.Job)
+		}
+		jobs = append(jobs, resp.Jobs...)
+		return nil
+	})
+	return jobs, err
+}
+
+// wait blocks until the job finishes and returns its final state.
+func (c *daemonClient) wait(ctx context.Context, id string) (Job, error) {
+	job, err := c.single(ctx, daemonRequest{Op: opWait, ID: id})
+	if err == nil && !job.finished() {
+		err = fmt.Errorf("daemon stopped before job %s finished", id)
+	}
+	return job, err
+}
+
+// enqueueAll queues every URL with settings s, resolving the output
+// directory against the client's working directory and passing on the
+// client's retry options. It returns the job ID
+// or the rejection of each URL.
+func (c *daemonClient) enqueueAll(ctx context.Context, urls []string, s Settings) ([]string, []error, error) {
+	if s.OutputDir == "" {
+		s.OutputDir = "."
+	}
+	dir, err := filepath.Abs(s.OutputDir)
+	if err != nil {
+		return nil, nil, classify(ErrOutputDir, fmt.Errorf("failed to resolve output directory path: %v", err))
+	}
+	s.OutputDir = dir
+	s.Retry = currentRetryOptions()
+
+	ids := make([]string, len(urls))
+	errs := make([]error, len(urls))
+	for i, url := range urls {
+		job, err := c.enqueue(ctx, url, s)
+		if err != nil && errors.Is(err, ErrInterrupted) {
+			return nil, nil, err
+		}
+		ids[i], errs[i] = job.ID, err
+	}
+	return ids, errs, nil
+}
+
+// batch queues every URL with the daemon up front, so that its workers can
+// run them concurrently, and returns a runBatch processor that waits for
+// each job in turn. Interrupting the wait cancels the jobs still pending.
+func (c *daemonClient) batch(ctx context.Context, urls []string, s Settings, log io.Writer) (func(ctx context.Context, i int) (*Result, error), error) {
+	ids, errs, err := c.enqueueAll(ctx, urls, s)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, i int) (*Result, error) {
+		url := urls[i]
+		if err := errs[i]; err != nil {
+			return &Result{URL: url, Status: statusFailed, ErrorCode: errorCode(err), Error: err.Error()}, err
+		}
+		fmt.Fprintf(log, "Downloading audio from %s...\n", url)
+		job, err := c.wait(ctx, ids[i])
+		if err != nil {
+			if ctx.Err() != nil {
+				c.cancelAll(ids[i:], log)
+			}
+			return &Result{URL: url, Status: statusFailed, ErrorCode: errorCode(err), Error: err.Error()}, err
+		}
+		return jobResult(job)
+	}, nil
+}
+
+// cancelAll cancels the given daemon jobs, ignoring ones that already
+// finished.
+func (c *daemonClient) cancelAll(ids []string, log io.Writer) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, id := range ids {
+		if id == "" {
+			continue
+		}
+		if _, err := c.cancel(ctx, id); err != nil && !errors.Is(err, errJobFinished) {
+			fmt.Fprintf(log, "Failed to cancel daemon job %s: %v\n", id, err)
+		}
+	}
+}
+
+// jobResult returns a finished job's result and, if it did not succeed, its
+// error.
+func jobResult(job Job) (*Result, error) {
+	res := job.Result
+	if res == nil {
+		res = &Result{URL: job.URL, Status: statusFailed}
+	}
+	switch job.State {
+	case jobDone:
+		return res, nil
+	case jobCanceled:
+		err := classify(ErrInterrupted, fmt.Errorf("job %s was canceled", job.ID))
+		res.Status, res.ErrorCode, res.Error = statusFailed, errorCode(err), err.Error()
+		return res, err
+	default:
+		return res, errorFromCode(res.ErrorCode, res.Error)
+	}
+}
+
+// printJobs writes jobs as a table.
+func printJobs(w io.Writer, jobs []Job) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATE\tPROGRESS\tURL\tRESULT")
+	for _, j := range jobs {
+		result := ""
+		if j.Result != nil {
+			result = j.Result.FinalPath
+			if j.Result.Error != "" {
+				result = errorSummary(errors.New(j.Result.Error))
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.0f%%\t%s\t%s\n", j.ID, j.State, j.Progress, j.URL, result)
+	}
+	return tw.Flush()
+}
+
+var daemonCmd = &cobra.Command{
+	Use:          "daemon",
+	Short:        "Run a background downloader that other yt2mp3 commands hand URLs to",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		log := cmd.ErrOrStderr()
+		path, err := socketPath()
+		if err != nil {
+			return err
+		}
+
+		tempDir, err := os.MkdirTemp("", "yt2mp3")
+		if err != nil {
+			return fmt.Errorf("failed to create temp directory: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+		ytdl, err := newYtDlp(tempDir)
+		if err != nil {
+			return err
+		}
+		d := retryingDownloader{downloader: ytdl, policy: newRetryPolicy(retries, retryMaxWait), log: log}
+
+		l, err := listenDaemon(path)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(path)
+
+		ctx := cmd.Context()
+		jobs, err := newJobManager(ctx, d, nil, jobManagerOptions{
+			Workers:   daemonWorkers,
+			QueueSize: daemonQueueSize,
+			Retention: daemonRetention,
+			Log:       log,
+		})
+		if err != nil {
+			l.Close()
+			return err
+		}
+		fmt.Fprintf(log, "Listening on %s\n", path)
+		err = (&daemon{jobs: jobs, log: log}).serve(ctx, l)
+		jobs.Wait()
+		return err
+	},
+}
+
+var enqueueCmd = &cobra.Command{
+	Use:          "enqueue URL...",
+	Short:        "Queue downloads in the running daemon and print their job IDs",
+	Args:         cobra.MinimumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := connectDaemon()
+		if err != nil {
+			return err
+		}
+		settings, sources, err := loadSettings(cmd)
+		if err != nil {
+			return err
+		}
+		if settings.OutputDir != "" {
+			if err := ensureOutputDir(settings.OutputDir, sources["output_dir"]); err != nil {
+				return err
+			}
+		}
+
+		ctx := cmd.Context()
+		log := cmd.ErrOrStderr()
+		if enqueueWait {
+			process, err := c.batch(ctx, args, settings, log)
+			if err != nil {
+				return err
+			}
+			printer, err := newResultPrinter(formatText, cmd.OutOrStdout())
+			if err != nil {
+				return err
+			}
+			return runBatch(ctx, args, process, printer, log)
+		}
+
+		ids, errs, err := c.enqueueAll(ctx, args, settings)
+		if err != nil {
+			return err
+		}
+		var firstErr error
+		failed := 0
+		for i, url := range args {
+			if errs[i] != nil {
+				failed++
+				if firstErr == nil {
+					firstErr = errs[i]
+				}
+				if len(args) > 1 {
+					fmt.Fprintf(log, "Failed to queue %s: %v\n", url, errs[i])
+				}
+				continue
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), ids[i])
+		}
+		return batchError(failed, len(args), firstErr, "URLs")
+	},
+}
+
+var statusCmd = &cobra.Command{
+	Use:          "status [ID]",
+	Short:        "Show the jobs of the running daemon",
+	Args:         cobra.MaximumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := connectDaemon()
+		if err != nil {
+			return err
+		}
+		id := ""
+		if len(args) == 1 {
+			id = args[0]
+		}
+		jobs, err := c.status(cmd.Context(), id)
+		if err != nil {
+			return err
+		}
+		if statusJSON {
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetIndent("", "  ")
+			if jobs == nil {
+				jobs = []Job{}
+			}
+			return enc.Encode(jobs)
+		}
+		return printJobs(cmd.OutOrStdout(), jobs)
+	},
+}
+
+var cancelCmd = &cobra.Command{
+	Use:          "cancel ID",
+	Short:        "Cancel a queued or running daemon job",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := connectDaemon()
+		if err != nil {
+			return err
+		}
+		job, err := c.cancel(cmd.Context(), args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Canceled job %s (%s)\n", job.ID, job.URL)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&daemonSocket, "socket", "", "Daemon control socket (default $XDG_RUNTIME_DIR/yt2mp3.sock)")
+	rootCmd.Flags().BoolVar(&noDaemon, "no-daemon", false, "Download in this process even if a daemon is running")
+	daemonCmd.Flags().IntVar(&daemonWorkers, "workers", 2, "Number of concurrent downloads")
+	enqueueCmd.Flags().BoolVar(&enqueueWait, "wait", false, "Wait for the jobs to finish and print the results")
+	statusCmd.Flags().BoolVar(&statusJSON, "json", false, "Output jobs as JSON")
+	rootCmd.AddCommand(daemonCmd, enqueueCmd, statusCmd, cancelCmd)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestDaemon runs a daemon backed by d on a socket in a temporary
+// directory and points the client commands at it.
+func startTestDaemon(t *testing.T, d downloader) *daemonClient {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "d.sock")
+	l, err := listenDaemon(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	jobs, err := newJobManager(ctx, d, nil, jobManagerOptions{Workers: 1, QueueSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- (&daemon{jobs: jobs, log: &bytes.Buffer{}}).serve(ctx, l) }()
+	daemonSocket = path
+	t.Cleanup(func() {
+		daemonSocket = ""
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+		jobs.Wait()
+	})
+	c, ok := findDaemon()
+	if !ok {
+		t.Fatal("daemon not reachable")
+	}
+	return c
+}
+
+func TestDaemonEnqueueWaitStatus(t *testing.T) {
+	c := startTestDaemon(t, &fakeDownloader{info: map[string]videoInfo{
+		"https://youtu.be/abc": {ID: "abc", Title: "Song"},
+	}})
+	ctx := context.Background()
+	out := t.TempDir()
+	s := builtinSettings()
+	s.OutputDir = out
+
+	job, err := c.enqueue(ctx, "https://youtu.be/abc", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := c.wait(ctx, job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := jobResult(done)
+	if err != nil || res.FinalPath != filepath.Join(out, "Song.mp3") {
+		t.Fatalf("result = %+v, %v", res, err)
+	}
+
+	jobs, err := c.status(ctx, "")
+	if err != nil || len(jobs) != 1 || jobs[0].ID != job.ID {
+		t.Errorf("status = %+v, %v", jobs, err)
+	}
+	jobs, err = c.status(ctx, job.ID)
+	if err != nil || len(jobs) != 1 || jobs[0].State != jobDone {
+		t.Errorf("status by ID = %+v, %v", jobs, err)
+	}
+	if _, err := c.status(ctx, "missing"); !errors.Is(err, errJobNotFound) {
+		t.Errorf("status of an unknown job: %v", err)
+	}
+	if _, err := c.cancel(ctx, job.ID); !errors.Is(err, errJobFinished) || err.Error() != errJobFinished.Error() {
+		t.Errorf("cancel finished job: %v", err)
+	}
+}
+
+func TestDaemonRejectsBadRequests(t *testing.T) {
+	c := startTestDaemon(t, &fakeDownloader{})
+	ctx := context.Background()
+
+	_, err := c.enqueue(ctx, "not a url", builtinSettings())
+	if !errors.Is(err, ErrInvalidURL) {
+		t.Errorf("invalid URL: %v (code %s)", err, errorCode(err))
+	}
+	s := builtinSettings()
+	s.OutputDir = "relative"
+	if _, err := c.enqueue(ctx, "https://youtu.be/x", s); !errors.Is(err, ErrOutputDir) {
+		t.Errorf("relative output dir: %v", err)
+	}
+	s.OutputDir = t.TempDir()
+	s.AudioFormat = "wma"
+	if _, err := c.enqueue(ctx, "https://youtu.be/x", s); err == nil {
+		t.Error("invalid settings should be rejected")
+	}
+	if err := c.call(ctx, daemonRequest{Op: "bogus"}, func(daemonResponse) error { return nil }); err == nil {
+		t.Error("unknown operation should fail")
+	}
+}
+
+func TestDaemonCancel(t *testing.T) {
+	d := &fakeDownloader{block: make(chan struct{})}
+	defer close(d.block)
+	c := startTestDaemon(t, d)
+	ctx := context.Background()
+	s := builtinSettings()
+	s.OutputDir = t.TempDir()
+
+	job, err := c.enqueue(ctx, "https://youtu.be/x", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.cancel(ctx, job.ID); err != nil {
+		t.Fatal(err)
+	}
+	done, err := c.wait(ctx, job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jobResult(done); !errors.Is(err, ErrInterrupted) {
+		t.Errorf("canceled job error = %v", err)
+	}
+}
+
+func TestDaemonBatch(t *testing.T) {
+	c := startTestDaemon(t, &fakeDownloader{info: map[string]videoInfo{
+		"https://youtu.be/a": {ID: "a", Title: "First"},
+		"https://youtu.be/b": {ID: "b", Title: "Second"},
+	}})
+	out := t.TempDir()
+	s := builtinSettings()
+	s.OutputDir = out
+	urls := []string{"https://youtu.be/a", "bad url", "https://youtu.be/b"}
+
+	ctx := context.Background()
+	process, err := c.batch(ctx, urls, s, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout bytes.Buffer
+	printer, _ := newResultPrinter(formatJSON, &stdout)
+	err = runBatch(ctx, urls, process, printer, &bytes.Buffer{})
+	if !errors.Is(err, ErrPartialFailure) {
+		t.Errorf("runBatch error = %v", err)
+	}
+	var results []Result
+	if err := json.Unmarshal(stdout.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0].FinalPath != filepath.Join(out, "First.mp3") ||
+		results[1].ErrorCode != "invalid_url" || results[2].Status != statusOK {
+		t.Errorf("results = %+v", results)
+	}
+}
+
+func TestDaemonUsesClientRetries(t *testing.T) {
+	fake := &fakeDownloader{err: classify(ErrTransient, errors.New("HTTP Error 503"))}
+	var slept []time.Duration
+	c := startTestDaemon(t, retryingDownloader{downloader: fake, policy: testRetryPolicy(0, &slept), log: &bytes.Buffer{}})
+	oldRetries, oldMaxWait := retries, retryMaxWait
+	retries, retryMaxWait = 2, time.Millisecond
+	t.Cleanup(func() { retries, retryMaxWait = oldRetries, oldMaxWait })
+
+	ctx := context.Background()
+	urls := []string{"https://youtu.be/x"}
+	ids, errs, err := c.enqueueAll(ctx, urls, Settings{OutputDir: t.TempDir(), AudioFormat: "mp3", AudioQuality: "0"})
+	if err != nil || errs[0] != nil {
+		t.Fatal(err, errs[0])
+	}
+	done, err := c.wait(ctx, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jobResult(done); !errors.Is(err, ErrTransient) {
+		t.Errorf("job error = %v", err)
+	}
+	if got := fake.calls.Load(); got != 3 {
+		t.Errorf("downloader called %d times, want 3", got)
+	}
+}
+
+func TestRootHandsOffToDaemon(t *testing.T) {
+	d := &fakeDownloader{info: map[string]videoInfo{
+		"https://youtu.be/abc": {ID: "abc", Title: "Handed Off"},
+	}}
+	startTestDaemon(t, d)
+	out := t.TempDir()
+	t.Setenv("YT2MP3_OUTPUT_DIR", out)
+
+	var stdout, stderr bytes.Buffer
+	rootCmd.SetOut(&stdout)
+	rootCmd.SetErr(&stderr)
+	rootCmd.SetArgs([]string{"--socket", daemonSocket, "https://youtu.be/abc"})
+	t.Cleanup(func() {
+		rootCmd.SetOut(nil)
+		rootCmd.SetErr(nil)
+		rootCmd.SetArgs(nil)
+	})
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatalf("Execute() = %v; stderr: %s", err, stderr.String())
+	}
+	if d.calls.Load() != 1 {
+		t.Errorf("daemon downloader called %d times", d.calls.Load())
+	}
+	if !strings.Contains(stderr.String(), "Handing off") {
+		t.Errorf("stderr = %q", stderr.String())
+	}
+	if want := filepath.Join(out, "Handed Off.mp3"); !strings.Contains(stdout.String(), want) {
+		t.Errorf("stdout = %q, want %s", stdout.String(), want)
+	}
+	if _, err := os.Stat(filepath.Join(out, "Handed Off.mp3")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestListenDaemon(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "d.sock")
+	// A leftover file from a crashed daemon is replaced.
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	l, err := listenDaemon(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v, %v", info.Mode(), err)
+	}
+	if _, err := listenDaemon(path); err == nil {
+		t.Error("second daemon on the same socket should fail")
+	}
+}
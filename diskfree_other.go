@@ -0,0 +1,10 @@
+//go:build !darwin && !linux && !windows
+
+package main
+
+import "errors"
+
+// diskFree is not implemented on this platform.
+func diskFree(path string) (uint64, error) {
+	return 0, errors.New("disk space check is not supported on this platform")
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// minFreeDiskBytes is the free space below which the disk check fails.
+	// A long video converted at the best quality can easily take a few
+	// hundred megabytes while yt-dlp keeps the intermediate file around.
+	minFreeDiskBytes = 500 << 20
+	// doctorCheckTimeout bounds each individual check so a hanging DNS
+	// lookup or binary does not block the whole report.
+	doctorCheckTimeout = 15 * time.Second
+	// doctorLookupHost is the host resolved by the DNS check.
+	doctorLookupHost = "www.youtube.com"
+)
+
+// doctorJSON makes the doctor command emit JSON instead of a table
+var doctorJSON bool
+
+// doctorCheck is a single environment diagnostic. Run returns a short detail
+// string describing what was found, or an error when the check fails.
+type doctorCheck struct {
+	Name string
+	Run  func(ctx context.Context) (string, error)
+}
+
+// checkResult is the outcome of running one doctorCheck.
+type checkResult struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail"`
+}
+
+// doctorReport is the JSON document printed by `yt2mp3 doctor --json`.
+type doctorReport struct {
+	Version string        `json:"version"`
+	OS      string        `json:"os"`
+	Arch    string        `json:"arch"`
+	Passed  bool          `json:"passed"`
+	Checks  []checkResult `json:"checks"`
+}
+
+// defaultDoctorChecks returns the checks run by `yt2mp3 doctor`, in the order
+// they are reported. outputDir is the configured output directory; "" is
+// the current directory.
+func defaultDoctorChecks(outputDir string) []doctorCheck {
+	tempDir := os.TempDir()
+	return []doctorCheck{
+		{"temp dir writable", func(ctx context.Context) (string, error) {
+			return checkTempDirWritable(tempDir)
+		}},
+		{"yt-dlp runs", func(ctx context.Context) (string, error) {
+			return checkYtDlp(ctx, binaries, tempDir)
+		}},
+		{"ffmpeg available", checkFfmpeg},
+		{"temp dir disk space", func(ctx context.Context) (string, error) {
+			return checkDiskSpace(tempDir, minFreeDiskBytes)
+		}},
+		{"output dir disk space", func(ctx context.Context) (string, error) {
+			return checkDiskSpace(existingAncestor(outputDir), minFreeDiskBytes)
+		}},
+		{"DNS resolution", func(ctx context.Context) (string, error) {
+			return checkDNS(ctx, net.DefaultResolver.LookupHost, doctorLookupHost)
+		}},
+	}
+}
+
+// runDoctorChecks runs every check with its own timeout and collects results.
+func runDoctorChecks(ctx context.Context, checks []doctorCheck) []checkResult {
+	results := make([]checkResult, 0, len(checks))
+	for _, c := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, doctorCheckTimeout)
+		detail, err := c.Run(checkCtx)
+		cancel()
+		r := checkResult{Name: c.Name, Passed: err == nil, Detail: detail}
+		if err != nil {
+			r.Detail = err.Error()
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// checkTempDirWritable verifies that a file can be created and removed in dir.
+func checkTempDirWritable(dir string) (string, error) {
+	f, err := os.CreateTemp(dir, "yt2mp3-doctor-*")
+	if err != nil {
+		return "", fmt.Errorf("cannot write to %s: %v", dir, err)
+	}
+	name := f.Name()
+	_, werr := f.WriteString("yt2mp3")
+	f.Close()
+	os.Remove(name)
+	if werr != nil {
+		return "", fmt.Errorf("cannot write to %s: %v", dir, werr)
+	}
+	return dir, nil
+}
+
+// checkYtDlp extracts the embedded yt-dlp into a fresh directory under
+// tempRoot and runs it with --version. This catches noexec mounts, which
+// otherwise only surface as a confusing "permission denied" mid-download.
+func checkYtDlp(ctx context.Context, bins fs.FS, tempRoot string) (string, error) {
+	dir, err := os.MkdirTemp(tempRoot, "yt2mp3-doctor")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := extractYtDlp(bins, dir); err != nil {
+		return "", err
+	}
+	out, err := exec.CommandContext(ctx, filepath.Join(dir, ytDlpBinaryName()), "--version").CombinedOutput()
+	if err != nil {
+		if errors.Is(err, fs.ErrPermission) {
+			return "", fmt.Errorf("cannot execute yt-dlp in %s (is it mounted noexec? set TMPDIR to another directory): %v", tempRoot, err)
+		}
+		return "", fmt.Errorf("yt-dlp --version failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return "version " + firstLine(string(out)), nil
+}
+
+// checkFfmpeg verifies that ffmpeg, which yt-dlp needs for audio extraction,
+// is on PATH and runs.
+func checkFfmpeg(ctx context.Context) (string, error) {
+	path, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", fmt.Errorf("ffmpeg not found in PATH")
+	}
+	out, err := exec.CommandContext(ctx, path, "-version").Output()
+	if err != nil {
+		return "", fmt.Errorf("ffmpeg -version failed: %v", err)
+	}
+	return firstLine(string(out)), nil
+}
+
+// checkDiskSpace fails when the file system holding dir has less than min
+// bytes available.
+func checkDiskSpace(dir string, min uint64) (string, error) {
+	free, err := diskFree(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read free space of %s: %v", dir, err)
+	}
+	detail := fmt.Sprintf("%s free in %s", formatBytes(free), dir)
+	if free < min {
+		return "", fmt.Errorf("only %s (need at least %s)", detail, formatBytes(min))
+	}
+	return detail, nil
+}
+
+// existingAncestor returns dir, or its closest ancestor that exists when
+// dir is yet to be created, so the free space of the file system it will
+// be on can be measured.
+func existingAncestor(dir string) string {
+	if dir == "" {
+		return "."
+	}
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// checkDNS resolves host with lookup.
+func checkDNS(ctx context.Context, lookup func(context.Context, string) ([]string, error), host string) (string, error) {
+	addrs, err := lookup(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %v", host, err)
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("failed to resolve %s: no addresses", host)
+	}
+	return fmt.Sprintf("%s -> %s", host, addrs[0]), nil
+}
+
+// printDoctorTable writes results as an aligned pass/fail table.
+func printDoctorTable(w io.Writer, results []checkResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tSTATUS\tDETAIL")
+	for _, r := range results {
+		status := "PASS"
+		if !r.Passed {
+			status = "FAIL"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Name, status, r.Detail)
+	}
+	return tw.Flush()
+}
+
+// firstLine returns the first non-empty line of s, trimmed.
+func firstLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// formatBytes renders n using binary units, e.g. "1.5 GiB".
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+var doctorCmd = &cobra.Command{
+	Use:          "doctor",
+	Short:        "Diagnose the local environment for common download problems",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		settings, _, err := loadSettings(cmd)
+		if err != nil {
+			return err
+		}
+		results := runDoctorChecks(cmd.Context(), defaultDoctorChecks(settings.OutputDir))
+
+		failed := 0
+		for _, r := range results {
+			if !r.Passed {
+				failed++
+			}
+		}
+
+		out := cmd.OutOrStdout()
+		if doctorJSON {
+			enc := json.NewEncoder(out)
+			enc.SetIndent("", "  ")
+			report := doctorReport{
+				Version: Version,
+				OS:      runtime.GOOS,
+				Arch:    runtime.GOARCH,
+				Passed:  failed == 0,
+				Checks:  results,
+			}
+			if err := enc.Encode(report); err != nil {
+				return err
+			}
+		} else if err := printDoctorTable(out, results); err != nil {
+			return err
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d of %d checks failed", failed, len(results))
+		}
+		return nil
+	},
+}
+
+func init() {
+	doctorCmd.Flags().BoolVar(&doctorJSON, "json", false, "Print results as JSON")
+	rootCmd.AddCommand(doctorCmd)
+}
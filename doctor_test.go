@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestRunDoctorChecks(t *testing.T) {
+	checks := []doctorCheck{
+		{"ok", func(ctx context.Context) (string, error) { return "fine", nil }},
+		{"broken", func(ctx context.Context) (string, error) { return "", errors.New("boom") }},
+	}
+
+	results := runDoctorChecks(context.Background(), checks)
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	if !results[0].Passed || results[0].Detail != "fine" {
+		t.Errorf("unexpected first result: %+v", results[0])
+	}
+	if results[1].Passed || results[1].Detail != "boom" {
+		t.Errorf("unexpected second result: %+v", results[1])
+	}
+
+	var buf bytes.Buffer
+	if err := printDoctorTable(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{"CHECK", "PASS", "FAIL", "boom"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("table missing %q:\n%s", want, out)
+		}
+	}
+
+	data, err := json.Marshal(doctorReport{Checks: results})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"name":"broken","passed":false`) {
+		t.Errorf("unexpected JSON: %s", data)
+	}
+}
+
+func TestCheckTempDirWritable(t *testing.T) {
+	if _, err := checkTempDirWritable(t.TempDir()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := checkTempDirWritable(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected an error for a nonexistent directory")
+	}
+}
+
+func TestCheckYtDlp(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as a fake yt-dlp")
+	}
+	t.Setenv("GOOS", "linux")
+
+	t.Run("reports the version", func(t *testing.T) {
+		bins := mockFS{files: map[string][]byte{
+			"bin/yt-dlp": []byte("#!/bin/sh\necho 2025.01.15\n"),
+		}}
+		detail, err := checkYtDlp(context.Background(), bins, t.TempDir())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if detail != "version 2025.01.15" {
+			t.Errorf("detail = %q", detail)
+		}
+	})
+
+	t.Run("binary fails to run", func(t *testing.T) {
+		bins := mockFS{files: map[string][]byte{
+			"bin/yt-dlp": []byte("#!/bin/sh\necho broken >&2\nexit 3\n"),
+		}}
+		_, err := checkYtDlp(context.Background(), bins, t.TempDir())
+		if err == nil || !strings.Contains(err.Error(), "broken") {
+			t.Errorf("expected failure mentioning output, got %v", err)
+		}
+	})
+
+	t.Run("missing embedded binary", func(t *testing.T) {
+		_, err := checkYtDlp(context.Background(), mockFS{files: map[string][]byte{}}, t.TempDir())
+		if err == nil {
+			t.Error("expected an error when the binary is missing")
+		}
+	})
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" && runtime.GOOS != "windows" {
+		t.Skip("disk space check not supported")
+	}
+	dir := t.TempDir()
+	if _, err := checkDiskSpace(dir, 0); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := checkDiskSpace(dir, 1<<62); err == nil {
+		t.Error("expected an error when requiring an impossible amount of space")
+	}
+}
+
+func TestCheckDNS(t *testing.T) {
+	ok := func(ctx context.Context, host string) ([]string, error) { return []string{"127.0.0.1"}, nil }
+	fail := func(ctx context.Context, host string) ([]string, error) { return nil, errors.New("no such host") }
+	empty := func(ctx context.Context, host string) ([]string, error) { return nil, nil }
+
+	if detail, err := checkDNS(context.Background(), ok, "example.com"); err != nil || detail != "example.com -> 127.0.0.1" {
+		t.Errorf("got (%q, %v)", detail, err)
+	}
+	if _, err := checkDNS(context.Background(), fail, "example.com"); err == nil {
+		t.Error("expected an error for a failed lookup")
+	}
+	if _, err := checkDNS(context.Background(), empty, "example.com"); err == nil {
+		t.Error("expected an error when no addresses are returned")
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		in   uint64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536 << 20, "1.5 GiB"},
+	}
+	for _, tt := range tests {
+		if got := formatBytes(tt.in); got != tt.want {
+			t.Errorf("formatBytes(%d) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestExistingAncestor(t *testing.T) {
+	dir := t.TempDir()
+	tests := map[string]string{
+		"":                                   ".",
+		dir:                                  dir,
+		filepath.Join(dir, "not", "yet"):     dir,
+		filepath.Join(dir, "not", "..", "x"): dir,
+	}
+	for in, want := range tests {
+		if got := existingAncestor(in); got != want {
+			t.Errorf("existingAncestor(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// Sentinel errors that classify failures across the pipeline. Match them
+// with errors.Is; the original error message is preserved by classify.
+var (
+	ErrInvalidURL     = errors.New("invalid URL")
+	ErrUnavailable    = errors.New("video unavailable")
+	ErrGeoBlocked     = errors.New("video is geo-blocked")
+	ErrAgeRestricted  = errors.New("video is age-restricted")
+	ErrNoAudio        = errors.New("no audio downloaded")
+	ErrTransient      = errors.New("transient download failure")
+	ErrDownload       = errors.New("download failed")
+	ErrTagging        = errors.New("failed to write tags")
+	ErrOutputDir      = errors.New("output directory error")
+	ErrDiskFull       = errors.New("no space left on device")
+	ErrInterrupted    = errors.New("interrupted")
+	ErrPartialFailure = errors.New("some downloads failed")
+)
+
+// Exit codes returned by yt2mp3. They are part of the documented CLI
+// contract, so existing values must never be renumbered.
+const (
+	exitOK            = 0
+	exitUnknown       = 1
+	exitPartial       = 2
+	exitInvalidURL    = 3
+	exitUnavailable   = 4
+	exitGeoBlocked    = 5
+	exitAgeRestricted = 6
+	exitNoAudio       = 7
+	exitDownload      = 8
+	exitTagging       = 9
+	exitOutputDir     = 10
+	exitDiskFull      = 11
+	exitTransient     = 12
+	exitInterrupted   = 130
+)
+
+// errorClasses maps each sentinel to its machine-readable code and exit
+// code. Order matters: the first matching entry wins.
+var errorClasses = []struct {
+	err  error
+	code string
+	exit int
+}{
+	{ErrInterrupted, "interrupted", exitInterrupted},
+	{ErrPartialFailure, "partial_failure", exitPartial},
+	{ErrInvalidURL, "invalid_url", exitInvalidURL},
+	{ErrGeoBlocked, "geo_blocked", exitGeoBlocked},
+	{ErrAgeRestricted, "age_restricted", exitAgeRestricted},
+	{ErrUnavailable, "unavailable", exitUnavailable},
+	{ErrNoAudio, "no_audio", exitNoAudio},
+	{ErrDiskFull, "disk_full", exitDiskFull},
+	{ErrTagging, "tagging_failed", exitTagging},
+	{ErrOutputDir, "output_dir", exitOutputDir},
+	{ErrTransient, "transient", exitTransient},
+	{ErrDownload, "download_failed", exitDownload},
+}
+
+// classifiedError attaches a sentinel kind to an error without changing its
+// message.
+type classifiedError struct {
+	kind error
+	err  error
+}
+
+func (e *classifiedError) Error() string   { return e.err.Error() }
+func (e *classifiedError) Unwrap() []error { return []error{e.kind, e.err} }
+
+// classify marks err as being of the given kind. A nil err stays nil. Disk
+// full conditions are detected from the underlying error and take precedence
+// over kind, since they are what the user needs to act on.
+func classify(kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		kind = ErrDiskFull
+	}
+	return &classifiedError{kind: kind, err: err}
+}
+
+// batchError is the result of a batch of total items of which failed
+// failed, firstErr being the first failure. A single item returns its own
+// error and a batch where everything failed keeps the class of firstErr;
+// otherwise the batch is a partial failure. noun names the items, e.g.
+// "files".
+func batchError(failed, total int, firstErr error, noun string) error {
+	switch {
+	case failed == 0:
+		return nil
+	case total == 1:
+		return firstErr
+	case failed == total:
+		return fmt.Errorf("%d of %d %s failed: %w", failed, total, noun, firstErr)
+	default:
+		return classify(ErrPartialFailure, fmt.Errorf("%d of %d %s failed", failed, total, noun))
+	}
+}
+
+// errorCode returns the stable machine-readable code for err.
+func errorCode(err error) string {
+	for _, c := range errorClasses {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return "unknown"
+}
+
+// errorFromCode rebuilds a classified error from a code produced by
+// errorCode and its message, e.g. for results reported by another process.
+func errorFromCode(code, msg string) error {
+	err := errors.New(msg)
+	for _, c := range errorClasses {
+		if c.code == code {
+			return classify(c.err, err)
+		}
+	}
+	return err
+}
+
+// exitCode returns the process exit code for err.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	for _, c := range errorClasses {
+		if errors.Is(err, c.err) {
+			return c.exit
+		}
+	}
+	return exitUnknown
+}
+
+// ytDlpErrorPatterns maps substrings of yt-dlp's output to error kinds,
+// checked in order. Geo and age messages often also contain "Video
+// unavailable", so they must come first.
+var ytDlpErrorPatterns = []struct {
+	pattern string
+	kind    error
+}{
+	{"is not a valid url", ErrInvalidURL},
+	{"unsupported url", ErrInvalidURL},
+	{"incomplete youtube id", ErrInvalidURL},
+	{"available in your country", ErrGeoBlocked},
+	{"geo restrict", ErrGeoBlocked},
+	{"geo-restrict", ErrGeoBlocked},
+	{"confirm your age", ErrAgeRestricted},
+	{"age-restricted", ErrAgeRestricted},
+	{"age restricted", ErrAgeRestricted},
+	{"inappropriate for some users", ErrAgeRestricted},
+	{"video unavailable", ErrUnavailable},
+	{"private video", ErrUnavailable},
+	{"has been removed", ErrUnavailable},
+	{"members-only", ErrUnavailable},
+	{"http error 404", ErrUnavailable},
+	{"requested format is not available", ErrNoAudio},
+	{"no space left on device", ErrDiskFull},
+	{"http error 429", ErrTransient},
+	{"too many requests", ErrTransient},
+	{"http error 500", ErrTransient},
+	{"http error 502", ErrTransient},
+	{"http error 503", ErrTransient},
+	{"http error 504", ErrTransient},
+	{"timed out", ErrTransient},
+	{"connection reset", ErrTransient},
+	{"connection refused", ErrTransient},
+	{"remote end closed connection", ErrTransient},
+	{"temporary failure in name resolution", ErrTransient},
+	{"network is unreachable", ErrTransient},
+	{"incompleteread", ErrTransient},
+}
+
+// classifyYtDlpOutput returns the error kind matching yt-dlp's combined
+// output, or ErrDownload when nothing more specific matches.
+func classifyYtDlpOutput(output string) error {
+	lower := strings.ToLower(output)
+	for _, p := range ytDlpErrorPatterns {
+		if strings.Contains(lower, p.pattern) {
+			return p.kind
+		}
+	}
+	return ErrDownload
+}
+
+// errorSummary returns a one-line description of err for logs: the last
+// "ERROR:" line of embedded yt-dlp output if there is one, else the first
+// line of the message.
+func errorSummary(err error) string {
+	lines := strings.Split(err.Error(), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if line := strings.TrimSpace(lines[i]); strings.HasPrefix(line, "ERROR:") {
+			return line
+		}
+	}
+	return strings.TrimSpace(lines[0])
+}
+
+// classifyContext returns ErrInterrupted when ctx was cancelled, and kind
+// otherwise. It lets callers attribute a failed command to the interrupt
+// that killed it rather than to the command's own output.
+func classifyContext(ctx context.Context, kind error) error {
+	if ctx.Err() != nil {
+		return ErrInterrupted
+	}
+	return kind
+}
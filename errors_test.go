@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyYtDlpOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   error
+	}{
+		{"invalid url", "ERROR: 'foo' is not a valid URL.", ErrInvalidURL},
+		{"unsupported url", "ERROR: Unsupported URL: https://example.com", ErrInvalidURL},
+		{"geo blocked", "ERROR: [youtube] abc: Video unavailable. The uploader has not made this video available in your country", ErrGeoBlocked},
+		{"age restricted", "ERROR: [youtube] abc: Sign in to confirm your age. This video may be inappropriate for some users.", ErrAgeRestricted},
+		{"unavailable", "ERROR: [youtube] abc: Video unavailable", ErrUnavailable},
+		{"private", "ERROR: [youtube] abc: Private video. Sign in if you've been granted access", ErrUnavailable},
+		{"no audio", "ERROR: [youtube] abc: Requested format is not available", ErrNoAudio},
+		{"disk full", "ERROR: unable to write data: [Errno 28] No space left on device", ErrDiskFull},
+		{"rate limited", "ERROR: Unable to download webpage: HTTP Error 429: Too Many Requests", ErrTransient},
+		{"timeout", "ERROR: Read timed out.", ErrTransient},
+		{"other", "ERROR: something unexpected", ErrDownload},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyYtDlpOutput(tt.output); got != tt.want {
+				t.Errorf("classifyYtDlpOutput() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassify(t *testing.T) {
+	if classify(ErrTagging, nil) != nil {
+		t.Error("classify(nil) should be nil")
+	}
+
+	base := errors.New("failed to save ID3 tags")
+	err := classify(ErrTagging, base)
+	if err.Error() != base.Error() {
+		t.Errorf("message changed: %q", err.Error())
+	}
+	if !errors.Is(err, ErrTagging) || !errors.Is(err, base) {
+		t.Error("classified error should match both kind and cause")
+	}
+
+	full := classify(ErrOutputDir, fmt.Errorf("failed to move file: %w", &os.PathError{Op: "write", Path: "x", Err: syscall.ENOSPC}))
+	if !errors.Is(full, ErrDiskFull) {
+		t.Error("ENOSPC should be classified as ErrDiskFull")
+	}
+
+	// A more specific inner kind wins over an outer ErrDownload.
+	nested := classify(ErrDownload, classify(ErrGeoBlocked, base))
+	if errorCode(nested) != "geo_blocked" {
+		t.Errorf("errorCode(nested) = %q", errorCode(nested))
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err      error
+		wantExit int
+		wantCode string
+	}{
+		{nil, exitOK, "unknown"},
+		{errors.New("plain"), exitUnknown, "unknown"},
+		{classify(ErrInvalidURL, errors.New("x")), exitInvalidURL, "invalid_url"},
+		{classify(ErrUnavailable, errors.New("x")), exitUnavailable, "unavailable"},
+		{classify(ErrOutputDir, errors.New("x")), exitOutputDir, "output_dir"},
+		{classify(ErrPartialFailure, errors.New("x")), exitPartial, "partial_failure"},
+		{fmt.Errorf("2 of 2 downloads failed: %w", classify(ErrNoAudio, errors.New("x"))), exitNoAudio, "no_audio"},
+		{classify(ErrDownload, classify(ErrInterrupted, errors.New("x"))), exitInterrupted, "interrupted"},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.wantExit {
+			t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.wantExit)
+		}
+		if tt.err != nil {
+			if got := errorCode(tt.err); got != tt.wantCode {
+				t.Errorf("errorCode(%v) = %q, want %q", tt.err, got, tt.wantCode)
+			}
+		}
+	}
+}
+
+func TestBatchError(t *testing.T) {
+	first := classify(ErrNoAudio, errors.New("no audio"))
+	tests := []struct {
+		failed, total int
+		firstErr      error
+		want          string
+		wantCode      string
+	}{
+		{0, 3, nil, "", ""},
+		{1, 1, first, "no audio", "no_audio"},
+		{2, 2, first, "2 of 2 files failed: no audio", "no_audio"},
+		{1, 3, first, "1 of 3 files failed", "partial_failure"},
+	}
+	for _, tt := range tests {
+		err := batchError(tt.failed, tt.total, tt.firstErr, "files")
+		if err == nil {
+			if tt.want != "" {
+				t.Errorf("batchError(%d, %d) = nil, want %q", tt.failed, tt.total, tt.want)
+			}
+			continue
+		}
+		if err.Error() != tt.want || errorCode(err) != tt.wantCode {
+			t.Errorf("batchError(%d, %d) = %q (%s), want %q (%s)", tt.failed, tt.total, err, errorCode(err), tt.want, tt.wantCode)
+		}
+	}
+}
+
+func TestClassifyContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if classifyContext(ctx, ErrUnavailable) != ErrUnavailable {
+		t.Error("live context should keep the kind")
+	}
+	cancel()
+	if classifyContext(ctx, ErrUnavailable) != ErrInterrupted {
+		t.Error("cancelled context should be ErrInterrupted")
+	}
+}
+
+func TestProcessURLErrorCodes(t *testing.T) {
+	d := &fakeDownloader{err: classify(ErrAgeRestricted, errors.New("Sign in to confirm your age"))}
+	s := Settings{OutputDir: t.TempDir(), AudioFormat: "mp3"}
+	res, err := processURL(context.Background(), d, "u", s, io.Discard, nil)
+	if !errors.Is(err, ErrAgeRestricted) {
+		t.Fatalf("err = %v, want ErrAgeRestricted", err)
+	}
+	if res.ErrorCode != "age_restricted" {
+		t.Errorf("error_code = %q", res.ErrorCode)
+	}
+}
+
+func TestErrorSummary(t *testing.T) {
+	err := errors.New("failed to download audio: exit status 1\nOutput: [youtube] abc: Downloading\nERROR: HTTP Error 429\n")
+	if got := errorSummary(err); got != "ERROR: HTTP Error 429" {
+		t.Errorf("errorSummary() = %q", got)
+	}
+	if got := errorSummary(errors.New("plain\nsecond")); got != "plain" {
+		t.Errorf("errorSummary() = %q", got)
+	}
+}
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bogem/id3v2"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// feedFileName is the feed that feed build writes into a folder.
+	feedFileName = "feed.xml"
+	// feedCoversDir holds the cover art that feed build extracts from the
+	// tracks, since a static feed can only link to files. Only yt2mp3
+	// writes to it, so stale covers can be deleted.
+	feedCoversDir = ".yt2mp3-covers"
+	// itunesNamespace is the namespace of Apple's podcast RSS extensions.
+	itunesNamespace = "http://www.itunes.com/dtds/podcast-1.0.dtd"
+	// mediaLinkLifetime is how long the signed media links of a served feed
+	// stay valid. Podcast apps refetch the feed long before they expire.
+	mediaLinkLifetime = 7 * 24 * time.Hour
+)
+
+var (
+	// Base URL option for feed build
+	feedBaseURL string
+	// Feed title option for feed build
+	feedTitle string
+	// Output file option for feed build
+	feedOutput string
+	// Subscription option for feed build
+	feedSubscription string
+)
+
+// rssFeed is an RSS 2.0 document with iTunes podcast extensions.
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	ITunes  string     `xml:"xmlns:itunes,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string       `xml:"title"`
+	Link          string       `xml:"link"`
+	Description   string       `xml:"description"`
+	Generator     string       `xml:"generator"`
+	LastBuildDate string       `xml:"lastBuildDate,omitempty"`
+	Author        string       `xml:"itunes:author,omitempty"`
+	Image         *itunesImage `xml:"itunes:image"`
+	Explicit      string       `xml:"itunes:explicit"`
+	Items         []rssItem    `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string       `xml:"title"`
+	Description string       `xml:"description,omitempty"`
+	Link        string       `xml:"link,omitempty"`
+	GUID        rssGUID      `xml:"guid"`
+	PubDate     string       `xml:"pubDate,omitempty"`
+	Enclosure   rssEnclosure `xml:"enclosure"`
+	Author      string       `xml:"itunes:author,omitempty"`
+	Duration    string       `xml:"itunes:duration,omitempty"`
+	Image       *itunesImage `xml:"itunes:image"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type itunesImage struct {
+	Href string `xml:"href,attr"`
+}
+
+// feedItem is a tagged MP3 file in a feed folder.
+type feedItem struct {
+	// Name is the file name inside the folder.
+	Name    string
+	Tags    trackTags
+	Size    int64
+	ModTime time.Time
+	// Cover is the embedded cover art, if any.
+	Cover *id3v2.PictureFrame
+}
+
+// published returns when the item's video was uploaded, or the file's
+// modification time when the tags do not say.
+func (it feedItem) published() time.Time {
+	for _, layout := range []string{"20060102", "2006"} {
+		if t, err := time.Parse(layout, it.Tags.UploadDate); err == nil {
+			return t
+		}
+	}
+	return it.ModTime
+}
+
+// guid identifies the item across feed rebuilds and file renames.
+func (it feedItem) guid() string {
+	if it.Tags.URL != "" {
+		return it.Tags.URL
+	}
+	return it.Name
+}
+
+// readFeedItems reads the tags of the MP3 files directly in dir, newest
+// first. Files whose tags cannot be read are skipped with a warning to log.
+func readFeedItems(dir string, log io.Writer) ([]feedItem, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.mp3"))
+	if err != nil {
+		return nil, err
+	}
+	items := make([]feedItem, 0, len(matches))
+	for _, p := range matches {
+		fi, err := os.Stat(p)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		st, err := readStoredTag(p)
+		if err != nil {
+			fmt.Fprintf(log, "Warning: skipping %s: %v\n", filepath.Base(p), err)
+			continue
+		}
+		it := feedItem{Name: filepath.Base(p), Tags: st.Tags, Size: fi.Size(), ModTime: fi.ModTime(), Cover: st.Cover}
+		if it.Tags.Title == "" {
+			it.Tags.Title = strings.TrimSuffix(it.Name, filepath.Ext(it.Name))
+		}
+		items = append(items, it)
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		pi, pj := items[i].published(), items[j].published()
+		if !pi.Equal(pj) {
+			return pi.After(pj)
+		}
+		return items[i].Name < items[j].Name
+	})
+	return items, nil
+}
+
+// feedInfo describes a feed's channel.
+type feedInfo struct {
+	Title       string
+	Link        string
+	Description string
+}
+
+// feedLinks maps feed items to the URLs a podcast app fetches them from.
+type feedLinks struct {
+	// media returns the URL of the file named name.
+	media func(name string) string
+	// cover returns the URL of the item's cover art; it is only called for
+	// items that have one.
+	cover func(it feedItem) string
+}
+
+// buildFeed returns the podcast feed for items.
+func buildFeed(info feedInfo, items []feedItem, links feedLinks) rssFeed {
+	ch := rssChannel{
+		Title:       info.Title,
+		Link:        info.Link,
+		Description: info.Description,
+		Generator:   "yt2mp3 " + Version,
+		Explicit:    "false",
+		Items:       []rssItem{},
+	}
+	if ch.Description == "" {
+		ch.Description = info.Title
+	}
+	authors := map[string]bool{}
+	for _, it := range items {
+		item := rssItem{
+			Title:       it.Tags.Title,
+			Description: it.Tags.Description,
+			Link:        it.Tags.URL,
+			GUID:        rssGUID{Value: it.guid()},
+			PubDate:     it.published().UTC().Format(time.RFC1123Z),
+			Enclosure:   rssEnclosure{URL: links.media(it.Name), Length: it.Size, Type: "audio/mpeg"},
+			Author:      it.Tags.Artist,
+		}
+		if it.Tags.Duration > 0 {
+			item.Duration = formatFeedDuration(it.Tags.Duration)
+		}
+		if it.Cover != nil {
+			item.Image = &itunesImage{Href: links.cover(it)}
+			if ch.Image == nil {
+				ch.Image = item.Image
+			}
+		}
+		if it.Tags.Artist != "" {
+			authors[it.Tags.Artist] = true
+		}
+		ch.Items = append(ch.Items, item)
+	}
+	// A folder of one channel's videos names it as the podcast's author.
+	if len(authors) == 1 {
+		for a := range authors {
+			ch.Author = a
+		}
+	}
+	if len(items) > 0 {
+		ch.LastBuildDate = items[0].published().UTC().Format(time.RFC1123Z)
+	}
+	return rssFeed{Version: "2.0", ITunes: itunesNamespace, Channel: ch}
+}
+
+// formatFeedDuration formats d as HH:MM:SS for itunes:duration.
+func formatFeedDuration(d time.Duration) string {
+	s := int64(d.Round(time.Second) / time.Second)
+	return fmt.Sprintf("%02d:%02d:%02d", s/3600, s/60%60, s%60)
+}
+
+// writeTo writes the feed as an XML document.
+func (f rssFeed) writeTo(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(f); err != nil {
+		return fmt.Errorf("failed to encode feed: %v", err)
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// coverExt returns the file extension for a picture's MIME type.
+func coverExt(mimeType string) string {
+	switch strings.ToLower(mimeType) {
+	case "image/png":
+		return ".png"
+	case "image/webp":
+		return ".webp"
+	}
+	return ".jpg"
+}
+
+// fileBaseURL returns the file: URL of dir, for feeds that are read on the
+// same machine.
+func fileBaseURL(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}
+	if !strings.HasPrefix(u.Path, "/") {
+		u.Path = "/" + u.Path
+	}
+	return u.String() + "/", nil
+}
+
+// writeFolderFeed writes the feed for the MP3 files in dir to out, with
+// links relative to baseURL. Cover art is extracted into feedCoversDir so
+// the feed can link to it.
+func writeFolderFeed(dir, out string, info feedInfo, baseURL string, log io.Writer) (int, error) {
+	items, err := readFeedItems(dir, log)
+	if err != nil {
+		return 0, err
+	}
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return 0, fmt.Errorf("invalid base URL %q: %v", baseURL, err)
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	resolve := func(name string) string {
+		return base.ResolveReference(&url.URL{Path: name}).String()
+	}
+
+	covers := map[string]bool{}
+	for _, it := range items {
+		if it.Cover == nil {
+			continue
+		}
+		name := strings.TrimSuffix(it.Name, filepath.Ext(it.Name)) + coverExt(it.Cover.MimeType)
+		covers[name] = true
+		if err := os.MkdirAll(filepath.Join(dir, feedCoversDir), 0755); err != nil {
+			return 0, fmt.Errorf("failed to create covers directory: %v", err)
+		}
+		if err := writeFileAtomic(filepath.Join(dir, feedCoversDir, name), it.Cover.Picture); err != nil {
+			return 0, fmt.Errorf("failed to write cover art: %v", err)
+		}
+	}
+	// Drop the covers of tracks that are gone.
+	if entries, err := os.ReadDir(filepath.Join(dir, feedCoversDir)); err == nil {
+		for _, e := range entries {
+			if !e.IsDir() && !covers[e.Name()] {
+				os.Remove(filepath.Join(dir, feedCoversDir, e.Name()))
+			}
+		}
+	}
+
+	if info.Link == "" {
+		info.Link = base.String()
+	}
+	feed := buildFeed(info, items, feedLinks{
+		media: resolve,
+		cover: func(it feedItem) string {
+			return resolve(path.Join(feedCoversDir, strings.TrimSuffix(it.Name, filepath.Ext(it.Name))+coverExt(it.Cover.MimeType)))
+		},
+	})
+	var buf bytes.Buffer
+	if err := feed.writeTo(&buf); err != nil {
+		return 0, err
+	}
+	if err := writeFileAtomic(out, buf.Bytes()); err != nil {
+		return 0, fmt.Errorf("failed to write feed: %v", err)
+	}
+	return len(items), nil
+}
+
+// feedDir returns the folder of the library that a feed request asks for,
+// relative to the library and without any "..".
+func feedDir(r *http.Request) string {
+	return path.Clean("/" + r.URL.Query().Get("dir"))[1:]
+}
+
+// feedSignature signs the feed of the folder dir of u's library. Unlike
+// media links it does not expire, since podcast apps keep the feed URL for
+// good; revoking u's token invalidates it.
+func feedSignature(u *apiUser, dir string) string {
+	return mediaSignature(u, "feed:"+dir, 0)
+}
+
+// signedFeedURL returns the URL of the feed of the folder dir of u's library
+// on the server at base, signed so that podcast apps, which cannot send
+// headers, can fetch it without the API token.
+func signedFeedURL(base string, u *apiUser, dir string) string {
+	dir = path.Clean("/" + dir)[1:]
+	q := url.Values{"user": {u.Name}, "sig": {feedSignature(u, dir)}}
+	if dir != "" {
+		q.Set("dir", dir)
+	}
+	return strings.TrimSuffix(base, "/") + "/" + feedFileName + "?" + q.Encode()
+}
+
+// signedAuthenticate accepts requests signed for the user named by the
+// user query parameter, whose sig parameter must match sign for them, in
+// place of the API token. sign returns "" for requests that cannot be
+// valid. Requests without a signature need the token as usual.
+func (s *server) signedAuthenticate(h http.HandlerFunc, sign func(r *http.Request, u *apiUser) string) http.HandlerFunc {
+	auth := s.authenticate(h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("sig") == "" || s.tokens == nil {
+			auth(w, r)
+			return
+		}
+		u, err := s.tokens.user(q.Get("user"))
+		if err != nil && !errors.Is(err, errUnauthorized) {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err != nil || !hmac.Equal([]byte(q.Get("sig")), []byte(sign(r, u))) {
+			writeError(w, http.StatusUnauthorized, errUnauthorized)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, u)))
+	}
+}
+
+// feedAuthenticate accepts the signed feed URLs of signedFeedURL in place
+// of the API token.
+func (s *server) feedAuthenticate(h http.HandlerFunc) http.HandlerFunc {
+	return s.signedAuthenticate(h, func(r *http.Request, u *apiUser) string {
+		return feedSignature(u, feedDir(r))
+	})
+}
+
+// mediaSignature signs the link to the file at name, relative to u's
+// library, until expires (in Unix seconds). It is keyed with the hash of
+// u's token, so revoking the token invalidates the links.
+func mediaSignature(u *apiUser, name string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(u.TokenHash))
+	fmt.Fprintf(mac, "%s\n%s\n%d", u.Name, name, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// mediaAuthenticate accepts the signed links of a served feed in place of
+// the API token, so that the token never appears in enclosure URLs.
+func (s *server) mediaAuthenticate(h http.HandlerFunc) http.HandlerFunc {
+	return s.signedAuthenticate(h, func(r *http.Request, u *apiUser) string {
+		expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+		if err != nil || time.Now().Unix() > expires {
+			return ""
+		}
+		return mediaSignature(u, r.PathValue("path"), expires)
+	})
+}
+
+// libraryRoot returns the directory the requesting user's files live in.
+func (s *server) libraryRoot(r *http.Request) (string, error) {
+	root := s.root
+	if root == "" {
+		root = "."
+	}
+	if u := requestUser(r); u != nil {
+		return confineDir(root, u.root())
+	}
+	return root, nil
+}
+
+// handleFeed serves the podcast feed of a folder in the user's library,
+// selected with the dir query parameter.
+func (s *server) handleFeed(w http.ResponseWriter, r *http.Request) {
+	root, err := s.libraryRoot(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sub := feedDir(r)
+	dir, err := confineDir(root, filepath.FromSlash(sub))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("folder %q does not exist", sub))
+		return
+	}
+	log := s.log
+	if log == nil {
+		log = io.Discard
+	}
+	items, err := readFeedItems(dir, log)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	origin := scheme + "://" + r.Host
+	user := requestUser(r)
+	// Round the expiry to the day so links stay the same between refreshes.
+	expires := time.Now().Add(mediaLinkLifetime).Truncate(24 * time.Hour).Unix()
+	media := func(name string, extra url.Values) string {
+		file := path.Join(sub, name)
+		u := url.URL{Path: "/media/" + file}
+		q := url.Values{}
+		for k, v := range extra {
+			q[k] = v
+		}
+		if user != nil {
+			q.Set("user", user.Name)
+			q.Set("expires", strconv.FormatInt(expires, 10))
+			q.Set("sig", mediaSignature(user, file, expires))
+		}
+		u.RawQuery = q.Encode()
+		return origin + u.String()
+	}
+	title := path.Base(sub)
+	if sub == "" {
+		title = "yt2mp3"
+	}
+	feed := buildFeed(feedInfo{Title: title, Link: origin + "/"}, items, feedLinks{
+		media: func(name string) string { return media(name, nil) },
+		cover: func(it feedItem) string { return media(it.Name, url.Values{"cover": {"1"}}) },
+	})
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	feed.writeTo(w)
+}
+
+// handleMedia serves an audio file from the user's library, or its embedded
+// cover art when the cover query parameter is set.
+func (s *server) handleMedia(w http.ResponseWriter, r *http.Request) {
+	root, err := s.libraryRoot(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	name := r.PathValue("path")
+	file, err := confineDir(root, filepath.FromSlash(name))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	ext := strings.ToLower(filepath.Ext(file))
+	audio := false
+	for _, e := range audioFormatExt {
+		audio = audio || ext == e
+	}
+	fi, err := os.Stat(file)
+	if !audio || err != nil || !fi.Mode().IsRegular() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("file %q does not exist", name))
+		return
+	}
+	if r.URL.Query().Get("cover") == "" {
+		http.ServeFile(w, r, file)
+		return
+	}
+	tag, err := id3v2.Open(file, id3v2.Options{Parse: true, ParseFrames: []string{"Attached picture"}})
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("file %q has no cover art", name))
+		return
+	}
+	defer tag.Close()
+	for _, f := range tag.GetFrames(tag.CommonID("Attached picture")) {
+		if pic, ok := f.(id3v2.PictureFrame); ok && len(pic.Picture) > 0 {
+			w.Header().Set("Content-Type", pic.MimeType)
+			w.Write(pic.Picture)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Errorf("file %q has no cover art", name))
+}
+
+var feedCmd = &cobra.Command{
+	Use:   "feed",
+	Short: "Publish downloaded audio as podcast feeds",
+}
+
+var feedBuildCmd = &cobra.Command{
+	Use:   "build [DIR]",
+	Short: "Write a podcast feed for a folder of downloaded MP3 files",
+	Long: `Write a podcast feed (RSS 2.0 with iTunes extensions) for the MP3 files
+in DIR, or in the folder of the subscription named by --subscription.
+
+Titles, descriptions, upload dates, durations and cover art are read from
+the files' tags. The feed links to the files below --base-url, the URL the
+folder is published at; without it the feed uses file: URLs.`,
+	Args:         cobra.MaximumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		info := feedInfo{Title: feedTitle}
+		var dir string
+		switch {
+		case feedSubscription != "" && len(args) > 0:
+			return fmt.Errorf("give either DIR or --subscription, not both")
+		case feedSubscription != "":
+			path, err := resolveSubscriptionsPath()
+			if err != nil {
+				return err
+			}
+			subs, err := loadSubscriptions(path)
+			if err != nil {
+				return err
+			}
+			subs, err = selectSubscriptions(subs, []string{feedSubscription})
+			if err != nil {
+				return err
+			}
+			cfg, err := loadConfigFile()
+			if err != nil {
+				return err
+			}
+			profile := subs[0].Profile
+			if profile == "" {
+				profile = selectedProfile()
+			}
+			settings, _, err := resolveSettings(cfg, profile, os.Getenv, cmd.Flags())
+			if err != nil {
+				return err
+			}
+			dir = subs[0].outputDir(settings.OutputDir)
+			if info.Title == "" {
+				info.Title = subs[0].Name
+			}
+			info.Description = "Downloaded from " + subs[0].URL
+		case len(args) == 1:
+			dir = args[0]
+		default:
+			return fmt.Errorf("give the folder to build a feed for, or --subscription")
+		}
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			return classify(ErrOutputDir, fmt.Errorf("folder %s does not exist", dir))
+		}
+		if info.Title == "" {
+			abs, err := filepath.Abs(dir)
+			if err != nil {
+				return err
+			}
+			info.Title = filepath.Base(abs)
+		}
+		base := feedBaseURL
+		if base == "" {
+			var err error
+			if base, err = fileBaseURL(dir); err != nil {
+				return err
+			}
+		}
+		out := feedOutput
+		if out == "" {
+			out = filepath.Join(dir, feedFileName)
+		}
+		n, err := writeFolderFeed(dir, out, info, base, cmd.ErrOrStderr())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "Wrote %s with %d episodes\n", out, n)
+		return nil
+	},
+}
+
+func init() {
+	feedBuildCmd.Flags().StringVar(&feedBaseURL, "base-url", "", "URL the folder is published at (default file: URLs)")
+	feedBuildCmd.Flags().StringVar(&feedTitle, "title", "", "Podcast title (default the folder or subscription name)")
+	feedBuildCmd.Flags().StringVar(&feedOutput, "output", "", "Feed file to write (default feed.xml in the folder)")
+	feedBuildCmd.Flags().StringVar(&feedSubscription, "subscription", "", "Build the feed for this subscription's folder")
+	feedBuildCmd.Flags().StringVar(&subscriptionsPath, "subscriptions", "", "Subscriptions file (default $XDG_CONFIG_HOME/yt2mp3/subscriptions.yaml)")
+	feedCmd.AddCommand(feedBuildCmd)
+	rootCmd.AddCommand(feedCmd)
+}
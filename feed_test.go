@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bogem/id3v2"
+)
+
+// writeTaggedMP3 writes an MP3 file tagged with tags and, if cover is not
+// empty, a PNG cover.
+func writeTaggedMP3(t *testing.T, path string, tags trackTags, cover string) {
+	t.Helper()
+	mustWrite(t, path, "audio frames")
+	if err := writeID3Tags(path, tags, nil); err != nil {
+		t.Fatal(err)
+	}
+	if cover == "" {
+		return
+	}
+	tag, err := id3v2.Open(path, id3v2.Options{Parse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tag.Close()
+	tag.AddAttachedPicture(id3v2.PictureFrame{
+		Encoding:    id3v2.EncodingISO,
+		MimeType:    "image/png",
+		PictureType: id3v2.PTFrontCover,
+		Picture:     []byte(cover),
+	})
+	if err := saveID3Tag(tag); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// feedDoc is the part of a feed the tests look at.
+type feedDoc struct {
+	Channel struct {
+		Title string `xml:"title"`
+		Image struct {
+			Href string `xml:"href,attr"`
+		} `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd image"`
+		Items []struct {
+			Title     string `xml:"title"`
+			GUID      string `xml:"guid"`
+			PubDate   string `xml:"pubDate"`
+			Duration  string `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd duration"`
+			Enclosure struct {
+				URL    string `xml:"url,attr"`
+				Length int64  `xml:"length,attr"`
+				Type   string `xml:"type,attr"`
+			} `xml:"enclosure"`
+			Image struct {
+				Href string `xml:"href,attr"`
+			} `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd image"`
+		} `xml:"item"`
+	} `xml:"channel"`
+}
+
+func parseFeedDoc(t *testing.T, data []byte) feedDoc {
+	t.Helper()
+	var doc feedDoc
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("feed is not valid XML: %v\n%s", err, data)
+	}
+	return doc
+}
+
+// writeFeedFolder fills dir with two tagged lectures; only the newer one
+// has cover art.
+func writeFeedFolder(t *testing.T, dir string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTaggedMP3(t, filepath.Join(dir, "Lecture 1.mp3"), trackTags{
+		Title: "Lecture 1", Artist: "Uni", URL: "https://www.youtube.com/watch?v=a",
+		UploadDate: "20240101", Duration: time.Hour + 2*time.Minute + 3*time.Second,
+	}, "")
+	writeTaggedMP3(t, filepath.Join(dir, "Lecture 2.mp3"), trackTags{
+		Title: "Lecture 2", Artist: "Uni", URL: "https://www.youtube.com/watch?v=b",
+		Description: "Matrices & <vectors>", UploadDate: "20240108",
+	}, "png data")
+}
+
+func TestFormatFeedDuration(t *testing.T) {
+	tests := map[time.Duration]string{
+		0:                                     "00:00:00",
+		59*time.Second + 600*time.Millisecond: "00:01:00",
+		3*time.Hour + 25*time.Minute:          "03:25:00",
+	}
+	for d, want := range tests {
+		if got := formatFeedDuration(d); got != want {
+			t.Errorf("formatFeedDuration(%v) = %q, want %q", d, got, want)
+		}
+	}
+}
+
+func TestWriteFolderFeed(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "lectures")
+	writeFeedFolder(t, dir)
+	// A cover left over from a deleted track.
+	if err := os.MkdirAll(filepath.Join(dir, feedCoversDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mustWrite(t, filepath.Join(dir, feedCoversDir, "Gone.jpg"), "old")
+	// Art of the user's own is never touched.
+	if err := os.MkdirAll(filepath.Join(dir, "covers"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mustWrite(t, filepath.Join(dir, "covers", "folder.jpg"), "mine")
+	// A file with broken tags is left out of the feed.
+	mustWrite(t, filepath.Join(dir, "Broken.mp3"), "ID3\x04\x00\x00\x00\x00\x01\x00")
+
+	out := filepath.Join(dir, feedFileName)
+	var log strings.Builder
+	n, err := writeFolderFeed(dir, out, feedInfo{Title: "Lectures"}, "https://example.com/podcasts/lectures", &log)
+	if err != nil || n != 2 {
+		t.Fatalf("writeFolderFeed() = %d, %v", n, err)
+	}
+	if !strings.Contains(log.String(), "Warning: skipping Broken.mp3") {
+		t.Errorf("log = %q", log.String())
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := parseFeedDoc(t, data)
+	if doc.Channel.Title != "Lectures" || len(doc.Channel.Items) != 2 {
+		t.Fatalf("channel = %+v", doc.Channel)
+	}
+	newest, oldest := doc.Channel.Items[0], doc.Channel.Items[1]
+	if newest.Title != "Lecture 2" || oldest.Title != "Lecture 1" {
+		t.Errorf("items are not newest first: %q, %q", newest.Title, oldest.Title)
+	}
+	if oldest.Enclosure.URL != "https://example.com/podcasts/lectures/Lecture%201.mp3" || oldest.Enclosure.Type != "audio/mpeg" {
+		t.Errorf("enclosure = %+v", oldest.Enclosure)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "Lecture 1.mp3")); err != nil || oldest.Enclosure.Length != fi.Size() {
+		t.Errorf("enclosure length = %d, want the file size", oldest.Enclosure.Length)
+	}
+	if oldest.Duration != "01:02:03" || oldest.PubDate != "Mon, 01 Jan 2024 00:00:00 +0000" {
+		t.Errorf("duration %q, pubDate %q", oldest.Duration, oldest.PubDate)
+	}
+	if oldest.GUID != "https://www.youtube.com/watch?v=a" {
+		t.Errorf("guid = %q", oldest.GUID)
+	}
+	wantCover := "https://example.com/podcasts/lectures/.yt2mp3-covers/Lecture%202.png"
+	if newest.Image.Href != wantCover || doc.Channel.Image.Href != wantCover {
+		t.Errorf("cover = %q, channel image = %q", newest.Image.Href, doc.Channel.Image.Href)
+	}
+	if cover, err := os.ReadFile(filepath.Join(dir, feedCoversDir, "Lecture 2.png")); err != nil || string(cover) != "png data" {
+		t.Errorf("extracted cover = %q, %v", cover, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, feedCoversDir, "Gone.jpg")); !os.IsNotExist(err) {
+		t.Errorf("stale cover was kept: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "covers", "folder.jpg")); err != nil {
+		t.Errorf("the user's cover art was removed: %v", err)
+	}
+	if !strings.Contains(string(data), "Matrices &amp; &lt;vectors&gt;") {
+		t.Error("description is not escaped")
+	}
+}
+
+func TestServerFeed(t *testing.T) {
+	ts, root, tokens := newAuthTestServer(t, &fakeDownloader{}, apiUser{Name: "alice"})
+	writeFeedFolder(t, filepath.Join(root, "alice", "talks"))
+	mustWrite(t, filepath.Join(root, "alice", "talks", "notes.txt"), "private")
+	token := tokens["alice"]
+
+	get := func(path string) (*http.Response, []byte) {
+		t.Helper()
+		resp, err := http.Get(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+
+	alice := &apiUser{Name: "alice", TokenHash: hashToken(token)}
+	for name, path := range map[string]string{
+		"no token":      "/feed.xml?dir=talks",
+		"token in URL":  "/feed.xml?dir=talks&token=" + url.QueryEscape(token),
+		"other folder":  strings.Replace(strings.TrimPrefix(signedFeedURL(ts.URL, alice, "talks"), ts.URL), "dir=talks", "dir=music", 1),
+		"revoked token": strings.TrimPrefix(signedFeedURL(ts.URL, &apiUser{Name: "alice", TokenHash: hashToken("old")}, "talks"), ts.URL),
+		"bad signature": "/feed.xml?dir=talks&user=alice&sig=00",
+	} {
+		if resp, _ := get(ts.URL + path); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("feed with %s: status %d, want 401", name, resp.StatusCode)
+		}
+	}
+	resp, body := get(signedFeedURL(ts.URL, alice, "talks"))
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/rss+xml") {
+		t.Fatalf("feed: status %d, type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	doc := parseFeedDoc(t, body)
+	if doc.Channel.Title != "talks" || len(doc.Channel.Items) != 2 {
+		t.Fatalf("channel = %+v", doc.Channel)
+	}
+	enclosure := doc.Channel.Items[1].Enclosure.URL
+	if !strings.HasPrefix(enclosure, ts.URL+"/media/talks/Lecture%201.mp3?") || strings.Contains(enclosure, token) || !strings.Contains(enclosure, "sig=") {
+		t.Errorf("enclosure URL = %q", enclosure)
+	}
+	if resp, body := get(enclosure); resp.StatusCode != http.StatusOK || int64(len(body)) != doc.Channel.Items[1].Enclosure.Length {
+		t.Errorf("media: status %d, %d bytes", resp.StatusCode, len(body))
+	}
+	if resp, body := get(doc.Channel.Items[0].Image.Href); resp.StatusCode != http.StatusOK || string(body) != "png data" || resp.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("cover: status %d, type %q, body %q", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+
+	// A signature is only good for its own file, user and expiry.
+	signed, err := url.Parse(enclosure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := signed.Query()
+	for name, tamper := range map[string]func(url.Values) string{
+		"other file": func(q url.Values) string { return "/media/talks/Lecture%202.mp3?" + q.Encode() },
+		"other user": func(q url.Values) string { q.Set("user", "bob"); return signed.Path + "?" + q.Encode() },
+		"extended": func(q url.Values) string {
+			q.Set("expires", strconv.FormatInt(time.Now().Add(30*24*time.Hour).Unix(), 10))
+			return signed.Path + "?" + q.Encode()
+		},
+		"expired": func(q url.Values) string {
+			u := apiUser{Name: "alice", TokenHash: hashToken(token)}
+			expires := time.Now().Add(-time.Minute).Unix()
+			q.Set("expires", strconv.FormatInt(expires, 10))
+			q.Set("sig", mediaSignature(&u, "talks/Lecture 1.mp3", expires))
+			return signed.Path + "?" + q.Encode()
+		},
+	} {
+		if resp, _ := get(ts.URL + tamper(maps.Clone(q))); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: status %d, want 401", name, resp.StatusCode)
+		}
+	}
+	if resp, _ := get(ts.URL + signed.Path + "?token=" + url.QueryEscape(token)); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("media with a token in the URL: status %d, want 401", resp.StatusCode)
+	}
+
+	if resp, _ := get(signedFeedURL(ts.URL, alice, "missing")); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing folder: status %d, want 404", resp.StatusCode)
+	}
+	for _, path := range []string{"/media/talks/missing.mp3", "/media/talks/notes.txt"} {
+		if status := doAuth(t, http.MethodGet, ts.URL+path, token, "", nil); status != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", path, status)
+		}
+	}
+	if resp, _ := get(ts.URL + "/feed.xml?dir=../../etc&user=alice&sig=" + feedSignature(alice, "etc")); resp.StatusCode == http.StatusOK {
+		t.Error("feed outside the user's library was served")
+	}
+}
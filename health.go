@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readinessCacheTTL is how long a readiness result is reused, so that
+// frequent probes do not spawn yt-dlp and ffmpeg every time.
+const readinessCacheTTL = 10 * time.Second
+
+// readiness runs the server's readiness checks and caches the outcome.
+type readiness struct {
+	checks []doctorCheck
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	results   []checkResult
+}
+
+// newReadiness returns a readiness probe that verifies the extracted yt-dlp
+// and ffmpeg actually run.
+func newReadiness(ytdl ytDlp) *readiness {
+	return &readiness{checks: []doctorCheck{
+		{"yt-dlp runs", ytdl.Version},
+		{"ffmpeg available", checkFfmpeg},
+	}}
+}
+
+// check returns the latest check results and whether all of them passed.
+func (r *readiness) check(ctx context.Context) ([]checkResult, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.results == nil || time.Since(r.checkedAt) > readinessCacheTTL {
+		r.results = runDoctorChecks(ctx, r.checks)
+		r.checkedAt = time.Now()
+	}
+	for _, res := range r.results {
+		if !res.Passed {
+			return r.results, false
+		}
+	}
+	return r.results, true
+}
+
+// handleHealthz reports that the process is up and serving requests.
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz reports whether the server can process jobs.
+func (s *server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if s.ready == nil {
+		writeJSON(w, http.StatusOK, map[string]any{"ready": true, "checks": []checkResult{}})
+		return
+	}
+	results, ok := s.ready.check(r.Context())
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]any{"ready": ok, "checks": results})
+}
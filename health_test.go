@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadyz(t *testing.T) {
+	var calls int
+	ffmpegErr := errors.New("ffmpeg not found in PATH")
+	ready := &readiness{checks: []doctorCheck{
+		{"yt-dlp runs", func(ctx context.Context) (string, error) {
+			calls++
+			return "2025.01.01", nil
+		}},
+		{"ffmpeg available", func(ctx context.Context) (string, error) {
+			return "", ffmpegErr
+		}},
+	}}
+	ts := httptest.NewServer((&server{ready: ready}).routes())
+	defer ts.Close()
+
+	var body struct {
+		Ready  bool          `json:"ready"`
+		Checks []checkResult `json:"checks"`
+	}
+	if status := doJSON(t, http.MethodGet, ts.URL+"/readyz", nil, &body); status != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", status)
+	}
+	if body.Ready || len(body.Checks) != 2 || body.Checks[1].Detail != ffmpegErr.Error() {
+		t.Errorf("body = %+v", body)
+	}
+
+	// Results are cached between probes.
+	doJSON(t, http.MethodGet, ts.URL+"/readyz", nil, nil)
+	if calls != 1 {
+		t.Errorf("checks ran %d times, want 1", calls)
+	}
+
+	ffmpegErr = nil
+	ready.results = nil
+	if status := doJSON(t, http.MethodGet, ts.URL+"/readyz", nil, &body); status != http.StatusOK || !body.Ready {
+		t.Errorf("status = %d, body = %+v", status, body)
+	}
+
+	if status := doJSON(t, http.MethodGet, ts.URL+"/healthz", nil, nil); status != http.StatusOK {
+		t.Errorf("healthz status = %d", status)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/bogem/id3v2"
+)
+
+// id3FrameSize decodes a frame size field.
+func id3FrameSize(b []byte, synchsafe bool) int {
+	if !synchsafe {
+		return int(binary.BigEndian.Uint32(b))
+	}
+	return int(b[0])<<21 | int(b[1])<<14 | int(b[2])<<7 | int(b[3])
+}
+
+// walkID3Frames calls fn for every frame in the tag body frames, and
+// reports whether the frames exactly fill it up to the padding.
+func walkID3Frames(frames []byte, synchsafe bool, fn func(id string, body []byte)) bool {
+	pos := 0
+	for pos+10 <= len(frames) && frames[pos] != 0 {
+		for _, c := range frames[pos : pos+4] {
+			if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+				return false
+			}
+		}
+		size := id3FrameSize(frames[pos+4:pos+8], synchsafe)
+		if size < 0 || pos+10+size > len(frames) {
+			return false
+		}
+		if fn != nil {
+			fn(string(frames[pos:pos+4]), frames[pos+10:pos+10+size])
+		}
+		pos += 10 + size
+	}
+	for _, b := range frames[pos:] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// storedTag is the tag of an MP3 file as retag found it.
+type storedTag struct {
+	Tags  trackTags
+	Cover *id3v2.PictureFrame
+	// legacy is set for tags that earlier releases wrote with v2.4 frame
+	// sizes under a v2.3 header.
+	legacy bool
+	// albumArtist is the TPE2 frame, which album mode writes.
+	albumArtist string
+	// frames is the parsed tag, for the frames that Tags does not hold.
+	frames *id3v2.Tag
+	// overrides are written after Tags; extra are the ones among them that
+	// set frames Tags has no field for.
+	overrides, extra []tagOverride
+}
+
+// readStoredTag reads the tag of the MP3 file at path, including the ones
+// earlier releases wrote: their header claims v2.3 while the frames use
+// v2.4 sizes, and their comment frame lacks the terminator after its
+// description, so the source URL has to be dug out by hand.
+func readStoredTag(path string) (storedTag, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return storedTag{}, fmt.Errorf("failed to open MP3 file: %v", err)
+	}
+	defer f.Close()
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(f, header); err != nil || string(header[:3]) != "ID3" {
+		return storedTag{}, nil
+	}
+	frames := make([]byte, id3FrameSize(header[6:10], true))
+	if _, err := io.ReadFull(f, frames); err != nil {
+		return storedTag{}, fmt.Errorf("failed to read tags of %s: %v", path, err)
+	}
+
+	var st storedTag
+	synchsafe := header[3] == 4
+	if header[3] == 3 && !walkID3Frames(frames, false, nil) && walkID3Frames(frames, true, nil) {
+		st.legacy, synchsafe = true, true
+		header[3] = 4
+	}
+	tag, err := id3v2.ParseReader(io.MultiReader(bytes.NewReader(header), bytes.NewReader(frames)), id3v2.Options{Parse: true})
+	if err != nil {
+		return storedTag{}, fmt.Errorf("failed to read tags of %s: %v", path, err)
+	}
+	st.Tags = readTrackTags(tag)
+	st.albumArtist = tag.GetTextFrame("TPE2").Text
+	st.frames = tag
+	for _, f := range tag.GetFrames(tag.CommonID("Attached picture")) {
+		if pic, ok := f.(id3v2.PictureFrame); ok && len(pic.Picture) > 0 {
+			st.Cover = &pic
+			break
+		}
+	}
+	if st.Tags.URL == "" {
+		walkID3Frames(frames, synchsafe, func(id string, body []byte) {
+			// Encoding byte, language, then the description running straight
+			// into the URL.
+			if rest, ok := bytes.CutPrefix(body[min(4, len(body)):], []byte("YouTube URL")); id == "COMM" && ok {
+				st.Tags.URL = strings.Trim(string(rest), "\x00")
+			}
+		})
+	}
+	return st, nil
+}
+
+// repairID3Header restores the v2.4 version byte of a legacy tag in the
+// MP3 file at path, after which its frames parse again.
+func repairID3Header(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(f, header); err != nil || string(header[:3]) != "ID3" || header[3] != 3 {
+		return nil
+	}
+	frames := make([]byte, id3FrameSize(header[6:10], true))
+	if _, err := io.ReadFull(f, frames); err != nil {
+		return nil
+	}
+	if walkID3Frames(frames, false, nil) || !walkID3Frames(frames, true, nil) {
+		return nil
+	}
+	if _, err := f.WriteAt([]byte{4}, 3); err != nil {
+		return fmt.Errorf("failed to repair ID3 header: %v", err)
+	}
+	return nil
+}
+
+// openID3Tag opens the tag of the MP3 file at path for rewriting, repairing
+// legacy tags first. A legacy comment frame, which id3v2 skips and would
+// drop on save, is replaced by a well-formed one. New frames default to
+// UTF-16, since a parsed v2.3 tag defaults to ISO-8859-1, which cannot hold
+// most titles.
+func openID3Tag(path string) (*id3v2.Tag, error) {
+	st, err := readStoredTag(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := repairID3Header(path); err != nil {
+		return nil, err
+	}
+	tag, err := id3v2.Open(path, id3v2.Options{Parse: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open MP3 file for tagging: %v", err)
+	}
+	tag.SetDefaultEncoding(id3v2.EncodingUTF16)
+	if st.Tags.URL != "" && sourceURL(tag) == "" {
+		tag.AddCommentFrame(sourceURLFrame(st.Tags.URL))
+	}
+	return tag, nil
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job states. A job moves from queued through the pipeline stages to one of
+// the terminal states done, failed or canceled.
+const (
+	jobQueued      = "queued"
+	jobDownloading = stageDownloading
+	jobTagging     = stageTagging
+	jobDone        = "done"
+	jobFailed      = "failed"
+	jobCanceled    = "canceled"
+)
+
+var (
+	// errJobNotFound is returned for unknown job IDs.
+	errJobNotFound = errors.New("job not found")
+	// errJobFinished is returned when canceling a job that already ended.
+	errJobFinished = errors.New("job already finished")
+	// errQueueFull is returned when the job queue is at capacity.
+	errQueueFull = errors.New("job queue is full")
+)
+
+// JobRequest describes a download to enqueue.
+type JobRequest struct {
+	URL     string  `json:"url"`
+	Profile string  `json:"profile,omitempty"`
+	Options Profile `json:"options"`
+}
+
+// JobTransition records when a job entered a state.
+type JobTransition struct {
+	State string    `json:"state"`
+	At    time.Time `json:"at"`
+}
+
+// Job is a download tracked by a jobManager. Copies handed out by the
+// manager are snapshots and safe to read without locking.
+type Job struct {
+	ID        string          `json:"id"`
+	URL       string          `json:"url"`
+	Profile   string          `json:"profile,omitempty"`
+	Owner     string          `json:"owner,omitempty"`
+	State     string          `json:"state"`
+	Progress  float64         `json:"progress"`
+	Result    *Result         `json:"result,omitempty"`
+	History   []JobTransition `json:"history"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+
+	settings Settings
+	// maxRunning is how many of its owner's jobs may run at once; zero
+	// is no limit.
+	maxRunning int
+	cancel     context.CancelFunc
+}
+
+// snapshot returns a copy of j that does not share the history slice.
+func (j *Job) snapshot() Job {
+	c := *j
+	c.History = append([]JobTransition(nil), j.History...)
+	return c
+}
+
+// finished reports whether the job is in a terminal state.
+func (j *Job) finished() bool {
+	return j.State == jobDone || j.State == jobFailed || j.State == jobCanceled
+}
+
+// jobResolver turns a request by u into the settings the job runs with, or
+// rejects it. u is nil when the request is not authenticated.
+type jobResolver func(req JobRequest, u *apiUser) (Settings, error)
+
+// jobManagerOptions configures a jobManager.
+type jobManagerOptions struct {
+	// Workers is the number of jobs processed concurrently.
+	Workers int
+	// QueueSize is the number of jobs that may wait for a worker.
+	QueueSize int
+	// Store, if set, persists jobs so they survive restarts.
+	Store jobStore
+	// Retention is how long finished jobs are kept; zero keeps them forever.
+	Retention time.Duration
+	// Log receives pipeline progress messages and store errors.
+	Log io.Writer
+	// Metrics, if set, counts job outcomes.
+	Metrics *metrics
+	// OnFinish, if set, is called with every job that ends done or failed.
+	// It runs on the worker goroutine and should not block.
+	OnFinish func(Job)
+}
+
+// jobManager runs submitted jobs through the download pipeline on a bounded
+// pool of workers.
+type jobManager struct {
+	ctx       context.Context
+	d         downloader
+	resolve   jobResolver
+	log       io.Writer
+	store     jobStore
+	retention time.Duration
+	metrics   *metrics
+	onFinish  func(Job)
+	queue     chan *Job
+	wg        sync.WaitGroup
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+	subs map[*jobSubscription]struct{}
+	// running counts the running jobs of each owner with a limit.
+	running map[string]int
+	// held are the queued jobs of owners at their limit, oldest first.
+	held map[string][]*Job
+}
+
+// jobSubscription collects job changes for one subscriber. Only the latest
+// snapshot of each job is kept, so a slow reader skips intermediate progress
+// updates but never misses a job's final state.
+type jobSubscription struct {
+	// C receives a value whenever there are pending changes.
+	C chan struct{}
+
+	mu      sync.Mutex
+	pending map[string]Job
+}
+
+// Changes returns the jobs that changed since the last call, oldest first.
+func (s *jobSubscription) Changes() []Job {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[string]Job)
+	s.mu.Unlock()
+	jobs := make([]Job, 0, len(pending))
+	for _, j := range pending {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].CreatedAt.Before(jobs[k].CreatedAt) })
+	return jobs
+}
+
+func (s *jobSubscription) add(job Job) {
+	s.mu.Lock()
+	s.pending[job.ID] = job
+	s.mu.Unlock()
+	select {
+	case s.C <- struct{}{}:
+	default:
+	}
+}
+
+// newJobManager restores any jobs from opts.Store and starts workers that
+// process jobs until ctx is done. Jobs that were queued or in flight when
+// the previous process stopped are queued again from the start.
+func newJobManager(ctx context.Context, d downloader, resolve jobResolver, opts jobManagerOptions) (*jobManager, error) {
+	log := opts.Log
+	if log == nil {
+		log = io.Discard
+	}
+	m := &jobManager{
+		ctx:       ctx,
+		d:         d,
+		resolve:   resolve,
+		log:       log,
+		store:     opts.Store,
+		retention: opts.Retention,
+		metrics:   opts.Metrics,
+		onFinish:  opts.OnFinish,
+		jobs:      make(map[string]*Job),
+		subs:      make(map[*jobSubscription]struct{}),
+		running:   make(map[string]int),
+		held:      make(map[string][]*Job),
+	}
+
+	var pending []*Job
+	if m.store != nil {
+		stored, err := m.store.Load()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load jobs: %v", err)
+		}
+		sort.Slice(stored, func(i, k int) bool { return stored[i].CreatedAt.Before(stored[k].CreatedAt) })
+		for _, sj := range stored {
+			job := sj.Job
+			job.settings = sj.Settings
+			job.maxRunning = sj.MaxRunning
+			m.jobs[job.ID] = &job
+			if !job.finished() {
+				pending = append(pending, &job)
+			}
+		}
+	}
+
+	m.queue = make(chan *Job, opts.QueueSize+len(pending))
+	m.mu.Lock()
+	for _, job := range pending {
+		job.Progress = 0
+		m.transition(job, jobQueued)
+		m.queue <- job
+	}
+	m.purgeExpired(time.Now())
+	m.mu.Unlock()
+
+	for i := 0; i < opts.Workers; i++ {
+		m.wg.Add(1)
+		go m.worker()
+	}
+	if m.retention > 0 {
+		m.wg.Add(1)
+		go m.janitor()
+	}
+	return m, nil
+}
+
+// Wait blocks until every worker has exited after the manager's context is
+// done.
+func (m *jobManager) Wait() {
+	m.wg.Wait()
+}
+
+// transition moves job into state, records it in the job's history and
+// persists the job. The caller must hold m.mu.
+func (m *jobManager) transition(job *Job, state string) {
+	now := time.Now().UTC()
+	job.State = state
+	job.UpdatedAt = now
+	job.History = append(job.History, JobTransition{State: state, At: now})
+	m.persist(job)
+	m.publish(job)
+}
+
+// publish hands a snapshot of job to every subscriber. The caller must hold
+// m.mu.
+func (m *jobManager) publish(job *Job) {
+	for sub := range m.subs {
+		sub.add(job.snapshot())
+	}
+}
+
+// Subscribe returns a subscription that receives every subsequent job
+// change. Call Unsubscribe when done with it.
+func (m *jobManager) Subscribe() *jobSubscription {
+	sub := &jobSubscription{C: make(chan struct{}, 1), pending: make(map[string]Job)}
+	m.mu.Lock()
+	m.subs[sub] = struct{}{}
+	m.mu.Unlock()
+	return sub
+}
+
+// Unsubscribe stops delivering changes to sub.
+func (m *jobManager) Unsubscribe(sub *jobSubscription) {
+	m.mu.Lock()
+	delete(m.subs, sub)
+	m.mu.Unlock()
+}
+
+// Done returns a channel that is closed when the manager shuts down.
+func (m *jobManager) Done() <-chan struct{} {
+	return m.ctx.Done()
+}
+
+// persist writes job to the store, if any. The caller must hold m.mu.
+func (m *jobManager) persist(job *Job) {
+	if m.store == nil {
+		return
+	}
+	if err := m.store.Save(storedJob{Job: job.snapshot(), Settings: job.settings, MaxRunning: job.maxRunning}); err != nil {
+		fmt.Fprintf(m.log, "Failed to persist job %s: %v\n", job.ID, err)
+	}
+}
+
+// purgeExpired forgets finished jobs last updated before now minus the
+// retention period. The caller must hold m.mu.
+func (m *jobManager) purgeExpired(now time.Time) {
+	if m.retention <= 0 {
+		return
+	}
+	cutoff := now.Add(-m.retention)
+	for id, job := range m.jobs {
+		if !job.finished() || job.UpdatedAt.After(cutoff) {
+			continue
+		}
+		delete(m.jobs, id)
+		if m.store != nil {
+			if err := m.store.Delete(id); err != nil {
+				fmt.Fprintf(m.log, "Failed to delete job %s: %v\n", id, err)
+			}
+		}
+	}
+}
+
+// janitor periodically purges expired jobs until the context is done.
+func (m *jobManager) janitor() {
+	defer m.wg.Done()
+	interval := min(m.retention, time.Hour)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case now := <-t.C:
+			m.mu.Lock()
+			m.purgeExpired(now)
+			m.mu.Unlock()
+		}
+	}
+}
+
+// Submit validates req and enqueues it as a new job owned by u, which may
+// be nil. Only MaxJobs of a user's jobs run at once; the others wait.
+func (m *jobManager) Submit(req JobRequest, u *apiUser) (Job, error) {
+	settings, err := m.resolve(req, u)
+	if err != nil {
+		return Job{}, err
+	}
+	return m.SubmitResolved(req, settings, u)
+}
+
+// SubmitResolved enqueues req with settings that were already resolved and
+// validated by the caller.
+func (m *jobManager) SubmitResolved(req JobRequest, settings Settings, u *apiUser) (Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return Job{}, err
+	}
+	job := &Job{
+		ID:        id,
+		URL:       req.URL,
+		Profile:   req.Profile,
+		CreatedAt: time.Now().UTC(),
+		settings:  settings,
+	}
+	if u != nil {
+		job.Owner = u.Name
+		job.maxRunning = u.MaxJobs
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Held jobs have left the queue but still wait for a worker.
+	if len(m.queue)+m.heldCount() >= cap(m.queue) {
+		return Job{}, errQueueFull
+	}
+	select {
+	case m.queue <- job:
+	default:
+		return Job{}, errQueueFull
+	}
+	m.jobs[id] = job
+	m.transition(job, jobQueued)
+	return job.snapshot(), nil
+}
+
+// heldCount returns the number of held jobs. The caller must hold m.mu.
+func (m *jobManager) heldCount() int {
+	n := 0
+	for _, jobs := range m.held {
+		n += len(jobs)
+	}
+	return n
+}
+
+// admit reports whether job may start now, counting it as running if so.
+// A job whose owner is at their limit is held until one of their jobs
+// ends. The caller must hold m.mu.
+func (m *jobManager) admit(job *Job) bool {
+	if job.maxRunning <= 0 {
+		return true
+	}
+	if m.running[job.Owner] >= job.maxRunning {
+		m.held[job.Owner] = append(m.held[job.Owner], job)
+		return false
+	}
+	m.running[job.Owner]++
+	return true
+}
+
+// release counts job as no longer running and returns the oldest held job
+// of its owner that is still queued, or nil. The caller must hold m.mu.
+func (m *jobManager) release(job *Job) *Job {
+	if job.maxRunning <= 0 {
+		return nil
+	}
+	m.running[job.Owner]--
+	held := m.held[job.Owner]
+	for len(held) > 0 {
+		next := held[0]
+		held = held[1:]
+		if next.State == jobQueued {
+			m.held[job.Owner] = held
+			return next
+		}
+	}
+	delete(m.held, job.Owner)
+	return nil
+}
+
+// Counts returns the number of jobs waiting for a worker and being
+// processed.
+func (m *jobManager) Counts() (queued, running int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, job := range m.jobs {
+		switch job.State {
+		case jobQueued:
+			queued++
+		case jobDownloading, jobTagging:
+			running++
+		}
+	}
+	return queued, running
+}
+
+// Get returns a snapshot of the job with the given ID.
+func (m *jobManager) Get(id string) (Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return job.snapshot(), true
+}
+
+// List returns snapshots of all jobs, oldest first.
+func (m *jobManager) List() []Job {
+	m.mu.Lock()
+	jobs := make([]Job, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		jobs = append(jobs, j.snapshot())
+	}
+	m.mu.Unlock()
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].CreatedAt.Before(jobs[k].CreatedAt) })
+	return jobs
+}
+
+// Cancel stops a queued or running job.
+func (m *jobManager) Cancel(id string) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	if job.finished() {
+		return job.snapshot(), errJobFinished
+	}
+	m.transition(job, jobCanceled)
+	if job.cancel != nil {
+		job.cancel()
+	}
+	return job.snapshot(), nil
+}
+
+func (m *jobManager) worker() {
+	defer m.wg.Done()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case job := <-m.queue:
+			// A job that ends hands its worker to a held job of the
+			// same owner.
+			for job != nil {
+				job = m.run(job)
+			}
+		}
+	}
+}
+
+// run processes one job unless it was canceled while queued or its owner
+// is at their limit. It returns the held job to run next, if any.
+func (m *jobManager) run(job *Job) *Job {
+	ctx, cancel := context.WithCancel(m.ctx)
+	defer cancel()
+
+	m.mu.Lock()
+	if job.State != jobQueued || !m.admit(job) {
+		m.mu.Unlock()
+		return nil
+	}
+	job.cancel = cancel
+	settings := job.settings
+	m.mu.Unlock()
+	m.metrics.jobStarted()
+
+	var res *Result
+	var err error
+	if settings.OutputDir != "" {
+		err = os.MkdirAll(settings.OutputDir, 0755)
+	}
+	if err != nil {
+		err = classify(ErrOutputDir, fmt.Errorf("failed to create output directory: %w", err))
+		res = &Result{URL: job.URL, Status: statusFailed, ErrorCode: errorCode(err), Error: err.Error()}
+	} else {
+		res, err = processURL(ctx, m.d, job.URL, settings, m.log, func(stage string, pct float64) {
+			m.setProgress(job, stage, pct)
+		})
+	}
+
+	m.mu.Lock()
+	job.Result = res
+	job.cancel = nil
+	finished := false
+	switch {
+	case job.State == jobCanceled:
+		// Keep the state set by Cancel, but record the result.
+		job.UpdatedAt = time.Now().UTC()
+		m.persist(job)
+		m.publish(job)
+		m.metrics.jobCanceled()
+	case m.ctx.Err() != nil:
+		// Shutting down: leave the job in flight so that it is queued
+		// again on the next start.
+	case err != nil:
+		m.transition(job, jobFailed)
+		m.metrics.jobFailed(errorCode(err))
+		finished = true
+	default:
+		job.Progress = 100
+		m.transition(job, jobDone)
+		m.metrics.jobSucceeded(res.Size)
+		finished = true
+	}
+	snapshot := job.snapshot()
+	next := m.release(job)
+	if m.ctx.Err() != nil {
+		next = nil
+	}
+	m.mu.Unlock()
+
+	if finished && m.onFinish != nil {
+		m.onFinish(snapshot)
+	}
+	return next
+}
+
+// setProgress records a running job's pipeline stage and percentage.
+func (m *jobManager) setProgress(job *Job, stage string, pct float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if job.State == jobCanceled {
+		return
+	}
+	job.Progress = pct
+	if job.State != stage {
+		m.transition(job, stage)
+		return
+	}
+	job.UpdatedAt = time.Now().UTC()
+	m.publish(job)
+}
+
+// newJobID returns a random 16-character hex job ID.
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate job ID: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// defaultJobRetention is how long finished jobs stay queryable.
+	defaultJobRetention = 7 * 24 * time.Hour
+	// jobStoreOpenTimeout bounds the wait for the database lock, which is
+	// held by any other running server using the same file.
+	jobStoreOpenTimeout = time.Second
+)
+
+// jobsBucket holds one JSON-encoded storedJob per job ID.
+var jobsBucket = []byte("jobs")
+
+// storedJob is the on-disk form of a Job, including the settings it needs
+// to run again after a restart.
+type storedJob struct {
+	Job
+	Settings Settings `json:"settings"`
+	// MaxRunning is the owner's concurrency limit when the job was
+	// submitted.
+	MaxRunning int `json:"max_running,omitempty"`
+}
+
+// jobStore persists jobs across restarts.
+type jobStore interface {
+	Save(job storedJob) error
+	Delete(id string) error
+	Load() ([]storedJob, error)
+	Close() error
+}
+
+// boltJobStore is a jobStore backed by a bbolt database file.
+type boltJobStore struct {
+	db *bolt.DB
+}
+
+// defaultStateDir returns the directory for yt2mp3's persistent state:
+// $XDG_STATE_HOME/yt2mp3, ~/.local/state/yt2mp3 on other Unix systems, and
+// the user config directory elsewhere.
+func defaultStateDir() (string, error) {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "yt2mp3"), nil
+	}
+	if runtime.GOOS != "windows" && runtime.GOOS != "darwin" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(home, ".local", "state", "yt2mp3"), nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "yt2mp3"), nil
+}
+
+// openJobStoreAt opens the job database at path, or at jobs.db in the default
+// state directory when path is empty.
+func openJobStoreAt(path string) (*boltJobStore, error) {
+	if path == "" {
+		dir, err := defaultStateDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to locate state directory: %v", err)
+		}
+		path = filepath.Join(dir, "jobs.db")
+	}
+	return openJobStore(path)
+}
+
+// openJobStore opens (creating if needed) the job database at path.
+func openJobStore(path string) (*boltJobStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create job store directory: %v", err)
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: jobStoreOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open job store %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(jobsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize job store: %v", err)
+	}
+	return &boltJobStore{db: db}, nil
+}
+
+// Save inserts or replaces job.
+func (s *boltJobStore) Save(job storedJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Put([]byte(job.ID), data)
+	})
+}
+
+// Delete removes the job with the given ID.
+func (s *boltJobStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Delete([]byte(id))
+	})
+}
+
+// Load returns every stored job.
+func (s *boltJobStore) Load() ([]storedJob, error) {
+	var jobs []storedJob
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+			var job storedJob
+			if err := json.Unmarshal(v, &job); err != nil {
+				return fmt.Errorf("failed to decode job %s: %v", k, err)
+			}
+			jobs = append(jobs, job)
+			return nil
+		})
+	})
+	return jobs, err
+}
+
+// Close closes the database.
+func (s *boltJobStore) Close() error {
+	return s.db.Close()
+}
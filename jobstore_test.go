@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBoltJobStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "jobs.db")
+	store, err := openJobStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := storedJob{
+		Job:      Job{ID: "a", URL: "https://youtu.be/a", State: jobQueued, History: []JobTransition{{State: jobQueued}}},
+		Settings: Settings{AudioFormat: "opus", OutputDir: "out"},
+	}
+	if err := store.Save(job); err != nil {
+		t.Fatal(err)
+	}
+	job.State = jobDone
+	if err := store.Save(job); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(storedJob{Job: Job{ID: "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// Reopen to make sure the data was written to disk.
+	store, err = openJobStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	jobs, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("got %d jobs, want 1", len(jobs))
+	}
+	got := jobs[0]
+	if got.ID != "a" || got.State != jobDone || got.Settings.AudioFormat != "opus" || len(got.History) != 1 {
+		t.Errorf("unexpected job: %+v", got)
+	}
+
+	// A second open of the same file fails fast instead of hanging.
+	if _, err := openJobStore(path); err == nil {
+		t.Error("expected an error while the database is locked")
+	}
+}
+
+func TestJobManagerRestoresJobs(t *testing.T) {
+	store, err := openJobStore(filepath.Join(t.TempDir(), "jobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	out := t.TempDir()
+	now := time.Now().UTC()
+	settings := Settings{AudioFormat: "mp3", OutputDir: out}
+	for _, j := range []Job{
+		{ID: "queued", URL: "https://youtu.be/q", State: jobQueued, CreatedAt: now.Add(-3 * time.Minute), UpdatedAt: now},
+		{ID: "inflight", URL: "https://youtu.be/i", State: jobDownloading, Progress: 40, CreatedAt: now.Add(-2 * time.Minute), UpdatedAt: now},
+		{ID: "recent", URL: "https://youtu.be/r", State: jobDone, CreatedAt: now.Add(-time.Hour), UpdatedAt: now.Add(-time.Hour)},
+		{ID: "expired", URL: "https://youtu.be/e", State: jobFailed, CreatedAt: now.Add(-48 * time.Hour), UpdatedAt: now.Add(-48 * time.Hour)},
+	} {
+		if err := store.Save(storedJob{Job: j, Settings: settings}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := &fakeDownloader{}
+	m, err := newJobManager(ctx, d, nil, jobManagerOptions{Workers: 1, Store: store, Retention: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := m.Get("expired"); ok {
+		t.Error("expired job should have been purged")
+	}
+	if job, ok := m.Get("recent"); !ok || job.State != jobDone {
+		t.Errorf("recent job should still be queryable: %+v", job)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, id := range []string{"queued", "inflight"} {
+		for {
+			job, _ := m.Get(id)
+			if job.State == jobDone {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("job %s was not resumed (state %q)", id, job.State)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if d.calls.Load() != 2 {
+		t.Errorf("downloader called %d times, want 2", d.calls.Load())
+	}
+
+	cancel()
+	m.Wait()
+	stored, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := map[string]string{}
+	for _, j := range stored {
+		states[j.ID] = j.State
+	}
+	want := map[string]string{"queued": jobDone, "inflight": jobDone, "recent": jobDone}
+	if len(states) != len(want) {
+		t.Errorf("stored jobs = %v, want %v", states, want)
+	}
+	for id, state := range want {
+		if states[id] != state {
+			t.Errorf("stored state of %s = %q, want %q", id, states[id], state)
+		}
+	}
+}
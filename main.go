@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"io/fs"
 
@@ -28,18 +34,23 @@ var (
 	outputDir string
 )
 
-// extractYtDlp extracts the embedded yt-dlp binary to a temporary file
-func extractYtDlp(fs fs.FS, dir string) error {
-	// Set binary name
-	binaryName := "yt-dlp"
+// ytDlpBinaryName returns the file name of the embedded yt-dlp binary for the
+// target platform.
+func ytDlpBinaryName() string {
 	if goos := os.Getenv("GOOS"); goos == "" {
 		// If GOOS environment variable is not set, use runtime.GOOS
 		if runtime.GOOS == "windows" {
-			binaryName = "yt-dlp.exe"
+			return "yt-dlp.exe"
 		}
 	} else if goos == "windows" {
-		binaryName = "yt-dlp.exe"
+		return "yt-dlp.exe"
 	}
+	return "yt-dlp"
+}
+
+// extractYtDlp extracts the embedded yt-dlp binary to a temporary file
+func extractYtDlp(fs fs.FS, dir string) error {
+	binaryName := ytDlpBinaryName()
 
 	// Read the embedded binary
 	file, err := fs.Open(filepath.Join("bin", binaryName))
@@ -99,54 +110,221 @@ func prepareOutputDir(outputDir string) error {
 		return fmt.Errorf("failed to create output directory: path is outside of current directory")
 	}
 	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		return fmt.Errorf("failed to create output directory: %v", err)
+		return fmt.Errorf("failed to create output directory: %w", err)
 	}
 	return nil
 }
 
-// findDownloadedMP3 returns the name of the first .mp3 file in dir. The temp
-// directory also contains the extracted yt-dlp binary, so we must select the
-// .mp3 file explicitly rather than relying on directory ordering.
-func findDownloadedMP3(dir string) (string, error) {
+// ensureOutputDir creates the output directory. A directory given with
+// --output-dir is confined to the current directory by prepareOutputDir;
+// one from the config file or environment was set up deliberately by the
+// user ahead of time and is created wherever it points.
+func ensureOutputDir(outputDir, source string) error {
+	if source == sourceFlag {
+		return classify(ErrOutputDir, prepareOutputDir(outputDir))
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return classify(ErrOutputDir, fmt.Errorf("failed to create output directory: %w", err))
+	}
+	return nil
+}
+
+// findDownloadedAudio returns the name of the first file in dir with the
+// given extension (compared case-insensitively).
+func findDownloadedAudio(dir, ext string) (string, error) {
 	files, err := os.ReadDir(dir)
 	if err != nil {
 		return "", fmt.Errorf("failed to read temp directory: %v", err)
 	}
 	for _, f := range files {
-		if !f.IsDir() && strings.EqualFold(filepath.Ext(f.Name()), ".mp3") {
+		if !f.IsDir() && strings.EqualFold(filepath.Ext(f.Name()), ext) {
 			return f.Name(), nil
 		}
 	}
-	return "", fmt.Errorf("no MP3 file downloaded")
+	return "", fmt.Errorf("no %s file downloaded", strings.ToUpper(strings.TrimPrefix(ext, ".")))
+}
+
+// ytDlpArgs builds the yt-dlp command line that downloads url as audio
+// according to s, writing to outputTemplate.
+func ytDlpArgs(s Settings, outputTemplate, url string) []string {
+	args := []string{
+		"--extract-audio",
+		"--audio-format", s.AudioFormat,
+		"--audio-quality", s.AudioQuality,
+	}
+	if s.Mono {
+		args = append(args, "--postprocessor-args", "ExtractAudio:-ac 1")
+	}
+	if s.EmbedThumbnail {
+		args = append(args, "--embed-thumbnail")
+	}
+	if s.AudioFormat != "mp3" {
+		// Only MP3 files are tagged by writeID3Tags; let yt-dlp tag the rest.
+		args = append(args, "--embed-metadata")
+	}
+	return append(args,
+		"--newline",
+		"--no-playlist",
+		"--write-info-json",
+		"--output", outputTemplate,
+		url,
+	)
+}
+
+// trackTags are the ID3 tags yt2mp3 writes to a downloaded MP3 file.
+type trackTags struct {
+	Title  string
+	Artist string
+	Album  string
+	Genre  string
+	// URL is the video the file was downloaded from.
+	URL         string
+	Description string
+	// UploadDate is the video's upload date as YYYYMMDD, or the year of
+	// an album as YYYY.
+	UploadDate string
+	Duration   time.Duration
+	// Track is the track number, as "position" or "position/total".
+	Track string
+}
+
+// newTrackTags returns the tags for a video from its info JSON. p splits
+// the video title into title and artist; the channel is credited when the
+// title names no artist. title is used if the info has no title.
+func newTrackTags(title, url string, info videoInfo, p *titleParser) trackTags {
+	artist := channelArtist(info)
+	if info.Title != "" {
+		var named string
+		var featured []string
+		title, named, featured = p.parse(info.Title)
+		if named != "" {
+			artist = named
+		}
+		artist = joinArtists(append([]string{artist}, featured...)...)
+	}
+	return trackTags{
+		Title:       title,
+		Artist:      artist,
+		Album:       "YouTube",
+		URL:         url,
+		Description: info.Description,
+		UploadDate:  info.UploadDate,
+		Duration:    time.Duration(info.Duration * float64(time.Second)),
+	}
 }
 
-// writeID3Tags writes the basic ID3 tags (title, album, source URL) to the MP3
-// file and normalizes the tag version to v2.3 for QuickTime compatibility.
-func writeID3Tags(path, title, url string) error {
-	tag, err := id3v2.Open(path, id3v2.Options{Parse: true})
+// fields returns the tags that are set, keyed by their name in results.
+func (t trackTags) fields() map[string]string {
+	fields := map[string]string{}
+	for key, value := range map[string]string{
+		"title":   t.Title,
+		"artist":  t.Artist,
+		"album":   t.Album,
+		"genre":   t.Genre,
+		"comment": t.URL,
+		"date":    t.UploadDate,
+		"track":   t.Track,
+	} {
+		if value != "" {
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+// writeID3Tags writes t, and then overrides, to the MP3 file at path and
+// normalizes the tag to v2.3 for QuickTime compatibility.
+func writeID3Tags(path string, t trackTags, overrides []tagOverride) error {
+	tag, err := openID3Tag(path)
 	if err != nil {
-		return fmt.Errorf("failed to open MP3 file for tagging: %v", err)
+		return err
 	}
+	defer tag.Close()
+	applyTrackTags(tag, t)
+	applyTagOverrides(tag, overrides)
+	return saveID3Tag(tag)
+}
 
-	tag.SetTitle(title)
-	tag.SetAlbum("YouTube")
-	tag.AddCommentFrame(id3v2.CommentFrame{
-		Language:    "eng",
-		Description: "YouTube URL",
-		Text:        url,
-	})
+// applyTrackTags replaces the frames of tag that hold t. Frames for fields
+// that t leaves empty are removed, so stale values do not survive a retag.
+func applyTrackTags(tag *id3v2.Tag, t trackTags) {
+	for _, id := range []string{"TIT2", "TALB", "TPE1", "TYER", "TDAT", "TDRC", "TLEN", "TRCK"} {
+		tag.DeleteFrames(id)
+	}
+	tag.SetTitle(t.Title)
+	tag.SetAlbum(t.Album)
+	if t.Artist != "" {
+		tag.SetArtist(t.Artist)
+	}
+	tag.AddCommentFrame(sourceURLFrame(t.URL))
+	setUserText(tag, "description", t.Description)
+	if date, err := time.Parse("20060102", t.UploadDate); err == nil {
+		tag.AddTextFrame("TYER", id3v2.EncodingISO, date.Format("2006"))
+		tag.AddTextFrame("TDAT", id3v2.EncodingISO, date.Format("0201"))
+	} else if _, err := time.Parse("2006", t.UploadDate); err == nil {
+		// The year of an album, which album mode writes without a day.
+		tag.AddTextFrame("TYER", id3v2.EncodingISO, t.UploadDate)
+	}
+	if t.Duration > 0 {
+		tag.AddTextFrame("TLEN", id3v2.EncodingISO, strconv.FormatInt(t.Duration.Milliseconds(), 10))
+	}
+	if t.Track != "" {
+		tag.AddTextFrame("TRCK", id3v2.EncodingISO, t.Track)
+	}
+	if t.Genre != "" {
+		// Unlike the frames above, a genre set by hand is kept when t
+		// has none.
+		setTextFrame(tag, "TCON", t.Genre)
+	}
+}
 
-	if err = tag.Save(); err != nil {
-		tag.Close()
-		return fmt.Errorf("failed to save ID3 tags: %v", err)
+// setUserText replaces the TXXX frame described by desc, keeping the
+// others.
+func setUserText(tag *id3v2.Tag, desc, v string) {
+	others := tag.GetFrames("TXXX")
+	tag.DeleteFrames("TXXX")
+	for _, f := range others {
+		if u, ok := f.(id3v2.UserDefinedTextFrame); ok && u.Description != desc {
+			tag.AddUserDefinedTextFrame(u)
+		}
 	}
-	tag.Close()
+	if v != "" {
+		tag.AddUserDefinedTextFrame(id3v2.UserDefinedTextFrame{
+			Encoding:    id3v2.EncodingUTF16,
+			Description: desc,
+			Value:       v,
+		})
+	}
+}
 
-	// Fix ID3 tag version to v2.3 for QuickTime compatibility
-	if err = fixID3Version(path); err != nil {
-		return fmt.Errorf("failed to fix ID3 version: %v", err)
+// readTrackTags returns the tags that writeID3Tags stored in tag. Dates
+// written as a v2.4 TDRC frame by other taggers are read as well.
+func readTrackTags(tag *id3v2.Tag) trackTags {
+	t := trackTags{
+		Title:  tag.Title(),
+		Artist: tag.Artist(),
+		Album:  tag.Album(),
+		Genre:  tag.Genre(),
+		URL:    sourceURL(tag),
+		Track:  tag.GetTextFrame("TRCK").Text,
 	}
-	return nil
+	for _, f := range tag.GetFrames("TXXX") {
+		if u, ok := f.(id3v2.UserDefinedTextFrame); ok && u.Description == "description" {
+			t.Description = u.Value
+		}
+	}
+	if year := tag.GetTextFrame("TYER").Text; len(year) == 4 {
+		t.UploadDate = year
+		if date := tag.GetTextFrame("TDAT").Text; len(date) == 4 {
+			t.UploadDate += date[2:] + date[:2]
+		}
+	} else if tdrc := tag.GetTextFrame("TDRC").Text; len(tdrc) >= 4 {
+		t.UploadDate = strings.ReplaceAll(tdrc[:min(len(tdrc), 10)], "-", "")
+	}
+	if ms, err := strconv.ParseInt(tag.GetTextFrame("TLEN").Text, 10, 64); err == nil && ms > 0 {
+		t.Duration = time.Duration(ms) * time.Millisecond
+	}
+	return t
 }
 
 // isWithinDir reports whether target is the base directory itself or nested
@@ -162,116 +340,164 @@ func isWithinDir(base, target string) bool {
 }
 
 var rootCmd = &cobra.Command{
-	Use:     "yt2mp3 [URL]",
+	Use:     "yt2mp3 URL...",
 	Short:   "Download YouTube video and convert to MP3",
 	Version: Version,
-	Args:    cobra.ExactArgs(1),
+	Args:    cobra.MinimumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		url := args[0]
-
-		// Create a temporary directory
-		tempDir, err := os.MkdirTemp("", "yt2mp3")
+		printer, err := newResultPrinter(outputFormat, cmd.OutOrStdout())
 		if err != nil {
-			return fmt.Errorf("failed to create temp directory: %v", err)
+			return err
 		}
-		defer os.RemoveAll(tempDir)
+		// Human-readable progress always goes to stderr so stdout only
+		// carries results.
+		log := cmd.ErrOrStderr()
 
-		// Extract yt-dlp binary
-		if err := extractYtDlp(binaries, tempDir); err != nil {
+		settings, sources, err := loadSettings(cmd)
+		if err != nil {
 			return err
 		}
 
 		// If output directory is specified, check and create it
-		if outputDir != "" {
-			if err := prepareOutputDir(outputDir); err != nil {
+		if settings.OutputDir != "" {
+			if err := ensureOutputDir(settings.OutputDir, sources["output_dir"]); err != nil {
 				return err
 			}
 		}
 
-		// Download audio using yt-dlp
-		fmt.Println("Downloading audio...")
-		ytdlCmd := exec.Command(filepath.Join(tempDir, "yt-dlp"),
-			"--extract-audio",
-			"--audio-format", "mp3",
-			"--audio-quality", "0",
-			"--output", filepath.Join(tempDir, "%(title)s.%(ext)s"),
-			url,
-		)
-		if output, err := ytdlCmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("failed to download audio: %v\nOutput: %s", err, output)
+		ctx := cmd.Context()
+		albumFlag := cmd.Flags().Lookup("album-mode")
+		albums := slices.ContainsFunc(args, func(u string) bool { return useAlbumMode(u, albumFlag) })
+		// A running daemon already has yt-dlp extracted; let it do the work.
+		// Albums are tagged here, since their tags depend on the whole
+		// batch.
+		if !noDaemon && !albums {
+			if c, ok := findDaemon(); ok {
+				fmt.Fprintf(log, "Handing off to the yt2mp3 daemon at %s\n", c.path)
+				process, err := c.batch(ctx, args, settings, log)
+				if err != nil {
+					return err
+				}
+				return runBatch(ctx, args, process, printer, log)
+			}
 		}
 
-		// Find the downloaded MP3 file.
-		downloadedName, err := findDownloadedMP3(tempDir)
+		// Create a temporary directory
+		tempDir, err := os.MkdirTemp("", "yt2mp3")
 		if err != nil {
-			return err
-		}
-
-		// Use the downloaded file
-		downloadedFile := filepath.Join(tempDir, downloadedName)
-		targetName := sanitizeFilename(downloadedName)
-		targetFile := targetName
-		if outputDir != "" {
-			targetFile = filepath.Join(outputDir, targetName)
+			return fmt.Errorf("failed to create temp directory: %v", err)
 		}
+		defer os.RemoveAll(tempDir)
 
-		// Write ID3 tags (title without directory or extension)
-		title := strings.TrimSuffix(targetName, filepath.Ext(targetName))
-		if err := writeID3Tags(downloadedFile, title, url); err != nil {
+		// Extract yt-dlp binary
+		ytdl, err := newYtDlp(tempDir)
+		if err != nil {
 			return err
 		}
-
-		// Move file to current directory
-		if err := os.Rename(downloadedFile, targetFile); err != nil {
-			return fmt.Errorf("failed to move file: %v", err)
+		d := retryingDownloader{downloader: ytdl, policy: newRetryPolicy(retries, retryMaxWait), log: log}
+		if !albums {
+			return runBatch(ctx, args, func(ctx context.Context, i int) (*Result, error) {
+				return processURL(ctx, d, args[i], settings, log, nil)
+			}, printer, log)
 		}
 
-		fmt.Printf("Successfully downloaded and converted to: %s\n", targetFile)
-		return nil
+		if settings.AudioFormat != "mp3" {
+			fmt.Fprintf(log, "Warning: album mode only tags MP3 files; %s files are tagged by yt-dlp\n", settings.AudioFormat)
+		}
+		lister := retryingLister{playlistLister: ytdl, policy: newRetryPolicy(retries, retryMaxWait), log: log}
+		fetcher := retryingFetcher{infoFetcher: ytdl, policy: newRetryPolicy(retries, retryMaxWait), log: log}
+		items := expandAlbums(ctx, lister, fetcher, http.DefaultClient, args, albumFlag, log)
+		return runBatch(ctx, batchURLs(items), func(ctx context.Context, i int) (*Result, error) {
+			return processBatchItem(ctx, d, items[i], settings, log)
+		}, printer, log)
 	},
 }
 
-func init() {
-	rootCmd.Flags().StringVarP(&outputDir, "output-dir", "o", "", "Output directory to specify")
-}
-
-func main() {
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+// runBatch processes urls in order with process, which is given the index
+// of the URL, and prints each result. It summarizes the failures into one
+// error whose class decides the exit code.
+func runBatch(ctx context.Context, urls []string, process func(ctx context.Context, i int) (*Result, error), printer *resultPrinter, log io.Writer) error {
+	var firstErr error
+	failed, processed := 0, 0
+	for i, url := range urls {
+		if ctx.Err() != nil {
+			break
+		}
+		processed++
+		res, err := process(ctx, i)
+		if err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+			if len(urls) > 1 {
+				fmt.Fprintf(log, "Failed to process %s: %v\n", url, err)
+			}
+		}
+		if err := printer.add(res); err != nil {
+			return err
+		}
 	}
-}
-
-// fixID3Version opens the MP3 file and changes the tag version from ID3v2.4 to ID3v2.3 if needed.
-func fixID3Version(filename string) error {
-	f, err := os.OpenFile(filename, os.O_RDWR, 0644)
-	if err != nil {
+	if err := printer.close(); err != nil {
 		return err
 	}
-	defer f.Close()
 
-	header := make([]byte, 10)
-	if _, err := io.ReadFull(f, header); err != nil {
-		return fmt.Errorf("failed to read header: %w", err)
+	if ctx.Err() != nil {
+		return classify(ErrInterrupted, fmt.Errorf("interrupted after %d of %d URLs", processed, len(urls)))
 	}
+	return batchError(failed, len(urls), firstErr, "downloads")
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVarP(&outputDir, "output-dir", "o", "", "Output directory to specify")
+	rootCmd.Flags().StringVar(&outputFormat, "output-format", formatText, "Result format on stdout: text, json or jsonl")
+	rootCmd.Flags().BoolVar(&albumMode, "album-mode", false, "Download playlists as albums with shared tags and track numbers (default for YouTube Music albums)")
+}
 
-	if string(header[0:3]) != "ID3" {
-		// No ID3 tag present, nothing to fix
-		return nil
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := rootCmd.ExecuteContext(ctx)
+	stop()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitCode(err))
 	}
+}
 
-	// If version is 2.4 (0x04), change it to 2.3 (0x03)
-	if header[3] == 4 {
-		header[3] = 3
-		_, err = f.Seek(0, 0)
-		if err != nil {
-			return err
+// saveID3Tag writes tag back to its file as ID3v2.3, the newest version
+// QuickTime reads. Frames that v2.4 added are converted and UTF-8 text,
+// which v2.3 does not allow, is re-encoded as UTF-16.
+func saveID3Tag(tag *id3v2.Tag) error {
+	if tag.Version() == 4 {
+		if tdrc := tag.GetTextFrame("TDRC").Text; len(tdrc) >= 4 && tag.GetTextFrame("TYER").Text == "" {
+			tag.AddTextFrame("TYER", id3v2.EncodingISO, tdrc[:4])
 		}
-		_, err = f.Write(header)
-		if err != nil {
-			return err
+		tag.DeleteFrames("TDRC")
+	}
+	tag.SetVersion(3)
+	tag.SetDefaultEncoding(id3v2.EncodingUTF16)
+	for id, frames := range tag.AllFrames() {
+		for _, f := range frames {
+			switch f := f.(type) {
+			case id3v2.TextFrame:
+				if f.Encoding.Equals(id3v2.EncodingUTF8) {
+					tag.AddTextFrame(id, id3v2.EncodingUTF16, f.Text)
+				}
+			case id3v2.CommentFrame:
+				if f.Encoding.Equals(id3v2.EncodingUTF8) {
+					f.Encoding = id3v2.EncodingUTF16
+					tag.AddCommentFrame(f)
+				}
+			case id3v2.UserDefinedTextFrame:
+				if f.Encoding.Equals(id3v2.EncodingUTF8) {
+					f.Encoding = id3v2.EncodingUTF16
+					tag.AddUserDefinedTextFrame(f)
+				}
+			}
 		}
 	}
-
+	if err := tag.Save(); err != nil {
+		return fmt.Errorf("failed to save ID3 tags: %v", err)
+	}
 	return nil
 }
@@ -220,15 +220,15 @@ func TestExtractYtDlpWriteError(t *testing.T) {
 	}
 }
 
-func TestFindDownloadedMP3(t *testing.T) {
+func TestFindDownloadedAudio(t *testing.T) {
 	t.Run("selects mp3 alongside the yt-dlp binary", func(t *testing.T) {
 		dir := t.TempDir()
 		// The binary sorts before the mp3 alphabetically, so a naive files[0]
-		// would pick it; findDownloadedMP3 must skip it.
+		// would pick it; findDownloadedAudio must skip it.
 		mustWrite(t, filepath.Join(dir, "yt-dlp"), "binary")
 		mustWrite(t, filepath.Join(dir, "song.mp3"), "audio")
 
-		name, err := findDownloadedMP3(dir)
+		name, err := findDownloadedAudio(dir, ".mp3")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -240,7 +240,7 @@ func TestFindDownloadedMP3(t *testing.T) {
 	t.Run("uppercase extension is matched", func(t *testing.T) {
 		dir := t.TempDir()
 		mustWrite(t, filepath.Join(dir, "SONG.MP3"), "audio")
-		name, err := findDownloadedMP3(dir)
+		name, err := findDownloadedAudio(dir, ".mp3")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -252,13 +252,13 @@ func TestFindDownloadedMP3(t *testing.T) {
 	t.Run("no mp3 present", func(t *testing.T) {
 		dir := t.TempDir()
 		mustWrite(t, filepath.Join(dir, "yt-dlp"), "binary")
-		if _, err := findDownloadedMP3(dir); err == nil {
+		if _, err := findDownloadedAudio(dir, ".mp3"); err == nil {
 			t.Fatal("expected an error when no mp3 is present")
 		}
 	})
 
 	t.Run("unreadable directory", func(t *testing.T) {
-		if _, err := findDownloadedMP3(filepath.Join(t.TempDir(), "does-not-exist")); err == nil {
+		if _, err := findDownloadedAudio(filepath.Join(t.TempDir(), "does-not-exist"), ".mp3"); err == nil {
 			t.Fatal("expected an error for a nonexistent directory")
 		}
 	})
@@ -269,7 +269,7 @@ func TestWriteID3Tags(t *testing.T) {
 		path := filepath.Join(t.TempDir(), "song.mp3")
 		mustWrite(t, path, "")
 
-		if err := writeID3Tags(path, "My Title", "https://youtu.be/abc"); err != nil {
+		if err := writeID3Tags(path, trackTags{Title: "My Title", Album: "YouTube", URL: "https://youtu.be/abc"}, nil); err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
 
@@ -293,10 +293,48 @@ func TestWriteID3Tags(t *testing.T) {
 		if tag.Title() != "My Title" {
 			t.Errorf("title = %q, want %q", tag.Title(), "My Title")
 		}
+		if got := sourceURL(tag); got != "https://youtu.be/abc" {
+			t.Errorf("source URL = %q, want %q", got, "https://youtu.be/abc")
+		}
+	})
+
+	t.Run("round-trips video metadata", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "song.mp3")
+		mustWrite(t, path, "")
+		want := trackTags{
+			Title:       "講義 第1回",
+			Artist:      "大学チャンネル",
+			Album:       "YouTube",
+			URL:         "https://youtu.be/abc",
+			Description: strings.Repeat("この講義では線形代数を扱います。", 20),
+			UploadDate:  "20240315",
+			Duration:    61 * time.Minute,
+		}
+		if err := writeID3Tags(path, want, nil); err != nil {
+			t.Fatal(err)
+		}
+		tag, err := id3v2.Open(path, id3v2.Options{Parse: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tag.Close()
+		if tag.Version() != 3 {
+			t.Errorf("version = %d, want 3", tag.Version())
+		}
+		if got := readTrackTags(tag); got != want {
+			t.Errorf("readTrackTags() = %+v, want %+v", got, want)
+		}
+		for id, frames := range tag.AllFrames() {
+			for _, f := range frames {
+				if tf, ok := f.(id3v2.TextFrame); ok && tf.Encoding.Equals(id3v2.EncodingUTF8) {
+					t.Errorf("%s is UTF-8, which ID3v2.3 does not allow", id)
+				}
+			}
+		}
 	})
 
 	t.Run("error opening a nonexistent file", func(t *testing.T) {
-		err := writeID3Tags(filepath.Join(t.TempDir(), "missing.mp3"), "t", "u")
+		err := writeID3Tags(filepath.Join(t.TempDir(), "missing.mp3"), trackTags{Title: "t", URL: "u"}, nil)
 		if err == nil {
 			t.Fatal("expected an error for a nonexistent file")
 		}
@@ -379,7 +417,13 @@ func TestRootCmd(t *testing.T) {
 		{
 			name:        "Multiple arguments",
 			args:        []string{"url1", "url2"},
-			shouldError: true,
+			shouldError: false,
+			mockRunE: func(cmd *cobra.Command, args []string) error {
+				if len(args) != 2 {
+					return fmt.Errorf("expected 2 URLs, got %d", len(args))
+				}
+				return nil
+			},
 		},
 		{
 			name:        "Invalid URL",
@@ -579,92 +623,40 @@ func TestExtractYtDlp(t *testing.T) {
 	}
 }
 
-func TestFixID3Version(t *testing.T) {
-	tests := []struct {
-		name        string
-		setup       func(t *testing.T) string
-		shouldError bool
-	}{
-		{
-			name: "Convert ID3v2.4 to v2.3",
-			setup: func(t *testing.T) string {
-				tmpFile := filepath.Join(t.TempDir(), "test.mp3")
-				header := []byte("ID3\x04\x00\x00\x00\x00\x00\x00") // ID3v2.4 header
-				if err := os.WriteFile(tmpFile, header, 0644); err != nil {
-					t.Fatal(err)
-				}
-				return tmpFile
-			},
-			shouldError: false,
-		},
-		{
-			name: "File without ID3 tag",
-			setup: func(t *testing.T) string {
-				tmpFile := filepath.Join(t.TempDir(), "test.mp3")
-				if err := os.WriteFile(tmpFile, []byte("not an ID3 file"), 0644); err != nil {
-					t.Fatal(err)
-				}
-				return tmpFile
-			},
-			shouldError: false,
-		},
-		{
-			name: "Nonexistent file",
-			setup: func(t *testing.T) string {
-				return filepath.Join(t.TempDir(), "nonexistent.mp3")
-			},
-			shouldError: true,
-		},
-		{
-			name: "Read-only file",
-			setup: func(t *testing.T) string {
-				if os.Geteuid() == 0 {
-					t.Skip("running as root bypasses file permission checks")
-				}
-				tmpFile := filepath.Join(t.TempDir(), "readonly.mp3")
-				header := []byte("ID3\x04\x00\x00\x00\x00\x00\x00")
-				if err := os.WriteFile(tmpFile, header, 0444); err != nil {
-					t.Fatal(err)
-				}
-				return tmpFile
-			},
-			shouldError: true,
-		},
-		{
-			name: "Corrupt ID3 header",
-			setup: func(t *testing.T) string {
-				tmpFile := filepath.Join(t.TempDir(), "corrupt.mp3")
-				header := []byte("ID3") // incomplete header
-				if err := os.WriteFile(tmpFile, header, 0644); err != nil {
-					t.Fatal(err)
-				}
-				return tmpFile
-			},
-			shouldError: true,
-		},
+func TestSaveID3Tag(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.mp3")
+	mustWrite(t, path, "audio frames")
+	tag, err := id3v2.Open(path, id3v2.Options{Parse: true})
+	if err != nil {
+		t.Fatal(err)
 	}
+	tag.SetVersion(4)
+	tag.AddTextFrame("TIT2", id3v2.EncodingUTF8, "講義")
+	tag.AddTextFrame("TDRC", id3v2.EncodingUTF8, "2024-01-02")
+	if err := saveID3Tag(tag); err != nil {
+		t.Fatal(err)
+	}
+	tag.Close()
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			path := tt.setup(t)
-			err := fixID3Version(path)
-			if (err != nil) != tt.shouldError {
-				t.Errorf("fixID3Version() error = %v, shouldError %v", err, tt.shouldError)
-			}
-
-			if !tt.shouldError && err == nil {
-				// On success, verify the file contents
-				data, err := os.ReadFile(path)
-				if err != nil {
-					t.Fatal(err)
-				}
-
-				if len(data) >= 3 && string(data[0:3]) == "ID3" {
-					if len(data) >= 4 && data[3] == 4 {
-						t.Error("ID3 version was not changed from 2.4")
-					}
-				}
-			}
-		})
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data[:3]) != "ID3" || data[3] != 3 {
+		t.Fatalf("header = %q, want ID3v2.3", data[:4])
+	}
+	tag, err = id3v2.Open(path, id3v2.Options{Parse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tag.Close()
+	if f := tag.GetTextFrame("TIT2"); f.Text != "講義" || !f.Encoding.Equals(id3v2.EncodingUTF16) {
+		t.Errorf("TIT2 = %q in %v, want UTF-16", f.Text, f.Encoding)
+	}
+	if got := tag.GetTextFrame("TYER").Text; got != "2024" {
+		t.Errorf("TYER = %q, want 2024", got)
+	}
+	if len(tag.GetFrames("TDRC")) != 0 {
+		t.Error("the v2.4 TDRC frame was kept")
 	}
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// downloadDurationBuckets are the upper bounds, in seconds, of the download
+// duration histogram.
+var downloadDurationBuckets = []float64{1, 2, 5, 10, 30, 60, 120, 300, 600, 1800}
+
+// metrics collects server statistics and renders them in the Prometheus
+// text exposition format. A nil *metrics records nothing.
+type metrics struct {
+	ytDlpVersion string
+
+	mu              sync.Mutex
+	started         uint64
+	succeeded       uint64
+	canceled        uint64
+	failed          map[string]uint64
+	bytesWritten    uint64
+	downloadCounts  []uint64
+	downloadSum     float64
+	downloadSamples uint64
+}
+
+// newMetrics returns empty metrics for a server using the given yt-dlp
+// version.
+func newMetrics(ytDlpVersion string) *metrics {
+	return &metrics{
+		ytDlpVersion:   ytDlpVersion,
+		failed:         make(map[string]uint64),
+		downloadCounts: make([]uint64, len(downloadDurationBuckets)),
+	}
+}
+
+// jobStarted counts a job picked up by a worker.
+func (m *metrics) jobStarted() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.started++
+	m.mu.Unlock()
+}
+
+// jobSucceeded counts a finished job and the size of the file it wrote.
+func (m *metrics) jobSucceeded(size int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.succeeded++
+	m.bytesWritten += uint64(max(size, 0))
+	m.mu.Unlock()
+}
+
+// jobFailed counts a failed job under its error code.
+func (m *metrics) jobFailed(code string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.failed[code]++
+	m.mu.Unlock()
+}
+
+// jobCanceled counts a job canceled through the API.
+func (m *metrics) jobCanceled() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.canceled++
+	m.mu.Unlock()
+}
+
+// observeDownload records how long one download took.
+func (m *metrics) observeDownload(d time.Duration) {
+	if m == nil {
+		return
+	}
+	secs := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.downloadSum += secs
+	m.downloadSamples++
+	for i, le := range downloadDurationBuckets {
+		if secs <= le {
+			m.downloadCounts[i]++
+			break
+		}
+	}
+}
+
+// write renders the metrics along with the current queue state.
+func (m *metrics) write(w io.Writer, queued, running int) {
+	if m == nil {
+		m = newMetrics("")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	metric("yt2mp3_jobs_started_total", "counter", "Jobs picked up by a worker.")
+	fmt.Fprintf(w, "yt2mp3_jobs_started_total %d\n", m.started)
+	metric("yt2mp3_jobs_succeeded_total", "counter", "Jobs that finished successfully.")
+	fmt.Fprintf(w, "yt2mp3_jobs_succeeded_total %d\n", m.succeeded)
+	metric("yt2mp3_jobs_failed_total", "counter", "Jobs that failed, by error class.")
+	codes := make([]string, 0, len(m.failed))
+	for code := range m.failed {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "yt2mp3_jobs_failed_total{error_class=\"%s\"} %d\n", escapeLabel(code), m.failed[code])
+	}
+	metric("yt2mp3_jobs_canceled_total", "counter", "Jobs canceled through the API.")
+	fmt.Fprintf(w, "yt2mp3_jobs_canceled_total %d\n", m.canceled)
+
+	metric("yt2mp3_download_duration_seconds", "histogram", "Time spent downloading and converting with yt-dlp, including retries.")
+	var cumulative uint64
+	for i, le := range downloadDurationBuckets {
+		cumulative += m.downloadCounts[i]
+		fmt.Fprintf(w, "yt2mp3_download_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "yt2mp3_download_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.downloadSamples)
+	fmt.Fprintf(w, "yt2mp3_download_duration_seconds_sum %s\n", strconv.FormatFloat(m.downloadSum, 'g', -1, 64))
+	fmt.Fprintf(w, "yt2mp3_download_duration_seconds_count %d\n", m.downloadSamples)
+
+	metric("yt2mp3_bytes_written_total", "counter", "Bytes of audio written to the output directory.")
+	fmt.Fprintf(w, "yt2mp3_bytes_written_total %d\n", m.bytesWritten)
+	metric("yt2mp3_queue_depth", "gauge", "Jobs waiting for a worker.")
+	fmt.Fprintf(w, "yt2mp3_queue_depth %d\n", queued)
+	metric("yt2mp3_jobs_running", "gauge", "Jobs being processed.")
+	fmt.Fprintf(w, "yt2mp3_jobs_running %d\n", running)
+	metric("yt2mp3_build_info", "gauge", "Version of yt2mp3 and of the embedded yt-dlp.")
+	fmt.Fprintf(w, "yt2mp3_build_info{version=\"%s\",ytdlp_version=\"%s\"} 1\n", escapeLabel(Version), escapeLabel(m.ytDlpVersion))
+}
+
+// escapeLabel escapes a Prometheus label value.
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// meteredDownloader records the duration of every download in metrics.
+type meteredDownloader struct {
+	downloader
+	metrics *metrics
+}
+
+func (d meteredDownloader) Download(ctx context.Context, url, dir string, s Settings, progress func(percent float64)) error {
+	start := time.Now()
+	err := d.downloader.Download(ctx, url, dir, s, progress)
+	d.metrics.observeDownload(time.Since(start))
+	return err
+}
+
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	queued, running := s.jobs.Counts()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.metrics.write(w, queued, running)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	m := newMetrics("2025.01.01")
+	m.jobStarted()
+	m.jobStarted()
+	m.jobStarted()
+	m.jobSucceeded(1000)
+	m.jobFailed("geo_blocked")
+	m.jobFailed("geo_blocked")
+	m.jobCanceled()
+	m.observeDownload(500 * time.Millisecond)
+	m.observeDownload(3 * time.Second)
+	m.observeDownload(time.Hour)
+
+	var buf bytes.Buffer
+	m.write(&buf, 4, 1)
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE yt2mp3_jobs_started_total counter\nyt2mp3_jobs_started_total 3\n",
+		"yt2mp3_jobs_succeeded_total 1\n",
+		`yt2mp3_jobs_failed_total{error_class="geo_blocked"} 2` + "\n",
+		"yt2mp3_jobs_canceled_total 1\n",
+		`yt2mp3_download_duration_seconds_bucket{le="1"} 1` + "\n",
+		`yt2mp3_download_duration_seconds_bucket{le="5"} 2` + "\n",
+		`yt2mp3_download_duration_seconds_bucket{le="1800"} 2` + "\n",
+		`yt2mp3_download_duration_seconds_bucket{le="+Inf"} 3` + "\n",
+		"yt2mp3_download_duration_seconds_sum 3603.5\n",
+		"yt2mp3_download_duration_seconds_count 3\n",
+		"yt2mp3_bytes_written_total 1000\n",
+		"yt2mp3_queue_depth 4\n",
+		"yt2mp3_jobs_running 1\n",
+		`ytdlp_version="2025.01.01"} 1` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestMetricsNil(t *testing.T) {
+	var m *metrics
+	m.jobStarted()
+	m.jobFailed("unknown")
+	m.observeDownload(time.Second)
+	var buf bytes.Buffer
+	m.write(&buf, 0, 0)
+	if !strings.Contains(buf.String(), "yt2mp3_jobs_started_total 0\n") {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	if got := escapeLabel("a\"b\\c\nd"); got != `a\"b\\c\nd` {
+		t.Errorf("escapeLabel = %s", got)
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	stats := newMetrics("test")
+	d := meteredDownloader{downloader: &fakeDownloader{}, metrics: stats}
+	ctx, cancel := context.WithCancel(context.Background())
+	jobs, err := newJobManager(ctx, d, newJobResolver(&Config{}, nil, "", t.TempDir()), jobManagerOptions{Workers: 1, QueueSize: 10, Metrics: stats})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer((&server{jobs: jobs, metrics: stats}).routes())
+	defer func() {
+		ts.Close()
+		cancel()
+		jobs.Wait()
+	}()
+
+	job, err := jobs.Submit(JobRequest{URL: "https://youtu.be/x"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, ts.URL, job.ID, jobDone)
+
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	for _, want := range []string{
+		"yt2mp3_jobs_started_total 1\n",
+		"yt2mp3_jobs_succeeded_total 1\n",
+		"yt2mp3_download_duration_seconds_count 1\n",
+		"yt2mp3_queue_depth 0\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+	if strings.Contains(string(body), "yt2mp3_bytes_written_total 0\n") {
+		t.Error("bytes written were not counted")
+	}
+}
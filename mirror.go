@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bogem/id3v2"
+)
+
+// localTrack is an MP3 file in a subscription's output directory.
+type localTrack struct {
+	Path    string
+	VideoID string
+	Track   string
+	Title   string
+	// Duration is zero when the tags do not record it.
+	Duration time.Duration
+}
+
+// videoIDFromURL returns the YouTube video ID in a watch, youtu.be, shorts
+// or live URL, or "" if there is none.
+func videoIDFromURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	if v := u.Query().Get("v"); v != "" {
+		return v
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	switch {
+	case strings.TrimPrefix(u.Hostname(), "www.") == "youtu.be" && len(segments) == 1:
+		return segments[0]
+	case len(segments) == 2 && (segments[0] == "shorts" || segments[0] == "live" || segments[0] == "embed"):
+		return segments[1]
+	}
+	return ""
+}
+
+// sourceURLFrame returns the comment frame that records the URL a file was
+// downloaded from.
+func sourceURLFrame(url string) id3v2.CommentFrame {
+	return id3v2.CommentFrame{
+		Encoding:    id3v2.EncodingISO,
+		Language:    "eng",
+		Description: "YouTube URL",
+		Text:        url,
+	}
+}
+
+// sourceURL returns the URL that writeID3Tags stored in the comment frame.
+func sourceURL(tag *id3v2.Tag) string {
+	for _, f := range tag.GetFrames(tag.CommonID("Comments")) {
+		if c, ok := f.(id3v2.CommentFrame); ok && c.Description == "YouTube URL" {
+			return c.Text
+		}
+	}
+	return ""
+}
+
+// readTracks returns the MP3 files directly in dir with what their tags
+// say about them. Files whose tags cannot be read are skipped with a
+// warning to log.
+func readTracks(dir string, log io.Writer) ([]localTrack, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.mp3"))
+	if err != nil {
+		return nil, err
+	}
+	tracks := make([]localTrack, 0, len(matches))
+	for _, path := range matches {
+		st, err := readStoredTag(path)
+		if err != nil {
+			fmt.Fprintf(log, "Warning: skipping %s: %v\n", filepath.Base(path), err)
+			continue
+		}
+		tracks = append(tracks, localTrack{
+			Path:     path,
+			VideoID:  videoIDFromURL(st.Tags.URL),
+			Track:    st.Tags.Track,
+			Title:    st.Tags.Title,
+			Duration: st.Tags.Duration,
+		})
+	}
+	return tracks, nil
+}
+
+// readLocalTracks returns the MP3 files directly in dir whose tags name the
+// video they were downloaded from. Other files are left out, so mirroring
+// never touches files that yt2mp3 did not write.
+func readLocalTracks(dir string, log io.Writer) ([]localTrack, error) {
+	tracks, err := readTracks(dir, log)
+	if err != nil {
+		return nil, err
+	}
+	var tagged []localTrack
+	for _, t := range tracks {
+		if t.VideoID != "" {
+			tagged = append(tagged, t)
+		}
+	}
+	return tagged, nil
+}
+
+// trackRenumbering is a new track number for a file.
+type trackRenumbering struct {
+	Path  string
+	Track string
+}
+
+// mirrorPlan lists the changes that make a directory match a playlist.
+type mirrorPlan struct {
+	Remove   []localTrack
+	Renumber []trackRenumbering
+}
+
+// planMirror finds the tracks whose video left the playlist and the track
+// numbers, as "position/total", that follow the playlist order.
+func planMirror(entries []playlistEntry, tracks []localTrack) mirrorPlan {
+	position := playlistPositions(entries)
+	var plan mirrorPlan
+	for _, t := range tracks {
+		pos, ok := position[t.VideoID]
+		if !ok {
+			plan.Remove = append(plan.Remove, t)
+			continue
+		}
+		if track := fmt.Sprintf("%d/%d", pos, len(entries)); track != t.Track {
+			plan.Renumber = append(plan.Renumber, trackRenumbering{Path: t.Path, Track: track})
+		}
+	}
+	sort.Slice(plan.Renumber, func(i, j int) bool { return plan.Renumber[i].Path < plan.Renumber[j].Path })
+	return plan
+}
+
+// print describes the plan, one line per change.
+func (p mirrorPlan) print(w io.Writer, prefix string) {
+	for _, t := range p.Remove {
+		fmt.Fprintf(w, "%sremove %s (%s is no longer in the playlist)\n", prefix, t.Path, t.VideoID)
+	}
+	for _, r := range p.Renumber {
+		fmt.Fprintf(w, "%srenumber %s to track %s\n", prefix, r.Path, r.Track)
+	}
+}
+
+// apply carries out the plan. Removed files are moved into trashDir, or
+// deleted if trashDir is empty.
+func (p mirrorPlan) apply(trashDir string) error {
+	for _, t := range p.Remove {
+		if trashDir == "" {
+			if err := os.Remove(t.Path); err != nil {
+				return fmt.Errorf("failed to remove %s: %v", t.Path, err)
+			}
+			continue
+		}
+		if _, err := moveAside(t.Path, trashDir); err != nil {
+			return fmt.Errorf("failed to move %s to %s: %v", t.Path, trashDir, err)
+		}
+	}
+	for _, r := range p.Renumber {
+		if err := setTrackNumber(r.Path, r.Track); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setTrackNumber rewrites the TRCK frame of the MP3 file at path.
+func setTrackNumber(path, track string) error {
+	tag, err := openID3Tag(path)
+	if err != nil {
+		return err
+	}
+	defer tag.Close()
+	tag.AddTextFrame("TRCK", id3v2.EncodingISO, track)
+	return saveID3Tag(tag)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVideoIDFromURL(t *testing.T) {
+	tests := map[string]string{
+		"https://www.youtube.com/watch?v=abc123&list=PL1": "abc123",
+		"https://youtu.be/abc123?t=10":                    "abc123",
+		"https://www.youtube.com/shorts/abc123":           "abc123",
+		"https://www.youtube.com/live/abc123":             "abc123",
+		"https://www.youtube.com/@channel":                "",
+		"not a url %":                                     "",
+	}
+	for raw, want := range tests {
+		if got := videoIDFromURL(raw); got != want {
+			t.Errorf("videoIDFromURL(%q) = %q, want %q", raw, got, want)
+		}
+	}
+}
+
+func TestPlanMirror(t *testing.T) {
+	entries := []playlistEntry{{ID: "c"}, {ID: "a"}, {ID: "d"}}
+	tracks := []localTrack{
+		{Path: "a.mp3", VideoID: "a", Track: "1/3"},
+		{Path: "b.mp3", VideoID: "b", Track: "2/3"},
+		{Path: "c.mp3", VideoID: "c", Track: "1/3"},
+	}
+	plan := planMirror(entries, tracks)
+	want := mirrorPlan{
+		Remove:   []localTrack{{Path: "b.mp3", VideoID: "b", Track: "2/3"}},
+		Renumber: []trackRenumbering{{Path: "a.mp3", Track: "2/3"}},
+	}
+	if !reflect.DeepEqual(plan, want) {
+		t.Errorf("planMirror() = %+v, want %+v", plan, want)
+	}
+}
+
+func TestSyncMirror(t *testing.T) {
+	const url = "https://www.youtube.com/playlist?list=PL1"
+	entry := func(id, title string) playlistEntry {
+		return playlistEntry{ID: id, URL: "https://www.youtube.com/watch?v=" + id, Title: title}
+	}
+	lister := fakeLister{url: {Entries: []playlistEntry{entry("a", "First"), entry("b", "Second"), entry("c", "Third")}}}
+	d := &fakeDownloader{info: map[string]videoInfo{
+		"https://www.youtube.com/watch?v=a": {ID: "a", Title: "First"},
+		"https://www.youtube.com/watch?v=b": {ID: "b", Title: "Second"},
+		"https://www.youtube.com/watch?v=c": {ID: "c", Title: "Third"},
+	}}
+	base := t.TempDir()
+	var stdout bytes.Buffer
+	s := &syncer{
+		lister: lister,
+		d:      d,
+		out:    &stdout,
+		log:    &bytes.Buffer{},
+		settings: func(string) (Settings, map[string]string, error) {
+			st := builtinSettings()
+			st.OutputDir = base
+			return st, map[string]string{}, nil
+		},
+		mirror: true,
+	}
+	sub := Subscription{Name: "mix", URL: url, Archive: filepath.Join(base, "archive.txt")}
+	dir := filepath.Join(base, "mix")
+	// A file yt2mp3 did not write is never touched.
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "mine.mp3"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := s.syncOne(ctx, sub); err != nil {
+		t.Fatal(err)
+	}
+	tracks, err := readLocalTracks(dir, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numbers := map[string]string{}
+	for _, tr := range tracks {
+		numbers[tr.VideoID] = tr.Track
+	}
+	if want := map[string]string{"a": "1/3", "b": "2/3", "c": "3/3"}; !reflect.DeepEqual(numbers, want) {
+		t.Errorf("track numbers after first sync = %v, want %v", numbers, want)
+	}
+
+	// "Second" leaves the playlist and "Third" moves to the top.
+	lister[url] = playlist{Entries: []playlistEntry{entry("c", "Third"), entry("a", "First")}}
+	s.dryRun = true
+	stdout.Reset()
+	if err := s.syncOne(ctx, sub); err != nil {
+		t.Fatal(err)
+	}
+	out := stdout.String()
+	for _, want := range []string{
+		"would remove " + filepath.Join(dir, "Second.mp3") + " (b is no longer in the playlist)",
+		"would renumber " + filepath.Join(dir, "First.mp3") + " to track 2/2",
+		"would renumber " + filepath.Join(dir, "Third.mp3") + " to track 1/2",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("dry run output %q lacks %q", out, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Second.mp3")); err != nil {
+		t.Errorf("dry run removed a file: %v", err)
+	}
+
+	s.dryRun = false
+	if err := s.syncOne(ctx, sub); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".trash", "Second.mp3")); err != nil {
+		t.Errorf("removed track is not in the trash: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "mine.mp3")); err != nil {
+		t.Errorf("untagged file was touched: %v", err)
+	}
+	tracks, err = readLocalTracks(dir, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numbers = map[string]string{}
+	for _, tr := range tracks {
+		numbers[tr.VideoID] = tr.Track
+	}
+	if want := map[string]string{"c": "1/2", "a": "2/2"}; !reflect.DeepEqual(numbers, want) {
+		t.Errorf("track numbers after mirror = %v, want %v", numbers, want)
+	}
+	m3u, err := os.ReadFile(filepath.Join(dir, "mix.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "#EXTM3U\n#PLAYLIST:mix\n#EXTINF:-1,Third\nThird.mp3\n#EXTINF:-1,First\nFirst.mp3\n#EXTINF:-1,mine\nmine.mp3\n"; string(m3u) != want {
+		t.Errorf("mix.m3u8 = %q, want %q", m3u, want)
+	}
+
+	// An empty listing never wipes the directory.
+	lister[url] = playlist{}
+	s.deleteRemoved = true
+	if err := s.syncOne(ctx, sub); err != nil {
+		t.Fatal(err)
+	}
+	if tracks, _ := readLocalTracks(dir, io.Discard); len(tracks) != 2 {
+		t.Errorf("tracks after empty listing = %+v", tracks)
+	}
+}
+
+func TestReadTracksSkipsUnreadableTags(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "plain.mp3"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The header announces more frame data than the file holds.
+	if err := os.WriteFile(filepath.Join(dir, "broken.mp3"), []byte("ID3\x04\x00\x00\x00\x00\x01\x00TIT2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var log bytes.Buffer
+	tracks, err := readTracks(dir, &log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 1 || filepath.Base(tracks[0].Path) != "plain.mp3" {
+		t.Errorf("tracks = %+v", tracks)
+	}
+	if !strings.Contains(log.String(), "Warning: skipping broken.mp3") {
+		t.Errorf("log = %q", log.String())
+	}
+}
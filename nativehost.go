@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// nativeHostName identifies the host in manifests and in
+	// runtime.connectNative calls from the extension.
+	nativeHostName = "com.github.taross_f.yt2mp3"
+	// nativeMaxMessage is the largest message a browser accepts from a
+	// native host.
+	nativeMaxMessage = 1 << 20
+	// nativeMaxRequest bounds the messages the host reads from the browser.
+	// Download requests are tiny; anything larger is a protocol error.
+	nativeMaxRequest = 1 << 20
+	// nativeQueueSize is the number of downloads that may wait for a worker.
+	nativeQueueSize = 100
+)
+
+// Native messaging message types.
+const (
+	nativeDownload = "download"
+	nativeCancel   = "cancel"
+	nativePing     = "ping"
+	nativePong     = "pong"
+	nativeJob      = "job"
+	nativeError    = "error"
+)
+
+var (
+	// Worker pool size option for native-host
+	nativeWorkers int
+	// Browser option for native-host install
+	nativeBrowserName string
+	// Extension IDs allowed to talk to the host
+	nativeExtensionIDs []string
+)
+
+// chromeExtensionIDRe matches the 32-letter IDs of Chromium extensions.
+var chromeExtensionIDRe = regexp.MustCompile(`^[a-p]{32}$`)
+
+// nativeRequest is a message from the extension. ID is chosen by the
+// extension and echoed in every reply about the request.
+type nativeRequest struct {
+	Type    string  `json:"type"`
+	ID      string  `json:"id,omitempty"`
+	URL     string  `json:"url,omitempty"`
+	Profile string  `json:"profile,omitempty"`
+	Options Profile `json:"options"`
+	JobID   string  `json:"job_id,omitempty"`
+}
+
+// nativeMessage is a message to the extension. A download produces a job
+// message for every change to its job until the job has finished.
+type nativeMessage struct {
+	Type      string `json:"type"`
+	ID        string `json:"id,omitempty"`
+	Job       *Job   `json:"job,omitempty"`
+	Error     string `json:"error,omitempty"`
+	ErrorCode string `json:"error_code,omitempty"`
+	Version   string `json:"version,omitempty"`
+}
+
+// readNativeMessage reads one message framed as a 32-bit length in native
+// byte order followed by that many bytes of JSON.
+func readNativeMessage(r io.Reader) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(r, binary.NativeEndian, &n); err != nil {
+		return nil, err
+	}
+	if n > nativeMaxRequest {
+		return nil, fmt.Errorf("message of %d bytes exceeds the limit of %d", n, nativeMaxRequest)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("failed to read message: %v", err)
+	}
+	return msg, nil
+}
+
+// writeNativeMessage encodes v as JSON and writes it with a length prefix.
+func writeNativeMessage(w io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(data) > nativeMaxMessage {
+		return fmt.Errorf("message of %d bytes exceeds the limit of %d", len(data), nativeMaxMessage)
+	}
+	buf := binary.NativeEndian.AppendUint32(make([]byte, 0, 4+len(data)), uint32(len(data)))
+	_, err = w.Write(append(buf, data...))
+	return err
+}
+
+// nativeHost serves one browser connection. Requests are handled on a
+// single goroutine, which is also the only one writing to the browser.
+type nativeHost struct {
+	jobs *jobManager
+	w    io.Writer
+	log  io.Writer
+	// pending maps the IDs of unfinished jobs to the extension's request IDs.
+	pending map[string]string
+}
+
+// run handles messages from r until the browser closes the connection,
+// then waits for the jobs it started before returning.
+func (h *nativeHost) run(ctx context.Context, r io.Reader) error {
+	h.pending = make(map[string]string)
+	sub := h.jobs.Subscribe()
+	defer h.jobs.Unsubscribe(sub)
+
+	msgs := make(chan []byte)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := readNativeMessage(r)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case msgs <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	closed := false
+	for !closed || len(h.pending) > 0 {
+		select {
+		case msg := <-msgs:
+			h.handle(msg)
+		case err := <-readErr:
+			if !errors.Is(err, io.EOF) {
+				return err
+			}
+			// The browser stops reading once it disconnects, and writing
+			// to the closed pipe would end the process, so from here on
+			// jobs only run to completion.
+			closed = true
+			if len(h.pending) > 0 {
+				fmt.Fprintf(h.log, "Browser disconnected; waiting for %d downloads to finish\n", len(h.pending))
+			}
+		case <-sub.C:
+			for _, job := range sub.Changes() {
+				id, ok := h.pending[job.ID]
+				if !ok {
+					continue
+				}
+				if job.finished() {
+					delete(h.pending, job.ID)
+				}
+				if !closed {
+					h.send(nativeMessage{Type: nativeJob, ID: id, Job: &job})
+				}
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
+
+// handle answers one request from the extension.
+func (h *nativeHost) handle(msg []byte) {
+	var req nativeRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		h.fail("", fmt.Errorf("invalid message: %v", err))
+		return
+	}
+	switch req.Type {
+	case nativePing:
+		h.send(nativeMessage{Type: nativePong, ID: req.ID, Version: Version})
+	case nativeDownload:
+		job, err := h.jobs.Submit(JobRequest{URL: req.URL, Profile: req.Profile, Options: req.Options}, nil)
+		if err != nil {
+			h.fail(req.ID, err)
+			return
+		}
+		// Progress, including the queued state, arrives through the
+		// subscription, so the reply order always follows the job.
+		h.pending[job.ID] = req.ID
+	case nativeCancel:
+		if _, ok := h.pending[req.JobID]; !ok {
+			h.fail(req.ID, errJobNotFound)
+			return
+		}
+		if _, err := h.jobs.Cancel(req.JobID); err != nil {
+			h.fail(req.ID, err)
+		}
+	default:
+		h.fail(req.ID, fmt.Errorf("unknown message type %q", req.Type))
+	}
+}
+
+// fail reports an error about the request with the given ID.
+func (h *nativeHost) fail(id string, err error) {
+	h.send(nativeMessage{Type: nativeError, ID: id, Error: err.Error(), ErrorCode: errorCode(err)})
+}
+
+func (h *nativeHost) send(msg nativeMessage) {
+	if err := writeNativeMessage(h.w, msg); err != nil {
+		fmt.Fprintf(h.log, "Failed to send message to the browser: %v\n", err)
+	}
+}
+
+// defaultNativeOutputDir is where downloads started from the browser go
+// when no output directory is configured, as the host's working directory
+// is chosen by the browser.
+func defaultNativeOutputDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate home directory: %v", err)
+	}
+	return filepath.Join(home, "Music"), nil
+}
+
+// nativeBrowser describes where a browser looks for native messaging hosts.
+type nativeBrowser struct {
+	// firefox browsers list extension IDs instead of origins.
+	firefox bool
+	// linux is the directory under the user config directory (or the home
+	// directory for Firefox) that holds NativeMessagingHosts.
+	linux string
+	// darwin is the directory under ~/Library/Application Support.
+	darwin string
+	// registry is the HKEY_CURRENT_USER key on Windows.
+	registry string
+}
+
+var nativeBrowsers = map[string]nativeBrowser{
+	"chrome":   {linux: "google-chrome", darwin: "Google/Chrome", registry: `Software\Google\Chrome`},
+	"chromium": {linux: "chromium", darwin: "Chromium", registry: `Software\Chromium`},
+	"edge":     {linux: "microsoft-edge", darwin: "Microsoft Edge", registry: `Software\Microsoft\Edge`},
+	"brave":    {linux: "BraveSoftware/Brave-Browser", darwin: "BraveSoftware/Brave-Browser", registry: `Software\BraveSoftware\Brave-Browser`},
+	"firefox":  {firefox: true, linux: ".mozilla", darwin: "Mozilla", registry: `Software\Mozilla`},
+}
+
+// nativeManifest is the host manifest read by the browser.
+type nativeManifest struct {
+	Name              string   `json:"name"`
+	Description       string   `json:"description"`
+	Path              string   `json:"path"`
+	Type              string   `json:"type"`
+	AllowedOrigins    []string `json:"allowed_origins,omitempty"`
+	AllowedExtensions []string `json:"allowed_extensions,omitempty"`
+}
+
+// nativeManifestDir returns the per-user directory in which browser looks
+// for manifests on goos. On Windows the location is free, as the manifest
+// is registered in the registry, so the yt2mp3 config directory is used.
+func nativeManifestDir(b nativeBrowser, browser, goos, home, configDir string) string {
+	switch {
+	case goos == "windows":
+		return filepath.Join(configDir, "yt2mp3", "NativeMessagingHosts", browser)
+	case goos == "darwin":
+		return filepath.Join(home, "Library", "Application Support", b.darwin, "NativeMessagingHosts")
+	case b.firefox:
+		return filepath.Join(home, b.linux, "native-messaging-hosts")
+	default:
+		return filepath.Join(configDir, b.linux, "NativeMessagingHosts")
+	}
+}
+
+// newNativeManifest returns the manifest that lets the extensions ids start
+// the launcher.
+func newNativeManifest(b nativeBrowser, launcher string, ids []string) (nativeManifest, error) {
+	m := nativeManifest{
+		Name:        nativeHostName,
+		Description: "yt2mp3 downloader",
+		Path:        launcher,
+		Type:        "stdio",
+	}
+	if len(ids) == 0 {
+		return m, errors.New("at least one --extension-id is required")
+	}
+	for _, id := range ids {
+		if b.firefox {
+			m.AllowedExtensions = append(m.AllowedExtensions, id)
+			continue
+		}
+		if !chromeExtensionIDRe.MatchString(id) {
+			return m, fmt.Errorf("invalid extension ID %q: expected 32 letters from a to p", id)
+		}
+		m.AllowedOrigins = append(m.AllowedOrigins, "chrome-extension://"+id+"/")
+	}
+	return m, nil
+}
+
+// nativeLauncher returns a script that starts exe as a native host. Browsers
+// start the manifest's path with their own arguments, such as the calling
+// extension's origin, which yt2mp3 would otherwise take for a URL.
+func nativeLauncher(goos, exe string) (name, script string) {
+	if goos == "windows" {
+		return "native-host.bat", fmt.Sprintf("@echo off\r\n\"%s\" native-host %%*\r\n", exe)
+	}
+	quoted := "'" + strings.ReplaceAll(exe, "'", `'\''`) + "'"
+	return "native-host.sh", fmt.Sprintf("#!/bin/sh\nexec %s native-host \"$@\"\n", quoted)
+}
+
+// installNativeHost writes the launcher for exe into the yt2mp3 config
+// directory and the manifest for browser where it looks for it, and
+// returns the manifest path.
+func installNativeHost(browser string, ids []string, exe, goos, home, configDir string) (string, error) {
+	b, ok := nativeBrowsers[browser]
+	if !ok {
+		names := make([]string, 0, len(nativeBrowsers))
+		for name := range nativeBrowsers {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return "", fmt.Errorf("unsupported browser %q (supported: %s)", browser, strings.Join(names, ", "))
+	}
+
+	appDir := filepath.Join(configDir, "yt2mp3")
+	name, script := nativeLauncher(goos, exe)
+	launcher := filepath.Join(appDir, name)
+	manifest, err := newNativeManifest(b, launcher, ids)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(appDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %v", appDir, err)
+	}
+	if err := os.WriteFile(launcher, []byte(script), 0755); err != nil {
+		return "", fmt.Errorf("failed to write launcher: %v", err)
+	}
+	dir := nativeManifestDir(b, browser, goos, home, configDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	path := filepath.Join(dir, nativeHostName+".json")
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return "", fmt.Errorf("failed to write manifest: %v", err)
+	}
+	if goos == "windows" {
+		key := b.registry + `\NativeMessagingHosts\` + nativeHostName
+		if err := registerNativeHost(key, path); err != nil {
+			return "", fmt.Errorf("failed to register manifest: %v", err)
+		}
+	}
+	return path, nil
+}
+
+var nativeHostCmd = &cobra.Command{
+	Use:   "native-host",
+	Short: "Serve download requests from the browser extension over native messaging",
+	Long: `Serve download requests from the browser extension over native messaging.
+
+The browser starts this command itself once the host manifest has been
+installed with "yt2mp3 native-host install". Messages are JSON objects,
+each preceded by its length as a 32-bit integer in native byte order.`,
+	// Browsers pass the caller's origin or the manifest path as arguments,
+	// and Chrome on Windows adds --parent-window.
+	Args:               cobra.ArbitraryArgs,
+	FParseErrWhitelist: cobra.FParseErrWhitelist{UnknownFlags: true},
+	SilenceUsage:       true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		log := cmd.ErrOrStderr()
+
+		cfg, err := loadConfigFile()
+		if err != nil {
+			return err
+		}
+		base, sources, err := resolveSettings(cfg, selectedProfile(), os.Getenv, cmd.Flags())
+		if err != nil {
+			return err
+		}
+		root := base.OutputDir
+		if root == "" {
+			if root, err = defaultNativeOutputDir(); err != nil {
+				return err
+			}
+		}
+		if err := ensureOutputDir(root, sources["output_dir"]); err != nil {
+			return err
+		}
+
+		tempDir, err := os.MkdirTemp("", "yt2mp3")
+		if err != nil {
+			return fmt.Errorf("failed to create temp directory: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+		ytdl, err := newYtDlp(tempDir)
+		if err != nil {
+			return err
+		}
+		d := retryingDownloader{downloader: ytdl, policy: newRetryPolicy(retries, retryMaxWait), log: log}
+
+		ctx, cancel := context.WithCancel(cmd.Context())
+		defer cancel()
+		jobs, err := newJobManager(ctx, d, newJobResolver(cfg, cmd.Flags(), selectedProfile(), root), jobManagerOptions{
+			Workers:   nativeWorkers,
+			QueueSize: nativeQueueSize,
+			Log:       log,
+		})
+		if err != nil {
+			return err
+		}
+		h := &nativeHost{jobs: jobs, w: cmd.OutOrStdout(), log: log}
+		err = h.run(ctx, cmd.InOrStdin())
+		cancel()
+		jobs.Wait()
+		return err
+	},
+}
+
+var nativeHostInstallCmd = &cobra.Command{
+	Use:          "install",
+	Short:        "Register the native messaging host with a browser for the current user",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		exe, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("failed to locate the yt2mp3 executable: %v", err)
+		}
+		if exe, err = filepath.EvalSymlinks(exe); err != nil {
+			return fmt.Errorf("failed to locate the yt2mp3 executable: %v", err)
+		}
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("failed to locate home directory: %v", err)
+		}
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return fmt.Errorf("failed to locate config directory: %v", err)
+		}
+		path, err := installNativeHost(nativeBrowserName, nativeExtensionIDs, exe, runtime.GOOS, home, configDir)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Installed native messaging host %s for %s: %s\n", nativeHostName, nativeBrowserName, path)
+		return nil
+	},
+}
+
+func init() {
+	nativeHostCmd.Flags().IntVar(&nativeWorkers, "workers", 2, "Number of concurrent downloads")
+	nativeHostInstallCmd.Flags().StringVar(&nativeBrowserName, "browser", "chrome", "Browser: chrome, chromium, edge, brave or firefox")
+	nativeHostInstallCmd.Flags().StringSliceVar(&nativeExtensionIDs, "extension-id", nil, "ID of an extension allowed to use the host (repeatable)")
+	nativeHostCmd.AddCommand(nativeHostInstallCmd)
+	rootCmd.AddCommand(nativeHostCmd)
+}
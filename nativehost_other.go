@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// registerNativeHost is a no-op outside Windows, where browsers find the
+// manifest by its location alone.
+func registerNativeHost(key, manifest string) error {
+	return nil
+}
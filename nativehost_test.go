@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNativeMessageFraming(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeNativeMessage(&buf, map[string]string{"type": "ping"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := binary.NativeEndian.Uint32(buf.Bytes()); got != uint32(buf.Len()-4) {
+		t.Errorf("length prefix = %d, want %d", got, buf.Len()-4)
+	}
+	msg, err := readNativeMessage(&buf)
+	if err != nil || string(msg) != `{"type":"ping"}` {
+		t.Errorf("readNativeMessage = %q, %v", msg, err)
+	}
+	if _, err := readNativeMessage(&buf); err != io.EOF {
+		t.Errorf("read at end = %v, want EOF", err)
+	}
+
+	truncated := binary.NativeEndian.AppendUint32(nil, 10)
+	if _, err := readNativeMessage(bytes.NewReader(append(truncated, "{}"...))); err == nil {
+		t.Error("expected an error for a truncated message")
+	}
+	huge := binary.NativeEndian.AppendUint32(nil, nativeMaxRequest+1)
+	if _, err := readNativeMessage(bytes.NewReader(huge)); err == nil {
+		t.Error("expected an error for an oversized message")
+	}
+	if err := writeNativeMessage(io.Discard, strings.Repeat("x", nativeMaxMessage)); err == nil {
+		t.Error("expected an error for an oversized reply")
+	}
+}
+
+// nativeSession runs a nativeHost on pipes and returns the browser's ends.
+func nativeSession(t *testing.T, d downloader) (in io.WriteCloser, out *io.PipeReader, root string) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	root = t.TempDir()
+	jobs, err := newJobManager(ctx, d, newJobResolver(&Config{}, nil, "", root), jobManagerOptions{Workers: 1, QueueSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := (&nativeHost{jobs: jobs, w: outW, log: io.Discard}).run(ctx, inR)
+		outW.Close()
+		done <- err
+	}()
+	t.Cleanup(func() {
+		inW.Close()
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+		jobs.Wait()
+	})
+	return inW, outR, root
+}
+
+func sendNative(t *testing.T, w io.Writer, req nativeRequest) {
+	t.Helper()
+	if err := writeNativeMessage(w, req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func receiveNative(t *testing.T, r io.Reader) nativeMessage {
+	t.Helper()
+	type reply struct {
+		msg nativeMessage
+		err error
+	}
+	ch := make(chan reply, 1)
+	go func() {
+		var m nativeMessage
+		data, err := readNativeMessage(r)
+		if err == nil {
+			err = json.Unmarshal(data, &m)
+		}
+		ch <- reply{m, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		return nativeMessage{}
+	}
+}
+
+func TestNativeHostDownload(t *testing.T) {
+	in, out, root := nativeSession(t, &fakeDownloader{info: map[string]videoInfo{
+		"https://youtu.be/abc": {ID: "abc", Title: "Song"},
+	}})
+
+	sendNative(t, in, nativeRequest{Type: nativePing, ID: "p"})
+	if m := receiveNative(t, out); m.Type != nativePong || m.ID != "p" || m.Version != Version {
+		t.Errorf("ping reply = %+v", m)
+	}
+
+	sendNative(t, in, nativeRequest{Type: nativeDownload, ID: "r1", URL: "https://youtu.be/abc"})
+	var states []string
+	var last nativeMessage
+	for len(states) == 0 || !last.Job.finished() {
+		last = receiveNative(t, out)
+		if last.Type != nativeJob || last.ID != "r1" || last.Job == nil {
+			t.Fatalf("unexpected message %+v", last)
+		}
+		states = append(states, last.Job.State)
+	}
+	if states[0] != jobQueued || last.Job.State != jobDone {
+		t.Errorf("states = %v", states)
+	}
+	if last.Job.Result == nil || last.Job.Result.FinalPath != filepath.Join(root, "Song.mp3") {
+		t.Errorf("result = %+v", last.Job.Result)
+	}
+}
+
+func TestNativeHostErrors(t *testing.T) {
+	in, out, _ := nativeSession(t, &fakeDownloader{})
+
+	tests := []struct {
+		name string
+		msg  any
+		code string
+	}{
+		{"invalid URL", nativeRequest{Type: nativeDownload, ID: "a", URL: "nope"}, "invalid_url"},
+		{"unknown job", nativeRequest{Type: nativeCancel, ID: "b", JobID: "missing"}, "unknown"},
+		{"unknown type", nativeRequest{Type: "bogus", ID: "c"}, "unknown"},
+		{"not an object", []int{1}, "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := writeNativeMessage(in, tt.msg); err != nil {
+				t.Fatal(err)
+			}
+			m := receiveNative(t, out)
+			if m.Type != nativeError || m.ErrorCode != tt.code || m.Error == "" {
+				t.Errorf("reply = %+v, want error code %s", m, tt.code)
+			}
+		})
+	}
+}
+
+func TestNativeHostFinishesJobsAfterDisconnect(t *testing.T) {
+	d := &fakeDownloader{block: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	root := t.TempDir()
+	jobs, err := newJobManager(ctx, d, newJobResolver(&Config{}, nil, "", root), jobManagerOptions{Workers: 1, QueueSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var in bytes.Buffer
+	sendNative(t, &in, nativeRequest{Type: nativeDownload, ID: "r", URL: "https://youtu.be/x"})
+
+	done := make(chan error, 1)
+	go func() { done <- (&nativeHost{jobs: jobs, w: io.Discard, log: io.Discard}).run(ctx, &in) }()
+	select {
+	case <-done:
+		t.Fatal("host exited while a download was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(d.block)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("host did not exit after the download finished")
+	}
+	if _, err := os.Stat(filepath.Join(root, "Fake Song.mp3")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNativeHostCommandArgs(t *testing.T) {
+	t.Setenv("YT2MP3_OUTPUT_DIR", t.TempDir())
+	var stdout, stderr bytes.Buffer
+	rootCmd.SetIn(&bytes.Buffer{})
+	rootCmd.SetOut(&stdout)
+	rootCmd.SetErr(&stderr)
+	// Chrome on Windows starts the host with the origin and --parent-window.
+	rootCmd.SetArgs([]string{"native-host", "chrome-extension://abc/", "--parent-window=0"})
+	t.Cleanup(func() {
+		rootCmd.SetIn(nil)
+		rootCmd.SetOut(nil)
+		rootCmd.SetErr(nil)
+		rootCmd.SetArgs(nil)
+	})
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatalf("Execute() = %v; stderr: %s", err, stderr.String())
+	}
+}
+
+func TestInstallNativeHost(t *testing.T) {
+	chromeID := strings.Repeat("a", 32)
+	tests := []struct {
+		browser, goos string
+		ids           []string
+		wantDir       string
+		wantErr       bool
+	}{
+		{"chrome", "linux", []string{chromeID}, "config/google-chrome/NativeMessagingHosts", false},
+		{"firefox", "linux", []string{"yt2mp3@example.org"}, "home/.mozilla/native-messaging-hosts", false},
+		{"edge", "darwin", []string{chromeID}, "home/Library/Application Support/Microsoft Edge/NativeMessagingHosts", false},
+		{"chrome", "linux", []string{"not-an-id"}, "", true},
+		{"chrome", "linux", nil, "", true},
+		{"safari", "darwin", []string{chromeID}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.browser+"/"+tt.goos, func(t *testing.T) {
+			base := t.TempDir()
+			home, configDir := filepath.Join(base, "home"), filepath.Join(base, "config")
+			path, err := installNativeHost(tt.browser, tt.ids, "/opt/it's/yt2mp3", tt.goos, home, configDir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("installNativeHost() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if want := filepath.Join(base, tt.wantDir, nativeHostName+".json"); path != want {
+				t.Errorf("manifest path = %s, want %s", path, want)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var m nativeManifest
+			if err := json.Unmarshal(data, &m); err != nil {
+				t.Fatal(err)
+			}
+			launcher := filepath.Join(configDir, "yt2mp3", "native-host.sh")
+			if m.Name != nativeHostName || m.Type != "stdio" || m.Path != launcher {
+				t.Errorf("manifest = %+v", m)
+			}
+			if tt.browser == "firefox" {
+				if len(m.AllowedExtensions) != 1 || m.AllowedExtensions[0] != tt.ids[0] || m.AllowedOrigins != nil {
+					t.Errorf("allowed extensions = %v, origins = %v", m.AllowedExtensions, m.AllowedOrigins)
+				}
+			} else if len(m.AllowedOrigins) != 1 || m.AllowedOrigins[0] != "chrome-extension://"+chromeID+"/" {
+				t.Errorf("allowed origins = %v", m.AllowedOrigins)
+			}
+			script, err := os.ReadFile(launcher)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := `exec '/opt/it'\''s/yt2mp3' native-host "$@"`; !strings.Contains(string(script), want) {
+				t.Errorf("launcher = %q", script)
+			}
+		})
+	}
+}
+
+func TestNativeLauncherWindows(t *testing.T) {
+	name, script := nativeLauncher("windows", `C:\Program Files\yt2mp3\yt2mp3.exe`)
+	if name != "native-host.bat" || script != "@echo off\r\n\"C:\\Program Files\\yt2mp3\\yt2mp3.exe\" native-host %*\r\n" {
+		t.Errorf("launcher = %s %q", name, script)
+	}
+}
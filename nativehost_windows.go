@@ -0,0 +1,16 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows/registry"
+
+// registerNativeHost points the HKEY_CURRENT_USER key at the manifest, which
+// is how browsers find native messaging hosts on Windows.
+func registerNativeHost(key, manifest string) error {
+	k, _, err := registry.CreateKey(registry.CURRENT_USER, key, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer k.Close()
+	return k.SetStringValue("", manifest)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Output formats accepted by --output-format.
+const (
+	formatText  = "text"
+	formatJSON  = "json"
+	formatJSONL = "jsonl"
+)
+
+// Output format option
+var outputFormat string
+
+// resultPrinter writes per-URL results to stdout in the selected format. In
+// the text format only successes are printed, matching the historical
+// output; the json format collects every record and writes a single array on
+// close, while jsonl streams one record per line as results arrive.
+type resultPrinter struct {
+	format  string
+	w       io.Writer
+	results []*Result
+}
+
+// newResultPrinter validates format and returns a printer writing to w.
+func newResultPrinter(format string, w io.Writer) (*resultPrinter, error) {
+	switch format {
+	case formatText, formatJSON, formatJSONL:
+		return &resultPrinter{format: format, w: w, results: []*Result{}}, nil
+	}
+	return nil, fmt.Errorf("invalid output format %q (want text, json or jsonl)", format)
+}
+
+// add records r, printing it immediately for the streaming formats.
+func (p *resultPrinter) add(r *Result) error {
+	switch p.format {
+	case formatText:
+		if r.Status == statusOK {
+			_, err := fmt.Fprintf(p.w, "Successfully downloaded and converted to: %s\n", r.FinalPath)
+			return err
+		}
+	case formatJSONL:
+		return json.NewEncoder(p.w).Encode(r)
+	case formatJSON:
+		p.results = append(p.results, r)
+	}
+	return nil
+}
+
+// close flushes any buffered records.
+func (p *resultPrinter) close() error {
+	if p.format != formatJSON {
+		return nil
+	}
+	enc := json.NewEncoder(p.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p.results)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestResultPrinter(t *testing.T) {
+	ok := &Result{URL: "u1", FinalPath: "a\nb.mp3", Status: statusOK}
+	failed := &Result{URL: "u2", Status: statusFailed, ErrorCode: "download_failed", Error: "boom"}
+
+	t.Run("text prints successes only", func(t *testing.T) {
+		var buf bytes.Buffer
+		p, err := newResultPrinter(formatText, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.add(ok)
+		p.add(failed)
+		p.close()
+		if buf.String() != "Successfully downloaded and converted to: a\nb.mp3\n" {
+			t.Errorf("unexpected output: %q", buf.String())
+		}
+	})
+
+	t.Run("jsonl prints one record per line", func(t *testing.T) {
+		var buf bytes.Buffer
+		p, _ := newResultPrinter(formatJSONL, &buf)
+		p.add(ok)
+		p.add(failed)
+		p.close()
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("got %d lines: %q", len(lines), buf.String())
+		}
+		var r Result
+		if err := json.Unmarshal([]byte(lines[0]), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.FinalPath != "a\nb.mp3" {
+			t.Errorf("final_path did not round-trip: %q", r.FinalPath)
+		}
+	})
+
+	t.Run("json prints a single array", func(t *testing.T) {
+		var buf bytes.Buffer
+		p, _ := newResultPrinter(formatJSON, &buf)
+		p.add(ok)
+		p.add(failed)
+		if buf.Len() != 0 {
+			t.Error("json output should be buffered until close")
+		}
+		p.close()
+		var rs []Result
+		if err := json.Unmarshal(buf.Bytes(), &rs); err != nil {
+			t.Fatal(err)
+		}
+		if len(rs) != 2 || rs[1].ErrorCode != "download_failed" {
+			t.Errorf("unexpected records: %+v", rs)
+		}
+	})
+
+	t.Run("json with no results is an empty array", func(t *testing.T) {
+		var buf bytes.Buffer
+		p, _ := newResultPrinter(formatJSON, &buf)
+		p.close()
+		if strings.TrimSpace(buf.String()) != "[]" {
+			t.Errorf("got %q", buf.String())
+		}
+	})
+
+	t.Run("invalid format", func(t *testing.T) {
+		if _, err := newResultPrinter("xml", &bytes.Buffer{}); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Result statuses reported for each processed URL.
+const (
+	statusOK     = "ok"
+	statusFailed = "failed"
+)
+
+// Pipeline stages reported to a progressFunc.
+const (
+	stageDownloading = "downloading"
+	stageTagging     = "tagging"
+)
+
+// progressFunc receives pipeline progress: the current stage and, while
+// downloading, the percentage complete.
+type progressFunc func(stage string, percent float64)
+
+// ytDlpProgressRe matches the percentage in yt-dlp's "[download]" lines.
+var ytDlpProgressRe = regexp.MustCompile(`^\[download\]\s+([\d.]+)%`)
+
+// Result describes the outcome of processing one URL.
+type Result struct {
+	URL       string            `json:"url"`
+	VideoID   string            `json:"video_id,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	FinalPath string            `json:"final_path,omitempty"`
+	Size      int64             `json:"size,omitempty"`
+	Duration  float64           `json:"duration,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Status    string            `json:"status"`
+	ErrorCode string            `json:"error_code,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// videoInfo holds the fields yt2mp3 uses from the .info.json file that
+// yt-dlp writes next to the downloaded audio.
+type videoInfo struct {
+	ID          string  `json:"id"`
+	Title       string  `json:"title"`
+	Duration    float64 `json:"duration"`
+	Channel     string  `json:"channel"`
+	ChannelID   string  `json:"channel_id"`
+	Uploader    string  `json:"uploader"`
+	UploadDate  string  `json:"upload_date"`
+	ReleaseYear int     `json:"release_year"`
+	WebpageURL  string  `json:"webpage_url"`
+	Description string  `json:"description"`
+	Thumbnail   string  `json:"thumbnail"`
+	// Thumbnails lists the available thumbnails, best last.
+	Thumbnails []videoThumbnail `json:"thumbnails"`
+
+	// fields holds every field of the info JSON, for tag templates.
+	fields map[string]any
+}
+
+// videoThumbnail is one of a video's thumbnails in its info JSON.
+type videoThumbnail struct {
+	URL string `json:"url"`
+}
+
+// downloader fetches the audio for a single URL into dir, together with its
+// .info.json metadata file. progress, if not nil, receives the download
+// percentage as it advances.
+type downloader interface {
+	Download(ctx context.Context, url, dir string, s Settings, progress func(percent float64)) error
+}
+
+// ytDlp is the downloader backed by the extracted yt-dlp binary.
+type ytDlp struct {
+	path string
+}
+
+// newYtDlp extracts the embedded yt-dlp binary into dir.
+func newYtDlp(dir string) (ytDlp, error) {
+	if err := extractYtDlp(binaries, dir); err != nil {
+		return ytDlp{}, err
+	}
+	return ytDlp{path: filepath.Join(dir, ytDlpBinaryName())}, nil
+}
+
+// Version returns the output of yt-dlp --version.
+func (y ytDlp) Version(ctx context.Context) (string, error) {
+	out, err := exec.CommandContext(ctx, y.path, "--version").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("yt-dlp --version failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return firstLine(string(out)), nil
+}
+
+// Download runs yt-dlp for url, writing the audio and info JSON into dir.
+func (y ytDlp) Download(ctx context.Context, url, dir string, s Settings, progress func(percent float64)) error {
+	cmd := exec.CommandContext(ctx, y.path, ytDlpArgs(s, filepath.Join(dir, "%(title)s.%(ext)s"), url)...)
+	out := &progressWriter{progress: progress}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		output := out.buf.String()
+		kind := classifyContext(ctx, classifyYtDlpOutput(output))
+		return classify(kind, fmt.Errorf("failed to download audio: %v\nOutput: %s", err, output))
+	}
+	return nil
+}
+
+// progressWriter collects yt-dlp's output and reports the percentage from
+// each complete "[download]" line to progress.
+type progressWriter struct {
+	buf      bytes.Buffer
+	line     []byte
+	progress func(percent float64)
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	if w.progress == nil {
+		return len(p), nil
+	}
+	for _, b := range p {
+		if b != '\n' && b != '\r' {
+			w.line = append(w.line, b)
+			continue
+		}
+		if m := ytDlpProgressRe.FindSubmatch(w.line); m != nil {
+			if pct, err := strconv.ParseFloat(string(m[1]), 64); err == nil {
+				w.progress(pct)
+			}
+		}
+		w.line = w.line[:0]
+	}
+	return len(p), nil
+}
+
+// readVideoInfo parses the first .info.json file in dir. A missing file is
+// not an error; the returned info is then empty.
+func readVideoInfo(dir string) (videoInfo, error) {
+	var info videoInfo
+	matches, err := filepath.Glob(filepath.Join(dir, "*.info.json"))
+	if err != nil || len(matches) == 0 {
+		return info, err
+	}
+	data, err := os.ReadFile(matches[0])
+	if err != nil {
+		return info, fmt.Errorf("failed to read video info: %v", err)
+	}
+	return decodeVideoInfo(data)
+}
+
+// decodeVideoInfo parses an info JSON document.
+func decodeVideoInfo(data []byte) (videoInfo, error) {
+	var info videoInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return info, fmt.Errorf("failed to parse video info: %v", err)
+	}
+	if err := json.Unmarshal(data, &info.fields); err != nil {
+		return info, fmt.Errorf("failed to parse video info: %v", err)
+	}
+	return info, nil
+}
+
+// processURL downloads url with d into a fresh work directory, tags the
+// audio and moves it into s.OutputDir, or into the folder that a channel
+// rule names below it. The output directory must already exist. progress
+// may be nil. The returned Result is never nil; on failure it carries the
+// error details as well.
+func processURL(ctx context.Context, d downloader, url string, s Settings, log io.Writer, progress progressFunc) (*Result, error) {
+	if progress == nil {
+		progress = func(string, float64) {}
+	}
+	res := &Result{URL: url}
+	err := runPipeline(ctx, d, url, s, log, progress, res)
+	if err != nil {
+		res.Status = statusFailed
+		res.ErrorCode = errorCode(err)
+		res.Error = err.Error()
+		return res, err
+	}
+	res.Status = statusOK
+	return res, nil
+}
+
+func runPipeline(ctx context.Context, d downloader, url string, s Settings, log io.Writer, progress progressFunc, res *Result) error {
+	workDir, err := os.MkdirTemp("", "yt2mp3")
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	// Download audio using yt-dlp
+	fmt.Fprintf(log, "Downloading audio from %s...\n", url)
+	progress(stageDownloading, 0)
+	err = d.Download(ctx, url, workDir, s, func(pct float64) { progress(stageDownloading, pct) })
+	if err != nil {
+		// Errors the downloader already classified keep their more
+		// specific kind, since ErrDownload is matched last.
+		return classify(ErrDownload, err)
+	}
+
+	info, err := readVideoInfo(workDir)
+	if err != nil {
+		return classify(ErrDownload, err)
+	}
+	res.VideoID = info.ID
+	res.Duration = info.Duration
+
+	// Find the downloaded audio file.
+	ext := audioFormatExt[s.AudioFormat]
+	downloadedName, err := findDownloadedAudio(workDir, ext)
+	if err != nil {
+		return classify(ErrNoAudio, err)
+	}
+
+	downloadedFile := filepath.Join(workDir, downloadedName)
+	targetName := sanitizeFilename(downloadedName)
+	targetDir := filepath.Join(s.OutputDir, channelFolder(info, s.Channels))
+	targetFile := filepath.Join(targetDir, targetName)
+
+	// Write ID3 tags (title without directory or extension)
+	progress(stageTagging, 100)
+	title := strings.TrimSuffix(targetName, filepath.Ext(targetName))
+	res.Title = title
+	if info.Title != "" {
+		res.Title = info.Title
+	}
+	overrides, err := parseTagOverrides(s.Tags)
+	if err != nil {
+		return classify(ErrTagging, err)
+	}
+	parser, err := newTitleParser(s.TitleRules)
+	if err != nil {
+		return classify(ErrTagging, err)
+	}
+	if ext == ".mp3" {
+		tags := newTrackTags(title, url, info, parser)
+		applyChannelRule(&tags, info, s.Channels)
+		overrides = resolveTagOverrides(overrides, info)
+		if err := writeID3Tags(downloadedFile, tags, overrides); err != nil {
+			return classify(ErrTagging, err)
+		}
+		res.Tags = tags.fieldsWithOverrides(overrides)
+	} else if len(overrides) > 0 {
+		fmt.Fprintf(log, "Warning: --tag only applies to MP3 files; %s is tagged by yt-dlp\n", targetName)
+	}
+
+	// Move file to the output directory
+	if targetDir != "" {
+		// The output directory exists, but a channel's folder may not.
+		if err := os.MkdirAll(targetDir, 0755); err != nil {
+			return classify(ErrOutputDir, fmt.Errorf("failed to create output directory: %w", err))
+		}
+	}
+	if err := moveFile(downloadedFile, targetFile); err != nil {
+		return classify(ErrOutputDir, err)
+	}
+	res.FinalPath = targetFile
+	if fi, err := os.Stat(targetFile); err == nil {
+		res.Size = fi.Size()
+	}
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with data, so readers never see
+// a partly written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// moveFile renames src to dst, falling back to copy-and-delete when they are
+// on different file systems (e.g. a tmpfs temp dir and a NAS share).
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to move file: %v", err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to move file: %v", err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return fmt.Errorf("failed to move file: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("failed to move file: %w", err)
+	}
+	return os.Remove(src)
+}
+
+// moveAside moves src into dir, which is created if needed, without
+// overwriting an earlier file of the same name: "name-2.ext" and so on are
+// tried instead. It returns the new path.
+func moveAside(src, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := filepath.Base(src)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	dst := filepath.Join(dir, name)
+	for n := 2; ; n++ {
+		if _, err := os.Lstat(dst); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		dst = filepath.Join(dir, fmt.Sprintf("%s-%d%s", base, n, ext))
+	}
+	return dst, moveFile(src, dst)
+}
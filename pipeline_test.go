@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeDownloader writes an empty MP3 and an info JSON file instead of
+// running yt-dlp. Info is keyed by URL; unknown URLs get a generic title.
+// When block is set, downloads wait for it to be closed.
+type fakeDownloader struct {
+	info  map[string]videoInfo
+	err   error
+	block chan struct{}
+	calls atomic.Int32
+}
+
+func (f *fakeDownloader) Download(ctx context.Context, url, dir string, s Settings, progress func(percent float64)) error {
+	f.calls.Add(1)
+	if progress != nil {
+		progress(50)
+	}
+	if f.block != nil {
+		select {
+		case <-f.block:
+		case <-ctx.Done():
+			return classify(ErrInterrupted, ctx.Err())
+		}
+	}
+	if f.err != nil {
+		return f.err
+	}
+	info, ok := f.info[url]
+	if !ok {
+		info = videoInfo{ID: "vid", Title: "Fake Song"}
+	}
+	base := filepath.Join(dir, info.Title)
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(base+".info.json", data, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(base+audioFormatExt[s.AudioFormat], nil, 0644)
+}
+
+func TestProcessURL(t *testing.T) {
+	t.Run("downloads, tags and moves the file", func(t *testing.T) {
+		out := t.TempDir()
+		d := &fakeDownloader{info: map[string]videoInfo{
+			"https://youtu.be/abc": {ID: "abc", Title: "Song: Live", Duration: 61.5},
+		}}
+		s := Settings{OutputDir: out, AudioFormat: "mp3", AudioQuality: "0"}
+
+		res, err := processURL(context.Background(), d, "https://youtu.be/abc", s, io.Discard, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		wantPath := filepath.Join(out, "Song_ Live.mp3")
+		if res.Status != statusOK || res.FinalPath != wantPath {
+			t.Errorf("unexpected result: %+v", res)
+		}
+		if res.VideoID != "abc" || res.Title != "Song: Live" || res.Duration != 61.5 {
+			t.Errorf("metadata not populated: %+v", res)
+		}
+		if res.Tags["title"] != "Song: Live" || res.Tags["comment"] != "https://youtu.be/abc" {
+			t.Errorf("unexpected tags: %v", res.Tags)
+		}
+		fi, err := os.Stat(wantPath)
+		if err != nil {
+			t.Fatalf("file not moved: %v", err)
+		}
+		if res.Size != fi.Size() || res.Size == 0 {
+			t.Errorf("size = %d, want %d", res.Size, fi.Size())
+		}
+	})
+
+	t.Run("non-mp3 formats are not ID3 tagged", func(t *testing.T) {
+		out := t.TempDir()
+		s := Settings{OutputDir: out, AudioFormat: "opus", AudioQuality: "64K"}
+		res, err := processURL(context.Background(), &fakeDownloader{}, "u", s, io.Discard, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if res.Tags != nil || filepath.Ext(res.FinalPath) != ".opus" {
+			t.Errorf("unexpected result: %+v", res)
+		}
+	})
+
+	t.Run("download failure is reported", func(t *testing.T) {
+		d := &fakeDownloader{err: errors.New("HTTP Error 404")}
+		s := Settings{OutputDir: t.TempDir(), AudioFormat: "mp3"}
+		res, err := processURL(context.Background(), d, "u", s, io.Discard, nil)
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if res.Status != statusFailed || res.ErrorCode != "download_failed" || res.Error == "" {
+			t.Errorf("unexpected result: %+v", res)
+		}
+	})
+}
+
+func TestReadVideoInfo(t *testing.T) {
+	dir := t.TempDir()
+	if info, err := readVideoInfo(dir); err != nil || info.ID != "" {
+		t.Errorf("missing info: got (%+v, %v)", info, err)
+	}
+
+	mustWrite(t, filepath.Join(dir, "x.info.json"), `{"id":"abc","title":"T","channel_id":"UC1"}`)
+	info, err := readVideoInfo(dir)
+	if err != nil || info.ID != "abc" || info.ChannelID != "UC1" {
+		t.Errorf("got (%+v, %v)", info, err)
+	}
+
+	mustWrite(t, filepath.Join(dir, "x.info.json"), `{not json`)
+	if _, err := readVideoInfo(dir); err == nil {
+		t.Error("expected a parse error")
+	}
+}
+
+func TestMoveFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "a.mp3")
+	mustWrite(t, src, "audio")
+	dst := filepath.Join(dir, "b.mp3")
+	if err := moveFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Error("source still exists")
+	}
+	if data, _ := os.ReadFile(dst); string(data) != "audio" {
+		t.Errorf("dst content = %q", data)
+	}
+	if err := moveFile(filepath.Join(dir, "missing"), dst); err == nil {
+		t.Error("expected an error for a missing source")
+	}
+}
+
+func TestProgressWriter(t *testing.T) {
+	var got []float64
+	w := &progressWriter{progress: func(pct float64) { got = append(got, pct) }}
+	w.Write([]byte("[youtube] abc: Downloading webpage\n[download]   1.5% of 3.00MiB"))
+	w.Write([]byte("\r[download]  50.0% of 3.00MiB\n[download] 100% of 3.00MiB in 00:01\n"))
+
+	want := []float64{1.5, 50, 100}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	if !strings.Contains(w.buf.String(), "Downloading webpage") {
+		t.Error("output was not collected")
+	}
+}
+
+func TestMoveAsideKeepsEarlierFiles(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 2; i++ {
+		if err := os.WriteFile(filepath.Join(dir, "list.txt"), []byte{byte('0' + i)}, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := moveAside(filepath.Join(dir, "list.txt"), filepath.Join(dir, "done")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{"list.txt": "0", "list-2.txt": "1"} {
+		data, err := os.ReadFile(filepath.Join(dir, "done", name))
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v; want %q", name, data, err, want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strings"
+)
+
+// playlistEntry is one video of a playlist or channel as listed by yt-dlp
+// without downloading it.
+type playlistEntry struct {
+	ID         string  `json:"id"`
+	URL        string  `json:"url"`
+	Title      string  `json:"title"`
+	Duration   float64 `json:"duration"`
+	UploadDate string  `json:"upload_date"`
+	LiveStatus string  `json:"live_status"`
+	// Channel is the uploader, which for YouTube Music tracks is the
+	// artist's " - Topic" channel.
+	Channel string `json:"channel"`
+	IEKey   string `json:"ie_key"`
+}
+
+// archiveKey returns the entry's line in a yt-dlp download archive:
+// the lowercased extractor name and the video ID.
+func (e playlistEntry) archiveKey() string {
+	ie := strings.ToLower(e.IEKey)
+	if ie == "" {
+		ie = "youtube"
+	}
+	return ie + " " + e.ID
+}
+
+// playlistPositions maps the video IDs of entries to their position in
+// the playlist, from 1. A video listed twice keeps its first position.
+func playlistPositions(entries []playlistEntry) map[string]int {
+	position := make(map[string]int, len(entries))
+	for i, e := range entries {
+		if _, ok := position[e.ID]; !ok {
+			position[e.ID] = i + 1
+		}
+	}
+	return position
+}
+
+// playlist is the flat listing of a playlist or channel.
+type playlist struct {
+	ID      string          `json:"id"`
+	Title   string          `json:"title"`
+	Channel string          `json:"channel"`
+	Entries []playlistEntry `json:"entries"`
+	// Thumbnails lists the playlist's thumbnails, best last; an album
+	// playlist's are its cover.
+	Thumbnails []videoThumbnail `json:"thumbnails"`
+}
+
+// playlistLister lists the entries behind a playlist or channel URL.
+type playlistLister interface {
+	List(ctx context.Context, url string) (playlist, error)
+}
+
+// channelVideosURL returns the URL of the videos tab of the YouTube channel
+// at raw, or raw itself if it is not the home page of a channel. Listed
+// flat, a channel's home page yields its tabs rather than its videos.
+func channelVideosURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || !isYouTubeHost(u.Hostname()) {
+		return raw
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && strings.HasPrefix(parts[0], "@"):
+	case len(parts) == 2 && (parts[0] == "channel" || parts[0] == "c" || parts[0] == "user"):
+	default:
+		return raw
+	}
+	u.Path = "/" + strings.Join(parts, "/") + "/videos"
+	return u.String()
+}
+
+// isYouTubeHost reports whether host serves youtube.com pages.
+func isYouTubeHost(host string) bool {
+	host = strings.ToLower(host)
+	return host == "youtube.com" || strings.HasSuffix(host, ".youtube.com")
+}
+
+// parsePlaylist decodes yt-dlp's --dump-single-json output. A single video
+// is returned as a playlist with one entry, and entries without a URL get
+// their watch URL. Nested playlists, such as the tabs of a channel, are
+// skipped.
+func parsePlaylist(data []byte) (playlist, error) {
+	var raw struct {
+		playlist
+		Entries []struct {
+			playlistEntry
+			Type string `json:"_type"`
+		} `json:"entries"`
+		Type       string  `json:"_type"`
+		WebpageURL string  `json:"webpage_url"`
+		Duration   float64 `json:"duration"`
+		UploadDate string  `json:"upload_date"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return playlist{}, fmt.Errorf("failed to parse playlist: %v", err)
+	}
+	pl := raw.playlist
+	pl.Entries = nil
+	for _, e := range raw.Entries {
+		if e.Type != "playlist" {
+			pl.Entries = append(pl.Entries, e.playlistEntry)
+		}
+	}
+	if raw.Type != "playlist" {
+		pl.Entries = []playlistEntry{{
+			ID:         raw.ID,
+			URL:        raw.WebpageURL,
+			Title:      raw.Title,
+			Duration:   raw.Duration,
+			UploadDate: raw.UploadDate,
+		}}
+	}
+	entries := pl.Entries[:0]
+	for _, e := range pl.Entries {
+		if e.ID == "" {
+			continue
+		}
+		if e.URL == "" || !strings.HasPrefix(e.URL, "http") {
+			e.URL = "https://www.youtube.com/watch?v=" + e.ID
+		}
+		entries = append(entries, e)
+	}
+	pl.Entries = entries
+	return pl, nil
+}
+
+// List runs yt-dlp in flat-playlist mode, which reads the listing without
+// visiting every video. Channel URLs are listed from their videos tab.
+func (y ytDlp) List(ctx context.Context, url string) (playlist, error) {
+	cmd := exec.CommandContext(ctx, y.path, "--flat-playlist", "--dump-single-json", "--no-warnings", channelVideosURL(url))
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		output := stderr.String()
+		kind := classifyContext(ctx, classifyYtDlpOutput(output))
+		return playlist{}, classify(kind, fmt.Errorf("failed to list %s: %v\nOutput: %s", url, err, output))
+	}
+	return parsePlaylist(stdout.Bytes())
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePlaylist(t *testing.T) {
+	t.Run("flat playlist", func(t *testing.T) {
+		data := `{
+			"_type": "playlist", "id": "PL1", "title": "Lectures", "channel": "Uni",
+			"entries": [
+				{"_type": "url", "ie_key": "Youtube", "id": "a", "url": "https://www.youtube.com/watch?v=a", "title": "One", "duration": 61.0},
+				{"_type": "url", "ie_key": "Youtube", "id": "b", "url": "b", "title": "Two", "live_status": "is_upcoming"},
+				{"_type": "url", "title": "[Private video]"}
+			]
+		}`
+		pl, err := parsePlaylist([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := playlist{ID: "PL1", Title: "Lectures", Channel: "Uni", Entries: []playlistEntry{
+			{ID: "a", URL: "https://www.youtube.com/watch?v=a", Title: "One", Duration: 61, IEKey: "Youtube"},
+			{ID: "b", URL: "https://www.youtube.com/watch?v=b", Title: "Two", LiveStatus: "is_upcoming", IEKey: "Youtube"},
+		}}
+		if !reflect.DeepEqual(pl, want) {
+			t.Errorf("parsePlaylist() = %+v, want %+v", pl, want)
+		}
+		if key := pl.Entries[0].archiveKey(); key != "youtube a" {
+			t.Errorf("archiveKey() = %q", key)
+		}
+	})
+
+	t.Run("single video", func(t *testing.T) {
+		data := `{"_type": "video", "id": "v", "title": "Solo", "duration": 5, "upload_date": "20240102", "webpage_url": "https://www.youtube.com/watch?v=v"}`
+		pl, err := parsePlaylist([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []playlistEntry{{ID: "v", URL: "https://www.youtube.com/watch?v=v", Title: "Solo", Duration: 5, UploadDate: "20240102"}}
+		if !reflect.DeepEqual(pl.Entries, want) {
+			t.Errorf("entries = %+v, want %+v", pl.Entries, want)
+		}
+	})
+
+	t.Run("channel tabs", func(t *testing.T) {
+		data := `{
+			"_type": "playlist", "id": "UC1", "title": "Band",
+			"entries": [
+				{"_type": "playlist", "id": "UC1", "url": "https://www.youtube.com/@band/videos", "title": "Band - Videos"},
+				{"_type": "url", "id": "c", "url": "https://www.youtube.com/watch?v=c", "title": "Three"}
+			]
+		}`
+		pl, err := parsePlaylist([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []playlistEntry{{ID: "c", URL: "https://www.youtube.com/watch?v=c", Title: "Three"}}
+		if !reflect.DeepEqual(pl.Entries, want) {
+			t.Errorf("entries = %+v, want %+v", pl.Entries, want)
+		}
+	})
+
+	t.Run("invalid JSON", func(t *testing.T) {
+		if _, err := parsePlaylist([]byte("ERROR")); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestChannelVideosURL(t *testing.T) {
+	tests := []struct{ url, want string }{
+		{"https://www.youtube.com/@band", "https://www.youtube.com/@band/videos"},
+		{"https://youtube.com/@band/", "https://youtube.com/@band/videos"},
+		{"https://www.youtube.com/channel/UC123", "https://www.youtube.com/channel/UC123/videos"},
+		{"https://m.youtube.com/c/Band", "https://m.youtube.com/c/Band/videos"},
+		{"https://www.youtube.com/user/band?app=desktop", "https://www.youtube.com/user/band/videos?app=desktop"},
+		{"https://www.youtube.com/@band/streams", "https://www.youtube.com/@band/streams"},
+		{"https://www.youtube.com/playlist?list=PL1", "https://www.youtube.com/playlist?list=PL1"},
+		{"https://www.youtube.com/watch?v=abc", "https://www.youtube.com/watch?v=abc"},
+		{"https://example.com/@band", "https://example.com/@band"},
+	}
+	for _, tt := range tests {
+		if got := channelVideosURL(tt.url); got != tt.want {
+			t.Errorf("channelVideosURL(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
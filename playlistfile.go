@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	// PLS option for playlist rebuild
+	playlistPLS bool
+	// Playlist name option for playlist rebuild
+	playlistName string
+)
+
+// trackPosition returns the position in a "position/total" track number,
+// or 0 if there is none.
+func trackPosition(track string) int {
+	n, _ := strconv.Atoi(strings.TrimSpace(strings.SplitN(track, "/", 2)[0]))
+	return max(n, 0)
+}
+
+// orderByTrackNumber sorts tracks by their track number; tracks without one
+// come last. Ties keep file name order.
+func orderByTrackNumber(tracks []localTrack) {
+	sort.SliceStable(tracks, func(i, j int) bool {
+		pi, pj := trackPosition(tracks[i].Track), trackPosition(tracks[j].Track)
+		switch {
+		case pi == pj:
+			return tracks[i].Path < tracks[j].Path
+		case pi == 0 || pj == 0:
+			return pj == 0
+		}
+		return pi < pj
+	})
+}
+
+// orderByPlaylist sorts tracks into the order of entries. Tracks of videos
+// that are not in the playlist follow in track number order.
+func orderByPlaylist(tracks []localTrack, entries []playlistEntry) {
+	position := playlistPositions(entries)
+	orderByTrackNumber(tracks)
+	sort.SliceStable(tracks, func(i, j int) bool {
+		pi, iok := position[tracks[i].VideoID]
+		pj, jok := position[tracks[j].VideoID]
+		if iok && jok {
+			return pi < pj
+		}
+		return iok && !jok
+	})
+}
+
+// playlistRef returns the path of track relative to dir with forward
+// slashes, which players on every platform accept.
+func playlistRef(dir string, t localTrack) string {
+	rel, err := filepath.Rel(dir, t.Path)
+	if err != nil {
+		rel = t.Path
+	}
+	return filepath.ToSlash(rel)
+}
+
+// playlistTitle returns the title a playlist shows for t.
+func playlistTitle(t localTrack) string {
+	if t.Title != "" {
+		return t.Title
+	}
+	return strings.TrimSuffix(filepath.Base(t.Path), filepath.Ext(t.Path))
+}
+
+// playlistLength returns the track length in whole seconds, or -1 when it
+// is unknown, as both formats expect.
+func playlistLength(t localTrack) int {
+	if t.Duration <= 0 {
+		return -1
+	}
+	return int(t.Duration.Round(time.Second).Seconds())
+}
+
+// singleLine keeps tag values from breaking the line-based formats.
+func singleLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// formatM3U8 returns an extended M3U playlist, in UTF-8, of tracks in dir.
+func formatM3U8(dir, title string, tracks []localTrack) []byte {
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	if title != "" {
+		fmt.Fprintf(&b, "#PLAYLIST:%s\n", singleLine(title))
+	}
+	for _, t := range tracks {
+		fmt.Fprintf(&b, "#EXTINF:%d,%s\n%s\n", playlistLength(t), singleLine(playlistTitle(t)), playlistRef(dir, t))
+	}
+	return b.Bytes()
+}
+
+// formatPLS returns a PLS playlist of tracks in dir.
+func formatPLS(dir string, tracks []localTrack) []byte {
+	var b bytes.Buffer
+	b.WriteString("[playlist]\n")
+	for i, t := range tracks {
+		fmt.Fprintf(&b, "File%d=%s\n", i+1, playlistRef(dir, t))
+		fmt.Fprintf(&b, "Title%d=%s\n", i+1, singleLine(playlistTitle(t)))
+		fmt.Fprintf(&b, "Length%d=%d\n", i+1, playlistLength(t))
+	}
+	fmt.Fprintf(&b, "NumberOfEntries=%d\nVersion=2\n", len(tracks))
+	return b.Bytes()
+}
+
+// writePlaylistFiles writes NAME.m3u8, and NAME.pls if pls is set, into
+// dir, listing tracks in the given order. It returns the files written.
+func writePlaylistFiles(dir, name string, tracks []localTrack, pls bool) ([]string, error) {
+	m3u := filepath.Join(dir, name+".m3u8")
+	if err := writeFileAtomic(m3u, formatM3U8(dir, name, tracks)); err != nil {
+		return nil, fmt.Errorf("failed to write playlist: %v", err)
+	}
+	written := []string{m3u}
+	if pls {
+		path := filepath.Join(dir, name+".pls")
+		if err := writeFileAtomic(path, formatPLS(dir, tracks)); err != nil {
+			return written, fmt.Errorf("failed to write playlist: %v", err)
+		}
+		written = append(written, path)
+	}
+	return written, nil
+}
+
+// playlistFileName returns the default playlist name for dir: the name of
+// the folder itself.
+func playlistFileName(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(abs), nil
+}
+
+var playlistCmd = &cobra.Command{
+	Use:   "playlist",
+	Short: "Manage playlist files for downloaded folders",
+}
+
+var playlistRebuildCmd = &cobra.Command{
+	Use:   "rebuild DIR",
+	Short: "Regenerate the M3U8 (and PLS) playlist of a folder from its tags",
+	Long: `Regenerate the playlist files of a folder of downloaded MP3 files.
+
+The tracks are listed in track number order, which mirror mode keeps in
+step with the playlist they came from; tracks without a number follow in
+file name order. The playlist is written to DIR/NAME.m3u8, where NAME
+defaults to the folder name.`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dir := args[0]
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			return classify(ErrOutputDir, fmt.Errorf("folder %s does not exist", dir))
+		}
+		name := playlistName
+		if name == "" {
+			var err error
+			if name, err = playlistFileName(dir); err != nil {
+				return err
+			}
+		}
+		tracks, err := readTracks(dir, cmd.ErrOrStderr())
+		if err != nil {
+			return err
+		}
+		orderByTrackNumber(tracks)
+		written, err := writePlaylistFiles(dir, name, tracks, playlistPLS)
+		for _, path := range written {
+			fmt.Fprintf(cmd.ErrOrStderr(), "Wrote %s with %d tracks\n", path, len(tracks))
+		}
+		return err
+	},
+}
+
+func init() {
+	playlistRebuildCmd.Flags().BoolVar(&playlistPLS, "pls", false, "Also write a PLS playlist")
+	playlistRebuildCmd.Flags().StringVar(&playlistName, "name", "", "Playlist file name without extension (default the folder name)")
+	playlistCmd.AddCommand(playlistRebuildCmd)
+	rootCmd.AddCommand(playlistCmd)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlaylistFormats(t *testing.T) {
+	dir := filepath.Join("music", "mix")
+	tracks := []localTrack{
+		{Path: filepath.Join(dir, "Second Song.mp3"), Title: "Second\nSong", Duration: 61500 * time.Millisecond},
+		{Path: filepath.Join(dir, "extra", "First.mp3")},
+	}
+
+	wantM3U := "#EXTM3U\n" +
+		"#PLAYLIST:mix\n" +
+		"#EXTINF:62,Second Song\n" +
+		"Second Song.mp3\n" +
+		"#EXTINF:-1,First\n" +
+		"extra/First.mp3\n"
+	if got := string(formatM3U8(dir, "mix", tracks)); got != wantM3U {
+		t.Errorf("formatM3U8() = %q, want %q", got, wantM3U)
+	}
+
+	wantPLS := "[playlist]\n" +
+		"File1=Second Song.mp3\nTitle1=Second Song\nLength1=62\n" +
+		"File2=extra/First.mp3\nTitle2=First\nLength2=-1\n" +
+		"NumberOfEntries=2\nVersion=2\n"
+	if got := string(formatPLS(dir, tracks)); got != wantPLS {
+		t.Errorf("formatPLS() = %q, want %q", got, wantPLS)
+	}
+}
+
+func TestPlaylistOrder(t *testing.T) {
+	paths := func(tracks []localTrack) []string {
+		var p []string
+		for _, t := range tracks {
+			p = append(p, t.Path)
+		}
+		return p
+	}
+	tracks := []localTrack{
+		{Path: "a.mp3", VideoID: "a", Track: "3/3"},
+		{Path: "b.mp3", VideoID: "b"},
+		{Path: "c.mp3", VideoID: "c", Track: "1/3"},
+		{Path: "mine.mp3"},
+		{Path: "d.mp3", VideoID: "d", Track: "2"},
+	}
+
+	orderByTrackNumber(tracks)
+	if got, want := paths(tracks), []string{"c.mp3", "d.mp3", "a.mp3", "b.mp3", "mine.mp3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("orderByTrackNumber() = %v, want %v", got, want)
+	}
+
+	orderByPlaylist(tracks, []playlistEntry{{ID: "b"}, {ID: "a"}, {ID: "x"}})
+	if got, want := paths(tracks), []string{"b.mp3", "a.mp3", "c.mp3", "d.mp3", "mine.mp3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("orderByPlaylist() = %v, want %v", got, want)
+	}
+}
+
+func TestPlaylistRebuild(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Lectures")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTaggedMP3(t, filepath.Join(dir, "a.mp3"), trackTags{Title: "Intro", URL: "https://youtu.be/a", Duration: 90 * time.Second}, "")
+	writeTaggedMP3(t, filepath.Join(dir, "b.mp3"), trackTags{Title: "Basics", URL: "https://youtu.be/b"}, "")
+	if err := setTrackNumber(filepath.Join(dir, "a.mp3"), "2/2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := setTrackNumber(filepath.Join(dir, "b.mp3"), "1/2"); err != nil {
+		t.Fatal(err)
+	}
+	// A file with broken tags is left out rather than failing the rebuild.
+	if err := os.WriteFile(filepath.Join(dir, "broken.mp3"), []byte("ID3\x04\x00\x00\x00\x00\x01\x00"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stderr bytes.Buffer
+	rootCmd.SetOut(&bytes.Buffer{})
+	rootCmd.SetErr(&stderr)
+	rootCmd.SetArgs([]string{"playlist", "rebuild", dir, "--pls"})
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	playlistPLS = false
+	if !strings.Contains(stderr.String(), "Warning: skipping broken.mp3") {
+		t.Errorf("stderr = %q", stderr.String())
+	}
+
+	m3u, err := os.ReadFile(filepath.Join(dir, "Lectures.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "#EXTM3U\n#PLAYLIST:Lectures\n#EXTINF:-1,Basics\nb.mp3\n#EXTINF:90,Intro\na.mp3\n"
+	if string(m3u) != want {
+		t.Errorf("Lectures.m3u8 = %q, want %q", m3u, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Lectures.pls")); err != nil {
+		t.Errorf("PLS playlist was not written: %v", err)
+	}
+}
+
+func TestSyncThenRebuild(t *testing.T) {
+	const url = "https://www.youtube.com/playlist?list=PL1"
+	var entries []playlistEntry
+	info := map[string]videoInfo{}
+	for _, title := range []string{"Zulu", "Alpha", "Mike"} {
+		id := strings.ToLower(title)
+		entries = append(entries, playlistEntry{ID: id, URL: "https://www.youtube.com/watch?v=" + id, Title: title})
+		info["https://www.youtube.com/watch?v="+id] = videoInfo{ID: id, Title: title}
+	}
+	base := t.TempDir()
+	s := &syncer{
+		lister: fakeLister{url: {Entries: entries}},
+		d:      &fakeDownloader{info: info},
+		out:    &bytes.Buffer{},
+		log:    &bytes.Buffer{},
+		settings: func(string) (Settings, map[string]string, error) {
+			st := builtinSettings()
+			st.OutputDir = base
+			return st, map[string]string{}, nil
+		},
+	}
+	sub := Subscription{Name: "mix", URL: url, Archive: filepath.Join(base, "archive.txt")}
+	if err := s.syncOne(context.Background(), sub); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(base, "mix")
+	synced, err := os.ReadFile(filepath.Join(dir, "mix.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "#EXTM3U\n#PLAYLIST:mix\n#EXTINF:-1,Zulu\nZulu.mp3\n#EXTINF:-1,Alpha\nAlpha.mp3\n#EXTINF:-1,Mike\nMike.mp3\n"
+	if string(synced) != want {
+		t.Fatalf("synced mix.m3u8 = %q, want %q", synced, want)
+	}
+
+	// Rebuilding restores the playlist order from the track numbers.
+	rootCmd.SetOut(&bytes.Buffer{})
+	rootCmd.SetErr(&bytes.Buffer{})
+	rootCmd.SetArgs([]string{"playlist", "rebuild", dir})
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	rebuilt, err := os.ReadFile(filepath.Join(dir, "mix.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rebuilt) != want {
+		t.Errorf("rebuilt mix.m3u8 = %q, want %q", rebuilt, want)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bogem/id3v2"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// maxCoverSize bounds the thumbnails retag downloads.
+	maxCoverSize = 10 << 20
+	// coverFetchTimeout bounds a single thumbnail download.
+	coverFetchTimeout = 30 * time.Second
+)
+
+// Dry run option for retag
+var retagDryRun bool
+
+// infoFetcher fetches a video's metadata without downloading it.
+type infoFetcher interface {
+	Info(ctx context.Context, url string) (videoInfo, error)
+}
+
+// Info runs yt-dlp without downloading and decodes the video's info JSON.
+func (y ytDlp) Info(ctx context.Context, url string) (videoInfo, error) {
+	cmd := exec.CommandContext(ctx, y.path, "--dump-single-json", "--skip-download", "--no-playlist", "--no-warnings", url)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		output := stderr.String()
+		kind := classifyContext(ctx, classifyYtDlpOutput(output))
+		return videoInfo{}, classify(kind, fmt.Errorf("failed to fetch metadata of %s: %v\nOutput: %s", url, err, output))
+	}
+	return decodeVideoInfo(stdout.Bytes())
+}
+
+// coverURL returns the best JPEG or PNG thumbnail of the video, since MP3
+// players rarely show other formats. It returns "" if there is none.
+func coverURL(info videoInfo) string {
+	usable := func(u string) bool {
+		ext := strings.ToLower(filepath.Ext(strings.SplitN(u, "?", 2)[0]))
+		return ext == ".jpg" || ext == ".jpeg" || ext == ".png"
+	}
+	for i := len(info.Thumbnails) - 1; i >= 0; i-- {
+		if usable(info.Thumbnails[i].URL) {
+			return info.Thumbnails[i].URL
+		}
+	}
+	if usable(info.Thumbnail) {
+		return info.Thumbnail
+	}
+	return ""
+}
+
+// fetchCover downloads the image at url as a front cover picture frame.
+func fetchCover(ctx context.Context, client *http.Client, url string) (*id3v2.PictureFrame, error) {
+	ctx, cancel := context.WithTimeout(ctx, coverFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "yt2mp3/"+Version)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch cover art: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch cover art: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCoverSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch cover art: %v", err)
+	}
+	if len(data) > maxCoverSize {
+		return nil, fmt.Errorf("cover art is larger than %d bytes", maxCoverSize)
+	}
+	mimeType := http.DetectContentType(data)
+	if mimeType != "image/jpeg" && mimeType != "image/png" {
+		return nil, fmt.Errorf("cover art is %s, not JPEG or PNG", mimeType)
+	}
+	return &id3v2.PictureFrame{
+		Encoding:    id3v2.EncodingISO,
+		MimeType:    mimeType,
+		PictureType: id3v2.PTFrontCover,
+		Picture:     data,
+	}, nil
+}
+
+// tagChange is a field that retag changes.
+type tagChange struct {
+	Field, Old, New string
+}
+
+// describeTag shortens a tag value for a one-line diff.
+func describeTag(v string) string {
+	if v == "" {
+		return "(none)"
+	}
+	v = singleLine(v)
+	if utf8.RuneCountInString(v) > 60 {
+		v = string([]rune(v)[:60]) + "…"
+	}
+	return fmt.Sprintf("%q", v)
+}
+
+// describeCover summarizes a picture frame for a diff.
+func describeCover(p *id3v2.PictureFrame) string {
+	if p == nil {
+		return "(none)"
+	}
+	return fmt.Sprintf("%s, %d bytes", p.MimeType, len(p.Picture))
+}
+
+// diffTags lists the fields that differ between old and new.
+func diffTags(old, new storedTag) []tagChange {
+	length := func(d time.Duration) string {
+		if d <= 0 {
+			return ""
+		}
+		return d.Round(time.Second).String()
+	}
+	var changes []tagChange
+	for _, f := range []struct{ name, old, new string }{
+		{"title", old.Tags.Title, new.Tags.Title},
+		{"artist", old.Tags.Artist, new.Tags.Artist},
+		{"album", old.Tags.Album, new.Tags.Album},
+		{"genre", old.Tags.Genre, new.Tags.Genre},
+		{"url", old.Tags.URL, new.Tags.URL},
+		{"description", old.Tags.Description, new.Tags.Description},
+		{"date", old.Tags.UploadDate, new.Tags.UploadDate},
+		{"length", length(old.Tags.Duration), length(new.Tags.Duration)},
+		{"track", old.Tags.Track, new.Tags.Track},
+	} {
+		if f.old != f.new {
+			changes = append(changes, tagChange{f.name, describeTag(f.old), describeTag(f.new)})
+		}
+	}
+	// Overrides of frames that trackTags has no field for.
+	for _, o := range new.extra {
+		if v := overriddenValue(old.frames, o); v != o.Value {
+			changes = append(changes, tagChange{o.Key, describeTag(v), describeTag(o.Value)})
+		}
+	}
+	if old.Cover == nil != (new.Cover == nil) || old.Cover != nil && !bytes.Equal(old.Cover.Picture, new.Cover.Picture) {
+		changes = append(changes, tagChange{"cover", describeCover(old.Cover), describeCover(new.Cover)})
+	}
+	return changes
+}
+
+// retagger rewrites the tags of existing files from fresh metadata.
+type retagger struct {
+	info infoFetcher
+	// client downloads cover art.
+	client *http.Client
+	out    io.Writer
+	log    io.Writer
+	// titles splits video titles into artist and title.
+	titles *titleParser
+	// channels are the channel rules applied after the title rules.
+	channels map[string]ChannelRule
+	// overrides are the --tag overrides, applied last.
+	overrides []tagOverride
+	// embedThumbnail adds cover art to files that have none.
+	embedThumbnail bool
+	dryRun         bool
+}
+
+// retagOne retags the MP3 file at path.
+func (r *retagger) retagOne(ctx context.Context, path string) error {
+	old, err := readStoredTag(path)
+	if err != nil {
+		return err
+	}
+	if old.Tags.URL == "" {
+		return fmt.Errorf("no source URL in the tags; the file was not downloaded by yt2mp3")
+	}
+	info, err := r.info.Info(ctx, old.Tags.URL)
+	if err != nil {
+		return err
+	}
+
+	updated := storedTag{Tags: newTrackTags(old.Tags.Title, old.Tags.URL, info, r.titles), Cover: old.Cover}
+	updated.Tags.Track = old.Tags.Track
+	applyChannelRule(&updated.Tags, info, r.channels)
+	if updated.Tags.Genre == "" {
+		// Writing the tags keeps a genre set by hand.
+		updated.Tags.Genre = old.Tags.Genre
+	}
+	album := old.albumArtist != ""
+	if album {
+		// The album's title, year and cover are shared by its tracks and
+		// unknown to the video's metadata.
+		updated.Tags.Album, updated.Tags.UploadDate = old.Tags.Album, old.Tags.UploadDate
+	}
+	updated.overrides = resolveTagOverrides(r.overrides, info)
+	updated.extra = updated.Tags.applyOverrides(updated.overrides)
+	if u := coverURL(info); u != "" && !album && (old.Cover != nil || r.embedThumbnail) {
+		if cover, err := fetchCover(ctx, r.client, u); err != nil {
+			fmt.Fprintf(r.log, "%s: keeping the current cover art: %v\n", path, err)
+		} else {
+			updated.Cover = cover
+		}
+	}
+
+	changes := diffTags(old, updated)
+	if len(changes) == 0 && !old.legacy {
+		fmt.Fprintf(r.log, "%s: up to date\n", path)
+		return nil
+	}
+	prefix := "retagged"
+	if r.dryRun {
+		prefix = "would retag"
+	}
+	fmt.Fprintf(r.out, "%s %s\n", prefix, path)
+	for _, c := range changes {
+		fmt.Fprintf(r.out, "  %s: %s -> %s\n", c.Field, c.Old, c.New)
+	}
+	if r.dryRun {
+		return nil
+	}
+	return writeStoredTag(path, updated)
+}
+
+// writeStoredTag replaces the tags of the MP3 file at path with st.
+func writeStoredTag(path string, st storedTag) error {
+	tag, err := openID3Tag(path)
+	if err != nil {
+		return err
+	}
+	defer tag.Close()
+	applyTrackTags(tag, st.Tags)
+	applyTagOverrides(tag, st.overrides)
+	if st.Cover != nil {
+		tag.DeleteFrames(tag.CommonID("Attached picture"))
+		tag.AddAttachedPicture(*st.Cover)
+	}
+	return saveID3Tag(tag)
+}
+
+// retagAll retags paths one after another; a failing file does not stop
+// the others.
+func (r *retagger) retagAll(ctx context.Context, paths []string) error {
+	var firstErr error
+	failed := 0
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := r.retagOne(ctx, path); err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+			fmt.Fprintf(r.log, "%s: %v\n", path, err)
+		}
+	}
+	if ctx.Err() != nil {
+		return classify(ErrInterrupted, ctx.Err())
+	}
+	return batchError(failed, len(paths), firstErr, "files")
+}
+
+var retagCmd = &cobra.Command{
+	Use:   "retag FILE...",
+	Short: "Rewrite the tags of downloaded MP3 files from fresh metadata",
+	Long: `Rewrite the tags of MP3 files that yt2mp3 downloaded earlier.
+
+The source URL is read back from each file's tags and the video's current
+metadata is fetched without downloading the audio. The tags are then
+rewritten the way a new download would be tagged, and cover art is
+refreshed for files that have it (or for all files with embed_thumbnail).
+Use --dry-run to see the changes first.`,
+	Args:         cobra.MinimumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		log := cmd.ErrOrStderr()
+		settings, _, err := loadSettings(cmd)
+		if err != nil {
+			return err
+		}
+		titles, err := newTitleParser(settings.TitleRules)
+		if err != nil {
+			return err
+		}
+		overrides, err := parseTagOverrides(settings.Tags)
+		if err != nil {
+			return err
+		}
+		tempDir, err := os.MkdirTemp("", "yt2mp3")
+		if err != nil {
+			return fmt.Errorf("failed to create temp directory: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+		ytdl, err := newYtDlp(tempDir)
+		if err != nil {
+			return err
+		}
+		r := &retagger{
+			info:           retryingFetcher{infoFetcher: ytdl, policy: newRetryPolicy(retries, retryMaxWait), log: log},
+			client:         http.DefaultClient,
+			titles:         titles,
+			channels:       settings.Channels,
+			overrides:      overrides,
+			out:            cmd.OutOrStdout(),
+			log:            log,
+			embedThumbnail: settings.EmbedThumbnail,
+			dryRun:         retagDryRun,
+		}
+		return r.retagAll(cmd.Context(), args)
+	},
+}
+
+func init() {
+	retagCmd.Flags().BoolVar(&retagDryRun, "dry-run", false, "Show the changes without writing them")
+	rootCmd.AddCommand(retagCmd)
+}
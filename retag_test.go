@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bogem/id3v2"
+)
+
+// fakeFetcher returns canned video info by URL.
+type fakeFetcher map[string]videoInfo
+
+func (f fakeFetcher) Info(ctx context.Context, url string) (videoInfo, error) {
+	info, ok := f[url]
+	if !ok {
+		return videoInfo{}, classify(ErrUnavailable, errors.New("video unavailable"))
+	}
+	return info, nil
+}
+
+// writeLegacyMP3 tags path the way releases before the v2.3 writer did:
+// v2.4 frames under a v2.3 header and a comment frame without a
+// terminator after its description.
+func writeLegacyMP3(t *testing.T, path, title, url string) {
+	t.Helper()
+	mustWrite(t, path, "audio frames")
+	tag, err := id3v2.Open(path, id3v2.Options{Parse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag.SetTitle(title)
+	tag.SetAlbum("YouTube")
+	tag.AddCommentFrame(id3v2.CommentFrame{Language: "eng", Description: "YouTube URL", Text: url})
+	if err := tag.Save(); err != nil {
+		t.Fatal(err)
+	}
+	tag.Close()
+	// Claim v2.3 in the header without converting the v2.4 frames.
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte{3}, 3); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadStoredTagLegacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.mp3")
+	// Long enough that its v2.4 frame size differs from a v2.3 one.
+	title := strings.Repeat("講義", 30)
+	writeLegacyMP3(t, path, title, "https://youtu.be/old")
+
+	st, err := readStoredTag(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.legacy || st.Tags.Title != title || st.Tags.URL != "https://youtu.be/old" {
+		t.Errorf("readStoredTag() = %+v", st)
+	}
+
+	// Renumbering repairs the tag instead of failing on it.
+	if err := setTrackNumber(path, "1/2"); err != nil {
+		t.Fatal(err)
+	}
+	st, err = readStoredTag(path)
+	if err != nil || st.legacy || st.Tags.Title != title || st.Tags.Track != "1/2" || st.Tags.URL != "https://youtu.be/old" {
+		t.Errorf("after setTrackNumber: %+v, %v", st, err)
+	}
+}
+
+func TestCoverURL(t *testing.T) {
+	tests := []struct {
+		name string
+		info videoInfo
+		want string
+	}{
+		{"best JPEG", videoInfo{Thumbnails: []videoThumbnail{{URL: "https://i/a.jpg"}, {URL: "https://i/b.jpg?x=1"}, {URL: "https://i/c.webp"}}}, "https://i/b.jpg?x=1"},
+		{"fallback", videoInfo{Thumbnail: "https://i/t.png", Thumbnails: []videoThumbnail{{URL: "https://i/c.webp"}}}, "https://i/t.png"},
+		{"none usable", videoInfo{Thumbnail: "https://i/t.webp"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := coverURL(tt.info); got != tt.want {
+				t.Errorf("coverURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetag(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n cover"
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cover.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(png))
+	}))
+	defer images.Close()
+
+	dir := t.TempDir()
+	old := filepath.Join(dir, "Lecture_ Vectors.mp3")
+	writeLegacyMP3(t, old, "Lecture_ Vectors", "https://youtu.be/old")
+	if err := setTrackNumber(old, "3/10"); err != nil {
+		t.Fatal(err)
+	}
+	mine := filepath.Join(dir, "mine.mp3")
+	mustWrite(t, mine, "")
+	before, err := os.ReadFile(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	titles, err := newTitleParser(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	r := &retagger{
+		info: fakeFetcher{"https://youtu.be/old": {
+			Title:       "Lecture: Vectors & Matrices",
+			Channel:     "Uni",
+			Description: "Week 3",
+			UploadDate:  "20240108",
+			Duration:    3600,
+			Thumbnails:  []videoThumbnail{{URL: images.URL + "/cover.png"}},
+		}},
+		client:         images.Client(),
+		titles:         titles,
+		out:            &stdout,
+		log:            &stderr,
+		embedThumbnail: true,
+		dryRun:         true,
+	}
+	ctx := context.Background()
+
+	if err := r.retagAll(ctx, []string{old}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"would retag " + old,
+		`  title: "Lecture_ Vectors" -> "Lecture: Vectors & Matrices"`,
+		`  artist: (none) -> "Uni"`,
+		`  date: (none) -> "20240108"`,
+		`  length: (none) -> "1h0m0s"`,
+		"  cover: (none) -> image/png, 14 bytes",
+	} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("dry run output %q lacks %q", stdout.String(), want)
+		}
+	}
+	if strings.Contains(stdout.String(), "url:") || strings.Contains(stdout.String(), "track:") {
+		t.Errorf("dry run lists unchanged fields: %q", stdout.String())
+	}
+	if after, _ := os.ReadFile(old); !bytes.Equal(after, before) {
+		t.Error("dry run changed the file")
+	}
+
+	r.dryRun = false
+	stdout.Reset()
+	err = r.retagAll(ctx, []string{old, mine})
+	if !errors.Is(err, ErrPartialFailure) {
+		t.Errorf("retagAll() error = %v, want partial failure", err)
+	}
+	if !strings.Contains(stderr.String(), mine+": no source URL") {
+		t.Errorf("log %q does not explain the untagged file", stderr.String())
+	}
+	st, err := readStoredTag(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := trackTags{
+		Title:       "Lecture: Vectors & Matrices",
+		Artist:      "Uni",
+		Album:       "YouTube",
+		URL:         "https://youtu.be/old",
+		Description: "Week 3",
+		UploadDate:  "20240108",
+		Duration:    time.Hour,
+		Track:       "3/10",
+	}
+	if st.Tags != want || st.Cover == nil || string(st.Cover.Picture) != png {
+		t.Errorf("retagged file = %+v, want %+v with the cover", st, want)
+	}
+
+	stderr.Reset()
+	if err := r.retagAll(ctx, []string{old}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr.String(), old+": up to date") {
+		t.Errorf("second retag log = %q", stderr.String())
+	}
+}
+
+func TestRetagAlbumTrack(t *testing.T) {
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("\x89PNG\r\n\x1a\n video thumbnail"))
+	}))
+	defer images.Close()
+
+	path := filepath.Join(t.TempDir(), "Opener.mp3")
+	writeTaggedMP3(t, path, trackTags{Title: "Opener", Artist: "First", Album: "YouTube", URL: "https://youtu.be/one", UploadDate: "20190301"}, "")
+	a := &album{
+		Title: "Hits", Artist: variousArtists, Compilation: true, Total: 2, Year: "2019",
+		Cover: &id3v2.PictureFrame{Encoding: id3v2.EncodingISO, MimeType: "image/jpeg", PictureType: id3v2.PTFrontCover, Picture: []byte("album cover")},
+	}
+	res := &Result{FinalPath: path}
+	if err := a.tagTrack(res, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	titles, err := newTitleParser(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	r := &retagger{
+		info: fakeFetcher{"https://youtu.be/one": {
+			Title:      "Opener Reprise",
+			Channel:    "First - Topic",
+			UploadDate: "20240105",
+			Thumbnails: []videoThumbnail{{URL: images.URL + "/cover.png"}},
+		}},
+		client:         images.Client(),
+		titles:         titles,
+		out:            &stdout,
+		log:            &stderr,
+		embedThumbnail: true,
+	}
+	ctx := context.Background()
+	if err := r.retagAll(ctx, []string{path}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stdout.String(), "album:") || strings.Contains(stdout.String(), "date:") || strings.Contains(stdout.String(), "cover:") {
+		t.Errorf("retag changed the album tags: %q", stdout.String())
+	}
+
+	tag, err := id3v2.Open(path, id3v2.Options{Parse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]string{
+		"TIT2": "Opener Reprise",
+		"TALB": "Hits",
+		"TPE2": variousArtists,
+		"TYER": "2019",
+		"TDAT": "",
+		"TRCK": "1/2",
+		"TCMP": "1",
+	} {
+		if got := tag.GetTextFrame(id).Text; got != want {
+			t.Errorf("%s = %q, want %q", id, got, want)
+		}
+	}
+	pics := tag.GetFrames(tag.CommonID("Attached picture"))
+	if len(pics) != 1 || string(pics[0].(id3v2.PictureFrame).Picture) != "album cover" {
+		t.Error("the album cover was replaced")
+	}
+	tag.Close()
+
+	stderr.Reset()
+	if err := r.retagAll(ctx, []string{path}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr.String(), path+": up to date") {
+		t.Errorf("second retag log = %q", stderr.String())
+	}
+}
+
+func TestRetagTagOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "Vectors.mp3")
+	writeTaggedMP3(t, path, trackTags{Title: "Vectors", Album: "YouTube", URL: "https://youtu.be/v"}, "")
+	overrides, err := parseTagOverrides([]string{"album=Lectures", "album_artist=Uni", "TXXX:course=Linear Algebra", "year={upload_date}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	titles, err := newTitleParser(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	r := &retagger{
+		info: fakeFetcher{"https://youtu.be/v": {
+			Title: "Vectors", Channel: "Uni", UploadDate: "20240108",
+			fields: map[string]any{"upload_date": "20240108"},
+		}},
+		titles:    titles,
+		overrides: overrides,
+		out:       &stdout,
+		log:       &stderr,
+		dryRun:    true,
+	}
+	ctx := context.Background()
+
+	if err := r.retagAll(ctx, []string{path}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`  album: "YouTube" -> "Lectures"`,
+		`  date: (none) -> "2024"`,
+		`  album_artist: (none) -> "Uni"`,
+		`  TXXX:course: (none) -> "Linear Algebra"`,
+	} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("dry run output %q lacks %q", stdout.String(), want)
+		}
+	}
+
+	r.dryRun = false
+	if err := r.retagAll(ctx, []string{path}); err != nil {
+		t.Fatal(err)
+	}
+	st, err := readStoredTag(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Tags.Album != "Lectures" || st.Tags.UploadDate != "2024" || st.albumArtist != "Uni" {
+		t.Errorf("retagged tags = %+v, album artist %q", st.Tags, st.albumArtist)
+	}
+	if v := overriddenValue(st.frames, overrides[2]); v != "Linear Algebra" {
+		t.Errorf("TXXX:course = %q", v)
+	}
+
+	stderr.Reset()
+	if err := r.retagAll(ctx, []string{path}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr.String(), path+": up to date") {
+		t.Errorf("second retag log = %q", stderr.String())
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	// defaultRetries is the number of retries after the first attempt.
+	defaultRetries = 3
+	// defaultRetryBaseDelay is the delay before the first retry; it doubles
+	// with each further attempt.
+	defaultRetryBaseDelay = time.Second
+	// defaultRetryMaxWait caps the delay between two attempts.
+	defaultRetryMaxWait = 30 * time.Second
+)
+
+var (
+	// Retry count option
+	retries int
+	// Maximum wait between retries option
+	retryMaxWait time.Duration
+)
+
+// RetryOptions are the --retries and --retry-max-wait options.
+type RetryOptions struct {
+	Retries int           `json:"retries"`
+	MaxWait time.Duration `json:"max_wait"`
+}
+
+// currentRetryOptions returns the retry options of this process.
+func currentRetryOptions() *RetryOptions {
+	return &RetryOptions{Retries: retries, MaxWait: retryMaxWait}
+}
+
+// retryPolicy retries transient failures with exponential backoff and
+// jitter.
+type retryPolicy struct {
+	Retries   int
+	BaseDelay time.Duration
+	MaxWait   time.Duration
+
+	// sleep and jitter are replaced in tests.
+	sleep  func(ctx context.Context, d time.Duration) error
+	jitter func() float64
+}
+
+// newRetryPolicy returns a policy with the default base delay.
+func newRetryPolicy(retries int, maxWait time.Duration) retryPolicy {
+	return retryPolicy{
+		Retries:   retries,
+		BaseDelay: defaultRetryBaseDelay,
+		MaxWait:   maxWait,
+		sleep:     sleepContext,
+		jitter:    rand.Float64,
+	}
+}
+
+// delay returns the wait before retry number attempt (starting at 1). The
+// exponential delay is capped at MaxWait, if it is positive, and then
+// randomized into its upper half, so concurrent clients hitting the same
+// rate limit spread out without ever retrying immediately.
+func (p retryPolicy) delay(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && (p.MaxWait <= 0 || d < p.MaxWait) && d < math.MaxInt64/2; i++ {
+		d *= 2
+	}
+	if p.MaxWait > 0 && d > p.MaxWait {
+		d = p.MaxWait
+	}
+	return d/2 + time.Duration(p.jitter()*float64(d/2))
+}
+
+// do runs fn until it succeeds, fails with a non-transient error, or the
+// retries are exhausted. Each failed attempt is logged to log.
+func (p retryPolicy) do(ctx context.Context, log io.Writer, label string, fn func() error) error {
+	attempts := p.Retries + 1
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !errors.Is(err, ErrTransient) || attempt >= attempts {
+			if err != nil && attempt > 1 {
+				fmt.Fprintf(log, "Attempt %d/%d for %s failed: %s; giving up\n", attempt, attempts, label, errorSummary(err))
+			}
+			return err
+		}
+		wait := p.delay(attempt)
+		fmt.Fprintf(log, "Attempt %d/%d for %s failed: %s; retrying in %s\n",
+			attempt, attempts, label, errorSummary(err), wait.Round(100*time.Millisecond))
+		if err := p.sleep(ctx, wait); err != nil {
+			return classify(ErrInterrupted, err)
+		}
+	}
+}
+
+// sleepContext waits for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryingDownloader wraps a downloader, retrying transient failures.
+type retryingDownloader struct {
+	downloader
+	policy retryPolicy
+	log    io.Writer
+}
+
+// Download implements downloader. The retry options of s, if any, replace
+// those of r's policy.
+func (r retryingDownloader) Download(ctx context.Context, url, dir string, s Settings, progress func(percent float64)) error {
+	if o := s.Retry; o != nil {
+		r.policy.Retries, r.policy.MaxWait = o.Retries, o.MaxWait
+	}
+	return r.policy.do(ctx, r.log, url, func() error {
+		return r.downloader.Download(ctx, url, dir, s, progress)
+	})
+}
+
+// retryingLister retries listings that fail with transient errors.
+type retryingLister struct {
+	playlistLister
+	policy retryPolicy
+	log    io.Writer
+}
+
+// List implements playlistLister.
+func (r retryingLister) List(ctx context.Context, url string) (playlist, error) {
+	var pl playlist
+	err := r.policy.do(ctx, r.log, url, func() error {
+		var err error
+		pl, err = r.playlistLister.List(ctx, url)
+		return err
+	})
+	return pl, err
+}
+
+// retryingFetcher retries metadata fetches that fail with transient
+// errors.
+type retryingFetcher struct {
+	infoFetcher
+	policy retryPolicy
+	log    io.Writer
+}
+
+// Info implements infoFetcher.
+func (r retryingFetcher) Info(ctx context.Context, url string) (videoInfo, error) {
+	var info videoInfo
+	err := r.policy.do(ctx, r.log, url, func() error {
+		var err error
+		info, err = r.infoFetcher.Info(ctx, url)
+		return err
+	})
+	return info, err
+}
+
+func init() {
+	pf := rootCmd.PersistentFlags()
+	pf.IntVar(&retries, "retries", defaultRetries, "Number of retries for transient download failures")
+	pf.DurationVar(&retryMaxWait, "retry-max-wait", defaultRetryMaxWait, "Maximum wait between retries")
+}
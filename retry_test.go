@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRetryPolicy returns a policy that records its sleeps instead of
+// waiting and uses a fixed jitter.
+func testRetryPolicy(retries int, slept *[]time.Duration) retryPolicy {
+	p := newRetryPolicy(retries, 10*time.Second)
+	p.jitter = func() float64 { return 1 }
+	p.sleep = func(ctx context.Context, d time.Duration) error {
+		*slept = append(*slept, d)
+		return ctx.Err()
+	}
+	return p
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := newRetryPolicy(5, 10*time.Second)
+
+	p.jitter = func() float64 { return 1 }
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, w := range want {
+		if got := p.delay(i + 1); got != w {
+			t.Errorf("delay(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+
+	p.jitter = func() float64 { return 0 }
+	if got := p.delay(3); got != 2*time.Second {
+		t.Errorf("minimum jittered delay = %v, want half of 4s", got)
+	}
+
+	// Without a cap the delay keeps doubling.
+	p = newRetryPolicy(5, 0)
+	p.jitter = func() float64 { return 1 }
+	for i, w := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second} {
+		if got := p.delay(i + 1); got != w {
+			t.Errorf("uncapped delay(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+	if got := p.delay(100); got <= 0 {
+		t.Errorf("uncapped delay(100) = %v, want no overflow", got)
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	transient := classify(ErrTransient, errors.New("failed to download audio\nERROR: HTTP Error 429: Too Many Requests"))
+
+	t.Run("retries transient failures until success", func(t *testing.T) {
+		var slept []time.Duration
+		var log bytes.Buffer
+		calls := 0
+		err := testRetryPolicy(3, &slept).do(context.Background(), &log, "URL", func() error {
+			calls++
+			if calls < 3 {
+				return transient
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if calls != 3 || len(slept) != 2 {
+			t.Errorf("calls = %d, sleeps = %v", calls, slept)
+		}
+		if !strings.Contains(log.String(), "Attempt 1/4 for URL failed: ERROR: HTTP Error 429") {
+			t.Errorf("attempts not logged:\n%s", log.String())
+		}
+	})
+
+	t.Run("gives up after the configured retries", func(t *testing.T) {
+		var slept []time.Duration
+		var log bytes.Buffer
+		calls := 0
+		err := testRetryPolicy(2, &slept).do(context.Background(), &log, "URL", func() error {
+			calls++
+			return transient
+		})
+		if !errors.Is(err, ErrTransient) || calls != 3 {
+			t.Errorf("err = %v, calls = %d", err, calls)
+		}
+		if !strings.Contains(log.String(), "giving up") {
+			t.Errorf("final attempt not logged:\n%s", log.String())
+		}
+	})
+
+	t.Run("does not retry permanent failures", func(t *testing.T) {
+		var slept []time.Duration
+		calls := 0
+		err := testRetryPolicy(3, &slept).do(context.Background(), &bytes.Buffer{}, "URL", func() error {
+			calls++
+			return classify(ErrUnavailable, errors.New("Video unavailable"))
+		})
+		if !errors.Is(err, ErrUnavailable) || calls != 1 || len(slept) != 0 {
+			t.Errorf("err = %v, calls = %d, sleeps = %v", err, calls, slept)
+		}
+	})
+
+	t.Run("interrupted while waiting", func(t *testing.T) {
+		var slept []time.Duration
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := testRetryPolicy(3, &slept).do(ctx, &bytes.Buffer{}, "URL", func() error { return transient })
+		if !errors.Is(err, ErrInterrupted) {
+			t.Errorf("err = %v, want ErrInterrupted", err)
+		}
+	})
+}
+
+func TestRetryingDownloader(t *testing.T) {
+	var slept []time.Duration
+	inner := &fakeDownloader{err: classify(ErrTransient, errors.New("timed out"))}
+	d := retryingDownloader{downloader: inner, policy: testRetryPolicy(1, &slept), log: &bytes.Buffer{}}
+
+	err := d.Download(context.Background(), "u", t.TempDir(), Settings{AudioFormat: "mp3"}, nil)
+	if !errors.Is(err, ErrTransient) {
+		t.Errorf("err = %v", err)
+	}
+	if inner.calls.Load() != 2 {
+		t.Errorf("calls = %d, want 2", inner.calls.Load())
+	}
+}
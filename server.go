@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// maxRequestBody bounds the size of JSON request bodies.
+	maxRequestBody = 1 << 20
+	// shutdownTimeout is how long in-flight HTTP requests get to finish
+	// after an interrupt.
+	shutdownTimeout = 10 * time.Second
+)
+
+var (
+	// Listen address option for serve
+	serveAddr string
+	// Worker pool size option for serve
+	serveWorkers int
+	// Job queue capacity option for serve
+	serveQueueSize int
+	// Job database path option for serve
+	serveDB string
+	// Finished job retention option for serve
+	serveRetention time.Duration
+)
+
+// server exposes a jobManager over a REST API and the web UI.
+type server struct {
+	jobs    *jobManager
+	options serverOptions
+	// root is the output directory that feeds and media are served from.
+	root string
+	// tokens, if set, authenticates API requests once any tokens exist.
+	tokens *tokenStore
+	// metrics, if set, is exposed on /metrics.
+	metrics *metrics
+	// ready, if set, backs the /readyz probe.
+	ready *readiness
+	// log, if set, receives warnings that do not fail a request.
+	log io.Writer
+}
+
+// routes returns the HTTP handler for the API.
+func (s *server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", s.authenticate(s.handleCreateJob))
+	mux.HandleFunc("GET /jobs", s.authenticate(s.handleListJobs))
+	mux.HandleFunc("GET /jobs/{id}", s.authenticate(s.handleGetJob))
+	mux.HandleFunc("GET /jobs/{id}/file", s.authenticate(s.handleGetJobFile))
+	mux.HandleFunc("DELETE /jobs/{id}", s.authenticate(s.handleCancelJob))
+	mux.HandleFunc("GET /events", s.authenticate(s.handleEvents))
+	mux.HandleFunc("GET /options", s.authenticate(s.handleOptions))
+	mux.HandleFunc("GET /feed.xml", s.feedAuthenticate(s.handleFeed))
+	mux.HandleFunc("GET /media/{path...}", s.mediaAuthenticate(s.handleMedia))
+	mux.HandleFunc("GET /metrics", s.handleMetrics)
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+	mux.Handle("GET /", webUI())
+	return mux
+}
+
+func (s *server) handleCreateJob(w http.ResponseWriter, r *http.Request) {
+	var req JobRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+		return
+	}
+	job, err := s.jobs.Submit(req, requestUser(r))
+	switch {
+	case errors.Is(err, errQueueFull):
+		writeError(w, http.StatusServiceUnavailable, err)
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		w.Header().Set("Location", "/jobs/"+job.ID)
+		writeJSON(w, http.StatusAccepted, job)
+	}
+}
+
+func (s *server) handleListJobs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.visibleJobs(requestUser(r)))
+}
+
+// visibleJobs returns the jobs u may see, oldest first.
+func (s *server) visibleJobs(u *apiUser) []Job {
+	jobs := []Job{}
+	for _, job := range s.jobs.List() {
+		if canAccess(u, job) {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+// requestedJob returns the job named by the request path if the requesting
+// user may see it. Other users' jobs are reported as not found.
+func (s *server) requestedJob(r *http.Request) (Job, bool) {
+	job, ok := s.jobs.Get(r.PathValue("id"))
+	if !ok || !canAccess(requestUser(r), job) {
+		return Job{}, false
+	}
+	return job, true
+}
+
+func (s *server) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.requestedJob(r)
+	if !ok {
+		writeError(w, http.StatusNotFound, errJobNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (s *server) handleGetJobFile(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.requestedJob(r)
+	if !ok {
+		writeError(w, http.StatusNotFound, errJobNotFound)
+		return
+	}
+	if job.State != jobDone || job.Result == nil {
+		writeError(w, http.StatusConflict, fmt.Errorf("job is %s", job.State))
+		return
+	}
+	path := job.Result.FinalPath
+	if _, err := os.Stat(path); err != nil {
+		writeError(w, http.StatusGone, fmt.Errorf("file is no longer available"))
+		return
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(path)}))
+	http.ServeFile(w, r, path)
+}
+
+func (s *server) handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requestedJob(r); !ok {
+		writeError(w, http.StatusNotFound, errJobNotFound)
+		return
+	}
+	job, err := s.jobs.Cancel(r.PathValue("id"))
+	switch {
+	case errors.Is(err, errJobNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, errJobFinished):
+		writeError(w, http.StatusConflict, err)
+	default:
+		writeJSON(w, http.StatusOK, job)
+	}
+}
+
+// writeJSON writes v as a JSON response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes err as a JSON error response, including its error code
+// when the error is classified.
+func writeError(w http.ResponseWriter, status int, err error) {
+	body := map[string]string{"error": err.Error()}
+	if code := errorCode(err); code != "unknown" {
+		body["error_code"] = code
+	}
+	writeJSON(w, status, body)
+}
+
+// validateURL rejects anything that is not an absolute http(s) URL before it
+// reaches yt-dlp.
+func validateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return classify(ErrInvalidURL, fmt.Errorf("invalid URL %q", raw))
+	}
+	return nil
+}
+
+// confineDir joins the relative directory sub onto root and rejects results
+// that would escape root.
+func confineDir(root, sub string) (string, error) {
+	if sub == "" {
+		return root, nil
+	}
+	if filepath.IsAbs(sub) {
+		return "", classify(ErrOutputDir, fmt.Errorf("output directory must be relative, got %q", sub))
+	}
+	dir := filepath.Join(root, sub)
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", classify(ErrOutputDir, fmt.Errorf("failed to resolve output directory path: %v", err))
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", classify(ErrOutputDir, fmt.Errorf("failed to resolve output directory path: %v", err))
+	}
+	if !isWithinDir(absRoot, absDir) {
+		return "", classify(ErrOutputDir, fmt.Errorf("output directory %q is outside of %s", sub, root))
+	}
+	return dir, nil
+}
+
+// newJobResolver returns a resolver that layers a request's profile (or
+// the user's or server's default profile) and options over the server's
+// configuration. Output is always written under root, or under the user's
+// library inside root; a request may only pick a subdirectory of it, and
+// output_dir values from profiles are ignored.
+func newJobResolver(cfg *Config, flags *pflag.FlagSet, defaultProfile, root string) jobResolver {
+	return func(req JobRequest, u *apiUser) (Settings, error) {
+		if err := validateURL(req.URL); err != nil {
+			return Settings{}, err
+		}
+		profile := req.Profile
+		userRoot := root
+		if u != nil {
+			if profile == "" {
+				profile = u.Profile
+			}
+			var err error
+			if userRoot, err = confineDir(root, u.root()); err != nil {
+				return Settings{}, err
+			}
+		}
+		if profile == "" {
+			profile = defaultProfile
+		}
+		s, _, err := resolveSettings(cfg, profile, os.Getenv, flags)
+		if err != nil {
+			return Settings{}, err
+		}
+
+		opts := req.Options
+		sub := ""
+		if opts.OutputDir != nil {
+			sub = *opts.OutputDir
+			opts.OutputDir = nil
+		}
+		opts.applyTo(&s, map[string]string{}, "request")
+		if err := validateSettings(s); err != nil {
+			return Settings{}, err
+		}
+		if s.OutputDir, err = confineDir(userRoot, sub); err != nil {
+			return Settings{}, err
+		}
+		return s, nil
+	}
+}
+
+var serveCmd = &cobra.Command{
+	Use:          "serve",
+	Short:        "Run an HTTP API that queues downloads",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		log := cmd.ErrOrStderr()
+
+		cfg, err := loadConfigFile()
+		if err != nil {
+			return err
+		}
+		base, sources, err := resolveSettings(cfg, selectedProfile(), os.Getenv, cmd.Flags())
+		if err != nil {
+			return err
+		}
+		root := base.OutputDir
+		if root == "" {
+			root = "."
+		}
+		if err := ensureOutputDir(root, sources["output_dir"]); err != nil {
+			return err
+		}
+
+		tempDir, err := os.MkdirTemp("", "yt2mp3")
+		if err != nil {
+			return fmt.Errorf("failed to create temp directory: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+		ytdl, err := newYtDlp(tempDir)
+		if err != nil {
+			return err
+		}
+		ctx := cmd.Context()
+		version, err := ytdl.Version(ctx)
+		if err != nil {
+			fmt.Fprintf(log, "Warning: %v\n", err)
+			version = "unknown"
+		}
+		stats := newMetrics(version)
+		d := meteredDownloader{
+			downloader: retryingDownloader{downloader: ytdl, policy: newRetryPolicy(retries, retryMaxWait), log: log},
+			metrics:    stats,
+		}
+
+		tokenFile, err := resolveTokensPath()
+		if err != nil {
+			return err
+		}
+		tokens, err := newTokenStore(tokenFile)
+		if err != nil {
+			return err
+		}
+		if enabled, _ := tokens.enabled(); !enabled {
+			fmt.Fprintf(log, "No API tokens in %s; the API is open to anyone who can reach it\n", tokenFile)
+		}
+
+		var onFinish func(Job)
+		if len(cfg.Webhooks) > 0 {
+			if err := validateWebhooks(cfg.Webhooks); err != nil {
+				return err
+			}
+			deadLetter := webhookDeadLetter
+			if deadLetter == "" {
+				dir, err := defaultStateDir()
+				if err != nil {
+					return fmt.Errorf("failed to locate state directory: %v", err)
+				}
+				deadLetter = filepath.Join(dir, "webhooks-dead-letter.jsonl")
+			}
+			hooks := newWebhookDispatcher(ctx, cfg.Webhooks, deadLetter, log)
+			defer hooks.Wait()
+			onFinish = hooks.Notify
+		}
+
+		store, err := openJobStoreAt(serveDB)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		resolve := newJobResolver(cfg, cmd.Flags(), selectedProfile(), root)
+		jobs, err := newJobManager(ctx, d, resolve, jobManagerOptions{
+			Workers:   serveWorkers,
+			QueueSize: serveQueueSize,
+			Store:     store,
+			Retention: serveRetention,
+			Log:       log,
+			Metrics:   stats,
+			OnFinish:  onFinish,
+		})
+		if err != nil {
+			return err
+		}
+		srv := &server{
+			jobs:    jobs,
+			options: newServerOptions(cfg, selectedProfile()),
+			root:    root,
+			tokens:  tokens,
+			metrics: stats,
+			ready:   newReadiness(ytdl),
+			log:     log,
+		}
+		return listenAndServe(ctx, serveAddr, srv.routes(), log, jobs.Wait)
+	},
+}
+
+// listenAndServe serves h on addr until ctx is done, then shuts the server
+// down gracefully and calls wait before returning.
+func listenAndServe(ctx context.Context, addr string, h http.Handler, log io.Writer, wait func()) error {
+	srv := &http.Server{Addr: addr, Handler: h, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Fprintf(log, "Listening on %s\n", addr)
+	err := srv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	if ctx.Err() != nil {
+		wait()
+	}
+	return err
+}
+
+func init() {
+	serveCmd.Flags().StringVar(&serveAddr, "addr", "localhost:8080", "Address to listen on")
+	serveCmd.Flags().IntVar(&serveWorkers, "workers", 2, "Number of concurrent downloads")
+	serveCmd.Flags().IntVar(&serveQueueSize, "queue-size", 100, "Maximum number of queued jobs")
+	serveCmd.Flags().StringVar(&serveDB, "db", "", "Job database file (default $XDG_STATE_HOME/yt2mp3/jobs.db)")
+	serveCmd.Flags().StringVar(&tokensPath, "tokens", "", "Token file (default $XDG_STATE_HOME/yt2mp3/tokens.json)")
+	serveCmd.Flags().StringVar(&webhookDeadLetter, "webhook-dead-letter", "", "Log of undeliverable webhooks (default $XDG_STATE_HOME/yt2mp3/webhooks-dead-letter.jsonl)")
+	serveCmd.Flags().DurationVar(&serveRetention, "retention", defaultJobRetention, "How long finished jobs stay queryable (0 keeps them forever)")
+	rootCmd.AddCommand(serveCmd)
+}
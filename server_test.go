@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer starts an API server backed by d that writes into a
+// temporary output root.
+func newTestServer(t *testing.T, d downloader, workers, queueSize int) (*httptest.Server, *jobManager, string) {
+	t.Helper()
+	root := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	resolve := newJobResolver(&Config{}, nil, "", root)
+	jobs, err := newJobManager(ctx, d, resolve, jobManagerOptions{Workers: workers, QueueSize: queueSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer((&server{jobs: jobs, root: root}).routes())
+	t.Cleanup(func() {
+		ts.Close()
+		cancel()
+		jobs.Wait()
+	})
+	return ts, jobs, root
+}
+
+// doJSON sends a request with an optional JSON body and decodes the JSON
+// response into out, returning the status code.
+func doJSON(t *testing.T, method, url string, body any, out any) int {
+	t.Helper()
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// waitForJob polls the job until cond holds or the test times out.
+func waitForJob(t *testing.T, base, id string, cond func(Job) bool) Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var job Job
+		doJSON(t, http.MethodGet, base+"/jobs/"+id, nil, &job)
+		if cond(job) {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for job %s (state %q)", id, job.State)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForState polls the job until it reaches state.
+func waitForState(t *testing.T, base, id, state string) Job {
+	t.Helper()
+	return waitForJob(t, base, id, func(j Job) bool { return j.State == state })
+}
+
+func TestServerJobLifecycle(t *testing.T) {
+	d := &fakeDownloader{info: map[string]videoInfo{
+		"https://youtu.be/abc": {ID: "abc", Title: "Song"},
+	}}
+	ts, _, root := newTestServer(t, d, 1, 10)
+
+	var job Job
+	status := doJSON(t, http.MethodPost, ts.URL+"/jobs", JobRequest{URL: "https://youtu.be/abc"}, &job)
+	if status != http.StatusAccepted || job.ID == "" || job.State != jobQueued {
+		t.Fatalf("create: status %d, job %+v", status, job)
+	}
+
+	done := waitForState(t, ts.URL, job.ID, jobDone)
+	if done.Result == nil || done.Result.FinalPath != filepath.Join(root, "Song.mp3") {
+		t.Fatalf("unexpected result: %+v", done.Result)
+	}
+	if done.Progress != 100 {
+		t.Errorf("progress = %v, want 100", done.Progress)
+	}
+
+	resp, err := http.Get(ts.URL + "/jobs/" + job.ID + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("file: status %d", resp.StatusCode)
+	}
+	if cd := resp.Header.Get("Content-Disposition"); !strings.Contains(cd, "Song.mp3") {
+		t.Errorf("Content-Disposition = %q", cd)
+	}
+
+	var list []Job
+	doJSON(t, http.MethodGet, ts.URL+"/jobs", nil, &list)
+	if len(list) != 1 || list[0].ID != job.ID {
+		t.Errorf("list = %+v", list)
+	}
+
+	if status := doJSON(t, http.MethodDelete, ts.URL+"/jobs/"+job.ID, nil, nil); status != http.StatusConflict {
+		t.Errorf("cancel finished job: status %d, want 409", status)
+	}
+}
+
+func TestServerCancel(t *testing.T) {
+	d := &fakeDownloader{block: make(chan struct{})}
+	defer close(d.block)
+	ts, _, _ := newTestServer(t, d, 1, 10)
+
+	var running, queued Job
+	doJSON(t, http.MethodPost, ts.URL+"/jobs", JobRequest{URL: "https://youtu.be/one"}, &running)
+	waitForState(t, ts.URL, running.ID, jobDownloading)
+	doJSON(t, http.MethodPost, ts.URL+"/jobs", JobRequest{URL: "https://youtu.be/two"}, &queued)
+
+	var canceled Job
+	if status := doJSON(t, http.MethodDelete, ts.URL+"/jobs/"+queued.ID, nil, &canceled); status != http.StatusOK || canceled.State != jobCanceled {
+		t.Errorf("cancel queued: status %d, state %q", status, canceled.State)
+	}
+	if status := doJSON(t, http.MethodDelete, ts.URL+"/jobs/"+running.ID, nil, &canceled); status != http.StatusOK {
+		t.Errorf("cancel running: status %d", status)
+	}
+	// Cancel returns before the worker has recorded the pipeline result.
+	job := waitForJob(t, ts.URL, running.ID, func(j Job) bool { return j.Result != nil })
+	if job.State != jobCanceled || job.Result.ErrorCode != "interrupted" {
+		t.Errorf("canceled job result: %+v", job.Result)
+	}
+
+	resp, err := http.Get(ts.URL + "/jobs/" + running.ID + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("file of canceled job: status %d, want 409", resp.StatusCode)
+	}
+}
+
+func TestServerRejectsBadRequests(t *testing.T) {
+	d := &fakeDownloader{block: make(chan struct{})}
+	defer close(d.block)
+	ts, _, _ := newTestServer(t, d, 1, 1)
+
+	tests := []struct {
+		name   string
+		body   any
+		status int
+		code   string
+	}{
+		{"invalid URL", JobRequest{URL: "not a url"}, http.StatusBadRequest, "invalid_url"},
+		{"unknown profile", JobRequest{URL: "https://youtu.be/x", Profile: "nope"}, http.StatusBadRequest, ""},
+		{"escaping output dir", map[string]any{"url": "https://youtu.be/x", "options": map[string]string{"output_dir": "../x"}}, http.StatusBadRequest, "output_dir"},
+		{"unknown field", map[string]string{"url": "https://youtu.be/x", "bogus": "1"}, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body map[string]string
+			status := doJSON(t, http.MethodPost, ts.URL+"/jobs", tt.body, &body)
+			if status != tt.status {
+				t.Errorf("status = %d, want %d (%v)", status, tt.status, body)
+			}
+			if body["error_code"] != tt.code {
+				t.Errorf("error_code = %q, want %q", body["error_code"], tt.code)
+			}
+		})
+	}
+
+	if status := doJSON(t, http.MethodGet, ts.URL+"/jobs/missing", nil, nil); status != http.StatusNotFound {
+		t.Errorf("unknown job: status %d", status)
+	}
+
+	// One running plus one queued fills a queue of size 1.
+	var first Job
+	doJSON(t, http.MethodPost, ts.URL+"/jobs", JobRequest{URL: "https://youtu.be/1"}, &first)
+	waitForState(t, ts.URL, first.ID, jobDownloading)
+	doJSON(t, http.MethodPost, ts.URL+"/jobs", JobRequest{URL: "https://youtu.be/2"}, nil)
+	if status := doJSON(t, http.MethodPost, ts.URL+"/jobs", JobRequest{URL: "https://youtu.be/3"}, nil); status != http.StatusServiceUnavailable {
+		t.Errorf("full queue: status %d, want 503", status)
+	}
+}
+
+func TestConfineDir(t *testing.T) {
+	root := t.TempDir()
+	if dir, err := confineDir(root, "podcasts/show"); err != nil || dir != filepath.Join(root, "podcasts", "show") {
+		t.Errorf("got (%q, %v)", dir, err)
+	}
+	if dir, err := confineDir(root, ""); err != nil || dir != root {
+		t.Errorf("got (%q, %v)", dir, err)
+	}
+	for _, bad := range []string{"../escape", "a/../../escape", filepath.Join(root, "abs")} {
+		if _, err := confineDir(root, bad); err == nil {
+			t.Errorf("confineDir(%q) should fail", bad)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenSocket listens on the Unix socket at path, which only the owner
+// may connect to. The socket is created with that mode rather than
+// restricted afterwards, so no other user can connect in between. The umask
+// is process-wide, so this runs before the daemon starts any work.
+func listenSocket(path string) (net.Listener, error) {
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
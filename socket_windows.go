@@ -0,0 +1,11 @@
+//go:build windows
+
+package main
+
+import "net"
+
+// listenSocket listens on the Unix socket at path. Windows has no socket
+// file modes; access follows the ACL of the socket directory.
+func listenSocket(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,788 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// Subscriptions file option
+	subscriptionsPath string
+	// Options for subscribe add
+	subscribeName        string
+	subscribeDir         string
+	subscribeMatch       string
+	subscribeReject      string
+	subscribeMinDuration time.Duration
+	subscribeMaxDuration time.Duration
+	subscribeMaxItems    int
+	subscribeMirror      bool
+	subscribePLS         bool
+	// Loop interval option for sync
+	syncInterval time.Duration
+	// Mirror mode options for sync
+	syncMirror    bool
+	syncDryRun    bool
+	syncTrashDir  string
+	syncDeleteOld bool
+	// PLS playlist option for sync
+	syncPLS bool
+)
+
+// unsafeNameCharsRe matches runs of characters not allowed in names.
+var unsafeNameCharsRe = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// Subscription is a playlist or channel that sync keeps downloading.
+type Subscription struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// Profile is the config profile the downloads use.
+	Profile string `yaml:"profile,omitempty"`
+	// OutputDir defaults to a directory named after the subscription in
+	// the profile's output directory.
+	OutputDir string `yaml:"output_dir,omitempty"`
+	// MatchTitle and RejectTitle are regular expressions that entry titles
+	// must match or must not match.
+	MatchTitle  string `yaml:"match_title,omitempty"`
+	RejectTitle string `yaml:"reject_title,omitempty"`
+	// MinDuration and MaxDuration skip entries of known duration outside
+	// the range, given as Go durations such as "10m".
+	MinDuration string `yaml:"min_duration,omitempty"`
+	MaxDuration string `yaml:"max_duration,omitempty"`
+	// MaxItems caps the downloads per sync; zero means no limit.
+	MaxItems int `yaml:"max_items,omitempty"`
+	// Mirror removes local tracks that left the playlist and renumbers
+	// the rest to match the playlist order on every sync.
+	Mirror bool `yaml:"mirror,omitempty"`
+	// PLS writes a PLS playlist next to the M3U8 one.
+	PLS bool `yaml:"pls,omitempty"`
+	// Archive is the download archive; it defaults to NAME.txt in the
+	// archives directory under the state directory.
+	Archive string `yaml:"archive,omitempty"`
+}
+
+// subscriptionFile is the on-disk layout of the subscriptions file.
+type subscriptionFile struct {
+	Subscriptions []Subscription `yaml:"subscriptions"`
+}
+
+// subscriptionFilter is the compiled form of a subscription's filters.
+type subscriptionFilter struct {
+	match, reject            *regexp.Regexp
+	minDuration, maxDuration time.Duration
+}
+
+// filter compiles the subscription's filters.
+func (sub Subscription) filter() (subscriptionFilter, error) {
+	var f subscriptionFilter
+	var err error
+	if sub.MatchTitle != "" {
+		if f.match, err = regexp.Compile(sub.MatchTitle); err != nil {
+			return f, fmt.Errorf("subscription %s: invalid match_title: %v", sub.Name, err)
+		}
+	}
+	if sub.RejectTitle != "" {
+		if f.reject, err = regexp.Compile(sub.RejectTitle); err != nil {
+			return f, fmt.Errorf("subscription %s: invalid reject_title: %v", sub.Name, err)
+		}
+	}
+	if sub.MinDuration != "" {
+		if f.minDuration, err = time.ParseDuration(sub.MinDuration); err != nil {
+			return f, fmt.Errorf("subscription %s: invalid min_duration: %v", sub.Name, err)
+		}
+	}
+	if sub.MaxDuration != "" {
+		if f.maxDuration, err = time.ParseDuration(sub.MaxDuration); err != nil {
+			return f, fmt.Errorf("subscription %s: invalid max_duration: %v", sub.Name, err)
+		}
+	}
+	return f, nil
+}
+
+// accepts reports whether e passes the filters. Live and upcoming streams
+// never do, as there is nothing to download yet.
+func (f subscriptionFilter) accepts(e playlistEntry) bool {
+	if e.LiveStatus == "is_live" || e.LiveStatus == "is_upcoming" {
+		return false
+	}
+	if f.match != nil && !f.match.MatchString(e.Title) {
+		return false
+	}
+	if f.reject != nil && f.reject.MatchString(e.Title) {
+		return false
+	}
+	d := time.Duration(e.Duration * float64(time.Second))
+	if d > 0 && f.minDuration > 0 && d < f.minDuration {
+		return false
+	}
+	if d > 0 && f.maxDuration > 0 && d > f.maxDuration {
+		return false
+	}
+	return true
+}
+
+// validate checks the subscription before it is saved or synced.
+func (sub Subscription) validate() error {
+	if !userNameRe.MatchString(sub.Name) {
+		return fmt.Errorf("invalid subscription name %q: use letters, digits, '.', '_' and '-'", sub.Name)
+	}
+	if err := validateURL(sub.URL); err != nil {
+		return err
+	}
+	if sub.MaxItems < 0 {
+		return fmt.Errorf("subscription %s: max_items must not be negative", sub.Name)
+	}
+	_, err := sub.filter()
+	return err
+}
+
+// subscriptionName derives a default name from a playlist or channel URL:
+// the playlist ID, or the last path segment such as a channel handle.
+func subscriptionName(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	name := u.Query().Get("list")
+	if name == "" {
+		segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+		for i := len(segments) - 1; i >= 0; i-- {
+			switch segments[i] {
+			case "videos", "streams", "shorts", "featured", "playlists":
+				continue
+			}
+			name = segments[i]
+			break
+		}
+	}
+	name = strings.TrimPrefix(name, "@")
+	name = unsafeNameCharsRe.ReplaceAllString(name, "-")
+	return strings.Trim(name, "-.")
+}
+
+// defaultSubscriptionsPath returns subscriptions.yaml next to the default
+// config file.
+func defaultSubscriptionsPath() (string, error) {
+	path, err := defaultConfigPath()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate config directory: %v", err)
+	}
+	return filepath.Join(filepath.Dir(path), "subscriptions.yaml"), nil
+}
+
+// resolveSubscriptionsPath returns the --subscriptions value or the default
+// path.
+func resolveSubscriptionsPath() (string, error) {
+	if subscriptionsPath != "" {
+		return subscriptionsPath, nil
+	}
+	return defaultSubscriptionsPath()
+}
+
+// loadSubscriptions reads the subscriptions file at path. A missing file
+// holds no subscriptions.
+func loadSubscriptions(path string) ([]Subscription, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read subscriptions file: %v", err)
+	}
+	var f subscriptionFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse subscriptions file %s: %v", path, err)
+	}
+	return f.Subscriptions, nil
+}
+
+// saveSubscriptions atomically replaces the subscriptions file at path.
+func saveSubscriptions(path string, subs []Subscription) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create subscriptions file directory: %v", err)
+	}
+	data, err := yaml.Marshal(subscriptionFile{Subscriptions: subs})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".subscriptions-*.yaml")
+	if err != nil {
+		return fmt.Errorf("failed to write subscriptions file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write subscriptions file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write subscriptions file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write subscriptions file: %v", err)
+	}
+	return nil
+}
+
+// downloadArchive is a download archive in yt-dlp's --download-archive
+// format: one "extractor id" line per downloaded video.
+type downloadArchive struct {
+	path string
+	keys map[string]bool
+}
+
+// openArchive reads the archive at path; a missing file is empty.
+func openArchive(path string) (*downloadArchive, error) {
+	a := &downloadArchive{path: path, keys: make(map[string]bool)}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read download archive: %v", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			a.keys[line] = true
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read download archive: %v", err)
+	}
+	return a, nil
+}
+
+// has reports whether the archive lists key.
+func (a *downloadArchive) has(key string) bool {
+	return a.keys[key]
+}
+
+// add appends key to the archive file.
+func (a *downloadArchive) add(key string) error {
+	if a.keys[key] {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(a.path), 0755); err != nil {
+		return fmt.Errorf("failed to update download archive: %v", err)
+	}
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to update download archive: %v", err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, key); err != nil {
+		return fmt.Errorf("failed to update download archive: %v", err)
+	}
+	a.keys[key] = true
+	return nil
+}
+
+// expandHome returns path with a leading "~" expanded, like output_dir in
+// the config file.
+func expandHome(path string) string {
+	p := Profile{OutputDir: &path}
+	p.expandHome()
+	return *p.OutputDir
+}
+
+// outputDir returns the directory the subscription downloads into: its own
+// output_dir, or a directory named after it inside base.
+func (sub Subscription) outputDir(base string) string {
+	if sub.OutputDir != "" {
+		return expandHome(sub.OutputDir)
+	}
+	return filepath.Join(base, sub.Name)
+}
+
+// archivePath returns the subscription's download archive.
+func (sub Subscription) archivePath() (string, error) {
+	if sub.Archive != "" {
+		return expandHome(sub.Archive), nil
+	}
+	dir, err := defaultStateDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate state directory: %v", err)
+	}
+	return filepath.Join(dir, "archives", sub.Name+".txt"), nil
+}
+
+// newEntries returns the entries that are not in the archive and pass the
+// filters, in listing order and capped at the subscription's max_items.
+func (sub Subscription) newEntries(entries []playlistEntry, archive *downloadArchive) ([]playlistEntry, error) {
+	f, err := sub.filter()
+	if err != nil {
+		return nil, err
+	}
+	var fresh []playlistEntry
+	for _, e := range entries {
+		if archive.has(e.archiveKey()) || !f.accepts(e) {
+			continue
+		}
+		if sub.MaxItems > 0 && len(fresh) == sub.MaxItems {
+			break
+		}
+		fresh = append(fresh, e)
+	}
+	return fresh, nil
+}
+
+// syncer downloads the new entries of subscriptions.
+type syncer struct {
+	lister playlistLister
+	d      downloader
+	out    io.Writer
+	log    io.Writer
+	// settings resolves the settings for a subscription's profile.
+	settings func(profile string) (Settings, map[string]string, error)
+
+	// mirror applies mirror mode to every subscription.
+	mirror bool
+	// dryRun prints the planned downloads and mirror changes instead.
+	dryRun bool
+	// trashDir receives removed tracks; the default is .trash in the
+	// subscription's output directory.
+	trashDir string
+	// deleteRemoved deletes removed tracks instead of moving them.
+	deleteRemoved bool
+	// pls writes PLS playlists for every subscription.
+	pls bool
+}
+
+// syncOne downloads the new entries of sub into its output directory and
+// records each success in its archive. In mirror mode it then removes the
+// tracks that left the playlist and renumbers the rest. Finally it writes
+// the directory's playlist files in playlist order.
+func (s *syncer) syncOne(ctx context.Context, sub Subscription) error {
+	settings, sources, err := s.settings(sub.Profile)
+	if err != nil {
+		return err
+	}
+	if sub.OutputDir != "" {
+		sources["output_dir"] = "subscription"
+	}
+	settings.OutputDir = sub.outputDir(settings.OutputDir)
+	archivePath, err := sub.archivePath()
+	if err != nil {
+		return err
+	}
+	archive, err := openArchive(archivePath)
+	if err != nil {
+		return err
+	}
+
+	pl, err := s.lister.List(ctx, sub.URL)
+	if err != nil {
+		return err
+	}
+	entries, err := sub.newEntries(pl.Entries, archive)
+	if err != nil {
+		return err
+	}
+	err = s.download(ctx, sub, pl, entries, settings, sources, archive)
+	if (s.mirror || sub.Mirror) && ctx.Err() == nil {
+		if mirrorErr := s.mirrorDir(sub, pl, settings.OutputDir); mirrorErr != nil && err == nil {
+			err = mirrorErr
+		}
+	}
+	if !s.dryRun && ctx.Err() == nil {
+		if plErr := s.writePlaylist(sub, pl, settings.OutputDir); plErr != nil && err == nil {
+			err = plErr
+		}
+	}
+	return err
+}
+
+// writePlaylist writes the playlist files of dir in the order of pl, so
+// players do not fall back to sorting the tracks by name.
+func (s *syncer) writePlaylist(sub Subscription, pl playlist, dir string) error {
+	tracks, err := readTracks(dir, s.log)
+	if err != nil || len(tracks) == 0 {
+		return err
+	}
+	orderByPlaylist(tracks, pl.Entries)
+	name, err := playlistFileName(dir)
+	if err != nil {
+		return err
+	}
+	_, err = writePlaylistFiles(dir, name, tracks, s.pls || sub.PLS)
+	return err
+}
+
+// download fetches entries, the new entries of pl, and adds each success to
+// the archive. MP3 files are numbered by their position in pl, so that
+// playlist rebuild can restore its order.
+func (s *syncer) download(ctx context.Context, sub Subscription, pl playlist, entries []playlistEntry, settings Settings, sources map[string]string, archive *downloadArchive) error {
+	if len(entries) == 0 {
+		fmt.Fprintf(s.log, "%s: no new entries\n", sub.Name)
+		return nil
+	}
+	if s.dryRun {
+		for _, e := range entries {
+			fmt.Fprintf(s.out, "would download %s (%s)\n", e.URL, e.Title)
+		}
+		return nil
+	}
+	fmt.Fprintf(s.log, "%s: downloading %d new entries\n", sub.Name, len(entries))
+	if err := ensureOutputDir(settings.OutputDir, sources["output_dir"]); err != nil {
+		return err
+	}
+
+	urls := make([]string, len(entries))
+	for i, e := range entries {
+		urls[i] = e.URL
+	}
+	printer, err := newResultPrinter(formatText, s.out)
+	if err != nil {
+		return err
+	}
+	position := playlistPositions(pl.Entries)
+	numbered := !overriddenFrames(settings.Tags)["TRCK"]
+	return runBatch(ctx, urls, func(ctx context.Context, i int) (*Result, error) {
+		res, err := processURL(ctx, s.d, urls[i], settings, s.log, nil)
+		if err == nil {
+			if err := archive.add(entries[i].archiveKey()); err != nil {
+				fmt.Fprintf(s.log, "Warning: %v\n", err)
+			}
+			if pos := position[entries[i].ID]; numbered && pos > 0 {
+				numberTrack(res, fmt.Sprintf("%d/%d", pos, len(pl.Entries)), s.log)
+			}
+		}
+		return res, err
+	}, printer, s.log)
+}
+
+// numberTrack sets the track number of the MP3 file of res.
+func numberTrack(res *Result, track string, log io.Writer) {
+	if !strings.EqualFold(filepath.Ext(res.FinalPath), ".mp3") {
+		return
+	}
+	if err := setTrackNumber(res.FinalPath, track); err != nil {
+		fmt.Fprintf(log, "Warning: failed to number %s: %v\n", res.FinalPath, err)
+		return
+	}
+	if res.Tags == nil {
+		res.Tags = map[string]string{}
+	}
+	res.Tags["track"] = track
+}
+
+// mirrorDir makes the tracks in dir match pl: files whose video is no
+// longer listed are moved to the trash directory (or deleted), and track
+// numbers follow the playlist order.
+func (s *syncer) mirrorDir(sub Subscription, pl playlist, dir string) error {
+	if len(pl.Entries) == 0 {
+		// An empty listing is more likely a hiccup than a purge.
+		fmt.Fprintf(s.log, "%s: the playlist is empty; not mirroring\n", sub.Name)
+		return nil
+	}
+	tracks, err := readLocalTracks(dir, s.log)
+	if err != nil {
+		return err
+	}
+	plan := planMirror(pl.Entries, tracks)
+	if s.dryRun {
+		plan.print(s.out, "would ")
+		return nil
+	}
+	plan.print(s.log, sub.Name+": ")
+	trashDir := s.trashDir
+	if trashDir == "" {
+		trashDir = filepath.Join(dir, ".trash")
+	}
+	if s.deleteRemoved {
+		trashDir = ""
+	}
+	return plan.apply(trashDir)
+}
+
+// syncAll syncs subs one after another. A failing subscription does not
+// stop the others; the returned error summarizes the failures.
+func (s *syncer) syncAll(ctx context.Context, subs []Subscription) error {
+	var firstErr error
+	failed := 0
+	for _, sub := range subs {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := s.syncOne(ctx, sub); err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+			fmt.Fprintf(s.log, "%s: %v\n", sub.Name, err)
+		}
+	}
+	if ctx.Err() != nil {
+		return classify(ErrInterrupted, ctx.Err())
+	}
+	return batchError(failed, len(subs), firstErr, "subscriptions")
+}
+
+// selectSubscriptions returns the subscriptions named in names, or all of
+// them if names is empty.
+func selectSubscriptions(subs []Subscription, names []string) ([]Subscription, error) {
+	if len(names) == 0 {
+		return subs, nil
+	}
+	var selected []Subscription
+	for _, name := range names {
+		found := false
+		for _, sub := range subs {
+			if sub.Name == name {
+				selected = append(selected, sub)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown subscription %q", name)
+		}
+	}
+	return selected, nil
+}
+
+// printSubscriptions writes subs as a table.
+func printSubscriptions(w io.Writer, subs []Subscription) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tPROFILE\tMAX ITEMS\tURL")
+	for _, sub := range subs {
+		profile, maxItems := sub.Profile, "unlimited"
+		if profile == "" {
+			profile = "-"
+		}
+		if sub.MaxItems > 0 {
+			maxItems = fmt.Sprint(sub.MaxItems)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", sub.Name, profile, maxItems, sub.URL)
+	}
+	return tw.Flush()
+}
+
+var subscribeCmd = &cobra.Command{
+	Use:   "subscribe",
+	Short: "Manage playlist and channel subscriptions for sync",
+}
+
+var subscribeAddCmd = &cobra.Command{
+	Use:          "add URL",
+	Short:        "Subscribe to a playlist or channel",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := resolveSubscriptionsPath()
+		if err != nil {
+			return err
+		}
+		subs, err := loadSubscriptions(path)
+		if err != nil {
+			return err
+		}
+		sub := Subscription{
+			Name:        subscribeName,
+			URL:         args[0],
+			Profile:     profileName,
+			OutputDir:   subscribeDir,
+			MatchTitle:  subscribeMatch,
+			RejectTitle: subscribeReject,
+			MaxItems:    subscribeMaxItems,
+			Mirror:      subscribeMirror,
+			PLS:         subscribePLS,
+		}
+		if sub.Name == "" {
+			sub.Name = subscriptionName(sub.URL)
+		}
+		if subscribeMinDuration > 0 {
+			sub.MinDuration = subscribeMinDuration.String()
+		}
+		if subscribeMaxDuration > 0 {
+			sub.MaxDuration = subscribeMaxDuration.String()
+		}
+		if sub.Profile != "" {
+			cfg, err := loadConfigFile()
+			if err != nil {
+				return err
+			}
+			if _, ok := cfg.Profiles[sub.Profile]; !ok {
+				return fmt.Errorf("unknown profile %q", sub.Profile)
+			}
+		}
+		if err := sub.validate(); err != nil {
+			return err
+		}
+		for _, s := range subs {
+			if s.Name == sub.Name {
+				return fmt.Errorf("subscription %q already exists", sub.Name)
+			}
+		}
+		if err := saveSubscriptions(path, append(subs, sub)); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Subscribed to %s as %s\n", sub.URL, sub.Name)
+		return nil
+	},
+}
+
+var subscribeRemoveCmd = &cobra.Command{
+	Use:          "remove NAME",
+	Short:        "Remove a subscription",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := resolveSubscriptionsPath()
+		if err != nil {
+			return err
+		}
+		subs, err := loadSubscriptions(path)
+		if err != nil {
+			return err
+		}
+		kept := make([]Subscription, 0, len(subs))
+		for _, sub := range subs {
+			if sub.Name != args[0] {
+				kept = append(kept, sub)
+			}
+		}
+		if len(kept) == len(subs) {
+			return fmt.Errorf("unknown subscription %q", args[0])
+		}
+		if err := saveSubscriptions(path, kept); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Removed subscription %s\n", args[0])
+		return nil
+	},
+}
+
+var subscribeListCmd = &cobra.Command{
+	Use:          "list",
+	Short:        "List subscriptions",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := resolveSubscriptionsPath()
+		if err != nil {
+			return err
+		}
+		subs, err := loadSubscriptions(path)
+		if err != nil {
+			return err
+		}
+		return printSubscriptions(cmd.OutOrStdout(), subs)
+	},
+}
+
+var syncCmd = &cobra.Command{
+	Use:   "sync [NAME...]",
+	Short: "Download new entries of all or the named subscriptions",
+	Long: `Download new entries of all or the named subscriptions.
+
+Each subscription has a download archive of the videos it already fetched,
+so only new entries are downloaded. Without --interval sync runs once,
+which suits cron; with it, sync repeats until interrupted.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		log := cmd.ErrOrStderr()
+		path, err := resolveSubscriptionsPath()
+		if err != nil {
+			return err
+		}
+		subs, err := loadSubscriptions(path)
+		if err != nil {
+			return err
+		}
+		if subs, err = selectSubscriptions(subs, args); err != nil {
+			return err
+		}
+		if len(subs) == 0 {
+			return fmt.Errorf("no subscriptions in %s; add one with 'yt2mp3 subscribe add URL'", path)
+		}
+		for _, sub := range subs {
+			if err := sub.validate(); err != nil {
+				return err
+			}
+		}
+		cfg, err := loadConfigFile()
+		if err != nil {
+			return err
+		}
+
+		tempDir, err := os.MkdirTemp("", "yt2mp3")
+		if err != nil {
+			return fmt.Errorf("failed to create temp directory: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+		ytdl, err := newYtDlp(tempDir)
+		if err != nil {
+			return err
+		}
+		policy := newRetryPolicy(retries, retryMaxWait)
+		s := &syncer{
+			lister:        retryingLister{playlistLister: ytdl, policy: policy, log: log},
+			d:             retryingDownloader{downloader: ytdl, policy: policy, log: log},
+			out:           cmd.OutOrStdout(),
+			log:           log,
+			mirror:        syncMirror,
+			dryRun:        syncDryRun,
+			trashDir:      syncTrashDir,
+			deleteRemoved: syncDeleteOld,
+			pls:           syncPLS,
+			settings: func(profile string) (Settings, map[string]string, error) {
+				if profile == "" {
+					profile = selectedProfile()
+				}
+				return resolveSettings(cfg, profile, os.Getenv, cmd.Flags())
+			},
+		}
+
+		ctx := cmd.Context()
+		if syncInterval <= 0 {
+			return s.syncAll(ctx, subs)
+		}
+		for {
+			if err := s.syncAll(ctx, subs); err != nil && ctx.Err() == nil {
+				fmt.Fprintf(log, "Sync failed: %v\n", err)
+			}
+			fmt.Fprintf(log, "Next sync at %s\n", time.Now().Add(syncInterval).Format(time.DateTime))
+			if err := sleepContext(ctx, syncInterval); err != nil {
+				return nil
+			}
+		}
+	},
+}
+
+func init() {
+	subscribeCmd.PersistentFlags().StringVar(&subscriptionsPath, "subscriptions", "", "Subscriptions file (default $XDG_CONFIG_HOME/yt2mp3/subscriptions.yaml)")
+	subscribeAddCmd.Flags().StringVar(&subscribeName, "name", "", "Subscription name (default derived from the URL)")
+	subscribeAddCmd.Flags().StringVar(&subscribeDir, "dir", "", "Output directory (default NAME in the profile's output directory)")
+	subscribeAddCmd.Flags().StringVar(&subscribeMatch, "match-title", "", "Only download entries whose title matches this regular expression")
+	subscribeAddCmd.Flags().StringVar(&subscribeReject, "reject-title", "", "Skip entries whose title matches this regular expression")
+	subscribeAddCmd.Flags().DurationVar(&subscribeMinDuration, "min-duration", 0, "Skip entries shorter than this")
+	subscribeAddCmd.Flags().DurationVar(&subscribeMaxDuration, "max-duration", 0, "Skip entries longer than this")
+	subscribeAddCmd.Flags().IntVar(&subscribeMaxItems, "max-items", 0, "Maximum downloads per sync (0 for unlimited)")
+	subscribeAddCmd.Flags().BoolVar(&subscribeMirror, "mirror", false, "Keep the output directory identical to the playlist on every sync")
+	subscribeAddCmd.Flags().BoolVar(&subscribePLS, "pls", false, "Write a PLS playlist next to the M3U8 one")
+	subscribeCmd.AddCommand(subscribeAddCmd, subscribeRemoveCmd, subscribeListCmd)
+
+	syncCmd.Flags().StringVar(&subscriptionsPath, "subscriptions", "", "Subscriptions file (default $XDG_CONFIG_HOME/yt2mp3/subscriptions.yaml)")
+	syncCmd.Flags().DurationVar(&syncInterval, "interval", 0, "Sync repeatedly with this pause in between (default: once)")
+	syncCmd.Flags().BoolVar(&syncMirror, "mirror", false, "Remove local tracks that left the playlist and renumber the rest")
+	syncCmd.Flags().BoolVar(&syncDryRun, "dry-run", false, "Print planned downloads, removals and renumbering without changing anything")
+	syncCmd.Flags().StringVar(&syncTrashDir, "trash-dir", "", "Where mirror mode moves removed tracks (default .trash in the output directory)")
+	syncCmd.Flags().BoolVar(&syncDeleteOld, "delete", false, "Delete tracks removed by mirror mode instead of moving them to the trash")
+	syncCmd.Flags().BoolVar(&syncPLS, "pls", false, "Write PLS playlists next to the M3U8 ones")
+	rootCmd.AddCommand(subscribeCmd, syncCmd)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeLister returns canned playlists by URL.
+type fakeLister map[string]playlist
+
+func (f fakeLister) List(ctx context.Context, url string) (playlist, error) {
+	pl, ok := f[url]
+	if !ok {
+		return playlist{}, classify(ErrUnavailable, errors.New("playlist does not exist"))
+	}
+	return pl, nil
+}
+
+func TestSubscriptionNewEntries(t *testing.T) {
+	entries := []playlistEntry{
+		{ID: "1", Title: "Lecture 1", Duration: 3600},
+		{ID: "2", Title: "Lecture 2 (trailer)", Duration: 3600},
+		{ID: "3", Title: "Lecture 3", Duration: 30},
+		{ID: "4", Title: "Lecture 4", Duration: 7200},
+		{ID: "5", Title: "Lecture 5 live", LiveStatus: "is_live"},
+		{ID: "6", Title: "Lecture 6"},
+		{ID: "7", Title: "Q&A"},
+	}
+	archive := &downloadArchive{keys: map[string]bool{"youtube 1": true}}
+	tests := []struct {
+		name string
+		sub  Subscription
+		want []string
+	}{
+		{"archive only", Subscription{}, []string{"2", "3", "4", "6", "7"}},
+		{"title filters", Subscription{MatchTitle: `^Lecture`, RejectTitle: `(?i)trailer`}, []string{"3", "4", "6"}},
+		{"duration filters", Subscription{MinDuration: "1m", MaxDuration: "1h30m"}, []string{"2", "6", "7"}},
+		{"max items", Subscription{MatchTitle: `^Lecture`, MaxItems: 2}, []string{"2", "3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.sub.newEntries(entries, archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, e := range got {
+				ids = append(ids, e.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("newEntries() = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubscriptionValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		sub     Subscription
+		wantErr bool
+	}{
+		{"valid", Subscription{Name: "talks", URL: "https://www.youtube.com/@talks", MinDuration: "5m", MaxItems: 3}, false},
+		{"bad name", Subscription{Name: "../x", URL: "https://www.youtube.com/@talks"}, true},
+		{"bad URL", Subscription{Name: "x", URL: "talks"}, true},
+		{"bad regexp", Subscription{Name: "x", URL: "https://youtu.be/x", MatchTitle: "("}, true},
+		{"bad duration", Subscription{Name: "x", URL: "https://youtu.be/x", MaxDuration: "long"}, true},
+		{"negative cap", Subscription{Name: "x", URL: "https://youtu.be/x", MaxItems: -1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.sub.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSubscriptionName(t *testing.T) {
+	tests := map[string]string{
+		"https://www.youtube.com/playlist?list=PLabc_123":    "PLabc_123",
+		"https://www.youtube.com/@SomeChannel/videos":        "SomeChannel",
+		"https://www.youtube.com/channel/UC123":              "UC123",
+		"https://www.youtube.com/c/Some%20Name/streams":      "Some-Name",
+		"https://www.youtube.com/watch?v=x&list=OLAK5uy_abc": "OLAK5uy_abc",
+	}
+	for raw, want := range tests {
+		if got := subscriptionName(raw); got != want {
+			t.Errorf("subscriptionName(%q) = %q, want %q", raw, got, want)
+		}
+	}
+}
+
+func TestSubscriptionsRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "subs", "subscriptions.yaml")
+	subs, err := loadSubscriptions(path)
+	if err != nil || subs != nil {
+		t.Fatalf("missing file = %v, %v", subs, err)
+	}
+	want := []Subscription{
+		{Name: "talks", URL: "https://www.youtube.com/@talks", Profile: "podcast", OutputDir: "~/Podcasts/talks", MaxItems: 5},
+		{Name: "mix", URL: "https://www.youtube.com/playlist?list=PL1", RejectTitle: "(?i)live"},
+	}
+	if err := saveSubscriptions(path, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadSubscriptions(path)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("loadSubscriptions() = %+v, %v", got, err)
+	}
+}
+
+func TestSync(t *testing.T) {
+	lister := fakeLister{
+		"https://www.youtube.com/@talks": {Entries: []playlistEntry{
+			{ID: "a", URL: "https://youtu.be/a", Title: "First"},
+			{ID: "b", URL: "https://youtu.be/b", Title: "Second"},
+			{ID: "c", URL: "https://youtu.be/c", Title: "Third"},
+		}},
+	}
+	d := &fakeDownloader{info: map[string]videoInfo{
+		"https://youtu.be/a": {ID: "a", Title: "First"},
+		"https://youtu.be/b": {ID: "b", Title: "Second"},
+		"https://youtu.be/c": {ID: "c", Title: "Third"},
+	}}
+	base := t.TempDir()
+	var stdout, stderr bytes.Buffer
+	s := &syncer{
+		lister: lister,
+		d:      d,
+		out:    &stdout,
+		log:    &stderr,
+		settings: func(profile string) (Settings, map[string]string, error) {
+			st := builtinSettings()
+			st.OutputDir = base
+			return st, map[string]string{}, nil
+		},
+	}
+	sub := Subscription{
+		Name:     "talks",
+		URL:      "https://www.youtube.com/@talks",
+		MaxItems: 2,
+		Archive:  filepath.Join(base, "archive.txt"),
+	}
+	ctx := context.Background()
+
+	if err := s.syncAll(ctx, []Subscription{sub}); err != nil {
+		t.Fatal(err)
+	}
+	if d.calls.Load() != 2 {
+		t.Errorf("first sync downloaded %d entries, want 2", d.calls.Load())
+	}
+	for _, name := range []string{"First.mp3", "Second.mp3"} {
+		if _, err := os.Stat(filepath.Join(base, "talks", name)); err != nil {
+			t.Error(err)
+		}
+	}
+	archive, err := os.ReadFile(sub.Archive)
+	if err != nil || string(archive) != "youtube a\nyoutube b\n" {
+		t.Errorf("archive = %q, %v", archive, err)
+	}
+
+	// The second run only fetches what is left.
+	if err := s.syncAll(ctx, []Subscription{sub}); err != nil {
+		t.Fatal(err)
+	}
+	if d.calls.Load() != 3 {
+		t.Errorf("downloads after second sync = %d, want 3", d.calls.Load())
+	}
+	stderr.Reset()
+	if err := s.syncAll(ctx, []Subscription{sub}); err != nil {
+		t.Fatal(err)
+	}
+	if d.calls.Load() != 3 || !strings.Contains(stderr.String(), "talks: no new entries") {
+		t.Errorf("third sync: %d downloads, log %q", d.calls.Load(), stderr.String())
+	}
+
+	// A broken subscription does not keep the others from syncing.
+	gone := Subscription{Name: "gone", URL: "https://www.youtube.com/@gone", Archive: filepath.Join(base, "gone.txt")}
+	err = s.syncAll(ctx, []Subscription{gone, sub})
+	if !errors.Is(err, ErrPartialFailure) {
+		t.Errorf("syncAll() error = %v, want partial failure", err)
+	}
+	if err := s.syncAll(ctx, []Subscription{gone}); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("syncAll() error = %v, want unavailable", err)
+	}
+}
+
+func TestSelectSubscriptions(t *testing.T) {
+	subs := []Subscription{{Name: "a"}, {Name: "b"}}
+	if got, err := selectSubscriptions(subs, nil); err != nil || len(got) != 2 {
+		t.Errorf("all = %v, %v", got, err)
+	}
+	if got, err := selectSubscriptions(subs, []string{"b"}); err != nil || len(got) != 1 || got[0].Name != "b" {
+		t.Errorf("named = %v, %v", got, err)
+	}
+	if _, err := selectSubscriptions(subs, []string{"c"}); err == nil {
+		t.Error("expected an error for an unknown subscription")
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bogem/id3v2"
+)
+
+// tagOverrideFrames maps the named keys of --tag to their frames.
+var tagOverrideFrames = map[string]string{
+	"title":        "TIT2",
+	"artist":       "TPE1",
+	"album":        "TALB",
+	"album_artist": "TPE2",
+	"year":         "TYER",
+	"genre":        "TCON",
+	"track":        "TRCK",
+	"comment":      "COMM",
+}
+
+var (
+	// rawTextFrameID matches the ID of a text frame, which --tag accepts
+	// besides the named keys.
+	rawTextFrameID = regexp.MustCompile(`^T[A-Z0-9]{3}$`)
+	// yearPattern matches a year.
+	yearPattern = regexp.MustCompile(`^[0-9]{4}$`)
+)
+
+// tagOverride is a parsed --tag KEY=VALUE.
+type tagOverride struct {
+	// Key is the key as the results report it: a named key such as
+	// "album_artist", a frame ID, or "TXXX:description".
+	Key   string
+	Frame string
+	// Desc is the description of a TXXX frame.
+	Desc  string
+	Value string
+}
+
+// parseTagOverride parses a KEY=VALUE tag override. Templates in the value
+// are checked for syntax only, since the fields they name are not known
+// until the video's info is.
+func parseTagOverride(s string) (tagOverride, error) {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return tagOverride{}, fmt.Errorf("invalid tag %q: want KEY=VALUE", s)
+	}
+	key = strings.TrimSpace(key)
+	o := tagOverride{Key: strings.ToLower(key), Value: value}
+	if frame, ok := tagOverrideFrames[o.Key]; ok {
+		o.Frame = frame
+	} else if desc, ok := strings.CutPrefix(key, "TXXX:"); ok && desc != "" {
+		o.Key, o.Frame, o.Desc = key, "TXXX", desc
+	} else if rawTextFrameID.MatchString(key) && key != "TXXX" {
+		o.Key, o.Frame = key, key
+	} else {
+		return tagOverride{}, fmt.Errorf("invalid tag %q: unknown key %q", s, key)
+	}
+
+	if _, err := expandTemplate(value, nil); err != nil {
+		return tagOverride{}, fmt.Errorf("invalid tag %q: %v", s, err)
+	}
+	if !strings.Contains(value, "{") && value != "" {
+		switch o.Frame {
+		case "TYER":
+			if !yearPattern.MatchString(value) {
+				return tagOverride{}, fmt.Errorf("invalid tag %q: year is not YYYY", s)
+			}
+		case "TRCK":
+			if !trackNumberPattern.MatchString(value) {
+				return tagOverride{}, fmt.Errorf("invalid tag %q: track is not a number or N/TOTAL", s)
+			}
+		}
+	}
+	return o, nil
+}
+
+// parseTagOverrides parses every override in tags.
+func parseTagOverrides(tags []string) ([]tagOverride, error) {
+	overrides := make([]tagOverride, 0, len(tags))
+	for _, t := range tags {
+		o, err := parseTagOverride(t)
+		if err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, nil
+}
+
+// expandTemplate replaces each {field} in s with the field of the video's
+// info JSON; "{{" and "}}" stand for literal braces. Fields the info does
+// not have expand to "". With nil fields only the syntax is checked.
+func expandTemplate(s string, fields map[string]any) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '{' && strings.HasPrefix(s[i:], "{{"):
+			b.WriteByte('{')
+			i++
+		case c == '}' && strings.HasPrefix(s[i:], "}}"):
+			b.WriteByte('}')
+			i++
+		case c == '}':
+			return "", fmt.Errorf("unmatched } in %q", s)
+		case c == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unclosed { in %q", s)
+			}
+			name := s[i+1 : i+end]
+			if name == "" || strings.ContainsAny(name, "{ ") {
+				return "", fmt.Errorf("invalid field {%s} in %q", name, s)
+			}
+			if fields != nil {
+				b.WriteString(formatInfoField(fields[name]))
+			}
+			i += end
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+// formatInfoField formats a value of the info JSON for a tag; lists are
+// joined with ", " and whole numbers lose their fraction.
+func formatInfoField(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case []any:
+		parts := make([]string, 0, len(v))
+		for _, e := range v {
+			if s := formatInfoField(e); s != "" {
+				parts = append(parts, s)
+			}
+		}
+		return strings.Join(parts, ", ")
+	}
+	return ""
+}
+
+// resolveTagOverrides expands the templates of overrides against info.
+func resolveTagOverrides(overrides []tagOverride, info videoInfo) []tagOverride {
+	resolved := make([]tagOverride, len(overrides))
+	for i, o := range overrides {
+		// The syntax was checked when the settings were validated.
+		o.Value, _ = expandTemplate(o.Value, info.fields)
+		if o.Frame == "TYER" && len(o.Value) > 4 && yearPattern.MatchString(o.Value[:4]) {
+			// Such as {upload_date} or {release_date}, which are YYYYMMDD.
+			o.Value = o.Value[:4]
+		}
+		resolved[i] = o
+	}
+	return resolved
+}
+
+// applyTagOverrides sets the frames of overrides in tag, replacing what
+// applyTrackTags wrote. An empty value removes the frame.
+func applyTagOverrides(tag *id3v2.Tag, overrides []tagOverride) {
+	for _, o := range overrides {
+		switch o.Frame {
+		case "TXXX":
+			setUserText(tag, o.Desc, o.Value)
+		case "COMM":
+			// Keep the comment that records the source URL.
+			others := tag.GetFrames("COMM")
+			tag.DeleteFrames("COMM")
+			for _, f := range others {
+				if c, ok := f.(id3v2.CommentFrame); ok && c.Description != "" {
+					tag.AddCommentFrame(c)
+				}
+			}
+			if o.Value != "" {
+				tag.AddCommentFrame(id3v2.CommentFrame{
+					Encoding: id3v2.EncodingUTF16,
+					Language: "eng",
+					Text:     o.Value,
+				})
+			}
+		case "TYER":
+			// The day and month would no longer match the year.
+			tag.DeleteFrames("TDAT")
+			tag.DeleteFrames("TDRC")
+			setTextFrame(tag, "TYER", o.Value)
+		default:
+			setTextFrame(tag, o.Frame, o.Value)
+		}
+	}
+}
+
+// applyOverrides sets the fields of t that overrides change and returns
+// the overrides of frames that t has no field for.
+func (t *trackTags) applyOverrides(overrides []tagOverride) []tagOverride {
+	var extra []tagOverride
+	for _, o := range overrides {
+		switch o.Frame {
+		case "TIT2":
+			t.Title = o.Value
+		case "TPE1":
+			t.Artist = o.Value
+		case "TALB":
+			t.Album = o.Value
+		case "TCON":
+			t.Genre = o.Value
+		case "TRCK":
+			t.Track = o.Value
+		case "TYER":
+			t.UploadDate = o.Value
+		default:
+			extra = append(extra, o)
+		}
+	}
+	return extra
+}
+
+// fieldsWithOverrides returns t.fields() as overrides change them. The
+// keys of overrides that t has no field for are added as given.
+func (t trackTags) fieldsWithOverrides(overrides []tagOverride) map[string]string {
+	extra := t.applyOverrides(overrides)
+	fields := t.fields()
+	for _, o := range extra {
+		if o.Value == "" {
+			delete(fields, o.Key)
+		} else {
+			fields[o.Key] = o.Value
+		}
+	}
+	return fields
+}
+
+// overriddenValue returns the current value in tag of the frame that o
+// sets, or "" if tag is nil.
+func overriddenValue(tag *id3v2.Tag, o tagOverride) string {
+	if tag == nil {
+		return ""
+	}
+	switch o.Frame {
+	case "TXXX":
+		for _, f := range tag.GetFrames("TXXX") {
+			if u, ok := f.(id3v2.UserDefinedTextFrame); ok && u.Description == o.Desc {
+				return u.Value
+			}
+		}
+		return ""
+	case "COMM":
+		for _, f := range tag.GetFrames("COMM") {
+			if c, ok := f.(id3v2.CommentFrame); ok && c.Description == "" {
+				return c.Text
+			}
+		}
+		return ""
+	}
+	return tag.GetTextFrame(o.Frame).Text
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bogem/id3v2"
+)
+
+func TestParseTagOverride(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    tagOverride
+		wantErr string
+	}{
+		{in: "Album_Artist=Various", want: tagOverride{Key: "album_artist", Frame: "TPE2", Value: "Various"}},
+		{in: "genre=", want: tagOverride{Key: "genre", Frame: "TCON"}},
+		{in: "album={channel} Live", want: tagOverride{Key: "album", Frame: "TALB", Value: "{channel} Live"}},
+		{in: "TXXX:source=yt=dlp", want: tagOverride{Key: "TXXX:source", Frame: "TXXX", Desc: "source", Value: "yt=dlp"}},
+		{in: "TPE3=Conductor", want: tagOverride{Key: "TPE3", Frame: "TPE3", Value: "Conductor"}},
+		{in: "year={upload_date}", want: tagOverride{Key: "year", Frame: "TYER", Value: "{upload_date}"}},
+		{in: "title", wantErr: "want KEY=VALUE"},
+		{in: "mood=happy", wantErr: `unknown key "mood"`},
+		{in: "TXXX=x", wantErr: "unknown key"},
+		{in: "APIC=x", wantErr: "unknown key"},
+		{in: "year=24", wantErr: "year is not YYYY"},
+		{in: "track=one", wantErr: "track is not a number"},
+		{in: "album={channel", wantErr: "unclosed {"},
+		{in: "album=a}b", wantErr: "unmatched }"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseTagOverride(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("parseTagOverride(%q) error = %v, want %q", tt.in, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("parseTagOverride(%q) = %+v, %v, want %+v", tt.in, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	fields := map[string]any{
+		"channel":    "Lofi Girl",
+		"view_count": 1234567.0,
+		"tags":       []any{"lofi", "study"},
+	}
+	tests := map[string]string{
+		"{channel} Live":        "Lofi Girl Live",
+		"{view_count} views":    "1234567 views",
+		"{tags}":                "lofi, study",
+		"{missing}x":            "x",
+		"{{literal}} {channel}": "{literal} Lofi Girl",
+		"no template":           "no template",
+	}
+	for in, want := range tests {
+		if got, err := expandTemplate(in, fields); err != nil || got != want {
+			t.Errorf("expandTemplate(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+}
+
+func TestProcessURLTagOverrides(t *testing.T) {
+	out := t.TempDir()
+	d := &fakeDownloader{info: map[string]videoInfo{
+		"https://youtu.be/abc": {ID: "abc", Title: "Set", Channel: "Club", UploadDate: "20230405"},
+	}}
+	s := Settings{OutputDir: out, AudioFormat: "mp3", AudioQuality: "0", Tags: []string{
+		"album={channel} Live",
+		"album_artist=Various Artists",
+		"year={upload_date}",
+		"genre=House",
+		"comment=recorded live",
+		"TXXX:source={id}",
+		"artist=",
+	}}
+
+	res, err := processURL(context.Background(), d, "https://youtu.be/abc", s, io.Discard, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"album":        "Club Live",
+		"album_artist": "Various Artists",
+		"date":         "2023",
+		"genre":        "House",
+		"comment":      "recorded live",
+		"TXXX:source":  "abc",
+	} {
+		if res.Tags[key] != want {
+			t.Errorf("result tag %s = %q, want %q", key, res.Tags[key], want)
+		}
+	}
+	if _, ok := res.Tags["artist"]; ok {
+		t.Errorf("removed artist is still reported: %v", res.Tags)
+	}
+
+	tag, err := id3v2.Open(filepath.Join(out, "Set.mp3"), id3v2.Options{Parse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tag.Close()
+	for id, want := range map[string]string{
+		"TALB": "Club Live",
+		"TPE2": "Various Artists",
+		"TYER": "2023",
+		"TDAT": "",
+		"TCON": "House",
+		"TPE1": "",
+	} {
+		if got := tag.GetTextFrame(id).Text; got != want {
+			t.Errorf("%s = %q, want %q", id, got, want)
+		}
+	}
+	if sourceURL(tag) != "https://youtu.be/abc" {
+		t.Error("the comment override replaced the source URL")
+	}
+	comments := 0
+	for _, f := range tag.GetFrames("COMM") {
+		if c, ok := f.(id3v2.CommentFrame); ok && c.Description == "" && c.Text == "recorded live" {
+			comments++
+		}
+	}
+	if comments != 1 {
+		t.Errorf("found %d comment frames with the override", comments)
+	}
+	found := false
+	for _, f := range tag.GetFrames("TXXX") {
+		if u, ok := f.(id3v2.UserDefinedTextFrame); ok && u.Description == "source" && u.Value == "abc" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("TXXX:source was not written")
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/spf13/cobra"
+)
+
+// JSON output option for tags show
+var tagsJSON bool
+
+// id3Encodings names the text encodings by their ID3v2 byte.
+var id3Encodings = []string{"ISO-8859-1", "UTF-16", "UTF-16BE", "UTF-8"}
+
+// id3PictureTypes names the APIC picture types by their byte.
+var id3PictureTypes = []string{
+	"other", "file icon", "other file icon", "front cover", "back cover",
+	"leaflet page", "media", "lead artist", "artist", "conductor", "band",
+	"composer", "lyricist", "recording location", "during recording",
+	"during performance", "video screen capture", "bright coloured fish",
+	"illustration", "band logotype", "publisher logotype",
+}
+
+var (
+	// id3v24Frames exist only in ID3v2.4.
+	id3v24Frames = map[string]bool{
+		"ASPI": true, "EQU2": true, "RVA2": true, "SEEK": true, "SIGN": true,
+		"TDEN": true, "TDOR": true, "TDRC": true, "TDRL": true, "TDTG": true,
+		"TIPL": true, "TMCL": true, "TMOO": true, "TPRO": true, "TSOA": true,
+		"TSOP": true, "TSOT": true, "TSST": true,
+	}
+	// id3v23Frames were dropped from ID3v2.4.
+	id3v23Frames = map[string]bool{
+		"EQUA": true, "IPLS": true, "RVAD": true, "TDAT": true, "TIME": true,
+		"TORY": true, "TRDA": true, "TSIZ": true, "TYER": true,
+	}
+)
+
+// tagChapter is the time range of a CHAP frame.
+type tagChapter struct {
+	ElementID string `json:"element_id"`
+	StartMS   uint32 `json:"start_ms"`
+	EndMS     uint32 `json:"end_ms"`
+}
+
+// tagFrame describes one ID3v2 frame.
+type tagFrame struct {
+	ID          string      `json:"id"`
+	Size        int         `json:"size"`
+	Encoding    string      `json:"encoding,omitempty"`
+	Language    string      `json:"language,omitempty"`
+	Description string      `json:"description,omitempty"`
+	Value       string      `json:"value,omitempty"`
+	MimeType    string      `json:"mime_type,omitempty"`
+	PictureType string      `json:"picture_type,omitempty"`
+	PictureSize int         `json:"picture_size,omitempty"`
+	Chapter     *tagChapter `json:"chapter,omitempty"`
+	Subframes   []tagFrame  `json:"subframes,omitempty"`
+	Problems    []string    `json:"problems,omitempty"`
+}
+
+// tagReport is what `yt2mp3 tags show` prints for one file.
+type tagReport struct {
+	File string `json:"file"`
+	// Version is the ID3v2 version, such as "2.3", or "" without a tag.
+	Version  string     `json:"version,omitempty"`
+	Size     int        `json:"size"`
+	ID3v1    bool       `json:"id3v1"`
+	Frames   []tagFrame `json:"frames"`
+	Problems []string   `json:"problems,omitempty"`
+}
+
+// decodeID3Text decodes text in the ID3v2 encoding enc.
+func decodeID3Text(enc byte, b []byte) (string, error) {
+	switch enc {
+	case 0:
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return string(runes), nil
+	case 1, 2:
+		if len(b)%2 != 0 {
+			return "", fmt.Errorf("UTF-16 text has an odd length")
+		}
+		order := binary.ByteOrder(binary.BigEndian)
+		if enc == 1 {
+			switch {
+			case bytes.HasPrefix(b, []byte{0xFF, 0xFE}):
+				order = binary.LittleEndian
+			case !bytes.HasPrefix(b, []byte{0xFE, 0xFF}) && len(b) > 0:
+				return "", fmt.Errorf("UTF-16 text has no byte order mark")
+			}
+			b = b[min(2, len(b)):]
+		}
+		units := make([]uint16, len(b)/2)
+		for i := range units {
+			units[i] = order.Uint16(b[2*i:])
+		}
+		return string(utf16.Decode(units)), nil
+	case 3:
+		if !utf8.Valid(b) {
+			return "", fmt.Errorf("text is not valid UTF-8")
+		}
+		return string(b), nil
+	}
+	return "", fmt.Errorf("unknown text encoding %d", enc)
+}
+
+// cutID3String splits b after the first string terminator of encoding enc.
+// ok is false when there is none.
+func cutID3String(enc byte, b []byte) (s, rest []byte, ok bool) {
+	if enc != 1 && enc != 2 {
+		i := bytes.IndexByte(b, 0)
+		if i < 0 {
+			return b, nil, false
+		}
+		return b[:i], b[i+1:], true
+	}
+	for i := 0; i+1 < len(b); i += 2 {
+		if b[i] == 0 && b[i+1] == 0 {
+			rest = b[i+2:]
+			if len(rest) >= 3 && rest[0] == 0 && (rest[1] == 0xFE && rest[2] == 0xFF || rest[1] == 0xFF && rest[2] == 0xFE) {
+				// id3v2 pads UTF-16 text with a zero byte, which shifts
+				// the terminator before the next byte order mark by one.
+				rest = rest[1:]
+			}
+			return b[:i], rest, true
+		}
+	}
+	return b, nil, false
+}
+
+// text decodes b in encoding enc, recording in f why it cannot.
+func (f *tagFrame) text(enc byte, b []byte) string {
+	s, err := decodeID3Text(enc, b)
+	if err != nil {
+		f.Problems = append(f.Problems, err.Error())
+	}
+	return s
+}
+
+// setEncoding records the text encoding byte of f and checks that the tag
+// version allows it.
+func (f *tagFrame) setEncoding(enc byte, version byte) {
+	if int(enc) >= len(id3Encodings) {
+		f.Encoding = fmt.Sprintf("unknown (%d)", enc)
+		f.Problems = append(f.Problems, fmt.Sprintf("unknown text encoding %d", enc))
+		return
+	}
+	f.Encoding = id3Encodings[enc]
+	if version == 3 && enc > 1 {
+		f.Problems = append(f.Problems, f.Encoding+" text is not allowed in ID3v2.3")
+	}
+}
+
+// description reads a terminated description from the start of b into f
+// and returns what follows it.
+func (f *tagFrame) description(enc byte, b []byte) []byte {
+	desc, rest, ok := cutID3String(enc, b)
+	if !ok {
+		f.Problems = append(f.Problems, "description is not terminated")
+	}
+	f.Description = f.text(enc, desc)
+	return rest
+}
+
+// inspectFrame decodes the body of the frame id of an ID3v2 tag of the
+// given major version.
+func inspectFrame(id string, body []byte, version byte) tagFrame {
+	f := tagFrame{ID: id, Size: len(body)}
+	switch {
+	case version == 3 && id3v24Frames[id]:
+		f.Problems = append(f.Problems, id+" is an ID3v2.4 frame")
+	case version == 4 && id3v23Frames[id]:
+		f.Problems = append(f.Problems, id+" is not an ID3v2.4 frame")
+	}
+	encoded := id[0] == 'T' || id == "COMM" || id == "USLT" || id == "APIC" || id == "WXXX"
+	if encoded && len(body) == 0 {
+		f.Problems = append(f.Problems, "frame is empty")
+		return f
+	}
+	var enc byte
+	if encoded {
+		enc = body[0]
+		f.setEncoding(enc, version)
+		body = body[1:]
+	}
+
+	switch {
+	case id == "TXXX":
+		f.Value = f.text(enc, trimID3Terminator(enc, f.description(enc, body)))
+	case id[0] == 'T':
+		f.Value = id3Values(f.text(enc, trimID3Terminator(enc, body)))
+	case id == "COMM" || id == "USLT":
+		if len(body) < 3 {
+			f.Problems = append(f.Problems, "frame is truncated")
+			return f
+		}
+		f.Language = string(body[:3])
+		f.Value = f.text(enc, trimID3Terminator(enc, f.description(enc, body[3:])))
+	case id == "WXXX":
+		f.Value = f.text(0, trimID3Terminator(0, f.description(enc, body)))
+	case id[0] == 'W':
+		f.Value = f.text(0, trimID3Terminator(0, body))
+	case id == "APIC":
+		mime, rest, ok := cutID3String(0, body)
+		if !ok || len(rest) == 0 {
+			f.Problems = append(f.Problems, "frame is truncated")
+			return f
+		}
+		f.MimeType = string(mime)
+		if int(rest[0]) < len(id3PictureTypes) {
+			f.PictureType = id3PictureTypes[rest[0]]
+		} else {
+			f.PictureType = fmt.Sprintf("unknown (%d)", rest[0])
+		}
+		picture := f.description(enc, rest[1:])
+		f.PictureSize = len(picture)
+	case id == "CHAP":
+		elementID, rest, ok := cutID3String(0, body)
+		if !ok || len(rest) < 16 {
+			f.Problems = append(f.Problems, "frame is truncated")
+			return f
+		}
+		f.Chapter = &tagChapter{
+			ElementID: string(elementID),
+			StartMS:   binary.BigEndian.Uint32(rest[0:4]),
+			EndMS:     binary.BigEndian.Uint32(rest[4:8]),
+		}
+		if !walkID3Frames(rest[16:], version == 4, func(id string, body []byte) {
+			f.Subframes = append(f.Subframes, inspectFrame(id, body, version))
+		}) {
+			f.Problems = append(f.Problems, "embedded frames are malformed")
+		}
+	}
+	return f
+}
+
+// trimID3Terminator drops one string terminator of encoding enc from the end
+// of b, which the spec allows after the last string of a frame.
+func trimID3Terminator(enc byte, b []byte) []byte {
+	if enc == 1 || enc == 2 {
+		if len(b)%2 != 0 && b[len(b)-1] == 0 {
+			// The padding byte id3v2 adds after odd-length UTF-16 text.
+			b = b[:len(b)-1]
+		}
+		if len(b) >= 2 && len(b)%2 == 0 && b[len(b)-2] == 0 && b[len(b)-1] == 0 {
+			return b[:len(b)-2]
+		}
+		return b
+	}
+	return bytes.TrimSuffix(b, []byte{0})
+}
+
+// id3Values joins the null-separated values of an ID3v2.4 text frame.
+func id3Values(s string) string {
+	return strings.Join(strings.Split(s, "\x00"), " / ")
+}
+
+// resync undoes ID3v2 unsynchronisation.
+func resync(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte{0xFF, 0x00}, []byte{0xFF})
+}
+
+// inspectTag reads the tags of the MP3 file at path without interpreting
+// them, so that frames a player might choke on are shown as they are.
+func inspectTag(path string) (tagReport, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return tagReport{}, fmt.Errorf("failed to open MP3 file: %v", err)
+	}
+	r := tagReport{File: path, Frames: []tagFrame{}}
+	r.ID3v1 = len(data) >= 128 && string(data[len(data)-128:len(data)-125]) == "TAG"
+	if len(data) < 10 || string(data[:3]) != "ID3" {
+		return r, nil
+	}
+
+	version, flags := data[3], data[5]
+	r.Version = fmt.Sprintf("2.%d", version)
+	r.Size = id3FrameSize(data[6:10], true)
+	frames := data[10:]
+	if len(frames) < r.Size {
+		r.Problems = append(r.Problems, "tag is larger than the file")
+	} else {
+		frames = frames[:r.Size]
+	}
+	if version != 3 && version != 4 {
+		r.Problems = append(r.Problems, fmt.Sprintf("ID3v2.%d tags are not supported", version))
+		return r, nil
+	}
+	if flags&0x80 != 0 {
+		frames = resync(frames)
+	}
+	if flags&0x40 != 0 && len(frames) >= 4 {
+		// The extended header size excludes itself in v2.3 only.
+		size := id3FrameSize(frames[:4], version == 4)
+		if version == 3 {
+			size += 4
+		}
+		frames = frames[min(size, len(frames)):]
+	}
+
+	synchsafe := version == 4
+	if version == 3 && !walkID3Frames(frames, false, nil) && walkID3Frames(frames, true, nil) {
+		r.Problems = append(r.Problems, "frame sizes are ID3v2.4 synchsafe integers in an ID3v2.3 tag")
+		synchsafe = true
+	}
+	if !walkID3Frames(frames, synchsafe, func(id string, body []byte) {
+		r.Frames = append(r.Frames, inspectFrame(id, body, version))
+	}) {
+		r.Problems = append(r.Problems, "frames are malformed or run past the tag")
+	}
+	return r, nil
+}
+
+// formatChapterTime formats a chapter boundary in milliseconds.
+func formatChapterTime(ms uint32) string {
+	d := time.Duration(ms) * time.Millisecond
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60, ms%1000)
+}
+
+// printTagFrame writes one line for f, and its problems, to w.
+func printTagFrame(w io.Writer, f tagFrame, indent string) {
+	var parts []string
+	if f.Encoding != "" {
+		parts = append(parts, f.Encoding)
+	}
+	if f.Chapter != nil {
+		parts = append(parts, fmt.Sprintf("%s %s-%s", f.Chapter.ElementID, formatChapterTime(f.Chapter.StartMS), formatChapterTime(f.Chapter.EndMS)))
+	}
+	if f.MimeType != "" {
+		parts = append(parts, fmt.Sprintf("%s, %d bytes (%s)", f.MimeType, f.PictureSize, f.PictureType))
+	}
+	value := describeTag(f.Value)
+	switch {
+	case f.Language != "":
+		value = fmt.Sprintf("[%s] %s: %s", f.Language, describeTag(f.Description), value)
+	case f.Description != "":
+		value = fmt.Sprintf("%s: %s", describeTag(f.Description), value)
+	}
+	if f.Value != "" || f.Description != "" {
+		parts = append(parts, value)
+	}
+	if len(parts) == 0 {
+		parts = append(parts, fmt.Sprintf("%d bytes", f.Size))
+	}
+	fmt.Fprintf(w, "%s%s  %s\n", indent, f.ID, strings.Join(parts, "  "))
+	for _, p := range f.Problems {
+		fmt.Fprintf(w, "%s  ! %s\n", indent, p)
+	}
+	for _, sub := range f.Subframes {
+		printTagFrame(w, sub, indent+"  ")
+	}
+}
+
+// printTagReport writes r in human-readable form to w.
+func printTagReport(w io.Writer, r tagReport) {
+	fmt.Fprintln(w, r.File)
+	v1 := "no ID3v1 tag"
+	if r.ID3v1 {
+		v1 = "ID3v1 tag present"
+	}
+	if r.Version == "" {
+		fmt.Fprintf(w, "  no ID3v2 tag, %s\n", v1)
+	} else {
+		fmt.Fprintf(w, "  ID3v%s, %d bytes, %s\n", r.Version, r.Size, v1)
+	}
+	for _, f := range r.Frames {
+		printTagFrame(w, f, "  ")
+	}
+	for _, p := range r.Problems {
+		fmt.Fprintf(w, "  ! %s\n", p)
+	}
+}
+
+var tagsCmd = &cobra.Command{
+	Use:   "tags",
+	Short: "Inspect the tags of MP3 files",
+}
+
+var tagsShowCmd = &cobra.Command{
+	Use:   "show FILE...",
+	Short: "Show every ID3 frame of MP3 files",
+	Long: `Show the ID3v2 tag of MP3 files frame by frame: the frame ID, text
+encoding and value, the MIME type and size of pictures and the time range
+of chapters, along with the tag version and whether an ID3v1 tag follows
+the audio.
+
+Frames are read as stored rather than through a tag library, and the ones
+that are invalid for the tag's version, such as UTF-8 text in an ID3v2.3
+tag, are flagged with "!".`,
+	Args:         cobra.MinimumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out := cmd.OutOrStdout()
+		reports := []tagReport{}
+		var firstErr error
+		failed := 0
+		for _, path := range args {
+			r, err := inspectTag(path)
+			if err != nil {
+				failed++
+				if firstErr == nil {
+					firstErr = err
+				}
+				fmt.Fprintf(cmd.ErrOrStderr(), "%s: %v\n", path, err)
+				continue
+			}
+			reports = append(reports, r)
+		}
+
+		if tagsJSON {
+			enc := json.NewEncoder(out)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(reports); err != nil {
+				return err
+			}
+		} else {
+			for i, r := range reports {
+				if i > 0 {
+					fmt.Fprintln(out)
+				}
+				printTagReport(out, r)
+			}
+		}
+
+		return batchError(failed, len(args), firstErr, "files")
+	},
+}
+
+func init() {
+	tagsShowCmd.Flags().BoolVar(&tagsJSON, "json", false, "Print the tags as JSON")
+	tagsCmd.AddCommand(tagsShowCmd)
+	rootCmd.AddCommand(tagsCmd)
+}
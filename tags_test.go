@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// rawID3Frame encodes a frame with a plain (v2.3) size.
+func rawID3Frame(id string, body string) string {
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(body)))
+	return id + string(size) + "\x00\x00" + body
+}
+
+// rawID3Tag encodes a v2.3 tag holding frames.
+func rawID3Tag(frames ...string) string {
+	body := strings.Join(frames, "")
+	n := len(body)
+	size := []byte{byte(n >> 21 & 0x7F), byte(n >> 14 & 0x7F), byte(n >> 7 & 0x7F), byte(n & 0x7F)}
+	return "ID3\x03\x00\x00" + string(size) + body
+}
+
+func TestInspectTag(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("written by yt2mp3", func(t *testing.T) {
+		path := filepath.Join(dir, "ours.mp3")
+		writeTaggedMP3(t, path, trackTags{Title: "講義 1", URL: "https://youtu.be/a", Description: "第1回", UploadDate: "20240108"}, "png data")
+		r, err := inspectTag(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Version != "2.3" || r.ID3v1 || len(r.Problems) != 0 {
+			t.Errorf("report = %+v", r)
+		}
+		frames := map[string]tagFrame{}
+		for _, f := range r.Frames {
+			if len(f.Problems) != 0 {
+				t.Errorf("%s: unexpected problems %v", f.ID, f.Problems)
+			}
+			frames[f.ID] = f
+		}
+		if f := frames["TIT2"]; f.Encoding != "UTF-16" || f.Value != "講義 1" {
+			t.Errorf("TIT2 = %+v", f)
+		}
+		if f := frames["COMM"]; f.Language != "eng" || f.Description != "YouTube URL" || f.Value != "https://youtu.be/a" {
+			t.Errorf("COMM = %+v", f)
+		}
+		if f := frames["TXXX"]; f.Description != "description" || f.Value != "第1回" {
+			t.Errorf("TXXX = %+v", f)
+		}
+		if f := frames["TYER"]; f.Value != "2024" {
+			t.Errorf("TYER = %+v", f)
+		}
+		if f := frames["APIC"]; f.MimeType != "image/png" || f.PictureSize != len("png data") || f.PictureType != "front cover" {
+			t.Errorf("APIC = %+v", f)
+		}
+	})
+
+	t.Run("invalid for v2.3", func(t *testing.T) {
+		path := filepath.Join(dir, "odd.mp3")
+		chapter := "ch0\x00" + "\x00\x00\x00\x00" + "\x00\x00\xea\x60" + "\xff\xff\xff\xff\xff\xff\xff\xff" +
+			rawID3Frame("TIT2", "\x00Intro")
+		v1 := "TAG" + strings.Repeat("\x00", 125)
+		mustWrite(t, path, rawID3Tag(
+			rawID3Frame("TIT2", "\x03Café"),
+			rawID3Frame("TDRC", "\x002024"),
+			rawID3Frame("CHAP", chapter),
+			rawID3Frame("PRIV", "owner\x00data"),
+		)+"audio frames"+v1)
+
+		r, err := inspectTag(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !r.ID3v1 || len(r.Frames) != 4 {
+			t.Fatalf("report = %+v", r)
+		}
+		if f := r.Frames[0]; f.Encoding != "UTF-8" || f.Value != "Café" || !reflect.DeepEqual(f.Problems, []string{"UTF-8 text is not allowed in ID3v2.3"}) {
+			t.Errorf("TIT2 = %+v", f)
+		}
+		if f := r.Frames[1]; !reflect.DeepEqual(f.Problems, []string{"TDRC is an ID3v2.4 frame"}) {
+			t.Errorf("TDRC = %+v", f)
+		}
+		chap := r.Frames[2]
+		if chap.Chapter == nil || *chap.Chapter != (tagChapter{ElementID: "ch0", StartMS: 0, EndMS: 60000}) {
+			t.Errorf("CHAP = %+v", chap)
+		}
+		if len(chap.Subframes) != 1 || chap.Subframes[0].Value != "Intro" {
+			t.Errorf("CHAP subframes = %+v", chap.Subframes)
+		}
+		if f := r.Frames[3]; f.Size != len("owner\x00data") || f.Value != "" {
+			t.Errorf("PRIV = %+v", f)
+		}
+
+		var out bytes.Buffer
+		printTagReport(&out, r)
+		for _, want := range []string{
+			"ID3v2.3, ",
+			"ID3v1 tag present",
+			`TIT2  UTF-8  "Café"`,
+			"  ! UTF-8 text is not allowed in ID3v2.3",
+			`CHAP  ch0 00:00:00.000-00:01:00.000`,
+			`    TIT2  ISO-8859-1  "Intro"`,
+			"PRIV  10 bytes",
+		} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("output %q lacks %q", out.String(), want)
+			}
+		}
+	})
+
+	t.Run("legacy", func(t *testing.T) {
+		path := filepath.Join(dir, "old.mp3")
+		writeLegacyMP3(t, path, strings.Repeat("講義", 30), "https://youtu.be/old")
+		r, err := inspectTag(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(r.Problems, []string{"frame sizes are ID3v2.4 synchsafe integers in an ID3v2.3 tag"}) {
+			t.Errorf("problems = %v", r.Problems)
+		}
+		for _, f := range r.Frames {
+			if f.ID == "COMM" && !reflect.DeepEqual(f.Problems, []string{"description is not terminated"}) {
+				t.Errorf("COMM = %+v", f)
+			}
+		}
+	})
+
+	t.Run("no tag", func(t *testing.T) {
+		path := filepath.Join(dir, "bare.mp3")
+		mustWrite(t, path, "audio frames")
+		r, err := inspectTag(path)
+		if err != nil || r.Version != "" || len(r.Frames) != 0 {
+			t.Errorf("inspectTag() = %+v, %v", r, err)
+		}
+	})
+}
+
+func TestTagsShowJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.mp3")
+	writeTaggedMP3(t, path, trackTags{Title: "Song", URL: "https://youtu.be/a"}, "")
+
+	var out bytes.Buffer
+	rootCmd.SetOut(&out)
+	rootCmd.SetErr(&bytes.Buffer{})
+	rootCmd.SetArgs([]string{"tags", "show", "--json", path})
+	err := rootCmd.Execute()
+	tagsJSON = false
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reports []tagReport
+	if err := json.Unmarshal(out.Bytes(), &reports); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, out.String())
+	}
+	if len(reports) != 1 || reports[0].File != path || reports[0].Version != "2.3" || len(reports[0].Frames) == 0 {
+		t.Errorf("reports = %+v", reports)
+	}
+}
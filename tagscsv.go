@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bogem/id3v2"
+	"github.com/spf13/cobra"
+)
+
+// Dry run option for tags import
+var tagsImportDryRun bool
+
+// trackNumberPattern matches a track number such as "3" or "3/12".
+var trackNumberPattern = regexp.MustCompile(`^[0-9]+(/[0-9]+)?$`)
+
+// tagColumn is a CSV column of tags export and import.
+type tagColumn struct {
+	name string
+	get  func(st storedTag) string
+	// set replaces the frames of the column in tag; an empty value removes
+	// them.
+	set   func(tag *id3v2.Tag, v string)
+	check func(v string) error
+}
+
+// setTextFrame replaces the text frame id of tag with v.
+func setTextFrame(tag *id3v2.Tag, id, v string) {
+	tag.DeleteFrames(id)
+	if v != "" {
+		tag.AddTextFrame(id, tag.DefaultEncoding(), v)
+	}
+}
+
+// tagColumns lists the columns of a tags CSV after the file column.
+var tagColumns = []tagColumn{
+	{
+		name: "title",
+		get:  func(st storedTag) string { return st.Tags.Title },
+		set:  func(tag *id3v2.Tag, v string) { setTextFrame(tag, "TIT2", v) },
+	},
+	{
+		name: "artist",
+		get:  func(st storedTag) string { return st.Tags.Artist },
+		set:  func(tag *id3v2.Tag, v string) { setTextFrame(tag, "TPE1", v) },
+	},
+	{
+		name: "album",
+		get:  func(st storedTag) string { return st.Tags.Album },
+		set:  func(tag *id3v2.Tag, v string) { setTextFrame(tag, "TALB", v) },
+	},
+	{
+		name: "album_artist",
+		get:  func(st storedTag) string { return st.albumArtist },
+		set:  func(tag *id3v2.Tag, v string) { setTextFrame(tag, "TPE2", v) },
+	},
+	{
+		name: "genre",
+		get:  func(st storedTag) string { return st.Tags.Genre },
+		set:  func(tag *id3v2.Tag, v string) { setTextFrame(tag, "TCON", v) },
+	},
+	{
+		name: "date",
+		get:  func(st storedTag) string { return st.Tags.UploadDate },
+		set: func(tag *id3v2.Tag, v string) {
+			for _, id := range []string{"TYER", "TDAT", "TDRC"} {
+				tag.DeleteFrames(id)
+			}
+			if v == "" {
+				return
+			}
+			tag.AddTextFrame("TYER", id3v2.EncodingISO, v[:4])
+			if len(v) == 8 {
+				tag.AddTextFrame("TDAT", id3v2.EncodingISO, v[6:]+v[4:6])
+			}
+		},
+		check: func(v string) error {
+			if v == "" {
+				return nil
+			}
+			if _, err := time.Parse("2006", v); err == nil {
+				return nil
+			}
+			if _, err := time.Parse("20060102", v); err != nil {
+				return fmt.Errorf("date %q is not YYYYMMDD or YYYY", v)
+			}
+			return nil
+		},
+	},
+	{
+		name: "track",
+		get:  func(st storedTag) string { return st.Tags.Track },
+		set:  func(tag *id3v2.Tag, v string) { setTextFrame(tag, "TRCK", v) },
+		check: func(v string) error {
+			if v != "" && !trackNumberPattern.MatchString(v) {
+				return fmt.Errorf("track %q is not a number or N/TOTAL", v)
+			}
+			return nil
+		},
+	},
+	{
+		name: "url",
+		get:  func(st storedTag) string { return st.Tags.URL },
+		set: func(tag *id3v2.Tag, v string) {
+			others := tag.GetFrames(tag.CommonID("Comments"))
+			tag.DeleteFrames(tag.CommonID("Comments"))
+			for _, f := range others {
+				if c, ok := f.(id3v2.CommentFrame); ok && c.Description != "YouTube URL" {
+					tag.AddCommentFrame(c)
+				}
+			}
+			if v != "" {
+				tag.AddCommentFrame(sourceURLFrame(v))
+			}
+		},
+	},
+	{
+		name: "description",
+		get:  func(st storedTag) string { return st.Tags.Description },
+		set:  func(tag *id3v2.Tag, v string) { setUserText(tag, "description", v) },
+	},
+}
+
+// findTagColumn returns the column called name.
+func findTagColumn(name string) (tagColumn, bool) {
+	for _, c := range tagColumns {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return tagColumn{}, false
+}
+
+// exportTags writes a CSV row with the tags of every MP3 file below dir to
+// w. Files whose tags cannot be read are reported to log and left out.
+func exportTags(w io.Writer, dir string, log io.Writer) (int, error) {
+	cw := csv.NewWriter(w)
+	header := []string{"file"}
+	for _, c := range tagColumns {
+		header = append(header, c.name)
+	}
+	cw.Write(header)
+	n := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.EqualFold(filepath.Ext(path), ".mp3") {
+			return nil
+		}
+		st, err := readStoredTag(path)
+		if err != nil {
+			fmt.Fprintf(log, "Warning: skipping %s: %v\n", path, err)
+			return nil
+		}
+		row := []string{path}
+		for _, c := range tagColumns {
+			row = append(row, c.get(st))
+		}
+		n++
+		return cw.Write(row)
+	})
+	if err != nil {
+		return n, err
+	}
+	cw.Flush()
+	return n, cw.Error()
+}
+
+// tagEdit is the changed cells of one row of a tags CSV.
+type tagEdit struct {
+	path    string
+	columns []tagColumn
+	values  []string
+	changes []tagChange
+}
+
+// readTagEdits reads a tags CSV and compares it with the files it names.
+// Every problem is reported before anything is written, so a bad cell does
+// not leave the files half edited.
+func readTagEdits(r io.Reader, name string) ([]tagEdit, []error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, []error{fmt.Errorf("%s: failed to read the header: %v", name, err)}
+	}
+	var errs []error
+	fileIndex := -1
+	columns := make([]tagColumn, len(header))
+	seen := map[string]bool{}
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+		if seen[h] {
+			errs = append(errs, fmt.Errorf("%s: column %q appears twice", name, h))
+		}
+		seen[h] = true
+		if h == "file" {
+			fileIndex = i
+			continue
+		}
+		c, ok := findTagColumn(h)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown column %q", name, h))
+		}
+		columns[i] = c
+	}
+	if fileIndex < 0 {
+		errs = append(errs, fmt.Errorf("%s: there is no file column", name))
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	var edits []tagEdit
+	files := map[string]int{}
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, append(errs, fmt.Errorf("%s: %v", name, err))
+		}
+		line, _ := cr.FieldPos(0)
+		rowErr := func(format string, args ...any) {
+			errs = append(errs, fmt.Errorf("%s:%d: %s", name, line, fmt.Sprintf(format, args...)))
+		}
+		path := row[fileIndex]
+		if first, ok := files[filepath.Clean(path)]; ok {
+			rowErr("%s is already listed on line %d", path, first)
+			continue
+		}
+		files[filepath.Clean(path)] = line
+		if fi, err := os.Stat(path); err != nil || !fi.Mode().IsRegular() {
+			rowErr("%s is not a file", path)
+			continue
+		}
+		old, err := readStoredTag(path)
+		if err != nil {
+			rowErr("%v", err)
+			continue
+		}
+		edit := tagEdit{path: path}
+		for i, c := range columns {
+			if i == fileIndex || row[i] == c.get(old) {
+				continue
+			}
+			if c.check != nil {
+				if err := c.check(row[i]); err != nil {
+					rowErr("%v", err)
+					continue
+				}
+			}
+			edit.columns = append(edit.columns, c)
+			edit.values = append(edit.values, row[i])
+			edit.changes = append(edit.changes, tagChange{c.name, describeTag(c.get(old)), describeTag(row[i])})
+		}
+		edits = append(edits, edit)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return edits, nil
+}
+
+// applyTagEdit writes the changed cells of e to its file.
+func applyTagEdit(e tagEdit) error {
+	tag, err := openID3Tag(e.path)
+	if err != nil {
+		return err
+	}
+	defer tag.Close()
+	for i, c := range e.columns {
+		c.set(tag, e.values[i])
+	}
+	if err := saveID3Tag(tag); err != nil {
+		return classify(ErrTagging, err)
+	}
+	return nil
+}
+
+var tagsExportCmd = &cobra.Command{
+	Use:   "export DIR",
+	Short: "Print the tags of the MP3 files in a folder as CSV",
+	Long: `Print one CSV row per MP3 file in DIR and its subfolders, with the
+file path followed by its title, artist, album, album artist, genre,
+date, track number, source URL and description. Files whose tags cannot be
+read are skipped with a warning. Edit the rows in a spreadsheet and apply them with
+"yt2mp3 tags import".`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if fi, err := os.Stat(args[0]); err != nil || !fi.IsDir() {
+			return classify(ErrOutputDir, fmt.Errorf("folder %s does not exist", args[0]))
+		}
+		n, err := exportTags(cmd.OutOrStdout(), args[0], cmd.ErrOrStderr())
+		if err != nil {
+			return fmt.Errorf("failed to export tags: %v", err)
+		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "Exported the tags of %d files\n", n)
+		return nil
+	},
+}
+
+var tagsImportCmd = &cobra.Command{
+	Use:   "import FILE.csv",
+	Short: "Apply tags edited in a CSV written by tags export",
+	Long: `Apply the tags in a CSV file written by "yt2mp3 tags export".
+
+Only the cells that differ from a file's current tags are written; files
+without changes are left alone. Columns may be removed from the CSV to
+leave them untouched, but the file column is required. All rows are
+checked before anything is written, so a bad date or track number stops
+the import without changing any file. Use --dry-run to see the changes
+first.`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out, log := cmd.OutOrStdout(), cmd.ErrOrStderr()
+		f, err := os.Open(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to open CSV file: %v", err)
+		}
+		defer f.Close()
+		edits, errs := readTagEdits(f, args[0])
+		if len(errs) > 0 {
+			for _, err := range errs {
+				fmt.Fprintln(log, err)
+			}
+			return fmt.Errorf("%s has errors; no file was changed", args[0])
+		}
+
+		var firstErr error
+		changed, failed := 0, 0
+		for _, e := range edits {
+			if len(e.changes) == 0 {
+				continue
+			}
+			changed++
+			prefix := "updated"
+			if tagsImportDryRun {
+				prefix = "would update"
+			}
+			fmt.Fprintf(out, "%s %s\n", prefix, e.path)
+			for _, c := range e.changes {
+				fmt.Fprintf(out, "  %s: %s -> %s\n", c.Field, c.Old, c.New)
+			}
+			if tagsImportDryRun {
+				continue
+			}
+			if err := applyTagEdit(e); err != nil {
+				failed++
+				if firstErr == nil {
+					firstErr = err
+				}
+				fmt.Fprintf(log, "%s: %v\n", e.path, err)
+			}
+		}
+		if tagsImportDryRun {
+			fmt.Fprintf(log, "%d of %d files would change\n", changed, len(edits))
+		} else {
+			fmt.Fprintf(log, "%d of %d files changed\n", changed-failed, len(edits))
+		}
+
+		return batchError(failed, changed, firstErr, "files")
+	},
+}
+
+func init() {
+	tagsImportCmd.Flags().BoolVar(&tagsImportDryRun, "dry-run", false, "Show the changes without writing them")
+	tagsCmd.AddCommand(tagsExportCmd, tagsImportCmd)
+}
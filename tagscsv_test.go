@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTagsCSVRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.mp3")
+	b := filepath.Join(dir, "live", "b.mp3")
+	if err := os.MkdirAll(filepath.Dir(b), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTaggedMP3(t, a, trackTags{Title: "Song A", Artist: "Chan", Album: "YouTube", Genre: "Jazz", URL: "https://youtu.be/a", Description: "first\nline", UploadDate: "20240108"}, "")
+	writeTaggedMP3(t, b, trackTags{Title: "Song B", Album: "YouTube", URL: "https://youtu.be/b"}, "")
+	// The header announces more frame data than the file holds.
+	broken := filepath.Join(dir, "broken.mp3")
+	mustWrite(t, broken, "ID3\x04\x00\x00\x00\x00\x01\x00TIT2")
+
+	var out, log bytes.Buffer
+	if n, err := exportTags(&out, dir, &log); err != nil || n != 2 {
+		t.Fatalf("exportTags() = %d, %v", n, err)
+	}
+	if !strings.Contains(log.String(), "Warning: skipping "+broken) {
+		t.Errorf("export log = %q", log.String())
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"file", "title", "artist", "album", "album_artist", "genre", "date", "track", "url", "description"},
+		{a, "Song A", "Chan", "YouTube", "", "Jazz", "20240108", "", "https://youtu.be/a", "first\nline"},
+		{b, "Song B", "", "YouTube", "", "", "", "", "https://youtu.be/b", ""},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("exported %q", rows)
+	}
+	for i := range want {
+		if strings.Join(rows[i], "|") != strings.Join(want[i], "|") {
+			t.Errorf("row %d = %q, want %q", i, rows[i], want[i])
+		}
+	}
+
+	writeCSV := func(rows [][]string) string {
+		t.Helper()
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		w.WriteAll(rows)
+		path := filepath.Join(t.TempDir(), "tags.csv")
+		mustWrite(t, path, buf.String())
+		return path
+	}
+	runImport := func(args ...string) (string, string, error) {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		rootCmd.SetOut(&stdout)
+		rootCmd.SetErr(&stderr)
+		rootCmd.SetArgs(append([]string{"tags", "import"}, args...))
+		err := rootCmd.Execute()
+		tagsImportDryRun = false
+		return stdout.String(), stderr.String(), err
+	}
+	before, err := os.ReadFile(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A bad cell stops the import before anything is written.
+	rows[1][2] = "Artist A"
+	rows[2][6] = "2024-13-01"
+	_, stderr, err := runImport(writeCSV(rows))
+	if err == nil || !strings.Contains(stderr, `:4: date "2024-13-01" is not YYYYMMDD or YYYY`) {
+		t.Errorf("import with a bad date = %v, log %q", err, stderr)
+	}
+	if st, _ := readStoredTag(a); st.Tags.Artist != "Chan" {
+		t.Error("a file was changed although the CSV had a problem")
+	}
+
+	rows[2][6] = ""
+	rows[1][4] = "Various"
+	rows[1][5] = "Blues"
+	rows[1][7] = "2/9"
+	stdout, stderr, err := runImport(writeCSV(rows))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"updated " + a, `  artist: "Chan" -> "Artist A"`, `  album_artist: (none) -> "Various"`, `  genre: "Jazz" -> "Blues"`, `  track: (none) -> "2/9"`} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("import output %q lacks %q", stdout, want)
+		}
+	}
+	if strings.Contains(stdout, b) || !strings.Contains(stderr, "1 of 2 files changed") {
+		t.Errorf("import output %q, log %q", stdout, stderr)
+	}
+	st, err := readStoredTag(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTags := trackTags{Title: "Song A", Artist: "Artist A", Album: "YouTube", Genre: "Blues", URL: "https://youtu.be/a", Description: "first\nline", UploadDate: "20240108", Track: "2/9"}
+	if st.Tags != wantTags || st.albumArtist != "Various" {
+		t.Errorf("tags = %+v, album artist %q, want %+v, \"Various\"", st.Tags, st.albumArtist, wantTags)
+	}
+	if after, _ := os.ReadFile(b); !bytes.Equal(after, before) {
+		t.Error("a file without changes was rewritten")
+	}
+
+	// Columns left out of the CSV are not touched.
+	stdout, _, err = runImport("--dry-run", writeCSV([][]string{{"file", "title"}, {b, "Renamed"}}))
+	if err != nil || !strings.Contains(stdout, "would update "+b+"\n  title: \"Song B\" -> \"Renamed\"\n") {
+		t.Errorf("dry run = %q, %v", stdout, err)
+	}
+	if after, _ := os.ReadFile(b); !bytes.Equal(after, before) {
+		t.Error("dry run changed a file")
+	}
+}
+
+func TestReadTagEditsHeader(t *testing.T) {
+	tests := []struct {
+		name, csv, want string
+	}{
+		{"no file column", "title\nx\n", "there is no file column"},
+		{"unknown column", "file,mood\nx,y\n", `unknown column "mood"`},
+		{"duplicate column", "file,title,Title\n", `column "title" appears twice`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, errs := readTagEdits(strings.NewReader(tt.csv), "tags.csv")
+			if len(errs) == 0 || !strings.Contains(errs[0].Error(), tt.want) {
+				t.Errorf("readTagEdits() = %v, want %q", errs, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// artistSeparator joins the artists of a multi-value TPE1 frame, as ID3v2.3
+// prescribes.
+const artistSeparator = "/"
+
+// TitleRule is one step of splitting a video title into artist and title.
+// Exactly one of its fields is set, apart from Order.
+type TitleRule struct {
+	// Noise lists regular expressions; bracketed parts of the title, such
+	// as "(Official Video)" or "【MV】", whose text matches one are removed.
+	Noise []string `yaml:"noise,omitempty" json:"noise,omitempty"`
+	// Quotes lists pairs of opening and closing quotes, such as "「」";
+	// "Artist「Title」" is split at them.
+	Quotes string `yaml:"quotes,omitempty" json:"quotes,omitempty"`
+	// Separator splits "Artist - Title" at its first occurrence.
+	Separator string `yaml:"separator,omitempty" json:"separator,omitempty"`
+	// Order is "artist-title" (the default) or "title-artist", the order of
+	// the parts around Separator.
+	Order string `yaml:"order,omitempty" json:"order,omitempty"`
+	// Feat moves artists credited with "feat." or "ft." into the artist.
+	Feat bool `yaml:"feat,omitempty" json:"feat,omitempty"`
+}
+
+// defaultTitleRules are used unless the settings list their own.
+var defaultTitleRules = []TitleRule{
+	{Noise: []string{
+		`(?i)official`, `(?i)\b(music ?)?video\b`, `(?i)\blyrics?\b`, `(?i)\baudio\b`,
+		`(?i)\b(mv|pv)\b`, `(?i)\b(4k|hd|hq|[0-9]{3,4}p)\b`, `(?i)\bremaster(ed)?\b`,
+		`(?i)\bvisuali[sz]er\b`, `公式`, `歌詞`,
+	}},
+	{Quotes: "「」『』"},
+	{Separator: " - "},
+	{Separator: " – "},
+	{Separator: " — "},
+	{Separator: " / ", Order: "title-artist"},
+	{Separator: " ／ ", Order: "title-artist"},
+	{Feat: true},
+}
+
+var (
+	// noiseBrackets are the bracket pairs that noise rules look inside.
+	noiseBrackets = [][2]string{{"(", ")"}, {"[", "]"}, {"（", "）"}, {"［", "］"}, {"【", "】"}}
+	// bracketedFeat matches "(feat. X)" and its variants.
+	bracketedFeat = regexp.MustCompile(`(?i)\s*[(\[（]\s*(?:feat\.?|ft\.|featuring)\s+([^)\]）]+)[)\]）]`)
+	// trailingFeat matches " feat. X" up to the end of the text.
+	trailingFeat = regexp.MustCompile(`(?i)\s+(?:feat\.?|ft\.|featuring)\s+(.+)$`)
+	// featSeparators split the artists of a feat. credit.
+	featSeparators = regexp.MustCompile(`\s*(?:,|&|\band\b)\s*`)
+)
+
+// titleParser applies compiled title rules.
+type titleParser struct {
+	rules []TitleRule
+	noise [][]*regexp.Regexp
+}
+
+// describeTitleRules summarizes rules for config show.
+func describeTitleRules(rules []TitleRule) string {
+	if rules == nil {
+		return "default"
+	}
+	return fmt.Sprintf("%d rules", len(rules))
+}
+
+// newTitleParser compiles rules, or the default rules if rules is nil.
+func newTitleParser(rules []TitleRule) (*titleParser, error) {
+	if rules == nil {
+		rules = defaultTitleRules
+	}
+	p := &titleParser{rules: rules, noise: make([][]*regexp.Regexp, len(rules))}
+	for i, r := range rules {
+		kinds := 0
+		for _, set := range []bool{len(r.Noise) > 0, r.Quotes != "", r.Separator != "", r.Feat} {
+			if set {
+				kinds++
+			}
+		}
+		if kinds != 1 {
+			return nil, fmt.Errorf("title rule %d: set exactly one of noise, quotes, separator and feat", i+1)
+		}
+		if r.Order != "" && r.Order != "artist-title" && r.Order != "title-artist" {
+			return nil, fmt.Errorf("title rule %d: order must be artist-title or title-artist, not %q", i+1, r.Order)
+		}
+		if n := len([]rune(r.Quotes)); n%2 != 0 {
+			return nil, fmt.Errorf("title rule %d: quotes must come in opening and closing pairs", i+1)
+		}
+		for _, expr := range r.Noise {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("title rule %d: %v", i+1, err)
+			}
+			p.noise[i] = append(p.noise[i], re)
+		}
+	}
+	return p, nil
+}
+
+// parse splits a video title into the song title, its artist and the
+// artists it features. artist is empty when the title does not name one.
+func (p *titleParser) parse(s string) (title, artist string, featured []string) {
+	title = s
+	split := false
+	for i, r := range p.rules {
+		switch {
+		case len(r.Noise) > 0:
+			title = removeNoise(title, p.noise[i])
+			artist = removeNoise(artist, p.noise[i])
+		case r.Quotes != "" && !split:
+			artist, title, split = splitQuoted(title, r.Quotes)
+		case r.Separator != "" && !split:
+			before, after, ok := strings.Cut(title, r.Separator)
+			before, after = cleanTitlePart(before), cleanTitlePart(after)
+			if !ok || before == "" || after == "" {
+				continue
+			}
+			split = true
+			if r.Order == "title-artist" {
+				title, artist = before, after
+			} else {
+				artist, title = before, after
+			}
+		case r.Feat:
+			var more []string
+			title, more = extractFeat(title)
+			featured = append(featured, more...)
+			artist, more = extractFeat(artist)
+			featured = append(featured, more...)
+		}
+	}
+	if title = cleanTitlePart(title); title == "" {
+		title = strings.TrimSpace(s)
+	}
+	return title, cleanTitlePart(artist), featured
+}
+
+// joinArtists joins the non-empty artists, each once, into a multi-value
+// artist.
+func joinArtists(artists ...string) string {
+	var unique []string
+	seen := map[string]bool{}
+	for _, a := range artists {
+		if a != "" && !seen[strings.ToLower(a)] {
+			seen[strings.ToLower(a)] = true
+			unique = append(unique, a)
+		}
+	}
+	return strings.Join(unique, artistSeparator)
+}
+
+// removeNoise drops the bracketed parts of s whose text matches noise.
+func removeNoise(s string, noise []*regexp.Regexp) string {
+	for _, b := range noiseBrackets {
+		var out strings.Builder
+		rest := s
+		for {
+			i := strings.Index(rest, b[0])
+			if i < 0 {
+				break
+			}
+			j := strings.Index(rest[i+len(b[0]):], b[1])
+			if j < 0 {
+				break
+			}
+			inner := rest[i+len(b[0]) : i+len(b[0])+j]
+			end := i + len(b[0]) + j + len(b[1])
+			isNoise := false
+			for _, re := range noise {
+				if re.MatchString(inner) {
+					isNoise = true
+					break
+				}
+			}
+			if isNoise {
+				out.WriteString(rest[:i])
+				out.WriteString(" ")
+			} else {
+				out.WriteString(rest[:end])
+			}
+			rest = rest[end:]
+		}
+		out.WriteString(rest)
+		s = out.String()
+	}
+	return s
+}
+
+// splitQuoted splits "Artist「Title」" at the first pair of quotes that
+// occurs in s. Text after the closing quote is taken as the artist when
+// nothing precedes the opening one.
+func splitQuoted(s, quotes string) (artist, title string, ok bool) {
+	q := []rune(quotes)
+	for k := 0; k+1 < len(q); k += 2 {
+		open, close := string(q[k]), string(q[k+1])
+		i := strings.Index(s, open)
+		if i < 0 {
+			continue
+		}
+		j := strings.Index(s[i+len(open):], close)
+		if j < 0 {
+			continue
+		}
+		inner := cleanTitlePart(s[i+len(open) : i+len(open)+j])
+		before := cleanTitlePart(s[:i])
+		after := cleanTitlePart(s[i+len(open)+j+len(close):])
+		if before == "" {
+			before = after
+		}
+		if inner == "" || before == "" {
+			continue
+		}
+		return before, inner, true
+	}
+	return "", s, false
+}
+
+// extractFeat removes a feat. credit from s and returns its artists.
+func extractFeat(s string) (string, []string) {
+	m := bracketedFeat.FindStringSubmatchIndex(s)
+	if m == nil {
+		m = trailingFeat.FindStringSubmatchIndex(s)
+	}
+	if m == nil {
+		return s, nil
+	}
+	var artists []string
+	for _, a := range featSeparators.Split(s[m[2]:m[3]], -1) {
+		if a = cleanTitlePart(a); a != "" {
+			artists = append(artists, a)
+		}
+	}
+	return s[:m[0]] + " " + s[m[1]:], artists
+}
+
+// cleanTitlePart collapses the whitespace in s and trims separators left
+// dangling at either end by removed parts.
+func cleanTitlePart(s string) string {
+	return strings.Trim(strings.Join(strings.Fields(s), " "), " -–—/／|｜:")
+}
+
+// channelArtist returns the artist to credit when the title names none:
+// the channel, without the " - Topic" suffix of YouTube's generated artist
+// channels, or else the uploader.
+func channelArtist(info videoInfo) string {
+	if info.Channel != "" {
+		return strings.TrimSuffix(info.Channel, " - Topic")
+	}
+	return info.Uploader
+}
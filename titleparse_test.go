@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// titleCorpus pairs real-world style video titles with the tags the default
+// rules should produce. Channel is credited when the title names no artist.
+var titleCorpus = []struct {
+	title, channel string
+	wantTitle      string
+	wantArtist     string
+}{
+	{"Artist - Song (Official Video) [4K]", "ArtistVEVO", "Song", "Artist"},
+	{"Artist - Song (Official Music Video)", "ArtistVEVO", "Song", "Artist"},
+	{"Artist – Song [Lyrics]", "Lyrics Hub", "Song", "Artist"},
+	{"Artist — Song (Audio)", "Artist", "Song", "Artist"},
+	{"Artist - Song (Remastered 2011)", "Artist", "Song", "Artist"},
+	{"Artist - Song (Live at Budokan)", "Artist", "Song (Live at Budokan)", "Artist"},
+	{"Artist - Song (feat. Guest)", "Artist", "Song", "Artist/Guest"},
+	{"Artist ft. Guest - Song", "Artist", "Song", "Artist/Guest"},
+	{"Artist - Song feat. A, B & C [HD]", "Artist", "Song", "Artist/A/B/C"},
+	{"Artist - Song (Featuring Artist)", "Artist", "Song", "Artist"},
+	{"Song (feat. Guest)", "Host", "Song", "Host/Guest"},
+	{"Song Title", "Some Channel", "Song Title", "Some Channel"},
+	{"Song Title", "Artist - Topic", "Song Title", "Artist"},
+	{"Lecture: Vectors & Matrices", "Uni", "Lecture: Vectors & Matrices", "Uni"},
+	{"Artist - Song - Remix", "Label", "Song - Remix", "Artist"},
+	{"【MV】曲名 / アーティスト", "レーベル", "曲名", "アーティスト"},
+	{"【公式】曲名 ／ アーティスト", "レーベル", "曲名", "アーティスト"},
+	{"アーティスト「曲名」Music Video", "レーベル", "曲名", "アーティスト"},
+	{"アーティスト『曲名』【MV】", "レーベル", "曲名", "アーティスト"},
+	{"「曲名」アーティスト", "レーベル", "曲名", "アーティスト"},
+	{"【歌ってみた】曲名 / 歌い手", "歌い手", "【歌ってみた】曲名", "歌い手"},
+	{"曲名 (Official Video)", "アーティスト", "曲名", "アーティスト"},
+	{"[MV] Song", "Band", "Song", "Band"},
+	{"(Official Video)", "Band", "(Official Video)", "Band"},
+}
+
+func TestTitleCorpus(t *testing.T) {
+	p, err := newTitleParser(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range titleCorpus {
+		t.Run(tt.title, func(t *testing.T) {
+			tags := newTrackTags("file name", "u", videoInfo{Title: tt.title, Channel: tt.channel}, p)
+			if tags.Title != tt.wantTitle || tags.Artist != tt.wantArtist {
+				t.Errorf("title %q, artist %q; want %q, %q", tags.Title, tags.Artist, tt.wantTitle, tt.wantArtist)
+			}
+		})
+	}
+}
+
+func TestTitleRules(t *testing.T) {
+	t.Run("custom rules run in order", func(t *testing.T) {
+		p, err := newTitleParser([]TitleRule{
+			{Noise: []string{`(?i)^live$`}},
+			{Separator: " | ", Order: "title-artist"},
+			{Separator: " - "},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		title, artist, featured := p.parse("Song - Part 2 | Band [LIVE]")
+		if title != "Song - Part 2" || artist != "Band" || featured != nil {
+			t.Errorf("parse() = %q, %q, %v", title, artist, featured)
+		}
+	})
+
+	t.Run("no rules keeps the title", func(t *testing.T) {
+		p, err := newTitleParser([]TitleRule{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags := newTrackTags("file", "u", videoInfo{Title: "Artist - Song (Official Video)", Uploader: "Up"}, p)
+		if tags.Title != "Artist - Song (Official Video)" || tags.Artist != "Up" {
+			t.Errorf("tags = %+v", tags)
+		}
+	})
+
+	t.Run("without info the file name is the title", func(t *testing.T) {
+		p, _ := newTitleParser(nil)
+		if tags := newTrackTags("Song_ Live", "u", videoInfo{}, p); tags.Title != "Song_ Live" || tags.Artist != "" {
+			t.Errorf("tags = %+v", tags)
+		}
+	})
+
+	for _, tt := range []struct {
+		name    string
+		rule    TitleRule
+		wantErr string
+	}{
+		{"empty", TitleRule{}, "exactly one"},
+		{"two kinds", TitleRule{Separator: " - ", Feat: true}, "exactly one"},
+		{"bad order", TitleRule{Separator: " - ", Order: "backwards"}, "order must be"},
+		{"odd quotes", TitleRule{Quotes: "「」『"}, "pairs"},
+		{"bad regexp", TitleRule{Noise: []string{"("}}, "missing closing )"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newTitleParser([]TitleRule{tt.rule})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("newTitleParser() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
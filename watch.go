@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// watchDoneDir and watchFailedDir receive processed inbox files.
+	watchDoneDir   = "done"
+	watchFailedDir = "failed"
+	// watchQueueSize is the number of downloads that may wait for a worker.
+	watchQueueSize = 1000
+)
+
+var (
+	// Worker pool size option for watch
+	watchWorkers int
+	// How long a dropped file must stay unchanged before it is read
+	watchSettle time.Duration
+)
+
+// watchURLRe finds http(s) URLs in free text.
+var watchURLRe = regexp.MustCompile(`https?://[^\s"'<>\x00-\x1f\x7f\x{FFFD}]+`)
+
+// inboxURLs extracts the URLs from the contents of an inbox file. The
+// second result is false for files the inbox does not handle.
+func inboxURLs(name string, data []byte) ([]string, bool) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".txt":
+		return textURLs(data), true
+	case ".url":
+		return internetShortcutURLs(data), true
+	case ".webloc":
+		return weblocURLs(data), true
+	}
+	return nil, false
+}
+
+// textURLs returns the URLs in a text file, one or more per line. Lines
+// starting with # are comments.
+func textURLs(data []byte) []string {
+	var urls []string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, watchURLRe.FindAllString(line, -1)...)
+	}
+	return urls
+}
+
+// internetShortcutURLs returns the URL= entry of a Windows .url file.
+func internetShortcutURLs(data []byte) []string {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(sc.Text()), "=")
+		if ok && strings.EqualFold(strings.TrimSpace(key), "URL") {
+			return []string{strings.TrimSpace(value)}
+		}
+	}
+	return nil
+}
+
+// weblocURLs returns the URL of a macOS .webloc file. These are property
+// lists; XML ones are parsed, and binary ones store the URL as plain ASCII,
+// so it is picked out of the raw bytes.
+func weblocURLs(data []byte) []string {
+	var plist struct {
+		Dict struct {
+			Items []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:"dict"`
+	}
+	if err := xml.Unmarshal(data, &plist); err == nil {
+		items := plist.Dict.Items
+		for i := 0; i+1 < len(items); i++ {
+			if items[i].XMLName.Local == "key" && items[i].Value == "URL" && items[i+1].XMLName.Local == "string" {
+				return []string{strings.TrimSpace(items[i+1].Value)}
+			}
+		}
+		return nil
+	}
+	if u := watchURLRe.Find(data); u != nil {
+		return []string{string(u)}
+	}
+	return nil
+}
+
+// inboxFile is a dropped file whose URLs are being downloaded.
+type inboxFile struct {
+	name string
+	urls []string
+	// results holds one line per URL, filled in as jobs finish.
+	results []string
+	jobs    map[string]int // job ID -> index into urls
+	// next is the index of the first URL that is not queued yet.
+	next   int
+	failed bool
+}
+
+// inboxWatcher queues the URLs of files dropped into dir and files each one
+// under done/ or failed/ once its downloads have finished. All state is
+// owned by the goroutine running run.
+type inboxWatcher struct {
+	dir      string
+	jobs     *jobManager
+	settings Settings
+	settle   time.Duration
+	log      io.Writer
+
+	// due holds files that changed recently, with the time they may be read.
+	due map[string]time.Time
+	// active holds files with downloads in progress, by name.
+	active map[string]*inboxFile
+	// byJob maps job IDs to their files.
+	byJob map[string]*inboxFile
+	// waiting holds files, in the order they were read, with URLs that did
+	// not fit into the job queue yet.
+	waiting []*inboxFile
+}
+
+// run watches the inbox until ctx is done. Files that are already there
+// when it starts are processed as if they had just been dropped.
+func (w *inboxWatcher) run(ctx context.Context) error {
+	w.due = make(map[string]time.Time)
+	w.active = make(map[string]*inboxFile)
+	w.byJob = make(map[string]*inboxFile)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to watch %s: %v", w.dir, err)
+	}
+	defer watcher.Close()
+	if err := watcher.Add(w.dir); err != nil {
+		return fmt.Errorf("failed to watch %s: %v", w.dir, err)
+	}
+	sub := w.jobs.Subscribe()
+	defer w.jobs.Unsubscribe(sub)
+
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", w.dir, err)
+	}
+	for _, e := range entries {
+		w.note(e.Name())
+	}
+
+	tick := w.settle / 4
+	if tick < 10*time.Millisecond {
+		tick = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if ev.Has(fsnotify.Create) || ev.Has(fsnotify.Write) {
+				w.note(filepath.Base(ev.Name))
+			} else if ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+				delete(w.due, filepath.Base(ev.Name))
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Fprintf(w.log, "Watch error: %v\n", err)
+		case now := <-ticker.C:
+			for name, at := range w.due {
+				if !now.Before(at) {
+					delete(w.due, name)
+					w.start(name)
+				}
+			}
+		case <-sub.C:
+			for _, job := range sub.Changes() {
+				w.jobChanged(job)
+			}
+			w.queue()
+		case <-ctx.Done():
+			// Unfinished files stay in the inbox and are picked up again
+			// on the next start.
+			return nil
+		}
+	}
+}
+
+// note schedules name to be read once it has not changed for the settle
+// time, so that files still being copied are not read half-written.
+func (w *inboxWatcher) note(name string) {
+	if strings.HasPrefix(name, ".") || w.active[name] != nil {
+		return
+	}
+	if _, ok := inboxURLs(name, nil); !ok {
+		return
+	}
+	w.due[name] = time.Now().Add(w.settle)
+}
+
+// start reads a settled file and queues its URLs.
+func (w *inboxWatcher) start(name string) {
+	path := filepath.Join(w.dir, name)
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		// Gone again, or a directory with a matching name.
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(w.log, "Failed to read %s: %v\n", path, err)
+		return
+	}
+	urls, _ := inboxURLs(name, data)
+	f := &inboxFile{name: name, urls: urls, results: make([]string, len(urls)), jobs: make(map[string]int)}
+	if len(urls) == 0 {
+		f.failed = true
+		f.results = []string{"failed  no URLs found"}
+		w.finish(f)
+		return
+	}
+
+	fmt.Fprintf(w.log, "Queuing %d URLs from %s\n", len(urls), name)
+	w.active[name] = f
+	w.waiting = append(w.waiting, f)
+	w.queue()
+}
+
+// queue submits the URLs of the waiting files until the job queue is full.
+// The rest wait for jobs to finish, so that a large file is downloaded in
+// full rather than failing the URLs beyond the queue size.
+func (w *inboxWatcher) queue() {
+	for len(w.waiting) > 0 {
+		f := w.waiting[0]
+		for ; f.next < len(f.urls); f.next++ {
+			url := f.urls[f.next]
+			err := validateURL(url)
+			var job Job
+			if err == nil {
+				job, err = w.jobs.SubmitResolved(JobRequest{URL: url}, w.settings, nil)
+			}
+			if errors.Is(err, errQueueFull) {
+				return
+			}
+			if err != nil {
+				f.failed = true
+				f.results[f.next] = fmt.Sprintf("failed  %s  %s: %v", url, errorCode(err), err)
+				continue
+			}
+			f.jobs[job.ID] = f.next
+			w.byJob[job.ID] = f
+		}
+		w.waiting = w.waiting[1:]
+		if len(f.jobs) == 0 {
+			w.finish(f)
+		}
+	}
+}
+
+// jobChanged records the result of a finished job and files its inbox
+// file once all of the file's jobs are done.
+func (w *inboxWatcher) jobChanged(job Job) {
+	f, ok := w.byJob[job.ID]
+	if !ok || !job.finished() {
+		return
+	}
+	delete(w.byJob, job.ID)
+	i := f.jobs[job.ID]
+	delete(f.jobs, job.ID)
+
+	res, err := jobResult(job)
+	if err != nil {
+		f.failed = true
+		f.results[i] = fmt.Sprintf("failed  %s  %s: %v", f.urls[i], errorCode(err), err)
+	} else {
+		f.results[i] = fmt.Sprintf("ok      %s  %s", f.urls[i], res.FinalPath)
+	}
+	if len(f.jobs) == 0 && f.next == len(f.urls) {
+		w.finish(f)
+	}
+}
+
+// finish moves a processed file into done/ or failed/ and writes the
+// results next to it as NAME.log.
+func (w *inboxWatcher) finish(f *inboxFile) {
+	delete(w.active, f.name)
+	sub := watchDoneDir
+	if f.failed {
+		sub = watchFailedDir
+	}
+	dir := filepath.Join(w.dir, sub)
+	dst, err := moveAside(filepath.Join(w.dir, f.name), dir)
+	if err != nil {
+		fmt.Fprintf(w.log, "Failed to move %s to %s: %v\n", f.name, dir, err)
+		return
+	}
+	log := fmt.Sprintf("# %s %s\n%s\n", f.name, time.Now().UTC().Format(time.RFC3339), strings.Join(f.results, "\n"))
+	if err := os.WriteFile(dst+".log", []byte(log), 0644); err != nil {
+		fmt.Fprintf(w.log, "Failed to write result log for %s: %v\n", f.name, err)
+	}
+	fmt.Fprintf(w.log, "Moved %s to %s/\n", f.name, sub)
+}
+
+var watchCmd = &cobra.Command{
+	Use:   "watch DIR",
+	Short: "Download the URLs in .txt, .url and .webloc files dropped into a directory",
+	Long: `Download the URLs in .txt, .url and .webloc files dropped into a directory.
+
+Each file is read once it has stopped changing. When all of its downloads
+have finished it is moved to DIR/done, or to DIR/failed if any of them
+failed, together with a NAME.log that lists the result for every URL.`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		log := cmd.ErrOrStderr()
+		dir := args[0]
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+
+		settings, sources, err := loadSettings(cmd)
+		if err != nil {
+			return err
+		}
+		if settings.OutputDir != "" {
+			if err := ensureOutputDir(settings.OutputDir, sources["output_dir"]); err != nil {
+				return err
+			}
+		}
+		if settings.OutputDir, err = filepath.Abs(settings.OutputDir); err != nil {
+			return classify(ErrOutputDir, fmt.Errorf("failed to resolve output directory path: %v", err))
+		}
+
+		tempDir, err := os.MkdirTemp("", "yt2mp3")
+		if err != nil {
+			return fmt.Errorf("failed to create temp directory: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+		ytdl, err := newYtDlp(tempDir)
+		if err != nil {
+			return err
+		}
+		d := retryingDownloader{downloader: ytdl, policy: newRetryPolicy(retries, retryMaxWait), log: log}
+
+		ctx := cmd.Context()
+		jobs, err := newJobManager(ctx, d, nil, jobManagerOptions{
+			Workers:   watchWorkers,
+			QueueSize: watchQueueSize,
+			Log:       log,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(log, "Watching %s\n", dir)
+		w := &inboxWatcher{dir: dir, jobs: jobs, settings: settings, settle: watchSettle, log: log}
+		err = w.run(ctx)
+		jobs.Wait()
+		return err
+	},
+}
+
+func init() {
+	watchCmd.Flags().IntVar(&watchWorkers, "workers", 2, "Number of concurrent downloads")
+	watchCmd.Flags().DurationVar(&watchSettle, "settle", 2*time.Second, "How long a file must stay unchanged before it is read")
+	rootCmd.AddCommand(watchCmd)
+}
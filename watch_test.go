@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInboxURLs(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		want   []string
+		wantOK bool
+	}{
+		{
+			name:   "list.txt",
+			data:   "# my list\nhttps://youtu.be/a\n\n  see https://www.youtube.com/watch?v=b and http://youtu.be/c\nnot a url\n",
+			want:   []string{"https://youtu.be/a", "https://www.youtube.com/watch?v=b", "http://youtu.be/c"},
+			wantOK: true,
+		},
+		{
+			name:   "Song.URL",
+			data:   "[{000214A0-0000-0000-C000-000000000046}]\r\nProp3=19,11\r\n[InternetShortcut]\r\nIDList=\r\nURL=https://www.youtube.com/watch?v=abc\r\n",
+			want:   []string{"https://www.youtube.com/watch?v=abc"},
+			wantOK: true,
+		},
+		{
+			name: "Song.webloc",
+			data: `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>URL</key>
+	<string>https://www.youtube.com/watch?v=xyz&amp;t=1</string>
+</dict>
+</plist>`,
+			want:   []string{"https://www.youtube.com/watch?v=xyz&t=1"},
+			wantOK: true,
+		},
+		{
+			name:   "binary.webloc",
+			data:   "bplist00\xd1\x01\x02SURL_\x10\x1chttps://youtu.be/binaryplist\x08\x0b",
+			want:   []string{"https://youtu.be/binaryplist"},
+			wantOK: true,
+		},
+		{name: "empty.txt", data: "# nothing yet\n", wantOK: true},
+		{name: "notes.md", data: "https://youtu.be/a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := inboxURLs(tt.name, []byte(tt.data))
+			if ok != tt.wantOK || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("inboxURLs() = %q, %v; want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// waitForFile polls until path exists.
+func waitForFile(t *testing.T, path string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s did not appear", path)
+}
+
+func TestInboxWatcher(t *testing.T) {
+	inbox, out := t.TempDir(), t.TempDir()
+	// A file dropped before the watcher starts is processed too.
+	if err := os.WriteFile(filepath.Join(inbox, "early.txt"), []byte("https://youtu.be/a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(inbox, "ignored.md"), []byte("https://youtu.be/a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &fakeDownloader{info: map[string]videoInfo{
+		"https://youtu.be/a": {ID: "a", Title: "First"},
+		"https://youtu.be/b": {ID: "b", Title: "Second"},
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	jobs, err := newJobManager(ctx, d, nil, jobManagerOptions{Workers: 1, QueueSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := builtinSettings()
+	s.OutputDir = out
+	w := &inboxWatcher{dir: inbox, jobs: jobs, settings: s, settle: 20 * time.Millisecond, log: io.Discard}
+	done := make(chan error, 1)
+	go func() { done <- w.run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+		jobs.Wait()
+	}()
+
+	waitForFile(t, filepath.Join(inbox, watchDoneDir, "early.txt.log"))
+	if err := os.WriteFile(filepath.Join(inbox, "mixed.txt"), []byte("https://youtu.be/b\nhttps:///no-host\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	shortcut := "[InternetShortcut]\nURL=https://youtu.be/b\n"
+	if err := os.WriteFile(filepath.Join(inbox, "early.url"), []byte(shortcut), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForFile(t, filepath.Join(inbox, watchFailedDir, "mixed.txt.log"))
+	waitForFile(t, filepath.Join(inbox, watchDoneDir, "early.url.log"))
+
+	log, err := os.ReadFile(filepath.Join(inbox, watchDoneDir, "early.txt.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(log), "ok      https://youtu.be/a  "+filepath.Join(out, "First.mp3")) {
+		t.Errorf("done log = %q", log)
+	}
+	log, err = os.ReadFile(filepath.Join(inbox, watchFailedDir, "mixed.txt.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(log), "ok      https://youtu.be/b") || !strings.Contains(string(log), "failed  https:///no-host  invalid_url") {
+		t.Errorf("failed log = %q", log)
+	}
+	for _, name := range []string{"early.txt", "mixed.txt", "early.url"} {
+		if _, err := os.Stat(filepath.Join(inbox, name)); !os.IsNotExist(err) {
+			t.Errorf("%s is still in the inbox", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(inbox, "ignored.md")); err != nil {
+		t.Errorf("unrelated file was touched: %v", err)
+	}
+}
+
+func TestInboxWatcherQueueFull(t *testing.T) {
+	inbox, out := t.TempDir(), t.TempDir()
+	// More URLs than fit into the queue, in two files.
+	info := map[string]videoInfo{}
+	var first, second []string
+	for i := range 5 {
+		url := fmt.Sprintf("https://youtu.be/v%d", i)
+		info[url] = videoInfo{ID: fmt.Sprintf("v%d", i), Title: fmt.Sprintf("Track %d", i)}
+		if i < 4 {
+			first = append(first, url)
+		} else {
+			second = append(second, url)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(inbox, "big.txt"), []byte(strings.Join(first, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(inbox, "small.txt"), []byte(strings.Join(second, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &fakeDownloader{info: info}
+	ctx, cancel := context.WithCancel(context.Background())
+	jobs, err := newJobManager(ctx, d, nil, jobManagerOptions{Workers: 1, QueueSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := builtinSettings()
+	s.OutputDir = out
+	w := &inboxWatcher{dir: inbox, jobs: jobs, settings: s, settle: 20 * time.Millisecond, log: io.Discard}
+	done := make(chan error, 1)
+	go func() { done <- w.run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+		jobs.Wait()
+	}()
+
+	for name, urls := range map[string][]string{"big.txt": first, "small.txt": second} {
+		waitForFile(t, filepath.Join(inbox, watchDoneDir, name+".log"))
+		log, err := os.ReadFile(filepath.Join(inbox, watchDoneDir, name+".log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, url := range urls {
+			if !strings.Contains(string(log), "ok      "+url+"  ") {
+				t.Errorf("%s log lacks %s: %q", name, url, log)
+			}
+		}
+	}
+	if got := d.calls.Load(); got != 5 {
+		t.Errorf("downloaded %d URLs, want 5", got)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookTimeout bounds a single delivery attempt.
+	webhookTimeout = 10 * time.Second
+	// webhookRetries is the number of retries after a failed delivery.
+	webhookRetries = 5
+	// webhookMaxWait caps the delay between two delivery attempts.
+	webhookMaxWait = time.Minute
+	// webhookQueueSize is the number of deliveries that may wait to be sent
+	// to one target.
+	webhookQueueSize = 100
+	// webhookSignatureHeader carries the HMAC-SHA256 of the request body.
+	webhookSignatureHeader = "X-Yt2mp3-Signature"
+)
+
+// Webhook events.
+const (
+	webhookEventDone   = "job.done"
+	webhookEventFailed = "job.failed"
+)
+
+// Dead-letter log option for serve
+var webhookDeadLetter string
+
+// Webhook is a configured webhook target.
+type Webhook struct {
+	URL string `yaml:"url"`
+	// Secret signs payloads; SecretEnv names an environment variable that
+	// holds it instead, to keep it out of the config file.
+	Secret    string `yaml:"secret"`
+	SecretEnv string `yaml:"secret_env"`
+	// Events limits deliveries to "done" or "failed"; empty means both.
+	Events []string `yaml:"events"`
+}
+
+// secret returns the signing secret of w.
+func (w Webhook) secret() string {
+	if w.SecretEnv != "" {
+		return os.Getenv(w.SecretEnv)
+	}
+	return w.Secret
+}
+
+// wants reports whether w subscribes to the job state.
+func (w Webhook) wants(state string) bool {
+	return len(w.Events) == 0 || slices.Contains(w.Events, state)
+}
+
+// validateWebhooks checks the configured targets.
+func validateWebhooks(hooks []Webhook) error {
+	for i, w := range hooks {
+		if err := validateURL(w.URL); err != nil {
+			return fmt.Errorf("webhook %d: %v", i+1, err)
+		}
+		if w.secret() == "" {
+			return fmt.Errorf("webhook %s: a secret is required", w.URL)
+		}
+		for _, e := range w.Events {
+			if e != jobDone && e != jobFailed {
+				return fmt.Errorf("webhook %s: unknown event %q (want %q or %q)", w.URL, e, jobDone, jobFailed)
+			}
+		}
+	}
+	return nil
+}
+
+// webhookPayload is the JSON body sent to webhook targets.
+type webhookPayload struct {
+	Event     string            `json:"event"`
+	JobID     string            `json:"job_id"`
+	URL       string            `json:"url"`
+	Title     string            `json:"title,omitempty"`
+	FinalPath string            `json:"final_path,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Status    string            `json:"status"`
+	ErrorCode string            `json:"error_code,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	Owner     string            `json:"owner,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// newWebhookPayload describes a finished job.
+func newWebhookPayload(job Job) webhookPayload {
+	p := webhookPayload{
+		Event:     webhookEventFailed,
+		JobID:     job.ID,
+		URL:       job.URL,
+		Status:    statusFailed,
+		Owner:     job.Owner,
+		Timestamp: job.UpdatedAt,
+	}
+	if job.State == jobDone {
+		p.Event = webhookEventDone
+		p.Status = statusOK
+	}
+	if r := job.Result; r != nil {
+		p.Title = r.Title
+		p.FinalPath = r.FinalPath
+		p.Tags = r.Tags
+		p.ErrorCode = r.ErrorCode
+		p.Error = r.Error
+	}
+	return p
+}
+
+// signPayload returns the signature header value for body:
+// "sha256=" followed by the hex HMAC-SHA256 of body keyed with secret.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookDelivery is one payload on its way to one target.
+type webhookDelivery struct {
+	hook  Webhook
+	event string
+	body  []byte
+}
+
+// deadLetter is a line in the dead-letter log.
+type deadLetter struct {
+	Time     time.Time       `json:"time"`
+	Target   string          `json:"target"`
+	Event    string          `json:"event"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// webhookDispatcher delivers job notifications to webhook targets in the
+// background, retrying failures and recording deliveries that never
+// succeed in a dead-letter log. Each target has its own queue, so one that
+// is being retried does not hold up the others.
+type webhookDispatcher struct {
+	hooks      []Webhook
+	client     *http.Client
+	policy     retryPolicy
+	deadLetter string
+	log        io.Writer
+	// queues holds the pending deliveries of each target of hooks.
+	queues []chan webhookDelivery
+	wg     sync.WaitGroup
+
+	mu sync.Mutex // serializes dead-letter writes
+}
+
+// newWebhookDispatcher starts delivering to hooks until ctx is done. Failed
+// deliveries are appended to the JSON Lines file deadLetter.
+func newWebhookDispatcher(ctx context.Context, hooks []Webhook, deadLetter string, log io.Writer) *webhookDispatcher {
+	d := &webhookDispatcher{
+		hooks:      hooks,
+		client:     &http.Client{Timeout: webhookTimeout},
+		policy:     newRetryPolicy(webhookRetries, webhookMaxWait),
+		deadLetter: deadLetter,
+		log:        log,
+		queues:     make([]chan webhookDelivery, len(hooks)),
+	}
+	for i := range hooks {
+		d.queues[i] = make(chan webhookDelivery, webhookQueueSize)
+		d.wg.Add(1)
+		go d.run(ctx, d.queues[i])
+	}
+	return d
+}
+
+// Notify queues deliveries of a finished job to every interested target.
+// It never blocks; if the queue is full the delivery is dead-lettered.
+func (d *webhookDispatcher) Notify(job Job) {
+	if job.State != jobDone && job.State != jobFailed {
+		return
+	}
+	payload := newWebhookPayload(job)
+	body, err := json.Marshal(payload)
+	if err != nil {
+		fmt.Fprintf(d.log, "Failed to encode webhook payload for job %s: %v\n", job.ID, err)
+		return
+	}
+	for i, h := range d.hooks {
+		if !h.wants(job.State) {
+			continue
+		}
+		delivery := webhookDelivery{hook: h, event: payload.Event, body: body}
+		select {
+		case d.queues[i] <- delivery:
+		default:
+			d.bury(delivery, 0, errors.New("webhook queue is full"))
+		}
+	}
+}
+
+// Wait blocks until the dispatcher has stopped after its context is done.
+func (d *webhookDispatcher) Wait() {
+	d.wg.Wait()
+}
+
+// run delivers the payloads of queue, which belongs to one target, in
+// order until ctx is done.
+func (d *webhookDispatcher) run(ctx context.Context, queue chan webhookDelivery) {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			// Keep undelivered payloads so that they can be replayed.
+			for {
+				select {
+				case delivery := <-queue:
+					d.bury(delivery, 0, ctx.Err())
+				default:
+					return
+				}
+			}
+		case delivery := <-queue:
+			attempts := 0
+			err := d.policy.do(ctx, d.log, "webhook "+delivery.hook.URL, func() error {
+				attempts++
+				return d.send(ctx, delivery)
+			})
+			if err != nil {
+				d.bury(delivery, attempts, err)
+			}
+		}
+	}
+}
+
+// send makes one delivery attempt. Network errors, timeouts, 429 and 5xx
+// responses are transient and retried; other failures are final.
+func (d *webhookDispatcher) send(ctx context.Context, delivery webhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.hook.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "yt2mp3/"+Version)
+	req.Header.Set("X-Yt2mp3-Event", delivery.event)
+	req.Header.Set(webhookSignatureHeader, signPayload(delivery.hook.secret(), delivery.body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return classify(ErrInterrupted, err)
+		}
+		return classify(ErrTransient, err)
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return classify(ErrTransient, fmt.Errorf("webhook returned %s", resp.Status))
+	default:
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+}
+
+// bury appends a failed delivery to the dead-letter log.
+func (d *webhookDispatcher) bury(delivery webhookDelivery, attempts int, cause error) {
+	fmt.Fprintf(d.log, "Webhook delivery to %s failed: %s\n", delivery.hook.URL, errorSummary(cause))
+	if d.deadLetter == "" {
+		return
+	}
+	line, err := json.Marshal(deadLetter{
+		Time:     time.Now().UTC(),
+		Target:   delivery.hook.URL,
+		Event:    delivery.event,
+		Attempts: attempts,
+		Error:    cause.Error(),
+		Payload:  delivery.body,
+	})
+	if err != nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(d.deadLetter), 0755); err != nil {
+		fmt.Fprintf(d.log, "Failed to write dead-letter log: %v\n", err)
+		return
+	}
+	f, err := os.OpenFile(d.deadLetter, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		fmt.Fprintf(d.log, "Failed to write dead-letter log: %v\n", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		fmt.Fprintf(d.log, "Failed to write dead-letter log: %v\n", err)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a local HTTP endpoint that records deliveries and
+// answers with the queued status codes, then 200.
+type webhookReceiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	bodies   [][]byte
+	headers  []http.Header
+	received chan struct{}
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	t.Helper()
+	r := &webhookReceiver{statuses: statuses, received: make(chan struct{}, 100)}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		r.bodies = append(r.bodies, body)
+		r.headers = append(r.headers, req.Header.Clone())
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		r.mu.Unlock()
+		w.WriteHeader(status)
+		r.received <- struct{}{}
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// wait blocks until n more requests arrived.
+func (r *webhookReceiver) wait(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for webhook %d of %d", i+1, n)
+		}
+	}
+}
+
+// newTestDispatcher returns a dispatcher that retries without sleeping.
+func newTestDispatcher(t *testing.T, hooks ...Webhook) (*webhookDispatcher, string) {
+	t.Helper()
+	deadLetter := filepath.Join(t.TempDir(), "dead.jsonl")
+	ctx, cancel := context.WithCancel(context.Background())
+	d := newWebhookDispatcher(ctx, hooks, deadLetter, io.Discard)
+	var slept []time.Duration
+	d.policy = testRetryPolicy(2, &slept)
+	t.Cleanup(func() {
+		cancel()
+		d.Wait()
+	})
+	return d, deadLetter
+}
+
+// readDeadLetters returns the entries of a dead-letter log.
+func readDeadLetters(t *testing.T, path string) []deadLetter {
+	t.Helper()
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []deadLetter
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e deadLetter
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestWebhookDeliversSignedPayload(t *testing.T) {
+	recv := newWebhookReceiver(t)
+	dispatcher, deadLetterPath := newTestDispatcher(t, Webhook{URL: recv.URL, Secret: "s3cret"})
+
+	d := &fakeDownloader{info: map[string]videoInfo{
+		"https://youtu.be/abc": {ID: "abc", Title: "Song"},
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	root := t.TempDir()
+	jobs, err := newJobManager(ctx, d, newJobResolver(&Config{}, nil, "", root), jobManagerOptions{
+		Workers:   1,
+		QueueSize: 10,
+		OnFinish:  dispatcher.Notify,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cancel()
+		jobs.Wait()
+	}()
+	job, err := jobs.Submit(JobRequest{URL: "https://youtu.be/abc"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv.wait(t, 1)
+
+	recv.mu.Lock()
+	body, header := recv.bodies[0], recv.headers[0]
+	recv.mu.Unlock()
+	if got, want := header.Get(webhookSignatureHeader), signPayload("s3cret", body); got != want {
+		t.Errorf("signature = %q, want %q", got, want)
+	}
+	if header.Get("X-Yt2mp3-Event") != webhookEventDone || header.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected headers: %v", header)
+	}
+	var p webhookPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.JobID != job.ID || p.URL != "https://youtu.be/abc" || p.Title != "Song" || p.Status != statusOK ||
+		p.FinalPath != filepath.Join(root, "Song.mp3") || p.Tags["title"] != "Song" {
+		t.Errorf("unexpected payload: %+v", p)
+	}
+	if entries := readDeadLetters(t, deadLetterPath); len(entries) != 0 {
+		t.Errorf("dead letters = %+v", entries)
+	}
+}
+
+func TestWebhookRetriesAndDeadLetters(t *testing.T) {
+	flaky := newWebhookReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	down := newWebhookReceiver(t, 500, 502, 503)
+	rejecting := newWebhookReceiver(t, http.StatusBadRequest)
+	dispatcher, deadLetterPath := newTestDispatcher(t,
+		Webhook{URL: flaky.URL, Secret: "a"},
+		Webhook{URL: down.URL, Secret: "b"},
+		Webhook{URL: rejecting.URL, Secret: "c"},
+		Webhook{URL: rejecting.URL, Secret: "c", Events: []string{jobDone}},
+	)
+
+	dispatcher.Notify(Job{ID: "j1", URL: "https://youtu.be/x", State: jobFailed,
+		Result: &Result{Status: statusFailed, ErrorCode: "geo_blocked", Error: "blocked"}})
+	flaky.wait(t, 3)
+	down.wait(t, 3)
+	rejecting.wait(t, 1)
+
+	// Deliveries run in the background, so wait for the log to settle.
+	deadline := time.Now().Add(5 * time.Second)
+	var entries []deadLetter
+	for len(entries) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		entries = readDeadLetters(t, deadLetterPath)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("dead letters = %+v", entries)
+	}
+	attempts := map[string]int{}
+	for _, e := range entries {
+		attempts[e.Target] = e.Attempts
+		var p webhookPayload
+		if err := json.Unmarshal(e.Payload, &p); err != nil || p.Event != webhookEventFailed || p.ErrorCode != "geo_blocked" {
+			t.Errorf("dead letter payload = %s (%v)", e.Payload, err)
+		}
+	}
+	if attempts[down.URL] != 3 || attempts[rejecting.URL] != 1 {
+		t.Errorf("attempts = %v", attempts)
+	}
+}
+
+func TestWebhookSlowTargetDoesNotBlockOthers(t *testing.T) {
+	release := make(chan struct{})
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer stuck.Close()
+	defer close(release)
+	recv := newWebhookReceiver(t)
+	dispatcher, _ := newTestDispatcher(t,
+		Webhook{URL: stuck.URL, Secret: "a"},
+		Webhook{URL: recv.URL, Secret: "b"},
+	)
+
+	dispatcher.Notify(Job{ID: "j1", State: jobDone, Result: &Result{Status: statusOK}})
+	dispatcher.Notify(Job{ID: "j2", State: jobDone, Result: &Result{Status: statusOK}})
+	recv.wait(t, 2)
+}
+
+func TestWebhookIgnoresUnfinishedJobs(t *testing.T) {
+	recv := newWebhookReceiver(t)
+	dispatcher, _ := newTestDispatcher(t, Webhook{URL: recv.URL, Secret: "s"})
+	dispatcher.Notify(Job{ID: "j", State: jobCanceled})
+	dispatcher.Notify(Job{ID: "j", State: jobDownloading})
+	select {
+	case <-recv.received:
+		t.Error("unexpected delivery")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestValidateWebhooks(t *testing.T) {
+	t.Setenv("HOOK_SECRET", "from-env")
+	tests := []struct {
+		name    string
+		hook    Webhook
+		wantErr bool
+	}{
+		{"valid", Webhook{URL: "https://example.com/hook", Secret: "x", Events: []string{"done"}}, false},
+		{"secret from env", Webhook{URL: "http://localhost:8123/hook", SecretEnv: "HOOK_SECRET"}, false},
+		{"missing secret", Webhook{URL: "https://example.com/hook"}, true},
+		{"empty env secret", Webhook{URL: "https://example.com/hook", SecretEnv: "UNSET_HOOK_SECRET"}, true},
+		{"bad URL", Webhook{URL: "ftp://example.com", Secret: "x"}, true},
+		{"unknown event", Webhook{URL: "https://example.com/hook", Secret: "x", Events: []string{"started"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateWebhooks([]Webhook{tt.hook}); (err != nil) != tt.wantErr {
+				t.Errorf("validateWebhooks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignPayload(t *testing.T) {
+	// printf '{"a":1}' | openssl dgst -sha256 -hmac key
+	want := "sha256=88a67f24bbcdaed0e6c997404bb79a743baf44c6bab2f4c27328e3009d22e342"
+	if got := signPayload("key", []byte(`{"a":1}`)); got != want {
+		t.Errorf("signPayload = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// sseKeepAlive is how often an idle event stream sends a comment so that
+// proxies do not close the connection.
+const sseKeepAlive = 30 * time.Second
+
+//go:embed web/*
+var webFiles embed.FS
+
+// serverOptions lists the choices offered by the web UI.
+type serverOptions struct {
+	Formats        []string `json:"formats"`
+	Profiles       []string `json:"profiles"`
+	DefaultProfile string   `json:"default_profile,omitempty"`
+	User           string   `json:"user,omitempty"`
+}
+
+// newServerOptions returns the formats yt2mp3 supports and the profiles
+// defined in cfg.
+func newServerOptions(cfg *Config, defaultProfile string) serverOptions {
+	opts := serverOptions{Formats: []string{}, Profiles: []string{}, DefaultProfile: defaultProfile}
+	for format := range audioFormatExt {
+		opts.Formats = append(opts.Formats, format)
+	}
+	for name := range cfg.Profiles {
+		opts.Profiles = append(opts.Profiles, name)
+	}
+	sort.Strings(opts.Formats)
+	sort.Strings(opts.Profiles)
+	return opts
+}
+
+// webUI returns a handler serving the embedded single-page UI.
+func webUI() http.Handler {
+	sub, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServerFS(sub)
+}
+
+func (s *server) handleOptions(w http.ResponseWriter, r *http.Request) {
+	opts := s.options
+	if u := requestUser(r); u != nil {
+		opts.User = u.Name
+		if u.Profile != "" {
+			opts.DefaultProfile = u.Profile
+		}
+	}
+	writeJSON(w, http.StatusOK, opts)
+}
+
+// handleEvents streams changes to the jobs the user may see as Server-Sent
+// Events. Every current job is sent first, followed by one "job" event per
+// change.
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	// Subscribe before listing so that no change falls in between.
+	sub := s.jobs.Subscribe()
+	defer s.jobs.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	u := requestUser(r)
+	for _, job := range s.visibleJobs(u) {
+		if err := writeEvent(w, "job", job); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	t := time.NewTicker(sseKeepAlive)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.jobs.Done():
+			return
+		case <-t.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-sub.C:
+			for _, job := range sub.Changes() {
+				if !canAccess(u, job) {
+					continue
+				}
+				if err := writeEvent(w, "job", job); err != nil {
+					return
+				}
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes v as a JSON-encoded Server-Sent Event.
+func writeEvent(w http.ResponseWriter, event string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
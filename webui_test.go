@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebUIServed(t *testing.T) {
+	ts, _, _ := newTestServer(t, &fakeDownloader{}, 1, 10)
+
+	resp, err := http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "<title>yt2mp3</title>") {
+		t.Errorf("index: status %d, body %.100q", resp.StatusCode, body)
+	}
+}
+
+func TestNewServerOptions(t *testing.T) {
+	cfg := &Config{Profiles: map[string]Profile{"podcast": {}, "archive": {}}}
+	opts := newServerOptions(cfg, "podcast")
+	if strings.Join(opts.Profiles, ",") != "archive,podcast" {
+		t.Errorf("profiles = %v", opts.Profiles)
+	}
+	if len(opts.Formats) != len(audioFormatExt) || opts.Formats[0] != "flac" {
+		t.Errorf("formats = %v", opts.Formats)
+	}
+	if opts.DefaultProfile != "podcast" {
+		t.Errorf("default profile = %q", opts.DefaultProfile)
+	}
+}
+
+func TestServerEvents(t *testing.T) {
+	d := &fakeDownloader{info: map[string]videoInfo{
+		"https://youtu.be/abc": {ID: "abc", Title: "Song"},
+	}}
+	ts, jobs, _ := newTestServer(t, d, 1, 10)
+
+	// A job that already finished is part of the initial snapshot.
+	first, err := jobs.Submit(JobRequest{URL: "https://youtu.be/abc"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, ts.URL, first.ID, jobDone)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	events := make(chan Job)
+	go func() {
+		defer close(events)
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			data, ok := strings.CutPrefix(sc.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var job Job
+			if err := json.Unmarshal([]byte(data), &job); err != nil {
+				t.Errorf("bad event data %q: %v", data, err)
+				return
+			}
+			events <- job
+		}
+	}()
+
+	if job := <-events; job.ID != first.ID || job.State != jobDone {
+		t.Fatalf("initial event = %+v", job)
+	}
+
+	second, err := jobs.Submit(JobRequest{URL: "https://youtu.be/abc"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for job := range events {
+		if job.ID != second.ID {
+			t.Fatalf("unexpected job %s", job.ID)
+		}
+		if job.State == jobDone {
+			if job.Result == nil || job.Result.Tags["title"] != "Song" {
+				t.Errorf("done event without tags: %+v", job.Result)
+			}
+			return
+		}
+	}
+	t.Fatal("event stream ended before the job finished")
+}